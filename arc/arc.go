@@ -0,0 +1,178 @@
+// Package arc validates and adds Authenticated Received Chain header
+// fields (RFC 8617), which let intermediaries such as mailing lists and
+// forwarders vouch for the authentication results a message had before
+// they changed it.
+//
+// A Verifier validates the ARC-Seal, ARC-Message-Signature and
+// ARC-Authentication-Results sets already in a message and records an
+// arc result in the envelope metadata. A Sealer adds a new set to
+// messages being relayed, recording this server's authentication results
+// and the chain validation status. Both are icesmtp.ContentFilters and
+// are built on the dkim package's canonicalization, key and hashing
+// primitives.
+package arc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iceisfun/icesmtp/dkim"
+)
+
+// Header field names.
+const (
+	HeaderSeal                  = "ARC-Seal"
+	HeaderMessageSignature      = "ARC-Message-Signature"
+	HeaderAuthenticationResults = "ARC-Authentication-Results"
+)
+
+// MaxInstance is the highest instance number a chain may reach.
+const MaxInstance = 50
+
+// Errors reported in Result.Err. Key lookup errors are the dkim package's,
+// such as dkim.ErrDNS.
+var (
+	// ErrStructure indicates missing, duplicate or out of sequence ARC
+	// header fields.
+	ErrStructure = errors.New("arc: invalid chain structure")
+
+	// ErrSyntax indicates a malformed ARC header field.
+	ErrSyntax = errors.New("arc: syntax error")
+
+	// ErrChainFailed indicates the most recent set already records a
+	// failed chain (cv=fail).
+	ErrChainFailed = errors.New("arc: chain marked as failed")
+
+	// ErrMessageSignature indicates the most recent ARC-Message-Signature
+	// did not verify.
+	ErrMessageSignature = errors.New("arc: message signature did not verify")
+
+	// ErrSeal indicates an ARC-Seal did not verify.
+	ErrSeal = errors.New("arc: seal did not verify")
+)
+
+// Status is a chain validation status (cv=), also used as the arc result
+// in Authentication-Results.
+type Status string
+
+// Statuses.
+const (
+	None Status = "none"
+	Pass Status = "pass"
+	Fail Status = "fail"
+)
+
+// Set is one ARC set: the three raw header fields sharing an instance
+// number, each ending with CRLF.
+type Set struct {
+	Instance              int
+	AuthenticationResults string
+	MessageSignature      string
+	Seal                  string
+}
+
+// ParseSets collects the ARC sets from raw header fields, as returned by
+// dkim.HeaderFields, in instance order. A message without ARC fields has
+// no sets; otherwise instances must run from 1 without gaps and each set
+// must be complete.
+func ParseSets(fields []string) ([]Set, error) {
+	byInstance := map[int]*Set{}
+	highest := 0
+	for _, f := range fields {
+		name, value, _ := strings.Cut(f, ":")
+		name = strings.TrimRight(name, " \t")
+
+		var slot func(*Set) *string
+		switch {
+		case strings.EqualFold(name, HeaderSeal):
+			slot = func(s *Set) *string { return &s.Seal }
+		case strings.EqualFold(name, HeaderMessageSignature):
+			slot = func(s *Set) *string { return &s.MessageSignature }
+		case strings.EqualFold(name, HeaderAuthenticationResults):
+			slot = func(s *Set) *string { return &s.AuthenticationResults }
+		default:
+			continue
+		}
+
+		i, err := instance(value)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := byInstance[i]
+		if !ok {
+			s = &Set{Instance: i}
+			byInstance[i] = s
+		}
+		p := slot(s)
+		if *p != "" {
+			return nil, fmt.Errorf("%w: duplicate %s for i=%d", ErrStructure, name, i)
+		}
+		*p = f
+		highest = max(highest, i)
+	}
+
+	sets := make([]Set, highest)
+	for i := 1; i <= highest; i++ {
+		s, ok := byInstance[i]
+		if !ok || s.Seal == "" || s.MessageSignature == "" || s.AuthenticationResults == "" {
+			return nil, fmt.Errorf("%w: incomplete set i=%d", ErrStructure, i)
+		}
+		sets[i-1] = *s
+	}
+	return sets, nil
+}
+
+// instance returns the i= instance number of an ARC field value. It is
+// the first tag of ARC-Authentication-Results, which is not a tag-list,
+// and any tag of the other fields.
+func instance(value string) (int, error) {
+	for _, spec := range strings.Split(value, ";") {
+		name, v, ok := strings.Cut(spec, "=")
+		if !ok || strings.TrimSpace(name) != "i" {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || i < 1 || i > MaxInstance {
+			return 0, fmt.Errorf("%w: invalid instance %q", ErrStructure, strings.TrimSpace(v))
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("%w: missing instance tag", ErrStructure)
+}
+
+// tags parses the tag-list of a raw ARC-Seal or ARC-Message-Signature
+// field and checks the tags every signature needs.
+func tags(field string) (dkim.Tags, error) {
+	_, value, _ := strings.Cut(field, ":")
+	t, err := dkim.ParseTags(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSyntax, err)
+	}
+	for _, name := range []string{"a", "b", "d", "s"} {
+		if _, ok := t[name]; !ok {
+			return nil, fmt.Errorf("%w: missing %s= tag", ErrSyntax, name)
+		}
+	}
+	return t, nil
+}
+
+// decodeBase64 decodes a base64 tag value, ignoring whitespace.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// foldBase64 splits a long base64 value over continuation lines.
+func foldBase64(s string) string {
+	const width = 72
+	var b strings.Builder
+	for len(s) > width {
+		b.WriteString(s[:width])
+		b.WriteString("\r\n\t ")
+		s = s[width:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
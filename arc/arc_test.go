@@ -0,0 +1,200 @@
+package arc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/dkim"
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+)
+
+const message = "From: Alice <alice@example.org>\r\n" +
+	"To: list@lists.example.net\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hello, list.\r\n"
+
+// setup returns an Ed25519 sealer for example.org and an RSA sealer for
+// lists.example.net, sharing a resolver with their public keys.
+func setup(t *testing.T) (origin, list *Sealer, r *dnstest.Resolver) {
+	t.Helper()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &dnstest.Resolver{TXT: map[string][]string{}}
+	publish(t, r, "arc._domainkey.example.org", edKey)
+	publish(t, r, "arc._domainkey.lists.example.net", rsaKey)
+
+	v := NewVerifier(r)
+	origin = NewSealer(&dkim.SigningKey{Domain: "example.org", Selector: "arc", Signer: edKey}, v)
+	list = NewSealer(&dkim.SigningKey{Domain: "lists.example.net", Selector: "arc", Signer: rsaKey}, v)
+	return origin, list, r
+}
+
+func publish(t *testing.T, r *dnstest.Resolver, name string, signer crypto.Signer) {
+	t.Helper()
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		r.TXT[name] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.TXT[name] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}
+	}
+}
+
+// seal validates msg, seals it with s and returns the sealed message.
+func seal(t *testing.T, s *Sealer, msg string) string {
+	t.Helper()
+	chain := s.verifier.Verify(context.Background(), []byte(msg))
+	return sealAs(t, s, msg, chain)
+}
+
+// sealAs seals msg as if its chain validated as chain.
+func sealAs(t *testing.T, s *Sealer, msg string, chain Result) string {
+	t.Helper()
+	set, err := s.Seal([]byte(msg), chain, "mx."+s.key.Domain, nil)
+	if err != nil || set == nil {
+		t.Fatalf("Seal = %v, %v", set, err)
+	}
+	return set.Seal + set.MessageSignature + set.AuthenticationResults + msg
+}
+
+func TestChain(t *testing.T) {
+	origin, list, r := setup(t)
+	v := NewVerifier(r)
+	ctx := context.Background()
+
+	if result := v.Verify(ctx, []byte(message)); result.Status != None {
+		t.Fatalf("unsealed message = %+v", result)
+	}
+
+	hop1 := seal(t, origin, message)
+	if !strings.Contains(hop1, "cv=none") || !strings.Contains(hop1, "ARC-Authentication-Results: i=1; mx.example.org;\r\n\tarc=none") {
+		t.Errorf("first set = %q", hop1)
+	}
+	if result := v.Verify(ctx, []byte(hop1)); result.Status != Pass {
+		t.Fatalf("hop 1 = %+v", result)
+	}
+
+	// The list validates the chain, then changes the message and seals
+	// it. The first message signature breaks, but only the latest one
+	// is checked.
+	chain := v.Verify(ctx, []byte(hop1))
+	modified := strings.Replace(hop1, "Subject: Hello", "Subject: [list] Hello", 1) + "--\r\nList footer\r\n"
+	hop2 := sealAs(t, list, modified, chain)
+	if !strings.Contains(hop2, "i=2; a=rsa-sha256; cv=pass") {
+		t.Errorf("second set = %q", hop2)
+	}
+	result := v.Verify(ctx, []byte(hop2))
+	if result.Status != Pass || len(result.Sets) != 2 {
+		t.Fatalf("hop 2 = %+v", result)
+	}
+	if got := result.AuthResult().String(); got != "arc=pass" {
+		t.Errorf("AuthResult = %q", got)
+	}
+
+	tests := []struct {
+		name string
+		msg  string
+		err  error
+	}{
+		{"body changed", hop2 + "More.\r\n", ErrMessageSignature},
+		{"old results changed", strings.Replace(hop2, "i=1; mx.example.org;", "i=1; mx.example.org; spf=pass;", 1), ErrSeal},
+		{"set removed", hop2[strings.Index(hop2, "ARC-Message-Signature"):], ErrStructure},
+		{"key missing", strings.ReplaceAll(hop2, "s=arc", "s=gone"), dkim.ErrNoKey},
+	}
+	for _, tt := range tests {
+		result := v.Verify(ctx, []byte(tt.msg))
+		if result.Status != Fail || !errors.Is(result.Err, tt.err) {
+			t.Errorf("%s: %+v", tt.name, result)
+		}
+	}
+}
+
+func TestSealFailedChain(t *testing.T) {
+	origin, list, r := setup(t)
+	v := NewVerifier(r)
+	ctx := context.Background()
+
+	// A broken chain is sealed with cv=fail, after which it is not
+	// extended.
+	broken := seal(t, origin, message) + "Tampered.\r\n"
+	failed := seal(t, list, broken)
+	if !strings.Contains(failed, "cv=fail") {
+		t.Fatalf("sealed broken chain = %q", failed)
+	}
+	result := v.Verify(ctx, []byte(failed))
+	if result.Status != Fail || !errors.Is(result.Err, ErrChainFailed) {
+		t.Errorf("failed chain = %+v", result)
+	}
+	if set, err := list.Seal([]byte(failed), result, "mx.lists.example.net", nil); set != nil || err != nil {
+		t.Errorf("Seal of failed chain = %v, %v", set, err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	origin, _, r := setup(t)
+	ctx := context.Background()
+
+	env := buildEnvelope(t, message, icesmtp.AuthResult{Method: "spf", Result: "pass",
+		Properties: []icesmtp.AuthProperty{{Type: "smtp", Name: "mailfrom", Value: "alice@example.org"}}})
+	result, err := origin.Filter(ctx, env, nil)
+	if err != nil || result.Envelope == nil {
+		t.Fatalf("Sealer.Filter = %+v, %v", result, err)
+	}
+	sealed := string(result.Envelope.Data())
+	if !strings.HasPrefix(sealed, "ARC-Seal: i=1;") ||
+		!strings.Contains(sealed, "ARC-Authentication-Results: i=1; mx.example.com;\r\n\tspf=pass smtp.mailfrom=alice@example.org;\r\n\tarc=none\r\n") {
+		t.Errorf("sealed = %q", sealed)
+	}
+
+	result, err = NewVerifier(r).Filter(ctx, buildEnvelope(t, sealed), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results := result.Envelope.Metadata().AuthResults; len(results) != 1 || results[0].String() != "arc=pass" {
+		t.Errorf("Verifier.Filter results = %+v", results)
+	}
+
+	// DNS failures defer rather than sealing the chain as failed.
+	r.Errors = map[string]error{"arc._domainkey.example.org": dnstest.Temporary("arc._domainkey.example.org")}
+	if _, err := origin.Filter(ctx, buildEnvelope(t, sealed), nil); !errors.Is(err, dkim.ErrDNS) {
+		t.Errorf("Sealer.Filter with DNS error = %v", err)
+	}
+}
+
+func buildEnvelope(t *testing.T, data string, results ...icesmtp.AuthResult) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{
+		ClientIP:       "192.0.2.1",
+		ServerHostname: "mx.example.com",
+		AuthResults:    results,
+	})
+	b.SetMailFrom(icesmtp.MailPath{Address: "alice@example.org"}, nil)
+	b.AddRecipient(icesmtp.MailPath{Address: "list@lists.example.net"})
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
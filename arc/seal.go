@@ -0,0 +1,190 @@
+package arc
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/dkim"
+)
+
+// DefaultSignedHeaders are the header fields an ARC-Message-Signature
+// signs when present, unless changed with WithSignedHeaders.
+var DefaultSignedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"DKIM-Signature",
+}
+
+// Sealer adds an ARC set to messages it relays (RFC 8617 section 5.1).
+type Sealer struct {
+	key      *dkim.SigningKey
+	verifier *Verifier
+
+	authservID string
+	headers    []string
+	now        func() time.Time
+}
+
+// SealerOption configures a Sealer.
+type SealerOption func(*Sealer)
+
+// WithAuthServID sets the authserv-id in ARC-Authentication-Results.
+// Defaults to the envelope's ServerHostname.
+func WithAuthServID(id string) SealerOption {
+	return func(s *Sealer) {
+		s.authservID = id
+	}
+}
+
+// WithSignedHeaders sets the header fields the ARC-Message-Signature
+// signs when present. From is always signed. Defaults to
+// DefaultSignedHeaders.
+func WithSignedHeaders(names ...string) SealerOption {
+	return func(s *Sealer) {
+		s.headers = names
+	}
+}
+
+// NewSealer creates a Sealer that signs with key and validates incoming
+// chains with verifier.
+func NewSealer(key *dkim.SigningKey, verifier *Verifier, opts ...SealerOption) *Sealer {
+	s := &Sealer{
+		key:      key,
+		verifier: verifier,
+		headers:  DefaultSignedHeaders,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Seal returns a new ARC set for a message whose chain validated as
+// chain, recording results under authservID. It returns nil if the chain
+// may not be extended: the most recent set already failed or the chain
+// is at MaxInstance.
+func (s *Sealer) Seal(message []byte, chain Result, authservID string, results []icesmtp.AuthResult) (*Set, error) {
+	if errors.Is(chain.Err, ErrChainFailed) || len(chain.Sets) >= MaxInstance {
+		return nil, nil
+	}
+	alg, err := s.key.Algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	header, body := icesmtp.SplitMessage(message)
+	fields := dkim.HeaderFields(header)
+	set := &Set{Instance: len(chain.Sets) + 1}
+	if chain.Status == Fail {
+		// A failed chain is not worth extending; the seal covers only
+		// the new set.
+		chain.Sets = nil
+	}
+
+	results = append(results[:len(results):len(results)], chain.AuthResult())
+	set.AuthenticationResults = field(HeaderAuthenticationResults,
+		fmt.Sprintf("i=%d; %s", set.Instance, icesmtp.AuthenticationResults(authservID, results)))
+
+	bh := dkim.NewBodyHasher(crypto.SHA256.New(), dkim.Relaxed, -1)
+	bh.Write(body)
+	signed := s.signedHeaders(fields)
+	now := s.now().Unix()
+	ams := fmt.Sprintf("i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		set.Instance, alg, s.key.Domain, s.key.Selector, now, strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bh.Sum()))
+	digest := dkim.HashHeaders(alg.Hash().New(), dkim.Relaxed, fields, signed, field(HeaderMessageSignature, ams))
+	sig, err := s.key.SignDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	set.MessageSignature = field(HeaderMessageSignature, ams+foldBase64(base64.StdEncoding.EncodeToString(sig)))
+
+	cv := chain.Status
+	seal := fmt.Sprintf("i=%d; a=%s; cv=%s; d=%s; s=%s;\r\n\tt=%d; b=",
+		set.Instance, alg, cv, s.key.Domain, s.key.Selector, now)
+	set.Seal = field(HeaderSeal, seal)
+	sig, err = s.key.SignDigest(hashSeal(alg.Hash().New(), append(chain.Sets[:len(chain.Sets):len(chain.Sets)], *set)))
+	if err != nil {
+		return nil, err
+	}
+	set.Seal = field(HeaderSeal, seal+foldBase64(base64.StdEncoding.EncodeToString(sig)))
+	return set, nil
+}
+
+// signedHeaders returns the h= list for fields: each configured name once
+// per occurrence.
+func (s *Sealer) signedHeaders(fields []string) []string {
+	count := map[string]int{}
+	for _, f := range fields {
+		name, _, _ := strings.Cut(f, ":")
+		count[strings.ToLower(strings.TrimRight(name, " \t"))]++
+	}
+	var signed []string
+	seen := map[string]bool{}
+	for _, name := range append([]string{"From"}, s.headers...) {
+		lower := strings.ToLower(name)
+		if seen[lower] {
+			continue
+		}
+		seen[lower] = true
+		for range count[lower] {
+			signed = append(signed, lower)
+		}
+	}
+	return signed
+}
+
+// field formats a raw header field.
+func field(name, value string) string {
+	return name + ": " + value + "\r\n"
+}
+
+// Ensure Sealer implements the interface.
+var _ icesmtp.ContentFilter = (*Sealer)(nil)
+
+// Filter validates the message's chain, then prepends a new ARC set
+// recording the envelope's authentication results. A chain that could
+// not be validated because of a DNS error defers the message rather than
+// sealing it as failed.
+func (s *Sealer) Filter(ctx context.Context, envelope icesmtp.Envelope, session icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	data := envelope.Data()
+	chain := s.verifier.Verify(ctx, data)
+	if errors.Is(chain.Err, dkim.ErrDNS) {
+		return icesmtp.FilterResult{}, chain.Err
+	}
+
+	metadata := envelope.Metadata()
+	id := s.authservID
+	if id == "" {
+		id = metadata.ServerHostname
+	}
+	// The chain result is added by Seal; drop one recorded by a Verifier.
+	var results []icesmtp.AuthResult
+	for _, r := range metadata.AuthResults {
+		if r.Method != "arc" {
+			results = append(results, r)
+		}
+	}
+
+	set, err := s.Seal(data, chain, id, results)
+	if err != nil || set == nil {
+		return icesmtp.FilterAccepted(), err
+	}
+	m, ok := envelope.(*icesmtp.ModifiedEnvelope)
+	if !ok {
+		m = icesmtp.NewModifiedEnvelope(envelope)
+	}
+	for _, f := range []string{set.AuthenticationResults, set.MessageSignature, set.Seal} {
+		name, value, _ := strings.Cut(strings.TrimSuffix(f, "\r\n"), ": ")
+		m.PrependHeader(name, value)
+	}
+	return icesmtp.FilterResult{Action: icesmtp.FilterAccept, Envelope: m}, nil
+}
@@ -0,0 +1,205 @@
+package arc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/dkim"
+)
+
+// Verifier validates ARC chains.
+type Verifier struct {
+	resolver dkim.Resolver
+}
+
+// NewVerifier creates a Verifier that fetches keys with resolver, or
+// net.DefaultResolver if resolver is nil.
+func NewVerifier(resolver dkim.Resolver) *Verifier {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Verifier{resolver: resolver}
+}
+
+// Result is the outcome of validating a message's ARC chain.
+type Result struct {
+	// Status is the chain validation status.
+	Status Status
+
+	// Sets are the message's ARC sets in instance order.
+	Sets []Set
+
+	// Err explains a Fail status.
+	Err error
+}
+
+// AuthResult converts a result to an Authentication-Results entry.
+func (r Result) AuthResult() icesmtp.AuthResult {
+	ar := icesmtp.AuthResult{Method: "arc", Result: string(r.Status)}
+	if r.Err != nil {
+		ar.Reason = strings.TrimPrefix(r.Err.Error(), "arc: ")
+	}
+	return ar
+}
+
+// Verify validates the ARC chain of a message (RFC 8617 section 5.2): the
+// sets must be complete and in sequence, the most recent
+// ARC-Message-Signature must verify, and so must every ARC-Seal.
+func (v *Verifier) Verify(ctx context.Context, message []byte) Result {
+	header, body := icesmtp.SplitMessage(message)
+	fields := dkim.HeaderFields(header)
+	sets, err := ParseSets(fields)
+	if err != nil {
+		return Result{Status: Fail, Err: err}
+	}
+	if len(sets) == 0 {
+		return Result{Status: None}
+	}
+
+	result := Result{Status: Fail, Sets: sets}
+	for _, s := range sets {
+		t, err := tags(s.Seal)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		cv := Status(strings.ToLower(t["cv"]))
+		switch {
+		case s.Instance == len(sets) && cv == Fail:
+			result.Err = fmt.Errorf("%w at i=%d", ErrChainFailed, s.Instance)
+			return result
+		case s.Instance == 1 && cv != None, s.Instance > 1 && cv != Pass:
+			result.Err = fmt.Errorf("%w: cv=%s at i=%d", ErrStructure, cv, s.Instance)
+			return result
+		}
+	}
+
+	if err := v.verifyMessageSignature(ctx, fields, body, sets[len(sets)-1]); err != nil {
+		result.Err = err
+		return result
+	}
+	for i := len(sets); i >= 1; i-- {
+		if err := v.verifySeal(ctx, sets[:i]); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	result.Status = Pass
+	return result
+}
+
+// verifyMessageSignature checks an ARC-Message-Signature, which is
+// computed like a DKIM signature (RFC 8617 section 4.1.2).
+func (v *Verifier) verifyMessageSignature(ctx context.Context, fields []string, body []byte, s Set) error {
+	t, err := tags(s.MessageSignature)
+	if err != nil {
+		return err
+	}
+	alg, err := dkim.ParseAlgorithm(t["a"])
+	if err != nil {
+		return err
+	}
+	hc, bc, err := dkim.ParseCanonicalization(t["c"])
+	if err != nil {
+		return err
+	}
+	sig, err := decodeBase64(t["b"])
+	if err != nil {
+		return fmt.Errorf("%w: b= is not base64", ErrSyntax)
+	}
+	bh, err := decodeBase64(t["bh"])
+	if err != nil {
+		return fmt.Errorf("%w: bh= is not base64", ErrSyntax)
+	}
+	var signed []string
+	for _, name := range strings.Split(t["h"], ":") {
+		if name = strings.TrimSpace(name); name != "" {
+			signed = append(signed, name)
+		}
+	}
+	if len(signed) == 0 {
+		return fmt.Errorf("%w: missing h= tag", ErrSyntax)
+	}
+
+	hasher := dkim.NewBodyHasher(alg.Hash().New(), bc, -1)
+	hasher.Write(body)
+	if !bytes.Equal(hasher.Sum(), bh) {
+		return fmt.Errorf("%w: body hash mismatch at i=%d", ErrMessageSignature, s.Instance)
+	}
+
+	key, err := dkim.LookupKey(ctx, v.resolver, t["s"], t["d"])
+	if err != nil {
+		return err
+	}
+	digest := dkim.HashHeaders(alg.Hash().New(), hc, fields, signed, s.MessageSignature)
+	if err := key.Verify(alg, digest, sig); err != nil {
+		return fmt.Errorf("%w at i=%d: %v", ErrMessageSignature, s.Instance, err)
+	}
+	return nil
+}
+
+// verifySeal checks the ARC-Seal of the last of sets.
+func (v *Verifier) verifySeal(ctx context.Context, sets []Set) error {
+	last := sets[len(sets)-1]
+	t, err := tags(last.Seal)
+	if err != nil {
+		return err
+	}
+	alg, err := dkim.ParseAlgorithm(t["a"])
+	if err != nil {
+		return err
+	}
+	sig, err := decodeBase64(t["b"])
+	if err != nil {
+		return fmt.Errorf("%w: b= is not base64", ErrSyntax)
+	}
+
+	key, err := dkim.LookupKey(ctx, v.resolver, t["s"], t["d"])
+	if err != nil {
+		return err
+	}
+	digest := hashSeal(alg.Hash().New(), sets)
+	if err := key.Verify(alg, digest, sig); err != nil {
+		return fmt.Errorf("%w at i=%d: %v", ErrSeal, last.Instance, err)
+	}
+	return nil
+}
+
+// hashSeal hashes the fields an ARC-Seal signs: every set up to and
+// including the last, each in the order ARC-Authentication-Results,
+// ARC-Message-Signature, ARC-Seal, with relaxed canonicalization and the
+// last seal's b= value removed (RFC 8617 section 5.1.1).
+func hashSeal(h hash.Hash, sets []Set) []byte {
+	for i, s := range sets {
+		io.WriteString(h, dkim.CanonicalizeHeader(dkim.Relaxed, s.AuthenticationResults))
+		io.WriteString(h, dkim.CanonicalizeHeader(dkim.Relaxed, s.MessageSignature))
+		if i < len(sets)-1 {
+			io.WriteString(h, dkim.CanonicalizeHeader(dkim.Relaxed, s.Seal))
+			continue
+		}
+		seal := dkim.CanonicalizeHeader(dkim.Relaxed, dkim.StripSignature(s.Seal))
+		io.WriteString(h, strings.TrimSuffix(seal, "\r\n"))
+	}
+	return h.Sum(nil)
+}
+
+// Ensure Verifier implements the interface.
+var _ icesmtp.ContentFilter = (*Verifier)(nil)
+
+// Filter validates the message's chain and records an arc result in the
+// envelope metadata. It never rejects.
+func (v *Verifier) Filter(ctx context.Context, envelope icesmtp.Envelope, session icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	result := v.Verify(ctx, envelope.Data())
+	m, ok := envelope.(*icesmtp.ModifiedEnvelope)
+	if !ok {
+		m = icesmtp.NewModifiedEnvelope(envelope)
+	}
+	m.AddAuthResult(result.AuthResult())
+	return icesmtp.FilterResult{Action: icesmtp.FilterAccept, Envelope: m}, nil
+}
@@ -0,0 +1,131 @@
+package icesmtp
+
+import (
+	"context"
+	"strings"
+)
+
+// AuthResult is the outcome of one message authentication check, such as
+// SPF or DKIM, in the form recorded by an Authentication-Results header
+// field (RFC 8601).
+type AuthResult struct {
+	// Method is the authentication method, e.g. "spf", "dkim", "dmarc"
+	// or "auth".
+	Method string
+
+	// Result is the method's result, e.g. "pass", "fail" or "none".
+	Result string
+
+	// Reason optionally explains the result.
+	Reason string
+
+	// Properties identify what was checked, e.g. smtp.mailfrom or
+	// header.d.
+	Properties []AuthProperty
+}
+
+// AuthProperty is a property of an authentication result, written as
+// Type.Name=Value.
+type AuthProperty struct {
+	// Type is the property type: "smtp", "header", "body" or "policy".
+	Type string
+
+	// Name is the property name, e.g. "mailfrom" or "d".
+	Name string
+
+	// Value is the property value.
+	Value string
+}
+
+// String returns the result in Authentication-Results syntax, e.g.
+// "spf=pass smtp.mailfrom=example.org".
+func (r AuthResult) String() string {
+	var b strings.Builder
+	b.WriteString(r.Method + "=" + r.Result)
+	if r.Reason != "" {
+		b.WriteString(" reason=" + quoteAuthValue(r.Reason))
+	}
+	for _, p := range r.Properties {
+		b.WriteString(" " + p.Type + "." + p.Name + "=" + quoteAuthValue(p.Value))
+	}
+	return b.String()
+}
+
+// SMTPAuthResult returns the result recorded for a session that
+// authenticated as user (RFC 8601 section 2.7.4).
+func SMTPAuthResult(user Username) AuthResult {
+	return AuthResult{
+		Method:     "auth",
+		Result:     "pass",
+		Properties: []AuthProperty{{Type: "smtp", Name: "auth", Value: user}},
+	}
+}
+
+// quoteAuthValue returns v as a token, or as a quoted string if it
+// contains characters a token cannot.
+func quoteAuthValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\r\n\"\\()<>,;:[]=") {
+		return v
+	}
+	v = strings.NewReplacer("\r", "", "\n", "", `\`, `\\`, `"`, `\"`).Replace(v)
+	return `"` + v + `"`
+}
+
+// AuthenticationResults formats an Authentication-Results field value
+// for authservID with one result per line, or "none" if there are no
+// results.
+func AuthenticationResults(authservID string, results []AuthResult) string {
+	if len(results) == 0 {
+		return authservID + "; none"
+	}
+	var b strings.Builder
+	b.WriteString(authservID)
+	for _, r := range results {
+		b.WriteString(";\r\n\t" + r.String())
+	}
+	return b.String()
+}
+
+// AuthResultsFilter is a ContentFilter that prepends an
+// Authentication-Results field built from the envelope's
+// EnvelopeMetadata.AuthResults: auth for SMTP AUTH, spf from the sender
+// policy, dkim from a data inspector and dmarc from the DMARC filter.
+// Place it after the filters that record results.
+//
+// Fields already in the message that claim the same authserv-id are
+// removed first, as they cannot have been added by this server (RFC 8601
+// section 5).
+type AuthResultsFilter struct {
+	// AuthServID identifies this server in the field. Defaults to the
+	// envelope's ServerHostname.
+	AuthServID string
+}
+
+// Ensure AuthResultsFilter implements the interface.
+var _ ContentFilter = AuthResultsFilter{}
+
+// Filter prepends the Authentication-Results field.
+func (f AuthResultsFilter) Filter(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error) {
+	metadata := envelope.Metadata()
+	id := f.AuthServID
+	if id == "" {
+		id = metadata.ServerHostname
+	}
+
+	m := NewModifiedEnvelope(envelope)
+	fields := m.Headers().Values("Authentication-Results")
+	for i := len(fields) - 1; i >= 0; i-- {
+		if strings.EqualFold(authServID(fields[i]), id) {
+			m.ChangeHeader("Authentication-Results", i+1, "")
+		}
+	}
+	m.PrependHeader("Authentication-Results", AuthenticationResults(id, metadata.AuthResults))
+	return FilterResult{Action: FilterAccept, Envelope: m}, nil
+}
+
+// authServID returns the authserv-id of an Authentication-Results value.
+func authServID(value string) string {
+	id, _, _ := strings.Cut(value, ";")
+	id, _, _ = strings.Cut(strings.TrimSpace(id), " ")
+	return strings.TrimSpace(id)
+}
@@ -0,0 +1,52 @@
+package icesmtp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAuthResult_String(t *testing.T) {
+	r := AuthResult{
+		Method: "spf",
+		Result: "permerror",
+		Reason: "syntax error: invalid term",
+		Properties: []AuthProperty{
+			{Type: "smtp", Name: "mailfrom", Value: "user@example.org"},
+		},
+	}
+	want := `spf=permerror reason="syntax error: invalid term" smtp.mailfrom=user@example.org`
+	if got := r.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	if got := SMTPAuthResult("alice").String(); got != "auth=pass smtp.auth=alice" {
+		t.Errorf("SMTPAuthResult = %q", got)
+	}
+	if got := AuthenticationResults("mx.example.com", nil); got != "mx.example.com; none" {
+		t.Errorf("no results = %q", got)
+	}
+}
+
+func TestAuthResultsFilter(t *testing.T) {
+	base := buildTestEnvelope(t, "Authentication-Results: MX.example.com; spf=pass\r\n"+
+		"Authentication-Results: other.example.net; dkim=pass\r\n"+
+		"Subject: hi\r\n\r\nbody\r\n")
+
+	m := NewModifiedEnvelope(base)
+	m.AddAuthResult(AuthResult{Method: "spf", Result: "fail",
+		Properties: []AuthProperty{{Type: "smtp", Name: "mailfrom", Value: "sender@example.com"}}})
+	if len(base.Metadata().AuthResults) != 0 {
+		t.Fatal("AddAuthResult changed the base metadata")
+	}
+
+	result, err := AuthResultsFilter{AuthServID: "mx.example.com"}.Filter(context.Background(), m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Authentication-Results: mx.example.com;\r\n\tspf=fail smtp.mailfrom=sender@example.com\r\n" +
+		"Authentication-Results: other.example.net; dkim=pass\r\n" +
+		"Subject: hi\r\n\r\nbody\r\n"
+	if got := string(result.Envelope.Data()); got != want {
+		t.Errorf("data = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,263 @@
+// Package clamav provides a ContentFilter that scans messages for viruses
+// with clamd.
+//
+// Messages are streamed to clamd over TCP or a Unix socket with the
+// INSTREAM command. Infected messages are rejected with 554 5.7.1 and the
+// signature name; if clamd cannot be reached the filter returns an error,
+// which the engine answers with 451. Use icesmtp.FilterChain with
+// WithFailOpen to accept mail unscanned instead.
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// DefaultStreamMaxLength is clamd's default StreamMaxLength (25 MB).
+const DefaultStreamMaxLength = 25 << 20
+
+// ErrScan is returned when clamd reports an error for a scan.
+var ErrScan = errors.New("clamav: scan error")
+
+// ErrTooLarge indicates a message exceeds the stream length limit.
+var ErrTooLarge = errors.New("clamav: message exceeds StreamMaxLength")
+
+// Result is the outcome of a scan.
+type Result struct {
+	// Infected is true if a virus was found.
+	Infected bool
+
+	// Signature is the name of the virus found, e.g.
+	// "Win.Test.EICAR_HDB-1".
+	Signature string
+}
+
+// Scanner scans messages with clamd.
+type Scanner struct {
+	network string
+	address string
+
+	timeout         time.Duration
+	chunkSize       int
+	streamMaxLength int64
+	scanOversize    bool
+}
+
+// Option configures a Scanner.
+type Option func(*Scanner)
+
+// WithTimeout bounds a whole scan, including connecting. Defaults to
+// 30 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Scanner) {
+		s.timeout = d
+	}
+}
+
+// WithChunkSize sets the size of the INSTREAM chunks. Defaults to 64 KB.
+func WithChunkSize(n int) Option {
+	return func(s *Scanner) {
+		s.chunkSize = n
+	}
+}
+
+// WithStreamMaxLength sets the largest message sent to clamd. It must not
+// exceed clamd's StreamMaxLength setting. Defaults to
+// DefaultStreamMaxLength.
+func WithStreamMaxLength(n int64) Option {
+	return func(s *Scanner) {
+		s.streamMaxLength = n
+	}
+}
+
+// WithScanOversize scans only the first StreamMaxLength bytes of larger
+// messages instead of rejecting them.
+func WithScanOversize() Option {
+	return func(s *Scanner) {
+		s.scanOversize = true
+	}
+}
+
+// New creates a Scanner for the clamd listening at address, e.g.
+// New("tcp", "127.0.0.1:3310") or New("unix", "/run/clamav/clamd.ctl").
+func New(network, address string, opts ...Option) *Scanner {
+	s := &Scanner{
+		network:         network,
+		address:         address,
+		timeout:         30 * time.Second,
+		chunkSize:       64 << 10,
+		streamMaxLength: DefaultStreamMaxLength,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// CheckLimits reports whether messages accepted under limits can be
+// scanned in full. It returns ErrTooLarge if MaxMessageSize is unlimited
+// or larger than the stream length limit.
+func (s *Scanner) CheckLimits(limits icesmtp.SessionLimits) error {
+	if limits.MaxMessageSize == 0 || limits.MaxMessageSize > s.streamMaxLength {
+		return fmt.Errorf("%w: MaxMessageSize %d, StreamMaxLength %d",
+			ErrTooLarge, limits.MaxMessageSize, s.streamMaxLength)
+	}
+	return nil
+}
+
+// Filter scans the message.
+func (s *Scanner) Filter(ctx context.Context, envelope icesmtp.Envelope, session icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	data := envelope.Data()
+	if int64(len(data)) > s.streamMaxLength {
+		if !s.scanOversize {
+			return icesmtp.FilterResult{
+				Action: icesmtp.FilterReject,
+				Response: icesmtp.NewEnhancedResponse(icesmtp.Reply552ExceededStorage,
+					icesmtp.EnhancedStatusCode{Class: icesmtp.EnhancedPermanent, Subject: icesmtp.EnhancedSubjectMailSystem, Detail: 4},
+					"Message too large to scan for viruses"),
+				Reason: ErrTooLarge.Error(),
+			}, nil
+		}
+		data = data[:s.streamMaxLength]
+	}
+
+	result, err := s.Scan(ctx, bytes.NewReader(data))
+	if err != nil {
+		return icesmtp.FilterResult{}, err
+	}
+	if result.Infected {
+		return icesmtp.FilterRejected("Message rejected: virus found (" + result.Signature + ")"), nil
+	}
+	return icesmtp.FilterAccepted(), nil
+}
+
+// Scan streams r to clamd with INSTREAM.
+func (s *Scanner) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("clamav: %w", err)
+	}
+
+	if err := s.stream(conn, r); err != nil {
+		// clamd replies and closes the connection when the stream
+		// exceeds its limit; prefer its reply to the write error.
+		if reply, rerr := readReply(conn); rerr == nil && reply != "" {
+			return parseReply(reply)
+		}
+		return Result{}, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, err
+	}
+	return parseReply(reply)
+}
+
+// stream writes r as INSTREAM chunks followed by the terminating
+// zero-length chunk.
+func (s *Scanner) stream(conn net.Conn, r io.Reader) error {
+	buf := make([]byte, 4+s.chunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("clamav: %w", err)
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("clamav: read message: %w", rerr)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("clamav: %w", err)
+	}
+	return nil
+}
+
+// Ping checks that clamd is responding.
+func (s *Scanner) Ping(ctx context.Context) error {
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("clamav: %w", err)
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: unexpected reply %q", ErrScan, reply)
+	}
+	return nil
+}
+
+// dial connects to clamd with the scan deadline applied.
+func (s *Scanner) dial(ctx context.Context) (net.Conn, error) {
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, fmt.Errorf("clamav: dial %s: %w", s.address, err)
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// readReply reads a NUL-terminated reply.
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", fmt.Errorf("clamav: read reply: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// parseReply parses an INSTREAM reply such as "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseReply(reply string) (Result, error) {
+	if strings.HasSuffix(reply, "size limit exceeded. ERROR") {
+		return Result{}, fmt.Errorf("%w: %s", ErrTooLarge, reply)
+	}
+	_, status, ok := strings.Cut(reply, ": ")
+	switch {
+	case !ok:
+		return Result{}, fmt.Errorf("%w: %s", ErrScan, reply)
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	default:
+		return Result{}, fmt.Errorf("%w: %s", ErrScan, status)
+	}
+}
+
+// Ensure Scanner implements the interface.
+var _ icesmtp.ContentFilter = (*Scanner)(nil)
@@ -0,0 +1,178 @@
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// fakeClamd answers INSTREAM and PING like clamd. Streams containing
+// "EICAR" are reported as infected.
+func fakeClamd(t *testing.T, network, address string, maxLength int) string {
+	t.Helper()
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, maxLength)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveClamd(conn net.Conn, maxLength int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var stream bytes.Buffer
+		var hdr [4]byte
+		for {
+			if _, err := io.ReadFull(r, hdr[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(hdr[:])
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&stream, r, int64(n)); err != nil {
+				return
+			}
+			if stream.Len() > maxLength {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+		}
+		if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			return
+		}
+		conn.Write([]byte("stream: OK\x00"))
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func buildEnvelope(t *testing.T, data string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{})
+	b.SetMailFrom(icesmtp.MailPath{Address: "sender@example.org"}, nil)
+	b.AddRecipient(icesmtp.MailPath{Address: "rcpt@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestScanner_Filter(t *testing.T) {
+	addr := fakeClamd(t, "tcp", "127.0.0.1:0", 1<<20)
+	s := New("tcp", addr, WithChunkSize(7))
+	ctx := context.Background()
+
+	result, err := s.Filter(ctx, buildEnvelope(t, "Subject: clean\r\n\r\nHello.\r\n"), nil)
+	if err != nil || result.Action != icesmtp.FilterAccept {
+		t.Errorf("clean message: %+v, %v", result, err)
+	}
+
+	result, err = s.Filter(ctx, buildEnvelope(t, "Subject: bad\r\n\r\nX5O!P%@AP EICAR test\r\n"), nil)
+	if err != nil {
+		t.Fatalf("infected message: %v", err)
+	}
+	if result.Action != icesmtp.FilterReject || result.Response.Code != 554 ||
+		!strings.Contains(result.Response.String(), "5.7.1") ||
+		!strings.Contains(result.Response.String(), "Eicar-Test-Signature") {
+		t.Errorf("infected message result = %+v", result)
+	}
+
+	if err := s.Ping(ctx); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+}
+
+func TestScanner_UnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	fakeClamd(t, "unix", sock, 1<<20)
+
+	res, err := New("unix", sock).Scan(context.Background(), strings.NewReader("EICAR"))
+	if err != nil || !res.Infected || res.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Scan = %+v, %v", res, err)
+	}
+}
+
+func TestScanner_Unavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = New("tcp", addr).Filter(context.Background(), buildEnvelope(t, "Subject: x\r\n\r\nbody\r\n"), nil)
+	if err == nil {
+		t.Error("expected error when clamd is unavailable")
+	}
+}
+
+func TestScanner_StreamMaxLength(t *testing.T) {
+	addr := fakeClamd(t, "tcp", "127.0.0.1:0", 16)
+	env := buildEnvelope(t, "Subject: big\r\n\r\n"+strings.Repeat("x", 64)+"\r\n")
+	ctx := context.Background()
+
+	// clamd's own limit is reported as ErrTooLarge.
+	if _, err := New("tcp", addr).Filter(ctx, env, nil); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge from clamd, got %v", err)
+	}
+
+	// Messages over the configured limit are rejected without scanning.
+	result, err := New("tcp", addr, WithStreamMaxLength(16)).Filter(ctx, env, nil)
+	if err != nil || result.Action != icesmtp.FilterReject || result.Response.Code != 552 {
+		t.Errorf("oversize result = %+v, %v", result, err)
+	}
+
+	// Or only their start is scanned.
+	result, err = New("tcp", addr, WithStreamMaxLength(16), WithScanOversize()).Filter(ctx, env, nil)
+	if err != nil || result.Action != icesmtp.FilterAccept {
+		t.Errorf("truncated scan result = %+v, %v", result, err)
+	}
+}
+
+func TestScanner_CheckLimits(t *testing.T) {
+	s := New("tcp", "127.0.0.1:3310")
+	if err := s.CheckLimits(icesmtp.SessionLimits{MaxMessageSize: 10 << 20}); err != nil {
+		t.Errorf("10 MB: %v", err)
+	}
+	if err := s.CheckLimits(icesmtp.SessionLimits{MaxMessageSize: 50 << 20}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("50 MB: %v", err)
+	}
+	if err := s.CheckLimits(icesmtp.SessionLimits{}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("unlimited: %v", err)
+	}
+}
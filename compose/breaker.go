@@ -0,0 +1,246 @@
+package compose
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// ErrCircuitOpen is the cause of store errors rejected by an open
+// CircuitBreaker.
+var ErrCircuitOpen = errors.New("storage circuit open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed passes stores through to the backend.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen rejects stores without calling the backend.
+	BreakerOpen
+
+	// BreakerHalfOpen lets a single trial store through after the
+	// cooldown; its outcome closes or reopens the circuit.
+	BreakerHalfOpen
+)
+
+// String returns the state name.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops calling a backend that is failing.
+//
+// The circuit opens after a run of consecutive retryable failures, or when
+// the backend implements StorageWithHealth and a background health probe
+// reports it unhealthy. While open, stores fail immediately with a
+// retryable StorageError so that the engine replies 451 without waiting
+// for the backend to time out. After the cooldown one trial store is let
+// through. Non-retryable failures mean the backend is working and rejected
+// the message, so they do not count towards the threshold. Outcomes of
+// stores that began before the circuit last opened are ignored.
+type CircuitBreaker struct {
+	backend        icesmtp.Storage
+	threshold      int
+	cooldown       time.Duration
+	healthInterval time.Duration
+
+	mu          sync.Mutex
+	state       BreakerState
+	generation  uint64 // incremented each time the circuit opens
+	failures    int
+	openedAt    time.Time
+	lastProbe   time.Time
+	probing     bool
+	trialActive bool
+}
+
+// probeTimeout bounds a background health probe.
+const probeTimeout = 10 * time.Second
+
+// BreakerOption configures a CircuitBreaker.
+type BreakerOption func(*CircuitBreaker)
+
+// WithFailureThreshold sets the number of consecutive retryable failures
+// that open the circuit. Defaults to 5.
+func WithFailureThreshold(n int) BreakerOption {
+	return func(b *CircuitBreaker) {
+		b.threshold = n
+	}
+}
+
+// WithCooldown sets how long the circuit stays open before a trial
+// store. Defaults to 30 seconds.
+func WithCooldown(d time.Duration) BreakerOption {
+	return func(b *CircuitBreaker) {
+		b.cooldown = d
+	}
+}
+
+// WithHealthInterval sets how often a closed circuit probes the backend's
+// Healthy method. A store that finds a probe due starts it in the
+// background and is not delayed by it. Zero disables probing. Defaults
+// to 5 seconds.
+func WithHealthInterval(d time.Duration) BreakerOption {
+	return func(b *CircuitBreaker) {
+		b.healthInterval = d
+	}
+}
+
+// NewCircuitBreaker wraps backend with a circuit breaker.
+func NewCircuitBreaker(backend icesmtp.Storage, opts ...BreakerOption) *CircuitBreaker {
+	b := &CircuitBreaker{
+		backend:        backend,
+		threshold:      5,
+		cooldown:       30 * time.Second,
+		healthInterval: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.threshold < 1 {
+		b.threshold = 1
+	}
+	return b
+}
+
+// State returns the current circuit state.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Store stores the envelope unless the circuit is open.
+func (b *CircuitBreaker) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	generation, err := b.allow()
+	if err != nil {
+		return icesmtp.StorageReceipt{}, storeutil.Error(envelope, icesmtp.StorageOpStore, err, false, "storage unavailable")
+	}
+	receipt, err := b.backend.Store(ctx, envelope)
+	b.record(generation, err)
+	return receipt, err
+}
+
+// StoreStream streams the envelope unless the circuit is open.
+func (b *CircuitBreaker) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	generation, err := b.allow()
+	if err != nil {
+		return icesmtp.StorageReceipt{}, storeutil.Error(envelope, icesmtp.StorageOpStoreStream, err, false, "storage unavailable")
+	}
+	receipt, err := b.backend.StoreStream(ctx, envelope, data)
+	b.record(generation, err)
+	return receipt, err
+}
+
+// allow decides whether a store may reach the backend and returns the
+// generation of the circuit it was let through in. A health probe that is
+// due is started in the background.
+func (b *CircuitBreaker) allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return 0, ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+
+	case BreakerHalfOpen:
+		if b.trialActive {
+			return 0, ErrCircuitOpen
+		}
+		b.trialActive = true
+
+	default:
+		if b.healthInterval > 0 && !b.probing && now.Sub(b.lastProbe) >= b.healthInterval {
+			b.lastProbe = now
+			b.probing = true
+			go b.probe(b.generation)
+		}
+	}
+	return b.generation, nil
+}
+
+// probe checks the backend's health and opens the circuit if it is
+// unhealthy, unless the circuit has opened since generation.
+func (b *CircuitBreaker) probe(generation uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	err := checkHealth(ctx, b.backend)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil && generation == b.generation {
+		b.trip()
+	}
+}
+
+// record updates the circuit with the outcome of a backend call let
+// through in generation.
+func (b *CircuitBreaker) record(generation uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		// The store began before the circuit opened.
+		return
+	}
+
+	if err != nil && isRetryable(err) {
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+			b.trip()
+		}
+		return
+	}
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trialActive = false
+}
+
+// trip opens the circuit. The caller holds mu.
+func (b *CircuitBreaker) trip() {
+	b.state = BreakerOpen
+	b.generation++
+	b.openedAt = time.Now()
+	b.failures = 0
+	b.trialActive = false
+}
+
+// Healthy returns ErrCircuitOpen while the circuit is open, and otherwise
+// the backend's health.
+func (b *CircuitBreaker) Healthy(ctx context.Context) error {
+	if b.State() == BreakerOpen {
+		return ErrCircuitOpen
+	}
+	return checkHealth(ctx, b.backend)
+}
+
+// Ensure CircuitBreaker implements the interfaces.
+var (
+	_ icesmtp.Storage           = (*CircuitBreaker)(nil)
+	_ icesmtp.StorageWithHealth = (*CircuitBreaker)(nil)
+)
@@ -0,0 +1,39 @@
+// Package compose provides Storage wrappers that combine or protect other
+// Storage backends.
+//
+// FanOut writes every message to several backends, Failover tries
+// backends in order until one accepts the message, and CircuitBreaker
+// stops calling a failing backend so that sessions receive a 4xx reply
+// immediately instead of waiting for timeouts. The wrappers implement
+// Storage themselves and can be nested, e.g. a FanOut whose primary is a
+// Failover of circuit-broken backends.
+package compose
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// isRetryable reports whether err may succeed on retry. Errors that are
+// not a *icesmtp.StorageError are treated as temporary, matching the
+// engine's 451 reply for them.
+func isRetryable(err error) bool {
+	var se *icesmtp.StorageError
+	if errors.As(err, &se) {
+		return !se.Permanent
+	}
+	return true
+}
+
+// replayable reads data fully so that it can be handed to more than one
+// backend.
+func replayable(data io.Reader) (func() io.Reader, error) {
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	return func() io.Reader { return bytes.NewReader(buf) }, nil
+}
@@ -0,0 +1,271 @@
+package compose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// fakeStorage returns err from every store and health from Healthy.
+type fakeStorage struct {
+	name   string
+	err    error
+	health error
+	calls  atomic.Int32
+}
+
+func (s *fakeStorage) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	s.calls.Add(1)
+	if s.err != nil {
+		return icesmtp.StorageReceipt{}, s.err
+	}
+	return icesmtp.StorageReceipt{MessageID: s.name, EnvelopeID: envelope.ID()}, nil
+}
+
+func (s *fakeStorage) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	io.Copy(io.Discard, data)
+	return s.Store(ctx, envelope)
+}
+
+func (s *fakeStorage) Healthy(ctx context.Context) error { return s.health }
+
+var (
+	errTemp = &icesmtp.StorageError{Cause: errors.New("down")}
+	errPerm = &icesmtp.StorageError{Cause: errors.New("rejected"), Permanent: true}
+)
+
+func buildEnvelope(t *testing.T) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{})
+	b.SetMailFrom(icesmtp.MailPath{Address: "a@example.org"}, nil)
+	b.AddRecipient(icesmtp.MailPath{Address: "b@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte("Subject: x\r\n\r\nbody\r\n"))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func retryable(t *testing.T, err error) bool {
+	t.Helper()
+	var se *icesmtp.StorageError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected *StorageError, got %v", err)
+	}
+	return !se.Permanent
+}
+
+func TestFanOut_Modes(t *testing.T) {
+	env := buildEnvelope(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		errs    []error
+		opts    []FanOutOption
+		wantErr bool
+		wantID  string
+	}{
+		{"all succeed", []error{nil, nil}, nil, false, "s0"},
+		{"all with failure", []error{nil, errTemp}, nil, true, ""},
+		{"quorum met", []error{errTemp, nil, nil}, []FanOutOption{WithMode(RequireQuorum)}, false, "s1"},
+		{"quorum missed", []error{errTemp, errTemp, nil}, []FanOutOption{WithMode(RequireQuorum)}, true, ""},
+		{"best-effort secondary", []error{nil, errTemp}, []FanOutOption{WithMode(PrimaryOnly)}, false, "s0"},
+		{"primary failure", []error{errTemp, nil}, []FanOutOption{WithMode(PrimaryOnly)}, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backends []icesmtp.Storage
+			for i, err := range tt.errs {
+				backends = append(backends, &fakeStorage{name: fmt.Sprintf("s%d", i), err: err})
+			}
+			var reported atomic.Int32
+			opts := append(tt.opts, WithErrorHandler(func(context.Context, int, icesmtp.Envelope, error) {
+				reported.Add(1)
+			}))
+
+			receipt, err := NewFanOut(backends, opts...).Store(ctx, env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && receipt.MessageID != tt.wantID {
+				t.Errorf("MessageID = %q, want %q", receipt.MessageID, tt.wantID)
+			}
+			var failures int32
+			for _, e := range tt.errs {
+				if e != nil {
+					failures++
+				}
+			}
+			if reported.Load() != failures {
+				t.Errorf("reported %d failures, want %d", reported.Load(), failures)
+			}
+		})
+	}
+
+	_, err := NewFanOut([]icesmtp.Storage{&fakeStorage{err: errPerm}, &fakeStorage{err: errPerm}}).Store(ctx, env)
+	if retryable(t, err) {
+		t.Error("all-permanent failures should not be retryable")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	env := buildEnvelope(t)
+	ctx := context.Background()
+
+	primary := &fakeStorage{name: "primary", err: errTemp}
+	secondary := &fakeStorage{name: "secondary"}
+	receipt, err := NewFailover(primary, secondary).StoreStream(ctx, env, strings.NewReader("x"))
+	if err != nil || receipt.MessageID != "secondary" {
+		t.Fatalf("receipt = %+v, err = %v", receipt, err)
+	}
+
+	// Permanent rejections are not retried elsewhere
+	primary.err = errPerm
+	secondary.calls.Store(0)
+	_, err = NewFailover(primary, secondary).Store(ctx, env)
+	if err == nil || retryable(t, err) || secondary.calls.Load() != 0 {
+		t.Fatalf("err = %v, secondary calls = %d", err, secondary.calls.Load())
+	}
+
+	_, err = NewFailover(&fakeStorage{err: errTemp}, &fakeStorage{err: errors.New("io")}).Store(ctx, env)
+	if !retryable(t, err) {
+		t.Error("exhausted failover should be retryable")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	env := buildEnvelope(t)
+	ctx := context.Background()
+
+	backend := &fakeStorage{err: errTemp}
+	cb := NewCircuitBreaker(backend, WithFailureThreshold(2), WithCooldown(20*time.Millisecond), WithHealthInterval(0))
+
+	cb.Store(ctx, env)
+	cb.Store(ctx, env)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state = %v, want open", cb.State())
+	}
+
+	_, err := cb.Store(ctx, env)
+	if !errors.Is(err, ErrCircuitOpen) || !retryable(t, err) || backend.calls.Load() != 2 {
+		t.Fatalf("open circuit: err = %v, calls = %d", err, backend.calls.Load())
+	}
+	if cb.Healthy(ctx) == nil {
+		t.Error("Healthy should fail while open")
+	}
+
+	// After the cooldown a successful trial closes the circuit
+	time.Sleep(30 * time.Millisecond)
+	backend.err = nil
+	if _, err := cb.Store(ctx, env); err != nil {
+		t.Fatalf("trial store: %v", err)
+	}
+	if cb.State() != BreakerClosed {
+		t.Errorf("state = %v, want closed", cb.State())
+	}
+}
+
+// probeStorage is a fakeStorage whose Healthy waits for a result on
+// health.
+type probeStorage struct {
+	fakeStorage
+	health chan error
+}
+
+func (s *probeStorage) Healthy(ctx context.Context) error { return <-s.health }
+
+// waitState waits for the circuit to reach want.
+func waitState(t *testing.T, cb *CircuitBreaker, want BreakerState) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); cb.State() != want; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %v, want %v", cb.State(), want)
+		}
+	}
+}
+
+func TestCircuitBreaker_HealthProbe(t *testing.T) {
+	env := buildEnvelope(t)
+	backend := &probeStorage{health: make(chan error)}
+	cb := NewCircuitBreaker(backend, WithHealthInterval(time.Nanosecond))
+
+	// The store does not wait for the probe it starts.
+	done := make(chan error, 1)
+	go func() {
+		_, err := cb.Store(context.Background(), env)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("store waited for the health probe")
+	}
+
+	backend.health <- errors.New("disk full")
+	waitState(t, cb, BreakerOpen)
+
+	_, err := cb.Store(context.Background(), env)
+	if !errors.Is(err, ErrCircuitOpen) || backend.calls.Load() != 1 {
+		t.Fatalf("err = %v, calls = %d", err, backend.calls.Load())
+	}
+}
+
+// slowStorage blocks its first store until release is closed and fails
+// the others.
+type slowStorage struct {
+	fakeStorage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStorage) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	if s.calls.Add(1) == 1 {
+		close(s.started)
+		<-s.release
+		return icesmtp.StorageReceipt{EnvelopeID: envelope.ID()}, nil
+	}
+	return icesmtp.StorageReceipt{}, errTemp
+}
+
+func TestCircuitBreaker_StaleResult(t *testing.T) {
+	env := buildEnvelope(t)
+	ctx := context.Background()
+	backend := &slowStorage{started: make(chan struct{}), release: make(chan struct{})}
+	cb := NewCircuitBreaker(backend, WithFailureThreshold(1), WithCooldown(time.Hour), WithHealthInterval(0))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cb.Store(ctx, env)
+		done <- err
+	}()
+	<-backend.started
+
+	cb.Store(ctx, env)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state = %v, want open", cb.State())
+	}
+
+	// The store that began before the circuit opened does not close it.
+	close(backend.release)
+	if err := <-done; err != nil {
+		t.Fatalf("slow store: %v", err)
+	}
+	if cb.State() != BreakerOpen {
+		t.Errorf("state = %v after a stale success, want open", cb.State())
+	}
+}
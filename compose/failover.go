@@ -0,0 +1,91 @@
+package compose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// Failover tries backends in order and returns the first success.
+//
+// A retryable failure moves on to the next backend. A non-retryable
+// failure is a permanent rejection of the message and is returned
+// immediately without trying the remaining backends.
+type Failover struct {
+	backends []icesmtp.Storage
+}
+
+// NewFailover creates a Failover over backends in priority order.
+func NewFailover(backends ...icesmtp.Storage) *Failover {
+	return &Failover{backends: backends}
+}
+
+// Store stores the envelope in the first backend that accepts it.
+func (f *Failover) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	return f.run(ctx, envelope, icesmtp.StorageOpStore, func(s icesmtp.Storage) (icesmtp.StorageReceipt, error) {
+		return s.Store(ctx, envelope)
+	})
+}
+
+// StoreStream buffers the data so that it can be replayed to the next
+// backend after a failure.
+func (f *Failover) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	open, err := replayable(data)
+	if err != nil {
+		return icesmtp.StorageReceipt{}, storeutil.Error(envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
+	}
+	return f.run(ctx, envelope, icesmtp.StorageOpStoreStream, func(s icesmtp.Storage) (icesmtp.StorageReceipt, error) {
+		return s.StoreStream(ctx, envelope, open())
+	})
+}
+
+func (f *Failover) run(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, store func(icesmtp.Storage) (icesmtp.StorageReceipt, error)) (icesmtp.StorageReceipt, error) {
+	var errs []error
+	for i, s := range f.backends {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		receipt, err := store(s)
+		if err == nil {
+			return receipt, nil
+		}
+		if !isRetryable(err) {
+			return icesmtp.StorageReceipt{}, err
+		}
+		errs = append(errs, fmt.Errorf("backend %d: %w", i, err))
+	}
+
+	if len(errs) == 0 {
+		errs = append(errs, errors.New("no backends"))
+	}
+	return icesmtp.StorageReceipt{}, storeutil.Error(envelope, op, errors.Join(errs...), false, "all failover backends failed")
+}
+
+// Healthy returns nil if any backend is healthy. Backends that do not
+// implement StorageWithHealth are assumed healthy.
+func (f *Failover) Healthy(ctx context.Context) error {
+	var errs []error
+	for i, s := range f.backends {
+		err := checkHealth(ctx, s)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("backend %d: %w", i, err))
+	}
+	if len(errs) == 0 {
+		return errors.New("no backends")
+	}
+	return errors.Join(errs...)
+}
+
+// Ensure Failover implements the interfaces.
+var (
+	_ icesmtp.Storage           = (*Failover)(nil)
+	_ icesmtp.StorageWithHealth = (*Failover)(nil)
+)
@@ -0,0 +1,199 @@
+package compose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// FanOutMode determines how many backends must accept a message.
+type FanOutMode int
+
+const (
+	// RequireAll fails the store unless every backend succeeds.
+	RequireAll FanOutMode = iota
+
+	// RequireQuorum fails the store unless at least the configured
+	// quorum of backends succeeds.
+	RequireQuorum
+
+	// PrimaryOnly requires the first backend to succeed and treats the
+	// others as best-effort secondaries whose failures are only reported
+	// to the error handler.
+	PrimaryOnly
+)
+
+// FanOut stores each message in several backends concurrently.
+//
+// A failed store may have succeeded on some backends, so a sender retry
+// can produce duplicates there. Backends that deduplicate on EnvelopeID
+// avoid this.
+type FanOut struct {
+	backends []icesmtp.Storage
+	mode     FanOutMode
+	quorum   int
+	onError  func(ctx context.Context, index int, envelope icesmtp.Envelope, err error)
+}
+
+// FanOutOption configures a FanOut.
+type FanOutOption func(*FanOut)
+
+// WithMode sets the fan-out mode. Defaults to RequireAll.
+func WithMode(mode FanOutMode) FanOutOption {
+	return func(f *FanOut) {
+		f.mode = mode
+	}
+}
+
+// WithQuorum sets the number of backends that must succeed in
+// RequireQuorum mode. Defaults to a majority.
+func WithQuorum(n int) FanOutOption {
+	return func(f *FanOut) {
+		f.quorum = n
+	}
+}
+
+// WithErrorHandler sets a callback invoked for every backend failure,
+// including those that do not fail the store. index is the backend's
+// position as passed to NewFanOut.
+func WithErrorHandler(fn func(ctx context.Context, index int, envelope icesmtp.Envelope, err error)) FanOutOption {
+	return func(f *FanOut) {
+		f.onError = fn
+	}
+}
+
+// NewFanOut creates a FanOut over backends. The first backend is the
+// primary: its receipt is returned on success.
+func NewFanOut(backends []icesmtp.Storage, opts ...FanOutOption) *FanOut {
+	f := &FanOut{
+		backends: backends,
+		quorum:   len(backends)/2 + 1,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+// Store stores the envelope in every backend.
+func (f *FanOut) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	return f.run(ctx, envelope, icesmtp.StorageOpStore, func(s icesmtp.Storage) (icesmtp.StorageReceipt, error) {
+		return s.Store(ctx, envelope)
+	})
+}
+
+// StoreStream buffers the data and streams a copy to every backend.
+func (f *FanOut) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	open, err := replayable(data)
+	if err != nil {
+		return icesmtp.StorageReceipt{}, storeutil.Error(envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
+	}
+	return f.run(ctx, envelope, icesmtp.StorageOpStoreStream, func(s icesmtp.Storage) (icesmtp.StorageReceipt, error) {
+		return s.StoreStream(ctx, envelope, open())
+	})
+}
+
+func (f *FanOut) run(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, store func(icesmtp.Storage) (icesmtp.StorageReceipt, error)) (icesmtp.StorageReceipt, error) {
+	if len(f.backends) == 0 {
+		return icesmtp.StorageReceipt{}, storeutil.Error(envelope, op, errors.New("no backends"), true, "fan-out has no backends")
+	}
+
+	receipts := make([]icesmtp.StorageReceipt, len(f.backends))
+	errs := make([]error, len(f.backends))
+
+	var wg sync.WaitGroup
+	for i, s := range f.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			receipts[i], errs[i] = store(s)
+		}()
+	}
+	wg.Wait()
+
+	succeeded := 0
+	var failed []error
+	for i, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		if f.onError != nil {
+			f.onError(ctx, i, envelope, err)
+		}
+		failed = append(failed, fmt.Errorf("backend %d: %w", i, err))
+	}
+
+	var ok bool
+	switch f.mode {
+	case RequireQuorum:
+		ok = succeeded >= f.quorum
+	case PrimaryOnly:
+		ok = errs[0] == nil
+	default:
+		ok = succeeded == len(f.backends)
+	}
+
+	if !ok {
+		// The store is only permanent if no failing backend could
+		// succeed on a retry.
+		retryable := false
+		for _, err := range errs {
+			if err != nil && isRetryable(err) {
+				retryable = true
+			}
+		}
+		return icesmtp.StorageReceipt{}, storeutil.Error(envelope, op, errors.Join(failed...), !retryable,
+			fmt.Sprintf("fan-out stored in %d of %d backends", succeeded, len(f.backends)))
+	}
+
+	for i, err := range errs {
+		if err == nil {
+			return receipts[i], nil
+		}
+	}
+	return icesmtp.StorageReceipt{}, nil
+}
+
+// Healthy returns nil if the backends required by the mode are healthy.
+// Backends that do not implement StorageWithHealth are assumed healthy.
+func (f *FanOut) Healthy(ctx context.Context) error {
+	backends := f.backends
+	if f.mode == PrimaryOnly && len(backends) > 0 {
+		backends = backends[:1]
+	}
+
+	healthy := 0
+	var errs []error
+	for i, s := range backends {
+		if err := checkHealth(ctx, s); err != nil {
+			errs = append(errs, fmt.Errorf("backend %d: %w", i, err))
+			continue
+		}
+		healthy++
+	}
+
+	if f.mode == RequireQuorum && healthy >= f.quorum {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// checkHealth calls Healthy if s implements StorageWithHealth.
+func checkHealth(ctx context.Context, s icesmtp.Storage) error {
+	if h, ok := s.(icesmtp.StorageWithHealth); ok {
+		return h.Healthy(ctx)
+	}
+	return nil
+}
+
+// Ensure FanOut implements the interfaces.
+var (
+	_ icesmtp.Storage           = (*FanOut)(nil)
+	_ icesmtp.StorageWithHealth = (*FanOut)(nil)
+)
@@ -0,0 +1,234 @@
+package dkim
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Canonicalization is a header or body canonicalization algorithm.
+type Canonicalization string
+
+// Canonicalization algorithms (RFC 6376 section 3.4).
+const (
+	Simple  Canonicalization = "simple"
+	Relaxed Canonicalization = "relaxed"
+)
+
+// ParseCanonicalization parses a c= value such as "relaxed/simple". The
+// body algorithm defaults to simple.
+func ParseCanonicalization(s string) (header, body Canonicalization, err error) {
+	if s == "" {
+		return Simple, Simple, nil
+	}
+	h, b, _ := strings.Cut(strings.ToLower(s), "/")
+	header, body = Canonicalization(h), Canonicalization(b)
+	if body == "" {
+		body = Simple
+	}
+	for _, c := range []Canonicalization{header, body} {
+		if c != Simple && c != Relaxed {
+			return "", "", fmt.Errorf("%w: canonicalization %q", ErrUnsupported, s)
+		}
+	}
+	return header, body, nil
+}
+
+// HeaderFields splits a header block into raw fields in message order.
+// Each field keeps its continuation lines and ends with CRLF; bare LF
+// line endings are converted.
+func HeaderFields(header []byte) []string {
+	var fields []string
+	var cur strings.Builder
+	for len(header) > 0 {
+		line := header
+		if i := bytes.IndexByte(header, '\n'); i >= 0 {
+			line, header = header[:i+1], header[i+1:]
+		} else {
+			header = nil
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' && cur.Len() > 0 {
+			fields = append(fields, cur.String())
+			cur.Reset()
+		}
+		cur.Write(line)
+		cur.WriteString("\r\n")
+	}
+	if cur.Len() > 0 {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+// fieldName returns the name of a raw header field.
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimRight(name, " \t")
+}
+
+// CanonicalizeHeader canonicalizes a raw header field, including its
+// trailing CRLF.
+func CanonicalizeHeader(c Canonicalization, field string) string {
+	if c != Relaxed {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return name + ":" + strings.Join(strings.Fields(value), " ") + "\r\n"
+}
+
+// HashHeaders hashes the header fields named in signed, selecting
+// repeated names from the bottom up and skipping names with no remaining
+// field, followed by the signature field sigField with its b= value
+// removed and no trailing CRLF (RFC 6376 section 3.7).
+func HashHeaders(h hash.Hash, c Canonicalization, fields, signed []string, sigField string) []byte {
+	used := make([]bool, len(fields))
+	for _, name := range signed {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			io.WriteString(h, CanonicalizeHeader(c, fields[i]))
+			break
+		}
+	}
+	sig := CanonicalizeHeader(c, StripSignature(sigField))
+	io.WriteString(h, strings.TrimSuffix(sig, "\r\n"))
+	return h.Sum(nil)
+}
+
+// StripSignature removes the value of the b= tag from a raw signature
+// field, keeping everything else byte for byte.
+func StripSignature(field string) string {
+	colon := strings.IndexByte(field, ':')
+	if colon < 0 {
+		return field
+	}
+	var b strings.Builder
+	b.WriteString(field[:colon+1])
+	rest := field[colon+1:]
+	for rest != "" {
+		tag, next, more := strings.Cut(rest, ";")
+		name, _, hasValue := strings.Cut(tag, "=")
+		if hasValue && strings.TrimSpace(name) == "b" {
+			tag = tag[:strings.IndexByte(tag, '=')+1]
+			if !more && strings.HasSuffix(rest, "\r\n") {
+				tag += "\r\n"
+			}
+		}
+		b.WriteString(tag)
+		if more {
+			b.WriteByte(';')
+		}
+		rest = next
+	}
+	return b.String()
+}
+
+// BodyHasher canonicalizes and hashes a message body as it is written,
+// holding back only trailing empty lines and the current partial line.
+type BodyHasher struct {
+	h     hash.Hash
+	c     Canonicalization
+	limit int64
+
+	line    []byte
+	empty   int
+	written int64
+	any     bool
+}
+
+// NewBodyHasher returns a BodyHasher that hashes at most limit bytes of
+// canonical body with h, or the whole body if limit is negative.
+func NewBodyHasher(h hash.Hash, c Canonicalization, limit int64) *BodyHasher {
+	return &BodyHasher{h: h, c: c, limit: limit}
+}
+
+// Write adds body data.
+func (b *BodyHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			b.line = append(b.line, p...)
+			break
+		}
+		b.line = append(b.line, p[:i]...)
+		b.endLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// endLine canonicalizes the completed line in b.line.
+func (b *BodyHasher) endLine() {
+	line := bytes.TrimSuffix(b.line, []byte("\r"))
+	if b.c == Relaxed {
+		line = relaxLine(line)
+	}
+	b.line = b.line[:0]
+	if len(line) == 0 {
+		b.empty++
+		return
+	}
+	for ; b.empty > 0; b.empty-- {
+		b.emit([]byte("\r\n"))
+	}
+	b.emit(line)
+	b.emit([]byte("\r\n"))
+}
+
+// relaxLine reduces whitespace runs to one space and removes trailing
+// whitespace.
+func relaxLine(line []byte) []byte {
+	out := make([]byte, 0, len(line))
+	space := false
+	for _, c := range line {
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// emit hashes canonical output up to the length limit.
+func (b *BodyHasher) emit(p []byte) {
+	b.any = true
+	if b.limit >= 0 && b.written+int64(len(p)) > b.limit {
+		p = p[:max(0, b.limit-b.written)]
+	}
+	b.h.Write(p)
+	b.written += int64(len(p))
+}
+
+// Sum finishes the body and returns its hash. An unterminated last line
+// is completed with CRLF; an empty body is CRLF under simple
+// canonicalization and empty under relaxed.
+func (b *BodyHasher) Sum() []byte {
+	if len(b.line) > 0 {
+		b.endLine()
+	}
+	if !b.any && b.c == Simple {
+		b.emit([]byte("\r\n"))
+	}
+	return b.h.Sum(nil)
+}
+
+// Length returns the number of canonical body bytes hashed so far.
+func (b *BodyHasher) Length() int64 {
+	return b.written
+}
@@ -0,0 +1,168 @@
+// Package dkim verifies and creates DomainKeys Identified Mail signatures
+// (RFC 6376).
+//
+// A Verifier checks the DKIM-Signature fields of a message with
+// rsa-sha256 or ed25519-sha256 (RFC 8463), simple and relaxed
+// canonicalization and the l= body length limit, fetching public keys
+// through a Resolver. It is an icesmtp.DataInspectorFactory: body hashes
+// are computed while DATA streams, and one result per signature is
+// recorded in the envelope metadata for DMARC evaluation and
+// icesmtp.AuthResultsFilter.
+//
+// A Signer adds DKIM-Signature fields to outgoing mail, choosing a key by
+// the From domain or the authenticated user through a KeySource. It is an
+// icesmtp.ContentFilter, and Storage applies it in front of another
+// backend.
+//
+// The canonicalization, tag-list, key and hashing primitives are exported
+// for ARC, which reuses them.
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Errors reported in Result.Err. An error wrapping ErrDNS produces
+// TempError.
+var (
+	// ErrDNS indicates a temporary DNS failure fetching a key.
+	ErrDNS = errors.New("dkim: DNS error")
+
+	// ErrNoKey indicates the selector publishes no key.
+	ErrNoKey = errors.New("dkim: no key for signature")
+
+	// ErrKeyRevoked indicates the selector's key has been revoked.
+	ErrKeyRevoked = errors.New("dkim: key revoked")
+
+	// ErrSyntax indicates a malformed signature or key record.
+	ErrSyntax = errors.New("dkim: syntax error")
+
+	// ErrUnsupported indicates an unsupported algorithm, key type or
+	// canonicalization.
+	ErrUnsupported = errors.New("dkim: unsupported")
+
+	// ErrBodyHash indicates the body does not match the signature's
+	// body hash.
+	ErrBodyHash = errors.New("dkim: body hash did not verify")
+
+	// ErrSignature indicates the signature does not verify.
+	ErrSignature = errors.New("dkim: signature did not verify")
+
+	// ErrExpired indicates the signature is past its expiration time.
+	ErrExpired = errors.New("dkim: signature expired")
+
+	// ErrKeyTooSmall indicates an RSA key shorter than the minimum.
+	ErrKeyTooSmall = errors.New("dkim: key too small")
+)
+
+// Resolver looks up TXT records. *net.Resolver implements it. A name with
+// no records must be reported as a *net.DNSError with IsNotFound set.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Algorithm is a signing algorithm.
+type Algorithm string
+
+// Supported algorithms.
+const (
+	RSASHA256     Algorithm = "rsa-sha256"
+	Ed25519SHA256 Algorithm = "ed25519-sha256"
+)
+
+// Hash returns the algorithm's hash function.
+func (a Algorithm) Hash() crypto.Hash {
+	return crypto.SHA256
+}
+
+// KeyType returns the k= key type the algorithm needs.
+func (a Algorithm) KeyType() string {
+	k, _, _ := strings.Cut(string(a), "-")
+	return k
+}
+
+// ParseAlgorithm parses an a= value. rsa-sha1 is not supported
+// (RFC 8301).
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch a := Algorithm(strings.ToLower(s)); a {
+	case RSASHA256, Ed25519SHA256:
+		return a, nil
+	default:
+		return "", fmt.Errorf("%w: algorithm %q", ErrUnsupported, s)
+	}
+}
+
+// Status is the result of verifying one signature, as named in
+// Authentication-Results (RFC 8601 section 2.7.1).
+type Status string
+
+// Statuses.
+const (
+	None      Status = "none"
+	Pass      Status = "pass"
+	Fail      Status = "fail"
+	Policy    Status = "policy"
+	Neutral   Status = "neutral"
+	TempError Status = "temperror"
+	PermError Status = "permerror"
+)
+
+// Result is the result of verifying one signature.
+type Result struct {
+	// Status is the verification status.
+	Status Status
+
+	// Signature is the parsed signature. It is nil if the field could not
+	// be parsed.
+	Signature *Signature
+
+	// Err is the reason the signature did not pass.
+	Err error
+}
+
+// statusOf returns the status for a verification error.
+func statusOf(err error) Status {
+	switch {
+	case err == nil:
+		return Pass
+	case errors.Is(err, ErrDNS):
+		return TempError
+	case errors.Is(err, ErrBodyHash), errors.Is(err, ErrSignature), errors.Is(err, ErrExpired):
+		return Fail
+	case errors.Is(err, ErrKeyTooSmall):
+		return Policy
+	default:
+		return PermError
+	}
+}
+
+// AuthResult converts the result to an Authentication-Results entry with
+// header.d, header.i, header.s, header.a and the first 8 characters of
+// header.b (RFC 6008).
+func (r Result) AuthResult() icesmtp.AuthResult {
+	ar := icesmtp.AuthResult{Method: "dkim", Result: string(r.Status)}
+	if r.Err != nil {
+		ar.Reason = strings.TrimPrefix(r.Err.Error(), "dkim: ")
+	}
+	if s := r.Signature; s != nil {
+		b := s.tags["b"]
+		b = strings.Join(strings.Fields(b), "")
+		if len(b) > 8 {
+			b = b[:8]
+		}
+		ar.Properties = []icesmtp.AuthProperty{
+			{Type: "header", Name: "d", Value: s.Domain},
+			{Type: "header", Name: "i", Value: s.Identity},
+			{Type: "header", Name: "s", Value: s.Selector},
+			{Type: "header", Name: "a", Value: string(s.Algorithm)},
+			{Type: "header", Name: "b", Value: b},
+		}
+	}
+	return ar
+}
@@ -0,0 +1,342 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/harness"
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+)
+
+// rfc8463Message is the ed25519-signed example of RFC 8463 appendix A.
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const testMessage = "From: Alice <alice@example.org>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject:  Hello   there\r\n" +
+	"\r\n" +
+	"Body  text\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func resolver() *dnstest.Resolver {
+	return &dnstest.Resolver{TXT: map[string][]string{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	}}
+}
+
+// publish adds the public key of signer under selector in example.org.
+func publish(t *testing.T, r *dnstest.Resolver, selector string, signer crypto.Signer) {
+	t.Helper()
+	var record string
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+	r.TXT[selector+"._domainkey.example.org"] = []string{record}
+}
+
+// sign prepends a DKIM-Signature for example.org to msg using the
+// exported primitives.
+func sign(t *testing.T, signer crypto.Signer, alg Algorithm, selector, c, extra, msg string) string {
+	t.Helper()
+	header, body, _ := strings.Cut(msg, "\r\n\r\n")
+	hc, bc, err := ParseCanonicalization(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limit := int64(-1)
+	if tags, _ := ParseTags(extra); tags["l"] != "" {
+		limit, _ = strconv.ParseInt(tags["l"], 10, 64)
+	}
+	bh := NewBodyHasher(alg.Hash().New(), bc, limit)
+	bh.Write([]byte(body))
+
+	field := "DKIM-Signature: v=1; a=" + string(alg) + "; c=" + c + "; d=example.org; s=" + selector + ";\r\n" +
+		"\th=from:to:subject:from; " + extra + "bh=" + base64.StdEncoding.EncodeToString(bh.Sum()) + ";\r\n\tb="
+	fields := HeaderFields([]byte(header + "\r\n"))
+	digest := HashHeaders(alg.Hash().New(), hc, fields, []string{"from", "to", "subject", "from"}, field+"\r\n")
+
+	opts := crypto.SignerOpts(alg.Hash())
+	if alg == Ed25519SHA256 {
+		opts = crypto.Hash(0)
+	}
+	sig, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return field + base64.StdEncoding.EncodeToString(sig) + "\r\n" + msg
+}
+
+func verify(t *testing.T, r Resolver, msg string, opts ...Option) []Result {
+	t.Helper()
+	results, err := NewVerifier(r, opts...).Verify(context.Background(), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestVerify_RFC8463(t *testing.T) {
+	results := verify(t, resolver(), rfc8463Message)
+	if len(results) != 1 || results[0].Status != Pass {
+		t.Fatalf("results = %+v", results)
+	}
+	want := "dkim=pass header.d=football.example.com header.i=@football.example.com header.s=brisbane header.a=ed25519-sha256 header.b=/gCrinpc"
+	if got := results[0].AuthResult().String(); got != want {
+		t.Errorf("AuthResult = %q, want %q", got, want)
+	}
+
+	tampered := strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1)
+	if results := verify(t, resolver(), tampered); results[0].Status != Fail || !errors.Is(results[0].Err, ErrSignature) {
+		t.Errorf("tampered header = %+v", results[0])
+	}
+	tampered = strings.Replace(rfc8463Message, "hungry", "thirsty", 1)
+	if results := verify(t, resolver(), tampered); results[0].Status != Fail || !errors.Is(results[0].Err, ErrBodyHash) {
+		t.Errorf("tampered body = %+v", results[0])
+	}
+	// Relaxed canonicalization tolerates whitespace changes.
+	reformatted := strings.Replace(rfc8463Message, "Subject: Is dinner", "Subject:   Is  dinner", 1)
+	reformatted = strings.Replace(reformatted, "Joe.\r\n", "Joe. \r\n\r\n\r\n", 1)
+	if results := verify(t, resolver(), reformatted); results[0].Status != Pass {
+		t.Errorf("reformatted = %+v", results[0])
+	}
+}
+
+func TestVerify_Algorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := resolver()
+	publish(t, r, "rsa", rsaKey)
+	publish(t, r, "ed", edKey)
+
+	for _, c := range []string{"simple/simple", "relaxed/relaxed", "relaxed/simple", "simple/relaxed"} {
+		for _, tc := range []struct {
+			signer   crypto.Signer
+			alg      Algorithm
+			selector string
+		}{
+			{rsaKey, RSASHA256, "rsa"},
+			{edKey, Ed25519SHA256, "ed"},
+		} {
+			msg := sign(t, tc.signer, tc.alg, tc.selector, c, "", testMessage)
+			if results := verify(t, r, msg); len(results) != 1 || results[0].Status != Pass {
+				t.Errorf("%s %s: %+v", tc.alg, c, results)
+			}
+		}
+	}
+
+	// Simple canonicalization rejects whitespace changes.
+	msg := sign(t, edKey, Ed25519SHA256, "ed", "simple/simple", "", testMessage)
+	msg = strings.Replace(msg, "Subject:  Hello", "Subject: Hello", 1)
+	if results := verify(t, r, msg); results[0].Status != Fail {
+		t.Errorf("simple whitespace change = %+v", results[0])
+	}
+
+	// Keys below the minimum size give a policy result.
+	msg = sign(t, rsaKey, RSASHA256, "rsa", "relaxed/relaxed", "", testMessage)
+	if results := verify(t, r, msg, WithMinRSAKeyBits(2048)); results[0].Status != Policy {
+		t.Errorf("small key = %+v", results[0])
+	}
+}
+
+func TestVerify_Length(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	r := resolver()
+	publish(t, r, "ed", key)
+
+	msg := sign(t, key, Ed25519SHA256, "ed", "relaxed/relaxed", "l=11; ", testMessage)
+	appended := msg + "Appended by a mailing list.\r\n"
+	if results := verify(t, r, appended); results[0].Status != Pass || results[0].Signature.Length != 11 {
+		t.Errorf("appended body with l= = %+v", results[0])
+	}
+	truncated := strings.Replace(msg, "Body  text\r\n", "Bo\r\n", 1)
+	if results := verify(t, r, truncated); results[0].Status != Fail {
+		t.Errorf("truncated body with l= = %+v", results[0])
+	}
+}
+
+func TestVerify_Errors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	r := resolver()
+	publish(t, r, "ed", key)
+	r.TXT["revoked._domainkey.example.org"] = []string{"v=DKIM1; k=ed25519; p="}
+	r.Errors = map[string]error{"broken._domainkey.example.org": dnstest.Temporary("broken._domainkey.example.org")}
+
+	tests := []struct {
+		name string
+		msg  string
+		want Status
+		err  error
+	}{
+		{"unsigned", testMessage, "", nil},
+		{"no key", sign(t, key, Ed25519SHA256, "missing", "relaxed", "", testMessage), PermError, ErrNoKey},
+		{"revoked", sign(t, key, Ed25519SHA256, "revoked", "relaxed", "", testMessage), PermError, ErrKeyRevoked},
+		{"dns error", sign(t, key, Ed25519SHA256, "broken", "relaxed", "", testMessage), TempError, ErrDNS},
+		{"expired", sign(t, key, Ed25519SHA256, "ed", "relaxed", "t=1000; x=2000; ", testMessage), Fail, ErrExpired},
+		{"rsa-sha1", "DKIM-Signature: v=1; a=rsa-sha1; d=example.org; s=x; h=from; bh=; b=\r\n" + testMessage, PermError, ErrUnsupported},
+		{"from unsigned", "DKIM-Signature: v=1; a=rsa-sha256; d=example.org; s=x; h=to; bh=; b=\r\n" + testMessage, PermError, ErrSyntax},
+		{"foreign i=", "DKIM-Signature: v=1; a=rsa-sha256; d=example.org; i=a@example.net; s=x; h=from; bh=; b=\r\n" + testMessage, PermError, ErrSyntax},
+	}
+	for _, tt := range tests {
+		results := verify(t, r, tt.msg)
+		if tt.want == "" {
+			if len(results) != 0 {
+				t.Errorf("%s: results = %+v", tt.name, results)
+			}
+			continue
+		}
+		if len(results) != 1 || results[0].Status != tt.want || !errors.Is(results[0].Err, tt.err) {
+			t.Errorf("%s: results = %+v", tt.name, results)
+		}
+	}
+}
+
+func TestCanonicalization(t *testing.T) {
+	// Example from RFC 6376 section 3.4.6.
+	header := "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+
+	fields := HeaderFields([]byte(header))
+	if len(fields) != 2 {
+		t.Fatalf("fields = %q", fields)
+	}
+	var relaxed, simple string
+	for _, f := range fields {
+		relaxed += CanonicalizeHeader(Relaxed, f)
+		simple += CanonicalizeHeader(Simple, f)
+	}
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("relaxed header = %q", relaxed)
+	}
+	if simple != header {
+		t.Errorf("simple header = %q", simple)
+	}
+
+	for _, tt := range []struct {
+		c    Canonicalization
+		body string
+		want string
+	}{
+		{Relaxed, body, " C\r\nD E\r\n"},
+		{Simple, body, " C \r\nD \t E\r\n"},
+		{Simple, "", "\r\n"},
+		{Relaxed, "", ""},
+		{Relaxed, "no newline", "no newline\r\n"},
+	} {
+		var got recorder
+		b := NewBodyHasher(&got, tt.c, -1)
+		// Split writes to exercise partial lines.
+		for i := 0; i < len(tt.body); i += 3 {
+			b.Write([]byte(tt.body[i:min(i+3, len(tt.body))]))
+		}
+		b.Sum()
+		if got.String() != tt.want {
+			t.Errorf("%s body %q = %q, want %q", tt.c, tt.body, got.String(), tt.want)
+		}
+	}
+}
+
+// recorder is a hash.Hash that keeps what it is given.
+type recorder struct{ strings.Builder }
+
+func (r *recorder) Sum(b []byte) []byte { return append(b, r.String()...) }
+func (r *recorder) Reset()              { r.Builder.Reset() }
+func (r *recorder) Size() int           { return 0 }
+func (r *recorder) BlockSize() int      { return 1 }
+
+func TestStripSignature(t *testing.T) {
+	field := "DKIM-Signature: v=1; bh=abc=; b=dGVz\r\n\tdA==; d=example.org\r\n"
+	if got := StripSignature(field); got != "DKIM-Signature: v=1; bh=abc=; b=; d=example.org\r\n" {
+		t.Errorf("StripSignature = %q", got)
+	}
+	field = "DKIM-Signature: v=1;\r\n b=dGVz\r\n\tdA==\r\n"
+	if got := StripSignature(field); got != "DKIM-Signature: v=1;\r\n b=\r\n" {
+		t.Errorf("StripSignature last tag = %q", got)
+	}
+}
+
+func TestDataInspector(t *testing.T) {
+	v := NewVerifier(resolver())
+	v.now = func() time.Time { return time.Unix(1528637909, 0) }
+
+	h := harness.NewHarness(harness.WithServerHostname("mx.example.com"))
+	h.Config.DataInspectorFactory = v
+	h.Config.ContentFilter = icesmtp.AuthResultsFilter{}
+	h.Mailbox.AddDomain("shopping.example.net")
+	h.Mailbox.SetCatchAll(true)
+	h.Start(context.Background())
+	defer h.Close()
+
+	for _, step := range []struct {
+		send string
+		code icesmtp.ReplyCode
+	}{
+		{"", 220},
+		{"EHLO client.example.org", 250},
+		{"MAIL FROM:<joe@football.example.com>", 250},
+		{"RCPT TO:<suzie@shopping.example.net>", 250},
+		{"DATA", 354},
+	} {
+		if step.send != "" {
+			h.Send(step.send)
+		}
+		if lines, err := h.Expect(step.code); err != nil {
+			t.Fatalf("%q: %v (%v)", step.send, err, lines)
+		}
+	}
+	h.SendData(rfc8463Message)
+	if lines, err := h.Expect(250); err != nil {
+		t.Fatalf("end of data: %v (%v)", err, lines)
+	}
+
+	msgs := h.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("stored %d messages", len(msgs))
+	}
+	want := "Authentication-Results: mx.example.com;\r\n\tdkim=pass header.d=football.example.com"
+	if !strings.HasPrefix(string(msgs[0].Data), want) {
+		t.Errorf("message = %q", msgs[0].Data)
+	}
+}
@@ -0,0 +1,155 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Key is a public key published in DNS (RFC 6376 section 3.6.1).
+type Key struct {
+	// PublicKey is an *rsa.PublicKey or ed25519.PublicKey.
+	PublicKey crypto.PublicKey
+
+	// Type is the key type (k=): "rsa" or "ed25519".
+	Type string
+
+	// HashAlgorithms are the acceptable hash algorithms (h=); empty
+	// means any.
+	HashAlgorithms []string
+
+	// Testing indicates the domain is testing DKIM (t=y).
+	Testing bool
+
+	// Strict requires i= to use exactly the d= domain (t=s).
+	Strict bool
+}
+
+// ParseKey parses a key record.
+func ParseKey(record string) (*Key, error) {
+	tags, err := ParseTags(record)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("%w: key version %q", ErrUnsupported, v)
+	}
+	if s, ok := tags["s"]; ok && !hasItem(s, "*") && !hasItem(s, "email") {
+		return nil, fmt.Errorf("%w: key is not for email", ErrUnsupported)
+	}
+
+	k := &Key{Type: "rsa"}
+	if t, ok := tags["k"]; ok {
+		k.Type = strings.ToLower(t)
+	}
+	if h, ok := tags["h"]; ok {
+		for _, alg := range strings.Split(h, ":") {
+			k.HashAlgorithms = append(k.HashAlgorithms, strings.ToLower(strings.TrimSpace(alg)))
+		}
+	}
+	if t, ok := tags["t"]; ok {
+		k.Testing = hasItem(t, "y")
+		k.Strict = hasItem(t, "s")
+	}
+
+	p, ok := tags["p"]
+	if !ok {
+		return nil, fmt.Errorf("%w: key has no p= tag", ErrSyntax)
+	}
+	if strings.TrimSpace(p) == "" {
+		return nil, ErrKeyRevoked
+	}
+	der, err := decodeBase64(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: p= is not base64", ErrSyntax)
+	}
+
+	switch k.Type {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(der)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid RSA key: %v", ErrSyntax, err)
+		}
+		if _, ok := pub.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("%w: p= is not an RSA key", ErrSyntax)
+		}
+		k.PublicKey = pub
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid Ed25519 key", ErrSyntax)
+		}
+		k.PublicKey = ed25519.PublicKey(der)
+	default:
+		return nil, fmt.Errorf("%w: key type %q", ErrUnsupported, k.Type)
+	}
+	return k, nil
+}
+
+// hasItem reports whether a colon-separated list contains item.
+func hasItem(list, item string) bool {
+	for _, v := range strings.Split(list, ":") {
+		if strings.EqualFold(strings.TrimSpace(v), item) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupKey fetches and parses the key published for selector in domain,
+// at selector._domainkey.domain.
+func LookupKey(ctx context.Context, r Resolver, selector, domain string) (*Key, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("%w: %s", ErrNoKey, name)
+		}
+		return nil, fmt.Errorf("%w: TXT %s: %v", ErrDNS, name, err)
+	}
+	if len(txts) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoKey, name)
+	}
+	return ParseKey(txts[0])
+}
+
+// Verify checks sig over digest, the hash of the signed data.
+func (k *Key) Verify(alg Algorithm, digest, sig []byte) error {
+	if alg.KeyType() != k.Type {
+		return fmt.Errorf("%w: %s signature with %s key", ErrSignature, alg, k.Type)
+	}
+	if len(k.HashAlgorithms) > 0 && !hasItem(strings.Join(k.HashAlgorithms, ":"), "sha256") {
+		return fmt.Errorf("%w: key does not allow sha256", ErrUnsupported)
+	}
+
+	switch pub := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, alg.Hash(), digest, sig); err != nil {
+			return ErrSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, sig) {
+			return ErrSignature
+		}
+	default:
+		return fmt.Errorf("%w: key type %T", ErrUnsupported, pub)
+	}
+	return nil
+}
+
+// bits returns the size of an RSA key, or 0 for other keys.
+func (k *Key) bits() int {
+	if pub, ok := k.PublicKey.(*rsa.PublicKey); ok {
+		return pub.N.BitLen()
+	}
+	return 0
+}
@@ -0,0 +1,396 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// DefaultSignedHeaders are the header fields signed when present, unless
+// changed with WithSignedHeaders.
+var DefaultSignedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// SigningKey is a private key and where its public half is published.
+type SigningKey struct {
+	// Domain is the signing domain (d=).
+	Domain string
+
+	// Selector is the key selector (s=).
+	Selector string
+
+	// Signer is an *rsa.PrivateKey, an ed25519.PrivateKey, or another
+	// crypto.Signer with an RSA or Ed25519 public key.
+	Signer crypto.Signer
+
+	// Identity is the agent or user identifier (i=). Optional.
+	Identity string
+}
+
+// Algorithm returns the signing algorithm for the key type.
+func (k *SigningKey) Algorithm() (Algorithm, error) {
+	switch pub := k.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		return RSASHA256, nil
+	case ed25519.PublicKey:
+		return Ed25519SHA256, nil
+	default:
+		return "", fmt.Errorf("%w: key type %T", ErrUnsupported, pub)
+	}
+}
+
+// SignDigest signs digest, a hash computed with the key's algorithm.
+func (k *SigningKey) SignDigest(digest []byte) ([]byte, error) {
+	alg, err := k.Algorithm()
+	if err != nil {
+		return nil, err
+	}
+	opts := crypto.SignerOpts(alg.Hash())
+	if alg == Ed25519SHA256 {
+		// Ed25519 signs the digest itself (RFC 8463 section 3).
+		opts = crypto.Hash(0)
+	}
+	sig, err := k.Signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: signing: %w", err)
+	}
+	return sig, nil
+}
+
+// KeySource chooses the key a message is signed with.
+type KeySource interface {
+	// SigningKey returns the key for a message whose From address is in
+	// domain, submitted by user ("" if the session did not
+	// authenticate). A nil key leaves the message unsigned.
+	SigningKey(ctx context.Context, domain string, user icesmtp.Username) (*SigningKey, error)
+}
+
+// KeyMap is a KeySource that selects a key by authenticated user, then
+// by From domain. Domain keys must be lower case.
+type KeyMap struct {
+	Users   map[icesmtp.Username]*SigningKey
+	Domains map[string]*SigningKey
+}
+
+// Ensure KeyMap implements the interface.
+var _ KeySource = KeyMap{}
+
+// SigningKey returns the user's key if there is one, else the domain's.
+func (m KeyMap) SigningKey(ctx context.Context, domain string, user icesmtp.Username) (*SigningKey, error) {
+	if k, ok := m.Users[user]; ok && user != "" {
+		return k, nil
+	}
+	return m.Domains[strings.ToLower(domain)], nil
+}
+
+// Signer adds DKIM-Signature fields to messages. It is an
+// icesmtp.ContentFilter, and Storage wraps a backend with it.
+//
+// By default only messages from authenticated sessions are signed, so
+// that a Signer on a server that also receives mail cannot be used to
+// sign forged messages.
+type Signer struct {
+	keys KeySource
+
+	headers         []string
+	oversign        []string
+	headerC         Canonicalization
+	bodyC           Canonicalization
+	expiration      time.Duration
+	unauthenticated bool
+	now             func() time.Time
+}
+
+// SignerOption configures a Signer.
+type SignerOption func(*Signer)
+
+// WithSignedHeaders sets the header fields signed when present. From is
+// always signed. Defaults to DefaultSignedHeaders.
+func WithSignedHeaders(names ...string) SignerOption {
+	return func(s *Signer) {
+		s.headers = names
+	}
+}
+
+// WithOversignedHeaders sets the header fields listed in h= once more
+// than they occur, so that adding another instance breaks the signature.
+// Defaults to From.
+func WithOversignedHeaders(names ...string) SignerOption {
+	return func(s *Signer) {
+		s.oversign = names
+	}
+}
+
+// WithCanonicalization sets the header and body canonicalization.
+// Defaults to relaxed/relaxed.
+func WithCanonicalization(header, body Canonicalization) SignerOption {
+	return func(s *Signer) {
+		s.headerC = header
+		s.bodyC = body
+	}
+}
+
+// WithExpiration adds an x= tag expiring signatures d after signing.
+func WithExpiration(d time.Duration) SignerOption {
+	return func(s *Signer) {
+		s.expiration = d
+	}
+}
+
+// WithUnauthenticated also signs messages from sessions that did not
+// authenticate, for relays that trust their clients by address.
+func WithUnauthenticated() SignerOption {
+	return func(s *Signer) {
+		s.unauthenticated = true
+	}
+}
+
+// NewSigner creates a Signer that takes keys from keys.
+func NewSigner(keys KeySource, opts ...SignerOption) *Signer {
+	s := &Signer{
+		keys:     keys,
+		headers:  DefaultSignedHeaders,
+		oversign: []string{"From"},
+		headerC:  Relaxed,
+		bodyC:    Relaxed,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Ensure Signer implements the interface.
+var _ icesmtp.ContentFilter = (*Signer)(nil)
+
+// Filter prepends a DKIM-Signature field to the message. Messages with
+// no key, or from unauthenticated sessions, are accepted unchanged. Key
+// and signing errors are returned, so the message is deferred rather than
+// sent unsigned.
+func (s *Signer) Filter(ctx context.Context, envelope icesmtp.Envelope, session icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	signed, err := s.signEnvelope(ctx, envelope)
+	if err != nil {
+		return icesmtp.FilterResult{}, err
+	}
+	return icesmtp.FilterResult{Action: icesmtp.FilterAccept, Envelope: signed}, nil
+}
+
+// signEnvelope returns envelope with a signature prepended, or envelope
+// itself if it is not signed.
+func (s *Signer) signEnvelope(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.Envelope, error) {
+	value, err := s.SignMessage(ctx, envelope.Data(), envelope.Metadata().AuthenticatedUser)
+	if err != nil || value == "" {
+		return envelope, err
+	}
+	m, ok := envelope.(*icesmtp.ModifiedEnvelope)
+	if !ok {
+		m = icesmtp.NewModifiedEnvelope(envelope)
+	}
+	m.PrependHeader("DKIM-Signature", value)
+	return m, nil
+}
+
+// SignMessage returns the value of a DKIM-Signature field for a message
+// submitted by user, or "" if it should not be signed. The message is
+// hashed in place.
+func (s *Signer) SignMessage(ctx context.Context, message []byte, user icesmtp.Username) (string, error) {
+	header, body := icesmtp.SplitMessage(message)
+	bh := NewBodyHasher(crypto.SHA256.New(), s.bodyC, -1)
+	bh.Write(body)
+	return s.sign(ctx, HeaderFields(header), bh, user)
+}
+
+// sign selects a key and signs the header fields and hashed body.
+func (s *Signer) sign(ctx context.Context, fields []string, body *BodyHasher, user icesmtp.Username) (string, error) {
+	if user == "" && !s.unauthenticated {
+		return "", nil
+	}
+	domain, err := fromDomain(fields)
+	if err != nil {
+		return "", err
+	}
+	key, err := s.keys.SigningKey(ctx, domain, user)
+	if err != nil || key == nil {
+		return "", err
+	}
+	return s.Sign(key, fields, body.Sum())
+}
+
+// fromDomain returns the domain of the message's From address.
+func fromDomain(fields []string) (string, error) {
+	for _, f := range fields {
+		if !strings.EqualFold(fieldName(f), "From") {
+			continue
+		}
+		_, value, _ := strings.Cut(f, ":")
+		addrs, err := mail.ParseAddressList(strings.TrimSpace(value))
+		if err != nil || len(addrs) == 0 {
+			return "", fmt.Errorf("%w: invalid From field", ErrSyntax)
+		}
+		_, domain, _ := strings.Cut(addrs[0].Address, "@")
+		return domain, nil
+	}
+	return "", fmt.Errorf("%w: message has no From field", ErrSyntax)
+}
+
+// Sign returns the value of a DKIM-Signature field signing the raw
+// header fields, as returned by HeaderFields, and the body hash with key.
+func (s *Signer) Sign(key *SigningKey, fields []string, bodyHash []byte) (string, error) {
+	alg, err := key.Algorithm()
+	if err != nil {
+		return "", err
+	}
+
+	signed := s.signedHeaders(fields)
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=1; a=%s; c=%s/%s; d=%s; s=%s;", alg, s.headerC, s.bodyC, key.Domain, key.Selector)
+	if key.Identity != "" {
+		fmt.Fprintf(&b, " i=%s;", key.Identity)
+	}
+	now := s.now()
+	fmt.Fprintf(&b, "\r\n\tt=%d;", now.Unix())
+	if s.expiration > 0 {
+		fmt.Fprintf(&b, " x=%d;", now.Add(s.expiration).Unix())
+	}
+	fmt.Fprintf(&b, "\r\n\th=%s;", strings.Join(signed, ":"))
+	fmt.Fprintf(&b, "\r\n\tbh=%s;", base64.StdEncoding.EncodeToString(bodyHash))
+	b.WriteString("\r\n\tb=")
+
+	digest := HashHeaders(alg.Hash().New(), s.headerC, fields, signed, "DKIM-Signature: "+b.String()+"\r\n")
+	sig, err := key.SignDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	b.WriteString(foldBase64(base64.StdEncoding.EncodeToString(sig)))
+	return b.String(), nil
+}
+
+// signedHeaders returns the h= list for fields: each configured name once
+// per occurrence, plus once more if it is oversigned.
+func (s *Signer) signedHeaders(fields []string) []string {
+	count := map[string]int{}
+	for _, f := range fields {
+		count[strings.ToLower(fieldName(f))]++
+	}
+	var signed []string
+	seen := map[string]bool{}
+	add := func(name string, extra int) {
+		lower := strings.ToLower(name)
+		if seen[lower] {
+			return
+		}
+		seen[lower] = true
+		for range count[lower] + extra {
+			signed = append(signed, lower)
+		}
+	}
+	names := append([]string{"From"}, s.headers...)
+	for _, name := range names {
+		extra := 0
+		for _, o := range s.oversign {
+			if strings.EqualFold(o, name) {
+				extra = 1
+			}
+		}
+		add(name, extra)
+	}
+	for _, name := range s.oversign {
+		add(name, 1)
+	}
+	return signed
+}
+
+// foldBase64 splits a long base64 value over continuation lines.
+func foldBase64(s string) string {
+	const width = 72
+	var b strings.Builder
+	for len(s) > width {
+		b.WriteString(s[:width])
+		b.WriteString("\r\n\t ")
+		s = s[width:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// Storage is an icesmtp.Storage that signs messages before passing them
+// to another backend.
+type Storage struct {
+	signer *Signer
+	next   icesmtp.Storage
+}
+
+// NewStorage wraps next so that messages are signed by signer first.
+func NewStorage(signer *Signer, next icesmtp.Storage) *Storage {
+	return &Storage{signer: signer, next: next}
+}
+
+// Ensure Storage implements the interface.
+var _ icesmtp.Storage = (*Storage)(nil)
+
+// Store signs the envelope's message and stores it.
+func (st *Storage) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	signed, err := st.signer.signEnvelope(ctx, envelope)
+	if err != nil {
+		return icesmtp.StorageReceipt{}, signingError(envelope, icesmtp.StorageOpStore, err)
+	}
+	return st.next.Store(ctx, signed)
+}
+
+// StoreStream reads data once, hashing the body as it is buffered, and
+// streams the signature followed by the buffered message to the backend.
+func (st *Storage) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	var buf bytes.Buffer
+	body := NewBodyHasher(crypto.SHA256.New(), st.signer.bodyC, -1)
+	split := &headerSplitter{body: body}
+	if _, err := io.Copy(io.MultiWriter(&buf, split), data); err != nil {
+		return icesmtp.StorageReceipt{}, storeutil.Error(envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
+	}
+
+	split.end()
+	value, err := st.signer.sign(ctx, HeaderFields(split.header.Bytes()), body, envelope.Metadata().AuthenticatedUser)
+	if err != nil {
+		return icesmtp.StorageReceipt{}, signingError(envelope, icesmtp.StorageOpStoreStream, err)
+	}
+	if value == "" {
+		return st.next.StoreStream(ctx, envelope, &buf)
+	}
+	field := strings.NewReader("DKIM-Signature: " + value + "\r\n")
+	return st.next.StoreStream(ctx, envelope, io.MultiReader(field, &buf))
+}
+
+// signingError wraps a signing failure as a *icesmtp.StorageError. Key
+// lookup failures may be temporary; malformed messages are not.
+func signingError(envelope icesmtp.Envelope, op icesmtp.StorageOperation, err error) *icesmtp.StorageError {
+	return storeutil.Error(envelope, op, err, errors.Is(err, ErrSyntax), "failed to sign message")
+}
+
+// headerSplitter passes the body written to it to a BodyHasher once the
+// header block has been collected.
+type headerSplitter struct {
+	headerBuffer
+	body *BodyHasher
+}
+
+func (h *headerSplitter) Write(p []byte) (int, error) {
+	h.body.Write(h.write(p))
+	return len(p), nil
+}
@@ -0,0 +1,202 @@
+package dkim
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+	"github.com/iceisfun/icesmtp/mem"
+)
+
+func buildEnvelope(t *testing.T, user icesmtp.Username, data string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{
+		ClientIP:          "192.0.2.1",
+		ServerHostname:    "smtp.example.org",
+		AuthenticatedUser: user,
+	})
+	b.SetMailFrom(icesmtp.MailPath{Address: "alice@example.org"}, nil)
+	b.AddRecipient(icesmtp.MailPath{Address: "bob@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// signingSetup returns RSA and Ed25519 keys for example.org published in
+// a resolver.
+func signingSetup(t *testing.T) (rsaKey, edKey *SigningKey, r *dnstest.Resolver) {
+	t.Helper()
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ek, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &dnstest.Resolver{TXT: map[string][]string{}}
+	publish(t, r, "rsa", rk)
+	publish(t, r, "ed", ek)
+	return &SigningKey{Domain: "example.org", Selector: "rsa", Signer: rk},
+		&SigningKey{Domain: "example.org", Selector: "ed", Signer: ek}, r
+}
+
+func TestSigner_RoundTrip(t *testing.T) {
+	rsaKey, edKey, r := signingSetup(t)
+	ctx := context.Background()
+
+	for _, key := range []*SigningKey{rsaKey, edKey} {
+		for _, c := range []Canonicalization{Simple, Relaxed} {
+			s := NewSigner(KeyMap{Domains: map[string]*SigningKey{"example.org": key}}, WithCanonicalization(c, c))
+			value, err := s.SignMessage(ctx, []byte(testMessage), "alice")
+			if err != nil || value == "" {
+				t.Fatalf("SignMessage = %q, %v", value, err)
+			}
+			results := verify(t, r, "DKIM-Signature: "+value+"\r\n"+testMessage)
+			if len(results) != 1 || results[0].Status != Pass {
+				t.Errorf("%s %s: %+v", key.Selector, c, results)
+			}
+		}
+	}
+}
+
+func TestSigner_Headers(t *testing.T) {
+	_, edKey, r := signingSetup(t)
+	keys := KeyMap{Domains: map[string]*SigningKey{"example.org": edKey}}
+	ctx := context.Background()
+
+	value, err := NewSigner(keys).SignMessage(ctx, []byte(testMessage), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseSignature("DKIM-Signature: " + value + "\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(sig.Headers, ":"); got != "from:from:subject:to" {
+		t.Errorf("h= %q", got)
+	}
+
+	// An added Reply-To breaks the signature only if Reply-To is
+	// oversigned.
+	for _, tt := range []struct {
+		oversign []string
+		want     Status
+	}{
+		{[]string{"Reply-To"}, Fail},
+		{nil, Pass},
+	} {
+		s := NewSigner(keys, WithOversignedHeaders(tt.oversign...), WithSignedHeaders("Subject"))
+		value, err := s.SignMessage(ctx, []byte(testMessage), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := "DKIM-Signature: " + value + "\r\n" + strings.Replace(testMessage, "\r\n\r\n", "\r\nReply-To: mallory@example.net\r\n\r\n", 1)
+		if results := verify(t, r, msg); results[0].Status != tt.want {
+			t.Errorf("oversign %v: %+v", tt.oversign, results[0])
+		}
+	}
+}
+
+func TestSigner_KeySelection(t *testing.T) {
+	rsaKey, edKey, _ := signingSetup(t)
+	keys := KeyMap{
+		Users:   map[icesmtp.Username]*SigningKey{"bob": rsaKey},
+		Domains: map[string]*SigningKey{"example.org": edKey},
+	}
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name string
+		opts []SignerOption
+		user icesmtp.Username
+		msg  string
+		want string
+	}{
+		{"domain", nil, "alice", testMessage, "s=ed"},
+		{"user", nil, "bob", testMessage, "s=rsa"},
+		{"unauthenticated", nil, "", testMessage, ""},
+		{"unauthenticated allowed", []SignerOption{WithUnauthenticated()}, "", testMessage, "s=ed"},
+		{"other domain", nil, "alice", strings.Replace(testMessage, "example.org", "example.net", 1), ""},
+	} {
+		value, err := NewSigner(keys, tt.opts...).SignMessage(ctx, []byte(tt.msg), tt.user)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if tt.want == "" && value != "" || !strings.Contains(value, tt.want) {
+			t.Errorf("%s: signature %q, want %q", tt.name, value, tt.want)
+		}
+	}
+
+	_, err := NewSigner(keys).SignMessage(ctx, []byte("Subject: x\r\n\r\nx\r\n"), "alice")
+	if !errors.Is(err, ErrSyntax) {
+		t.Errorf("no From: err = %v", err)
+	}
+}
+
+func TestSigner_FilterAndStorage(t *testing.T) {
+	_, edKey, r := signingSetup(t)
+	s := NewSigner(KeyMap{Domains: map[string]*SigningKey{"example.org": edKey}})
+	ctx := context.Background()
+
+	result, err := s.Filter(ctx, buildEnvelope(t, "alice", testMessage), nil)
+	if err != nil || result.Action != icesmtp.FilterAccept {
+		t.Fatalf("Filter = %+v, %v", result, err)
+	}
+	if results := verify(t, r, string(result.Envelope.Data())); len(results) != 1 || results[0].Status != Pass {
+		t.Errorf("filtered message: %+v", results)
+	}
+
+	backend := mem.NewStorage()
+	st := NewStorage(s, backend)
+	env := buildEnvelope(t, "alice", testMessage)
+	if _, err := st.Store(ctx, env); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := backend.Get(env.ID())
+	if results := verify(t, r, string(stored.Data)); len(results) != 1 || results[0].Status != Pass {
+		t.Errorf("stored message: %+v", results)
+	}
+
+	env = buildEnvelope(t, "alice", "")
+	if _, err := st.StoreStream(ctx, env, &chunkReader{s: testMessage}); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = backend.Get(env.ID())
+	if !strings.HasSuffix(string(stored.Data), testMessage) {
+		t.Errorf("streamed message = %q", stored.Data)
+	}
+	if results := verify(t, r, string(stored.Data)); len(results) != 1 || results[0].Status != Pass {
+		t.Errorf("streamed message: %+v", results)
+	}
+
+	// A missing From is a permanent storage error.
+	_, err = st.Store(ctx, buildEnvelope(t, "alice", "Subject: x\r\n\r\nx\r\n"))
+	var se *icesmtp.StorageError
+	if !errors.As(err, &se) || !se.Permanent {
+		t.Errorf("Store without From: err = %v", err)
+	}
+}
+
+// chunkReader returns s a few bytes at a time.
+type chunkReader struct{ s string }
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.s == "" {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), 5)], r.s)
+	r.s = r.s[n:]
+	return n, nil
+}
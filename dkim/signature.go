@@ -0,0 +1,177 @@
+package dkim
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tags is a parsed tag-list (RFC 6376 section 3.2). Values have their
+// surrounding whitespace removed; folding inside values is kept.
+type Tags map[string]string
+
+// ParseTags parses a tag-list such as "v=1; a=rsa-sha256; d=example.com".
+// Duplicate tags are an error.
+func ParseTags(s string) (Tags, error) {
+	tags := Tags{}
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w: invalid tag %q", ErrSyntax, strings.TrimSpace(spec))
+		}
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("%w: duplicate tag %q", ErrSyntax, name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// decodeBase64 decodes a base64 tag value, ignoring whitespace.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// Signature is a parsed DKIM-Signature field.
+type Signature struct {
+	// Algorithm is the signing algorithm (a=).
+	Algorithm Algorithm
+
+	// Data is the signature (b=).
+	Data []byte
+
+	// BodyHash is the hash of the canonical body (bh=).
+	BodyHash []byte
+
+	// HeaderCanonicalization and BodyCanonicalization are the c=
+	// algorithms.
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+
+	// Domain is the signing domain (d=).
+	Domain string
+
+	// Headers are the signed header field names (h=).
+	Headers []string
+
+	// Identity is the agent or user identifier (i=). Defaults to
+	// "@" followed by Domain.
+	Identity string
+
+	// Length is the number of canonical body bytes signed (l=), or -1
+	// for the whole body.
+	Length int64
+
+	// Selector is the key selector (s=).
+	Selector string
+
+	// Timestamp and Expiration are the t= and x= times; zero if absent.
+	Timestamp  time.Time
+	Expiration time.Time
+
+	// Field is the raw header field the signature was parsed from.
+	Field string
+
+	tags Tags
+}
+
+// ParseSignature parses a raw DKIM-Signature header field.
+func ParseSignature(field string) (*Signature, error) {
+	_, value, ok := strings.Cut(field, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: not a header field", ErrSyntax)
+	}
+	tags, err := ParseTags(value)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return nil, fmt.Errorf("%w: missing %s= tag", ErrSyntax, name)
+		}
+	}
+	if tags["v"] != "1" {
+		return nil, fmt.Errorf("%w: version %q", ErrUnsupported, tags["v"])
+	}
+
+	s := &Signature{
+		Domain:   strings.ToLower(strings.TrimSuffix(tags["d"], ".")),
+		Selector: tags["s"],
+		Length:   -1,
+		Field:    field,
+		tags:     tags,
+	}
+	if s.Algorithm, err = ParseAlgorithm(tags["a"]); err != nil {
+		return nil, err
+	}
+	if s.Data, err = decodeBase64(tags["b"]); err != nil {
+		return nil, fmt.Errorf("%w: b= is not base64", ErrSyntax)
+	}
+	if s.BodyHash, err = decodeBase64(tags["bh"]); err != nil {
+		return nil, fmt.Errorf("%w: bh= is not base64", ErrSyntax)
+	}
+	if s.HeaderCanonicalization, s.BodyCanonicalization, err = ParseCanonicalization(tags["c"]); err != nil {
+		return nil, err
+	}
+	if q, ok := tags["q"]; ok && !strings.Contains(strings.ToLower(q), "dns/txt") {
+		return nil, fmt.Errorf("%w: query method %q", ErrUnsupported, q)
+	}
+
+	from := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("%w: empty name in h=", ErrSyntax)
+		}
+		from = from || strings.EqualFold(name, "From")
+		s.Headers = append(s.Headers, name)
+	}
+	if !from {
+		return nil, fmt.Errorf("%w: From is not signed", ErrSyntax)
+	}
+
+	s.Identity = "@" + s.Domain
+	if i, ok := tags["i"]; ok {
+		_, idDomain, found := strings.Cut(i, "@")
+		idDomain = strings.ToLower(idDomain)
+		if !found || (idDomain != s.Domain && !strings.HasSuffix(idDomain, "."+s.Domain)) {
+			return nil, fmt.Errorf("%w: i= %q is not in d= %q", ErrSyntax, i, s.Domain)
+		}
+		s.Identity = i
+	}
+
+	if l, ok := tags["l"]; ok {
+		if s.Length, err = strconv.ParseInt(l, 10, 64); err != nil || s.Length < 0 {
+			return nil, fmt.Errorf("%w: invalid l= %q", ErrSyntax, l)
+		}
+	}
+	if s.Timestamp, err = parseTime(tags, "t"); err != nil {
+		return nil, err
+	}
+	if s.Expiration, err = parseTime(tags, "x"); err != nil {
+		return nil, err
+	}
+	if !s.Expiration.IsZero() && !s.Timestamp.IsZero() && s.Expiration.Before(s.Timestamp) {
+		return nil, fmt.Errorf("%w: x= is before t=", ErrSyntax)
+	}
+	return s, nil
+}
+
+// parseTime parses an optional Unix time tag.
+func parseTime(tags Tags, name string) (time.Time, error) {
+	v, ok := tags[name]
+	if !ok {
+		return time.Time{}, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("%w: invalid %s= %q", ErrSyntax, name, v)
+	}
+	return time.Unix(n, 0), nil
+}
@@ -0,0 +1,240 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// maxHeaderSize bounds the header block buffered for verification.
+const maxHeaderSize = 1 << 20
+
+// Verifier verifies DKIM signatures.
+type Verifier struct {
+	resolver Resolver
+
+	maxSignatures int
+	minRSABits    int
+	now           func() time.Time
+}
+
+// Option configures a Verifier.
+type Option func(*Verifier)
+
+// WithMaxSignatures sets how many signatures of a message are verified;
+// later ones are ignored. Defaults to 5.
+func WithMaxSignatures(n int) Option {
+	return func(v *Verifier) {
+		v.maxSignatures = n
+	}
+}
+
+// WithMinRSAKeyBits sets the smallest RSA key accepted. Smaller keys give
+// a policy result. Defaults to 1024, as required by RFC 8301.
+func WithMinRSAKeyBits(n int) Option {
+	return func(v *Verifier) {
+		v.minRSABits = n
+	}
+}
+
+// NewVerifier creates a Verifier that fetches keys with resolver, or
+// net.DefaultResolver if resolver is nil.
+func NewVerifier(resolver Resolver, opts ...Option) *Verifier {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	v := &Verifier{
+		resolver:      resolver,
+		maxSignatures: 5,
+		minRSABits:    1024,
+		now:           time.Now,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+// Ensure Verifier implements the interface.
+var _ icesmtp.DataInspectorFactory = (*Verifier)(nil)
+
+// Verify reads a message from r and verifies its signatures. It returns
+// one result per signature, or none if the message is unsigned. The
+// error is only set if r fails.
+func (v *Verifier) Verify(ctx context.Context, r io.Reader) ([]Result, error) {
+	vf := v.newVerification()
+	if _, err := io.Copy(vf, r); err != nil {
+		return nil, err
+	}
+	return vf.results(ctx), nil
+}
+
+// NewDataInspector returns an inspector that verifies the message as it
+// streams and reports a dkim result per signature, or dkim=none.
+func (v *Verifier) NewDataInspector(ctx context.Context, session icesmtp.SessionInfo) icesmtp.DataInspector {
+	return v.newVerification()
+}
+
+// verification verifies one message. It buffers the header block, then
+// hashes the body for each signature as it is written.
+type verification struct {
+	v *Verifier
+
+	headerBuffer
+	parsed bool
+	fields []string
+
+	sigs   []*Signature
+	errs   []error
+	bodies []*BodyHasher
+}
+
+func (v *Verifier) newVerification() *verification {
+	return &verification{v: v}
+}
+
+// Write receives message data.
+func (vf *verification) Write(p []byte) (int, error) {
+	n := len(p)
+	if !vf.parsed {
+		if p = vf.write(p); !vf.done {
+			return n, nil
+		}
+		vf.endHeader()
+	}
+	for _, b := range vf.bodies {
+		if b != nil {
+			b.Write(p)
+		}
+	}
+	return n, nil
+}
+
+// endHeader parses the signatures and starts hashing the body.
+func (vf *verification) endHeader() {
+	vf.parsed = true
+	vf.fields = HeaderFields(vf.header.Bytes())
+	for _, f := range vf.fields {
+		if !strings.EqualFold(fieldName(f), "DKIM-Signature") {
+			continue
+		}
+		if len(vf.sigs) == vf.v.maxSignatures {
+			break
+		}
+		sig, err := ParseSignature(f)
+		vf.sigs = append(vf.sigs, sig)
+		vf.errs = append(vf.errs, err)
+		if err != nil {
+			vf.bodies = append(vf.bodies, nil)
+			continue
+		}
+		vf.bodies = append(vf.bodies, NewBodyHasher(sig.Algorithm.Hash().New(), sig.BodyCanonicalization, sig.Length))
+	}
+}
+
+// Finish completes verification and returns the results as
+// Authentication-Results entries.
+func (vf *verification) Finish(ctx context.Context) []icesmtp.AuthResult {
+	results := vf.results(ctx)
+	if len(results) == 0 {
+		return []icesmtp.AuthResult{{Method: "dkim", Result: string(None)}}
+	}
+	ar := make([]icesmtp.AuthResult, len(results))
+	for i, r := range results {
+		ar[i] = r.AuthResult()
+	}
+	return ar
+}
+
+// results verifies each signature once the whole message has been
+// written.
+func (vf *verification) results(ctx context.Context) []Result {
+	if !vf.parsed {
+		vf.end()
+		vf.endHeader()
+	}
+	results := make([]Result, len(vf.sigs))
+	for i, sig := range vf.sigs {
+		err := vf.errs[i]
+		if err == nil {
+			err = vf.check(ctx, sig, vf.bodies[i])
+		}
+		results[i] = Result{Status: statusOf(err), Signature: sig, Err: err}
+	}
+	return results
+}
+
+// headerBuffer collects the header block of a message as it is written.
+type headerBuffer struct {
+	header bytes.Buffer
+	line   []byte
+	done   bool
+}
+
+// write buffers header data from p, up to maxHeaderSize, and returns any
+// body data in p once the blank line ending the header block has been
+// seen.
+func (hb *headerBuffer) write(p []byte) []byte {
+	for !hb.done && len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			hb.line = append(hb.line, p...)
+			return nil
+		}
+		hb.line = append(hb.line, p[:i+1]...)
+		p = p[i+1:]
+		if len(bytes.TrimRight(hb.line, "\r\n")) == 0 {
+			hb.done = true
+		} else if hb.header.Len()+len(hb.line) <= maxHeaderSize {
+			hb.header.Write(hb.line)
+		}
+		hb.line = hb.line[:0]
+	}
+	if !hb.done {
+		return nil
+	}
+	return p
+}
+
+// end completes a header block that was not followed by a blank line.
+func (hb *headerBuffer) end() {
+	if !hb.done && hb.header.Len()+len(hb.line) <= maxHeaderSize {
+		hb.header.Write(hb.line)
+	}
+	hb.done = true
+}
+
+// check verifies one parsed signature.
+func (vf *verification) check(ctx context.Context, sig *Signature, body *BodyHasher) error {
+	if !sig.Expiration.IsZero() && vf.v.now().After(sig.Expiration) {
+		return ErrExpired
+	}
+	if !bytes.Equal(body.Sum(), sig.BodyHash) {
+		return ErrBodyHash
+	}
+	if sig.Length >= 0 && body.Length() < sig.Length {
+		return fmt.Errorf("%w: body shorter than l=", ErrBodyHash)
+	}
+
+	key, err := LookupKey(ctx, vf.v.resolver, sig.Selector, sig.Domain)
+	if err != nil {
+		return err
+	}
+	if key.Strict {
+		if _, domain, _ := strings.Cut(sig.Identity, "@"); !strings.EqualFold(domain, sig.Domain) {
+			return fmt.Errorf("%w: i= must match d= for this key", ErrSignature)
+		}
+	}
+	if bits := key.bits(); bits > 0 && bits < vf.v.minRSABits {
+		return fmt.Errorf("%w: %d bits", ErrKeyTooSmall, bits)
+	}
+
+	digest := HashHeaders(sig.Algorithm.Hash().New(), sig.HeaderCanonicalization, vf.fields, sig.Headers, sig.Field)
+	return key.Verify(sig.Algorithm, digest, sig.Data)
+}
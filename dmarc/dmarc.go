@@ -0,0 +1,249 @@
+// Package dmarc evaluates Domain-based Message Authentication, Reporting
+// and Conformance (RFC 7489) for received mail.
+//
+// An Evaluator finds the policy published for the domain of a message's
+// From field, or for its organizational domain, and checks whether an SPF
+// or DKIM pass recorded in the envelope metadata is aligned with it. The
+// organizational domain is determined with an embedded copy of the Public
+// Suffix List.
+//
+// The Evaluator is an icesmtp.ContentFilter. Run it after the SPF sender
+// policy and the DKIM data inspector have recorded their results and
+// before icesmtp.AuthResultsFilter, which writes the dmarc result. A
+// failing message is quarantined or rejected as the policy and its pct=
+// sampling rate ask, up to a local maximum set with WithMaxPolicy.
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Errors reported in Outcome.Err.
+var (
+	// ErrDNS indicates a temporary DNS failure during policy discovery.
+	ErrDNS = errors.New("dmarc: DNS error")
+
+	// ErrSyntax indicates a malformed DMARC record.
+	ErrSyntax = errors.New("dmarc: syntax error")
+
+	// ErrMultipleRecords indicates a domain publishes more than one
+	// DMARC record, so no policy applies.
+	ErrMultipleRecords = errors.New("dmarc: multiple records")
+
+	// ErrFrom indicates the message does not have exactly one From
+	// domain to evaluate.
+	ErrFrom = errors.New("dmarc: no single From domain")
+)
+
+// Resolver performs the DNS lookups for policy discovery. *net.Resolver
+// implements it.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Result is the result of a DMARC evaluation.
+type Result string
+
+// Results, as recorded in Authentication-Results (RFC 7489 section 11.2).
+const (
+	None      Result = "none"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Policy is a requested handling of failing mail.
+type Policy string
+
+// Policies (p= and sp=).
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// weaker returns the next less strict policy.
+func (p Policy) weaker() Policy {
+	switch p {
+	case PolicyReject:
+		return PolicyQuarantine
+	default:
+		return PolicyNone
+	}
+}
+
+// rank orders policies from none to reject.
+func (p Policy) rank() int {
+	switch p {
+	case PolicyReject:
+		return 2
+	case PolicyQuarantine:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Alignment is an identifier alignment mode.
+type Alignment string
+
+// Alignment modes (adkim= and aspf=).
+const (
+	AlignRelaxed Alignment = "r"
+	AlignStrict  Alignment = "s"
+)
+
+// Record is a parsed DMARC record (RFC 7489 section 6.3).
+type Record struct {
+	// Policy is the policy for the domain (p=).
+	Policy Policy
+
+	// SubdomainPolicy is the policy for subdomains (sp=). Defaults to
+	// Policy.
+	SubdomainPolicy Policy
+
+	// Percent is the percentage of failing mail the policy applies to
+	// (pct=). Defaults to 100.
+	Percent int
+
+	// DKIMAlignment and SPFAlignment are the alignment modes (adkim=,
+	// aspf=). Default to relaxed.
+	DKIMAlignment Alignment
+	SPFAlignment  Alignment
+
+	// AggregateReports and FailureReports are the rua= and ruf= URIs.
+	AggregateReports []string
+	FailureReports   []string
+
+	// FailureOptions are the fo= reporting options. Defaults to "0".
+	FailureOptions string
+
+	// ReportInterval is the aggregate report interval in seconds (ri=).
+	// Defaults to 86400.
+	ReportInterval int
+}
+
+// ParseRecord parses a DMARC TXT record.
+func ParseRecord(txt string) (*Record, error) {
+	r := &Record{
+		Percent:        100,
+		DKIMAlignment:  AlignRelaxed,
+		SPFAlignment:   AlignRelaxed,
+		FailureOptions: "0",
+		ReportInterval: 86400,
+	}
+	first := true
+	for _, spec := range strings.Split(txt, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid tag %q", ErrSyntax, spec)
+		}
+		if first {
+			if name != "v" || value != "DMARC1" {
+				return nil, fmt.Errorf("%w: record does not start with v=DMARC1", ErrSyntax)
+			}
+			first = false
+			continue
+		}
+
+		var err error
+		switch name {
+		case "p":
+			r.Policy, err = parsePolicy(value)
+		case "sp":
+			r.SubdomainPolicy, err = parsePolicy(value)
+		case "pct":
+			r.Percent, err = strconv.Atoi(value)
+			if err == nil && (r.Percent < 0 || r.Percent > 100) {
+				err = fmt.Errorf("%w: pct=%d out of range", ErrSyntax, r.Percent)
+			}
+		case "adkim":
+			r.DKIMAlignment, err = parseAlignment(value)
+		case "aspf":
+			r.SPFAlignment, err = parseAlignment(value)
+		case "rua":
+			r.AggregateReports = splitURIs(value)
+		case "ruf":
+			r.FailureReports = splitURIs(value)
+		case "fo":
+			r.FailureOptions = value
+		case "ri":
+			r.ReportInterval, err = strconv.Atoi(value)
+		}
+		// Unknown tags are ignored (RFC 7489 section 6.3).
+		if err != nil {
+			if !errors.Is(err, ErrSyntax) {
+				err = fmt.Errorf("%w: invalid %s=%q", ErrSyntax, name, value)
+			}
+			return nil, err
+		}
+	}
+	if first {
+		return nil, fmt.Errorf("%w: empty record", ErrSyntax)
+	}
+	if r.Policy == "" {
+		// A record without p= but with rua= is treated as p=none
+		// (RFC 7489 section 6.6.3).
+		if len(r.AggregateReports) == 0 {
+			return nil, fmt.Errorf("%w: missing p= tag", ErrSyntax)
+		}
+		r.Policy = PolicyNone
+	}
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+	return r, nil
+}
+
+// parsePolicy parses a p= or sp= value.
+func parsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: unknown policy %q", ErrSyntax, s)
+}
+
+// parseAlignment parses an adkim= or aspf= value.
+func parseAlignment(s string) (Alignment, error) {
+	switch a := Alignment(strings.ToLower(s)); a {
+	case AlignRelaxed, AlignStrict:
+		return a, nil
+	}
+	return "", fmt.Errorf("%w: unknown alignment %q", ErrSyntax, s)
+}
+
+// splitURIs splits a comma-separated URI list.
+func splitURIs(s string) []string {
+	var uris []string
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			uris = append(uris, u)
+		}
+	}
+	return uris
+}
+
+// Aligned reports whether domain a is aligned with domain b under mode:
+// identical for strict, or sharing an organizational domain for relaxed.
+func Aligned(a, b string, mode Alignment) bool {
+	a = strings.ToLower(strings.TrimSuffix(a, "."))
+	b = strings.ToLower(strings.TrimSuffix(b, "."))
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b {
+		return true
+	}
+	return mode != AlignStrict && OrganizationalDomain(a) == OrganizationalDomain(b)
+}
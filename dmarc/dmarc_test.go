@@ -0,0 +1,207 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+)
+
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=DMARC1; p=Reject; sp=none; pct=50; adkim=s; rua=mailto:a@example.org, mailto:b@example.org; x=ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Policy != PolicyReject || r.SubdomainPolicy != PolicyNone || r.Percent != 50 ||
+		r.DKIMAlignment != AlignStrict || r.SPFAlignment != AlignRelaxed || len(r.AggregateReports) != 2 {
+		t.Errorf("record = %+v", r)
+	}
+
+	r, err = ParseRecord("v=DMARC1; rua=mailto:a@example.org")
+	if err != nil || r.Policy != PolicyNone || r.SubdomainPolicy != PolicyNone || r.Percent != 100 {
+		t.Errorf("record without p= = %+v, %v", r, err)
+	}
+
+	for _, txt := range []string{
+		"",
+		"p=reject; v=DMARC1",
+		"v=DMARC1",
+		"v=DMARC1; p=block",
+		"v=DMARC1; p=none; pct=101",
+		"v=DMARC1; p=none; aspf=x",
+	} {
+		if _, err := ParseRecord(txt); !errors.Is(err, ErrSyntax) {
+			t.Errorf("ParseRecord(%q) err = %v", txt, err)
+		}
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := []struct {
+		domain, suffix, org string
+	}{
+		{"example.com", "com", "example.com"},
+		{"a.b.Example.COM.", "com", "example.com"},
+		{"mail.example.co.uk", "co.uk", "example.co.uk"},
+		{"co.uk", "co.uk", "co.uk"},
+		{"user.github.io", "github.io", "user.github.io"},
+		{"a.b.c.ck", "c.ck", "b.c.ck"},
+		{"mail.www.ck", "ck", "www.ck"},
+		{"host.example.invalidtld", "invalidtld", "example.invalidtld"},
+	}
+	for _, tt := range tests {
+		if got := PublicSuffix(tt.domain); got != tt.suffix {
+			t.Errorf("PublicSuffix(%q) = %q, want %q", tt.domain, got, tt.suffix)
+		}
+		if got := OrganizationalDomain(tt.domain); got != tt.org {
+			t.Errorf("OrganizationalDomain(%q) = %q, want %q", tt.domain, got, tt.org)
+		}
+	}
+
+	if !Aligned("mail.example.com", "Example.com", AlignRelaxed) || Aligned("mail.example.com", "example.com", AlignStrict) ||
+		Aligned("a.co.uk", "b.co.uk", AlignRelaxed) {
+		t.Error("Aligned gave the wrong answer")
+	}
+}
+
+func spfPass(mailfrom string) icesmtp.AuthResult {
+	return icesmtp.AuthResult{Method: "spf", Result: "pass",
+		Properties: []icesmtp.AuthProperty{{Type: "smtp", Name: "mailfrom", Value: mailfrom}}}
+}
+
+func dkimResult(result, d string) icesmtp.AuthResult {
+	return icesmtp.AuthResult{Method: "dkim", Result: result,
+		Properties: []icesmtp.AuthProperty{{Type: "header", Name: "d", Value: d}}}
+}
+
+func resolver() *dnstest.Resolver {
+	return &dnstest.Resolver{
+		TXT: map[string][]string{
+			"_dmarc.example.org":     {"v=DMARC1; p=reject; sp=quarantine"},
+			"_dmarc.strict.example":  {"v=DMARC1; p=reject; aspf=s; adkim=s"},
+			"_dmarc.sampled.example": {"v=DMARC1; p=reject; pct=10"},
+			"_dmarc.double.example":  {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+			"_dmarc.bad.example":     {"v=DMARC1; p=maybe", "unrelated"},
+			"_dmarc.monitor.example": {"v=DMARC1; p=none"},
+		},
+		Errors: map[string]error{
+			"_dmarc.broken.example": dnstest.Temporary("_dmarc.broken.example"),
+		},
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	never := func(ev *Evaluator) {
+		ev.sample = func(int) bool { return false }
+	}
+	tests := []struct {
+		name    string
+		domain  string
+		results []icesmtp.AuthResult
+		opts    []Option
+		want    Result
+		policy  Policy
+		applied Policy
+	}{
+		{"spf aligned", "example.org", []icesmtp.AuthResult{spfPass("bounce@mail.example.org")}, nil, Pass, PolicyReject, PolicyNone},
+		{"dkim aligned", "example.org", []icesmtp.AuthResult{dkimResult("fail", "example.org"), dkimResult("pass", "sub.example.org")}, nil, Pass, PolicyReject, PolicyNone},
+		{"unaligned pass", "example.org", []icesmtp.AuthResult{spfPass("x@example.net"), dkimResult("pass", "example.net")}, nil, Fail, PolicyReject, PolicyReject},
+		{"dkim fail", "example.org", []icesmtp.AuthResult{dkimResult("fail", "example.org")}, nil, Fail, PolicyReject, PolicyReject},
+		{"subdomain policy", "news.example.org", nil, nil, Fail, PolicyQuarantine, PolicyQuarantine},
+		{"strict", "strict.example", []icesmtp.AuthResult{spfPass("x@a.strict.example"), dkimResult("pass", "a.strict.example")}, nil, Fail, PolicyReject, PolicyReject},
+		{"strict exact", "strict.example", []icesmtp.AuthResult{dkimResult("pass", "STRICT.example")}, nil, Pass, PolicyReject, PolicyNone},
+		{"pct sampled out", "sampled.example", nil, []Option{never}, Fail, PolicyReject, PolicyQuarantine},
+		{"max policy", "example.org", nil, []Option{WithMaxPolicy(PolicyQuarantine)}, Fail, PolicyReject, PolicyQuarantine},
+		{"monitor", "monitor.example", nil, nil, Fail, PolicyNone, PolicyNone},
+		{"no record", "example.net", []icesmtp.AuthResult{spfPass("x@example.net")}, nil, None, "", PolicyNone},
+		{"temperror", "broken.example", nil, nil, TempError, "", PolicyNone},
+		{"multiple records", "double.example", nil, nil, PermError, "", PolicyNone},
+		{"invalid record", "bad.example", nil, nil, PermError, "", PolicyNone},
+	}
+	for _, tt := range tests {
+		out := NewEvaluator(resolver(), tt.opts...).Evaluate(context.Background(), tt.domain, tt.results)
+		if out.Result != tt.want || out.Policy != tt.policy || out.Applied != tt.applied {
+			t.Errorf("%s: outcome = %+v", tt.name, out)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ev := NewEvaluator(resolver())
+	ctx := context.Background()
+
+	env := buildEnvelope(t, "From: Alice <alice@example.org>\r\nSubject: hi\r\n\r\nhi\r\n", spfPass("alice@example.org"))
+	result, err := ev.Filter(ctx, env, nil)
+	if err != nil || result.Action != icesmtp.FilterAccept {
+		t.Fatalf("pass: %+v, %v", result, err)
+	}
+	results := result.Envelope.Metadata().AuthResults
+	if got := results[len(results)-1].String(); got != "dmarc=pass header.from=example.org" {
+		t.Errorf("pass result = %q", got)
+	}
+
+	env = buildEnvelope(t, "From: alice@example.org\r\n\r\nhi\r\n", spfPass("x@example.net"))
+	result, _ = ev.Filter(ctx, env, nil)
+	if result.Action != icesmtp.FilterReject || result.Response.Code != 550 ||
+		result.Response.EnhancedCode.String() != "5.7.1" {
+		t.Errorf("reject: %+v", result)
+	}
+
+	env = buildEnvelope(t, "From: alice@news.example.org\r\n\r\nhi\r\n")
+	result, _ = ev.Filter(ctx, env, nil)
+	results = result.Envelope.Metadata().AuthResults
+	if result.Action != icesmtp.FilterQuarantine ||
+		results[0].String() != "dmarc=fail header.from=news.example.org policy.dmarc=quarantine" {
+		t.Errorf("quarantine: %+v", result)
+	}
+
+	env = buildEnvelope(t, "From: a@example.org\r\nFrom: b@example.org\r\n\r\nhi\r\n")
+	result, _ = ev.Filter(ctx, env, nil)
+	results = result.Envelope.Metadata().AuthResults
+	if result.Action != icesmtp.FilterAccept || results[0].Result != "permerror" {
+		t.Errorf("two From fields: %+v", result)
+	}
+}
+
+// TestAuthenticationResults checks the unified header written after the
+// DMARC filter.
+func TestAuthenticationResults(t *testing.T) {
+	ctx := context.Background()
+	env := buildEnvelope(t, "From: alice@example.org\r\n\r\nhi\r\n",
+		spfPass("alice@example.org"), dkimResult("pass", "example.org"))
+	chain := icesmtp.NewFilterChain()
+	chain.Add(NewEvaluator(resolver())).Add(icesmtp.AuthResultsFilter{})
+	result, err := chain.Filter(ctx, env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Authentication-Results: mx.example.com;\r\n" +
+		"\tspf=pass smtp.mailfrom=alice@example.org;\r\n" +
+		"\tdkim=pass header.d=example.org;\r\n" +
+		"\tdmarc=pass header.from=example.org\r\n"
+	if got := string(result.Envelope.Data()); !strings.HasPrefix(got, want) {
+		t.Errorf("data = %q, want prefix %q", got, want)
+	}
+}
+
+func buildEnvelope(t *testing.T, data string, results ...icesmtp.AuthResult) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{
+		ClientIP:       "192.0.2.1",
+		ServerHostname: "mx.example.com",
+		AuthResults:    results,
+	})
+	b.SetMailFrom(icesmtp.MailPath{Address: "alice@example.org"}, nil)
+	b.AddRecipient(icesmtp.MailPath{Address: "bob@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
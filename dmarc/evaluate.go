@@ -0,0 +1,277 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Evaluator evaluates DMARC for messages.
+type Evaluator struct {
+	resolver  Resolver
+	maxPolicy Policy
+	sample    func(pct int) bool
+}
+
+// Option configures an Evaluator.
+type Option func(*Evaluator)
+
+// WithMaxPolicy limits the policy applied to failing messages, e.g.
+// PolicyQuarantine to quarantine rather than reject, or PolicyNone to
+// only record results. Defaults to PolicyReject.
+func WithMaxPolicy(p Policy) Option {
+	return func(ev *Evaluator) {
+		ev.maxPolicy = p
+	}
+}
+
+// NewEvaluator creates an Evaluator that discovers policies with
+// resolver, or net.DefaultResolver if resolver is nil.
+func NewEvaluator(resolver Resolver, opts ...Option) *Evaluator {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ev := &Evaluator{
+		resolver:  resolver,
+		maxPolicy: PolicyReject,
+		sample: func(pct int) bool {
+			return rand.IntN(100) < pct
+		},
+	}
+	for _, opt := range opts {
+		opt(ev)
+	}
+	return ev
+}
+
+// Outcome is the result of evaluating DMARC for a message.
+type Outcome struct {
+	// Result is the DMARC result.
+	Result Result
+
+	// Domain is the From domain that was evaluated.
+	Domain string
+
+	// Record is the policy record, if one was found, and PolicyDomain
+	// the domain it was published for: Domain or its organizational
+	// domain.
+	Record       *Record
+	PolicyDomain string
+
+	// Policy is the policy the record requests for Domain: p=, or sp=
+	// if the record was found at the organizational domain.
+	Policy Policy
+
+	// Applied is the policy to apply to the message after pct= sampling
+	// and the local maximum. It is PolicyNone unless Result is Fail.
+	Applied Policy
+
+	// SPFAligned and DKIMAligned report which passing identifiers were
+	// aligned with Domain.
+	SPFAligned  bool
+	DKIMAligned bool
+
+	// Err explains a TempError or PermError result.
+	Err error
+}
+
+// Lookup discovers the policy for domain (RFC 7489 section 6.6.3): the
+// record at _dmarc.domain, or failing that at the organizational domain.
+// It returns a nil record if neither publishes one.
+func (ev *Evaluator) Lookup(ctx context.Context, domain string) (record *Record, policyDomain string, err error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	record, err = ev.lookup(ctx, domain)
+	if record != nil || err != nil {
+		return record, domain, err
+	}
+	if org := OrganizationalDomain(domain); org != domain {
+		record, err = ev.lookup(ctx, org)
+		if record != nil || err != nil {
+			return record, org, err
+		}
+	}
+	return nil, "", nil
+}
+
+// lookup fetches the record published at _dmarc.domain.
+func (ev *Evaluator) lookup(ctx context.Context, domain string) (*Record, error) {
+	name := "_dmarc." + domain
+	txts, err := ev.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: TXT %s: %v", ErrDNS, name, err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if v, _, _ := strings.Cut(txt, ";"); strings.TrimSpace(v) == "v=DMARC1" {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return nil, nil
+	case 1:
+		return ParseRecord(records[0])
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrMultipleRecords, name)
+	}
+}
+
+// Evaluate evaluates DMARC for a message whose From field is in domain,
+// given the spf and dkim results recorded for it.
+func (ev *Evaluator) Evaluate(ctx context.Context, domain string, results []icesmtp.AuthResult) Outcome {
+	out := Outcome{Result: None, Domain: strings.ToLower(domain), Applied: PolicyNone}
+	record, policyDomain, err := ev.Lookup(ctx, domain)
+	switch {
+	case errors.Is(err, ErrDNS):
+		out.Result, out.Err = TempError, err
+		return out
+	case err != nil:
+		out.Result, out.Err = PermError, err
+		return out
+	case record == nil:
+		return out
+	}
+
+	out.Record, out.PolicyDomain = record, policyDomain
+	out.Policy = record.Policy
+	if policyDomain != out.Domain {
+		out.Policy = record.SubdomainPolicy
+	}
+
+	for _, r := range results {
+		if r.Result != "pass" {
+			continue
+		}
+		switch r.Method {
+		case "spf":
+			out.SPFAligned = out.SPFAligned || Aligned(spfDomain(r), out.Domain, record.SPFAlignment)
+		case "dkim":
+			out.DKIMAligned = out.DKIMAligned || Aligned(property(r, "header", "d"), out.Domain, record.DKIMAlignment)
+		}
+	}
+	if out.SPFAligned || out.DKIMAligned {
+		out.Result = Pass
+		return out
+	}
+
+	out.Result = Fail
+	out.Applied = out.Policy
+	if record.Percent < 100 && !ev.sample(record.Percent) {
+		// Messages outside the sample get the next less strict policy
+		// (RFC 7489 section 6.6.4).
+		out.Applied = out.Applied.weaker()
+	}
+	if out.Applied.rank() > ev.maxPolicy.rank() {
+		out.Applied = ev.maxPolicy
+	}
+	return out
+}
+
+// spfDomain returns the domain an spf result was evaluated for: the
+// MAIL FROM domain, or the HELO name for the null reverse-path.
+func spfDomain(r icesmtp.AuthResult) string {
+	if from := property(r, "smtp", "mailfrom"); from != "" {
+		if i := strings.LastIndexByte(from, '@'); i >= 0 {
+			return from[i+1:]
+		}
+		return from
+	}
+	return property(r, "smtp", "helo")
+}
+
+// property returns the value of the type.name property of r.
+func property(r icesmtp.AuthResult, typ, name string) string {
+	for _, p := range r.Properties {
+		if p.Type == typ && p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// AuthResult converts an outcome to an Authentication-Results entry, with
+// the applied policy in policy.dmarc for failing messages.
+func (out Outcome) AuthResult() icesmtp.AuthResult {
+	r := icesmtp.AuthResult{Method: "dmarc", Result: string(out.Result)}
+	if out.Err != nil {
+		r.Reason = strings.TrimPrefix(out.Err.Error(), "dmarc: ")
+	}
+	if out.Domain != "" {
+		r.Properties = append(r.Properties, icesmtp.AuthProperty{Type: "header", Name: "from", Value: out.Domain})
+	}
+	if out.Result == Fail {
+		r.Properties = append(r.Properties, icesmtp.AuthProperty{Type: "policy", Name: "dmarc", Value: string(out.Applied)})
+	}
+	return r
+}
+
+// Ensure Evaluator implements the interface.
+var _ icesmtp.ContentFilter = (*Evaluator)(nil)
+
+// Filter evaluates DMARC for the message's From domain, records the
+// result in the envelope metadata and applies the policy: failing
+// messages are quarantined or rejected with 550 5.7.1.
+func (ev *Evaluator) Filter(ctx context.Context, envelope icesmtp.Envelope, session icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	var out Outcome
+	if domain, err := fromDomain(envelope.Headers().Values("From")); err != nil {
+		out = Outcome{Result: PermError, Applied: PolicyNone, Err: err}
+	} else {
+		out = ev.Evaluate(ctx, domain, envelope.Metadata().AuthResults)
+	}
+
+	m, ok := envelope.(*icesmtp.ModifiedEnvelope)
+	if !ok {
+		m = icesmtp.NewModifiedEnvelope(envelope)
+	}
+	m.AddAuthResult(out.AuthResult())
+	result := icesmtp.FilterResult{Action: icesmtp.FilterAccept, Envelope: m}
+
+	switch out.Applied {
+	case PolicyReject:
+		result.Action = icesmtp.FilterReject
+		result.Response = icesmtp.NewEnhancedResponse(icesmtp.Reply550MailboxUnavailable,
+			icesmtp.EnhancedStatusCode{Class: icesmtp.EnhancedPermanent, Subject: icesmtp.EnhancedSubjectPolicy, Detail: 1},
+			"Message rejected due to DMARC policy of "+out.PolicyDomain)
+		result.Reason = "dmarc=fail p=reject"
+	case PolicyQuarantine:
+		result.Action = icesmtp.FilterQuarantine
+		result.Reason = "dmarc=fail p=quarantine"
+	}
+	return result, nil
+}
+
+// fromDomain returns the single domain of a message's From field
+// (RFC 7489 section 6.6.1).
+func fromDomain(fields []string) (string, error) {
+	if len(fields) != 1 {
+		return "", fmt.Errorf("%w: %d From fields", ErrFrom, len(fields))
+	}
+	addrs, err := mail.ParseAddressList(fields[0])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFrom, err)
+	}
+	domain := ""
+	for _, a := range addrs {
+		_, d, _ := strings.Cut(a.Address, "@")
+		d = strings.ToLower(d)
+		if domain != "" && d != domain {
+			return "", fmt.Errorf("%w: From has several domains", ErrFrom)
+		}
+		domain = d
+	}
+	if domain == "" {
+		return "", ErrFrom
+	}
+	return domain, nil
+}
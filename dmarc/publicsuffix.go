@@ -0,0 +1,81 @@
+package dmarc
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+)
+
+// publicSuffixList is a copy of https://publicsuffix.org/list/, including
+// the private domains section. Internationalized rules are listed in
+// Unicode and so only match domains given in that form.
+//
+//go:embed public_suffix_list.dat
+var publicSuffixList string
+
+// suffixRules are the parsed list rules: a rule maps to true, and an
+// exception (a "!" rule) to false. Wildcard rules keep their "*." prefix.
+var (
+	suffixRules     map[string]bool
+	suffixRulesOnce sync.Once
+)
+
+// loadSuffixRules parses the embedded list.
+func loadSuffixRules() {
+	suffixRules = make(map[string]bool)
+	for _, line := range strings.Split(publicSuffixList, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		// Rules end at the first whitespace.
+		line, _, _ = strings.Cut(line, " ")
+		if rule, ok := strings.CutPrefix(line, "!"); ok {
+			suffixRules[strings.ToLower(rule)] = false
+		} else {
+			suffixRules[strings.ToLower(line)] = true
+		}
+	}
+}
+
+// PublicSuffix returns the public suffix of domain, such as "co.uk" for
+// "mail.example.co.uk". An unlisted top-level domain is its own public
+// suffix.
+func PublicSuffix(domain string) string {
+	suffixRulesOnce.Do(loadSuffixRules)
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	labels := strings.Split(domain, ".")
+
+	// Find the longest matching rule; an exception rule wins and
+	// removes its leftmost label (publicsuffix.org/list algorithm).
+	suffix := labels[len(labels)-1]
+	for i := len(labels) - 1; i >= 0; i-- {
+		name := strings.Join(labels[i:], ".")
+		if rule, ok := suffixRules[name]; ok {
+			if !rule {
+				return strings.Join(labels[i+1:], ".")
+			}
+			suffix = name
+		}
+		if i > 0 && suffixRules["*."+name] {
+			suffix = strings.Join(labels[i-1:], ".")
+		}
+	}
+	return suffix
+}
+
+// OrganizationalDomain returns the organizational domain of domain: its
+// public suffix plus one label (RFC 7489 section 3.2). A domain that is
+// itself a public suffix is returned unchanged.
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	suffix := PublicSuffix(domain)
+	if len(domain) <= len(suffix) {
+		return domain
+	}
+	rest := strings.TrimSuffix(domain[:len(domain)-len(suffix)], ".")
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return rest + "." + suffix
+}
@@ -0,0 +1,349 @@
+// Package dnsbl checks client addresses against DNS blocklists and
+// allowlists (RFC 5782).
+//
+// A Checker queries every configured List in parallel and adds up the
+// weights of the lists that return a matching code. Allowlists are lists
+// with a negative weight, so a listing on one offsets blocklist hits.
+// Answers, including "not listed", are cached; DNS errors are not, and a
+// list that cannot be queried is treated as not listing the client.
+//
+// Policy turns the score into a decision. It implements
+// icesmtp.ConnectionPolicy, to refuse listed clients before the greeting,
+// and icesmtp.SessionFilterFactory, to refuse them at RCPT TO instead so
+// that mail to postmaster still gets through.
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDNS indicates a list could not be queried. It is reported in
+// Report.Err.
+var ErrDNS = errors.New("dnsbl: DNS error")
+
+// Resolver looks up A records. *net.Resolver implements it. A name with
+// no records must be reported as a *net.DNSError with IsNotFound set.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// List is a DNS list zone.
+type List struct {
+	// Zone is the list's DNS zone, e.g. "zen.spamhaus.org".
+	Zone string
+
+	// Weight is added to the score when the client is listed. Use a
+	// negative weight for an allowlist. Zero counts as 1.
+	Weight float64
+
+	// Codes are the return codes that count as a listing, each an
+	// address ("127.0.0.2") or a prefix ("127.0.0.0/24"). If empty, any
+	// address in 127.0.0.0/8 counts except 127.255.255.0/24, which lists
+	// use to report query errors.
+	Codes []string
+}
+
+// Listing is a list that listed the client.
+type Listing struct {
+	// Zone is the list's zone.
+	Zone string
+
+	// Weight is the list's weight.
+	Weight float64
+
+	// Codes are the matching return codes.
+	Codes []net.IP
+}
+
+// Report is the result of checking an address.
+type Report struct {
+	// Score is the sum of the weights of the lists in Listings.
+	Score float64
+
+	// Listings are the lists that listed the client, in configuration
+	// order.
+	Listings []Listing
+
+	// Err wraps ErrDNS if any list could not be queried. Those lists
+	// do not contribute to the score.
+	Err error
+}
+
+// Listed reports whether any list with a positive weight listed the
+// client.
+func (r Report) Listed() bool {
+	for _, l := range r.Listings {
+		if l.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Zones returns the zones of the blocklists that listed the client.
+func (r Report) Zones() []string {
+	var zones []string
+	for _, l := range r.Listings {
+		if l.Weight > 0 {
+			zones = append(zones, l.Zone)
+		}
+	}
+	return zones
+}
+
+// list is a List with its codes parsed.
+type list struct {
+	zone   string
+	weight float64
+	codes  []*net.IPNet
+}
+
+// defaultCodes are the codes that count as a listing when a List has
+// none, and errorCodes are excluded from them.
+var (
+	defaultCodes = mustCIDR("127.0.0.0/8")
+	errorCodes   = mustCIDR("127.255.255.0/24")
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// match returns the codes in answers that count as a listing.
+func (l *list) match(answers []net.IP) []net.IP {
+	var matched []net.IP
+	for _, ip := range answers {
+		if len(l.codes) == 0 {
+			if defaultCodes.Contains(ip) && !errorCodes.Contains(ip) {
+				matched = append(matched, ip)
+			}
+			continue
+		}
+		for _, c := range l.codes {
+			if c.Contains(ip) {
+				matched = append(matched, ip)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Checker queries DNS lists. It is safe for concurrent use.
+type Checker struct {
+	resolver Resolver
+	lists    []list
+
+	timeout   time.Duration
+	cacheTTL  time.Duration
+	cacheSize int
+	now       func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// cacheEntry is a cached answer: the matching codes, or none if the
+// client is not listed.
+type cacheEntry struct {
+	codes   []net.IP
+	expires time.Time
+}
+
+// Option configures a Checker.
+type Option func(*Checker)
+
+// WithTimeout sets how long a check waits for the lists to answer. Lists
+// that have not answered in time are treated as not listing the client.
+// Defaults to 5 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) {
+		c.timeout = d
+	}
+}
+
+// WithCacheTTL sets how long answers are cached. Zero disables caching.
+// Defaults to 5 minutes.
+func WithCacheTTL(d time.Duration) Option {
+	return func(c *Checker) {
+		c.cacheTTL = d
+	}
+}
+
+// WithCacheSize sets the maximum number of cached answers. When the cache
+// is full, expired answers are dropped, and then the whole cache if none
+// had expired. Defaults to 10000.
+func WithCacheSize(n int) Option {
+	return func(c *Checker) {
+		c.cacheSize = n
+	}
+}
+
+// NewChecker creates a Checker for lists that queries resolver, or
+// net.DefaultResolver if resolver is nil. It returns an error if a list
+// has no zone or an invalid code.
+func NewChecker(resolver Resolver, lists []List, opts ...Option) (*Checker, error) {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	c := &Checker{
+		resolver:  resolver,
+		timeout:   5 * time.Second,
+		cacheTTL:  5 * time.Minute,
+		cacheSize: 10000,
+		now:       time.Now,
+		cache:     map[string]cacheEntry{},
+	}
+	for _, l := range lists {
+		zone := strings.Trim(l.Zone, ".")
+		if zone == "" {
+			return nil, errors.New("dnsbl: list without zone")
+		}
+		parsed := list{zone: zone, weight: l.Weight}
+		if parsed.weight == 0 {
+			parsed.weight = 1
+		}
+		for _, code := range l.Codes {
+			if !strings.Contains(code, "/") {
+				code += "/32"
+			}
+			_, n, err := net.ParseCIDR(code)
+			if err != nil || n.IP.To4() == nil {
+				return nil, fmt.Errorf("dnsbl: %s: invalid return code %q", zone, code)
+			}
+			parsed.codes = append(parsed.codes, n)
+		}
+		c.lists = append(c.lists, parsed)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// QueryName returns the name queried to look up ip in zone: the octets of
+// an IPv4 address, or the nibbles of an IPv6 address, in reverse order
+// followed by the zone. It returns "" if ip is not a valid address.
+func QueryName(ip net.IP, zone string) string {
+	zone = strings.Trim(zone, ".")
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", v4[3], v4[2], v4[1], v4[0], zone)
+	}
+	v6 := ip.To16()
+	if v6 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	b := make([]byte, 0, 64+len(zone))
+	for i := len(v6) - 1; i >= 0; i-- {
+		b = append(b, hex[v6[i]&0x0f], '.', hex[v6[i]>>4], '.')
+	}
+	return string(append(b, zone...))
+}
+
+// Check looks ip up in every list and returns the combined report.
+func (c *Checker) Check(ctx context.Context, ip net.IP) Report {
+	if ip.To16() == nil || len(c.lists) == 0 {
+		return Report{}
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	type answer struct {
+		codes []net.IP
+		err   error
+	}
+	answers := make([]answer, len(c.lists))
+	var wg sync.WaitGroup
+	for i := range c.lists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes, err := c.lookup(ctx, &c.lists[i], ip)
+			answers[i] = answer{codes, err}
+		}()
+	}
+	wg.Wait()
+
+	var report Report
+	var errs []error
+	for i, a := range answers {
+		l := c.lists[i]
+		switch {
+		case a.err != nil:
+			errs = append(errs, a.err)
+		case len(a.codes) > 0:
+			report.Score += l.weight
+			report.Listings = append(report.Listings, Listing{Zone: l.zone, Weight: l.weight, Codes: a.codes})
+		}
+	}
+	if len(errs) > 0 {
+		report.Err = errors.Join(errs...)
+	}
+	return report
+}
+
+// lookup returns the matching codes for ip in l, from the cache if
+// possible.
+func (c *Checker) lookup(ctx context.Context, l *list, ip net.IP) ([]net.IP, error) {
+	name := QueryName(ip, l.zone)
+	if codes, ok := c.cached(name); ok {
+		return l.match(codes), nil
+	}
+
+	answers, err := c.resolver.LookupIP(ctx, "ip4", name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, fmt.Errorf("%w: %s: %v", ErrDNS, name, err)
+		}
+		answers = nil
+	}
+	c.store(name, answers)
+	return l.match(answers), nil
+}
+
+// cached returns the cached answer for name.
+func (c *Checker) cached(name string) ([]net.IP, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[name]
+	if !ok || !c.now().Before(e.expires) {
+		return nil, false
+	}
+	return e.codes, true
+}
+
+// store caches the answer for name.
+func (c *Checker) store(name string, answers []net.IP) {
+	if c.cacheTTL <= 0 || c.cacheSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.cache) >= c.cacheSize {
+		for k, e := range c.cache {
+			if !now.Before(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= c.cacheSize {
+			clear(c.cache)
+		}
+	}
+	c.cache[name] = cacheEntry{codes: answers, expires: now.Add(c.cacheTTL)}
+}
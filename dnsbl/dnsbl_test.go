@@ -0,0 +1,241 @@
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/harness"
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+)
+
+func TestQueryName(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{"192.0.2.99", "99.2.0.192.bl.example"},
+		{"::ffff:192.0.2.99", "99.2.0.192.bl.example"},
+		{"2001:db8:1:2:3:4:567:89ab", "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.bl.example"},
+	}
+	for _, tt := range tests {
+		if got := QueryName(net.ParseIP(tt.ip), "bl.example."); got != tt.want {
+			t.Errorf("QueryName(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+	if got := QueryName(nil, "bl.example"); got != "" {
+		t.Errorf("QueryName(nil) = %q", got)
+	}
+}
+
+// zones returns a resolver where 192.0.2.1 is on both blocklists,
+// 192.0.2.2 only on the policy list of zen and 192.0.2.3 also on the
+// allowlist.
+func zones() *dnstest.Resolver {
+	return &dnstest.Resolver{IP: map[string][]string{
+		"1.2.0.192.bl.example":  {"127.0.0.2"},
+		"1.2.0.192.zen.example": {"127.0.0.4", "127.0.0.10"},
+		"2.2.0.192.zen.example": {"127.0.0.10"},
+		"3.2.0.192.bl.example":  {"127.0.0.2"},
+		"3.2.0.192.wl.example":  {"127.0.10.1"},
+		// A "query refused" answer is not a listing.
+		"4.2.0.192.bl.example": {"127.255.255.254"},
+		"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.bl.example": {"127.0.0.2"},
+	}}
+}
+
+var lists = []List{
+	{Zone: "bl.example"},
+	{Zone: "zen.example", Weight: 0.5, Codes: []string{"127.0.0.2/31", "127.0.0.4"}},
+	{Zone: "wl.example", Weight: -2},
+}
+
+func TestCheck(t *testing.T) {
+	c, err := NewChecker(zones(), lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		ip    string
+		score float64
+		zones []string
+	}{
+		{"192.0.2.1", 1.5, []string{"bl.example", "zen.example"}},
+		{"192.0.2.2", 0, nil},
+		{"192.0.2.3", -1, []string{"bl.example"}},
+		{"192.0.2.4", 0, nil},
+		{"2001:db8:1:2:3:4:567:89ab", 1, []string{"bl.example"}},
+	}
+	for _, tt := range tests {
+		report := c.Check(ctx, net.ParseIP(tt.ip))
+		if report.Score != tt.score || strings.Join(report.Zones(), ",") != strings.Join(tt.zones, ",") || report.Err != nil {
+			t.Errorf("Check(%s) = %+v", tt.ip, report)
+		}
+		if report.Listed() != (len(tt.zones) > 0) {
+			t.Errorf("Check(%s).Listed() = %v", tt.ip, report.Listed())
+		}
+	}
+
+	report := c.Check(ctx, net.ParseIP("192.0.2.1"))
+	if codes := report.Listings[1].Codes; len(codes) != 1 || !codes[0].Equal(net.ParseIP("127.0.0.4")) {
+		t.Errorf("zen codes = %v", codes)
+	}
+
+	for _, l := range []List{{}, {Zone: "bl.example", Codes: []string{"bogus"}}, {Zone: "bl.example", Codes: []string{"::1"}}} {
+		if _, err := NewChecker(zones(), []List{l}); err == nil {
+			t.Errorf("NewChecker(%+v) succeeded", l)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	r := zones()
+	now := time.Unix(1700000000, 0)
+	c, err := NewChecker(r, lists[:1], WithCacheTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	c.Check(ctx, net.ParseIP("192.0.2.1"))
+	c.Check(ctx, net.ParseIP("192.0.2.9"))
+	c.Check(ctx, net.ParseIP("192.0.2.1"))
+	c.Check(ctx, net.ParseIP("192.0.2.9"))
+	if q := r.Queries(); len(q) != 2 {
+		t.Errorf("queries with cache = %v", q)
+	}
+
+	now = now.Add(time.Minute)
+	c.Check(ctx, net.ParseIP("192.0.2.1"))
+	if q := r.Queries(); len(q) != 3 {
+		t.Errorf("queries after expiry = %v", q)
+	}
+
+	// Errors are not cached, and fail open.
+	r.Errors = map[string]error{"5.2.0.192.bl.example": dnstest.Temporary("5.2.0.192.bl.example")}
+	for range 2 {
+		if report := c.Check(ctx, net.ParseIP("192.0.2.5")); report.Score != 0 || !errors.Is(report.Err, ErrDNS) {
+			t.Errorf("Check with DNS error = %+v", report)
+		}
+	}
+	if q := r.Queries(); len(q) != 5 {
+		t.Errorf("queries with errors = %v", q)
+	}
+}
+
+// slowResolver blocks until the lookup is cancelled.
+type slowResolver struct{}
+
+func (slowResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	<-ctx.Done()
+	return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+}
+
+func TestTimeout(t *testing.T) {
+	c, err := NewChecker(slowResolver{}, lists, WithTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	report := c.Check(context.Background(), net.ParseIP("192.0.2.1"))
+	if report.Score != 0 || !errors.Is(report.Err, ErrDNS) {
+		t.Errorf("Check = %+v", report)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Check took %v", d)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	c, err := NewChecker(zones(), lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPolicy(c, WithRejectThreshold(1.5), WithDeferThreshold(1))
+	ctx := context.Background()
+
+	tests := []struct {
+		ip     string
+		accept bool
+		code   icesmtp.ReplyCode
+	}{
+		{"192.0.2.1", false, 554},
+		{"2001:db8:1:2:3:4:567:89ab", false, 421},
+		{"192.0.2.3", true, 0},
+		{"", true, 0},
+	}
+	for _, tt := range tests {
+		accept, resp := p.Accept(ctx, icesmtp.ConnectionInfo{RemoteIP: tt.ip})
+		if accept != tt.accept || resp.Code != tt.code {
+			t.Errorf("Accept(%s) = %v, %v", tt.ip, accept, resp)
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	c, err := NewChecker(zones(), lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := harness.NewHarness(harness.WithClientIP("192.0.2.1"), harness.WithServerHostname("mx.example.com"))
+	h.Config.ConnectionPolicy = NewPolicy(c)
+	h.Start(context.Background())
+	defer h.Close()
+
+	lines, err := h.Expect(554)
+	if err != nil {
+		t.Fatalf("expected 554: %v (%v)", err, lines)
+	}
+	if resp := strings.Join(lines, "\n"); !strings.Contains(resp, "5.7.1") || !strings.Contains(resp, "[192.0.2.1] blocked using bl.example, zen.example") {
+		t.Errorf("response = %q", resp)
+	}
+}
+
+func TestRcpt(t *testing.T) {
+	r := zones()
+	c, err := NewChecker(r, lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := harness.NewHarness(harness.WithClientIP("192.0.2.1"), harness.WithServerHostname("mx.example.com"))
+	h.Config.SessionFilterFactory = NewPolicy(c)
+	h.Mailbox.AddDomain("example.com")
+	h.Mailbox.SetCatchAll(true)
+	h.Start(context.Background())
+	defer h.Close()
+
+	expect := func(code icesmtp.ReplyCode) string {
+		t.Helper()
+		lines, err := h.Expect(code)
+		if err != nil {
+			t.Fatalf("expected %d: %v (%v)", code, err, lines)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	expect(220)
+	h.Send("EHLO client.example.net")
+	expect(250)
+	h.Send("MAIL FROM:<sender@example.net>")
+	expect(250)
+	h.Send("RCPT TO:<Postmaster@example.com>")
+	expect(250)
+	if q := r.Queries(); len(q) != 0 {
+		t.Errorf("postmaster was checked: %v", q)
+	}
+	h.Send("RCPT TO:<user@example.com>")
+	if resp := expect(550); !strings.Contains(resp, "5.7.1 Client [192.0.2.1] blocked using bl.example, zen.example") {
+		t.Errorf("response = %q", resp)
+	}
+	h.Send("RCPT TO:<other@example.com>")
+	expect(550)
+	if q := r.Queries(); len(q) != 3 {
+		t.Errorf("lists queried more than once: %v", q)
+	}
+}
@@ -0,0 +1,155 @@
+package dnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Policy refuses clients whose score reaches a threshold. It implements
+// icesmtp.ConnectionPolicy, which refuses them in place of the greeting,
+// and icesmtp.SessionFilterFactory, which refuses their recipients
+// instead, except for exempt ones such as postmaster. Use one or the
+// other.
+//
+// DNS errors are ignored: a list that cannot be queried does not count.
+type Policy struct {
+	checker *Checker
+
+	rejectAt float64
+	deferAt  float64
+	exempt   []string
+}
+
+// PolicyOption configures a Policy.
+type PolicyOption func(*Policy)
+
+// WithRejectThreshold rejects clients whose score is at least score.
+// Defaults to 1, so that a listing on any list of weight 1 rejects.
+func WithRejectThreshold(score float64) PolicyOption {
+	return func(p *Policy) {
+		p.rejectAt = score
+	}
+}
+
+// WithDeferThreshold defers clients whose score is at least score but
+// below the reject threshold. Zero, the default, never defers.
+func WithDeferThreshold(score float64) PolicyOption {
+	return func(p *Policy) {
+		p.deferAt = score
+	}
+}
+
+// WithExemptRecipients sets the local parts that are accepted at RCPT TO
+// from listed clients, so they can still reach the site's administrators
+// (RFC 5321 section 4.5.1). Defaults to "postmaster".
+func WithExemptRecipients(localParts ...string) PolicyOption {
+	return func(p *Policy) {
+		p.exempt = localParts
+	}
+}
+
+// NewPolicy creates a Policy that checks clients with checker.
+func NewPolicy(checker *Checker, opts ...PolicyOption) *Policy {
+	p := &Policy{
+		checker:  checker,
+		rejectAt: 1,
+		exempt:   []string{"postmaster"},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// decide checks ip and returns the decision for its score.
+func (p *Policy) decide(ctx context.Context, ip icesmtp.IPAddress) (icesmtp.PolicyDecision, Report) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return icesmtp.PolicyAllow, Report{}
+	}
+	report := p.checker.Check(ctx, addr)
+	switch {
+	case report.Score >= p.rejectAt:
+		return icesmtp.PolicyDeny, report
+	case p.deferAt > 0 && report.Score >= p.deferAt:
+		return icesmtp.PolicyDefer, report
+	}
+	return icesmtp.PolicyAllow, report
+}
+
+// Ensure Policy implements the interfaces.
+var (
+	_ icesmtp.ConnectionPolicy     = (*Policy)(nil)
+	_ icesmtp.SessionFilterFactory = (*Policy)(nil)
+)
+
+// Accept checks the client before the greeting, rejecting it with 554
+// 5.7.1 or deferring it with 421 4.7.1. Clients without a known IP
+// address are accepted unchecked.
+func (p *Policy) Accept(ctx context.Context, info icesmtp.ConnectionInfo) (bool, icesmtp.Response) {
+	decision, report := p.decide(ctx, info.RemoteIP)
+	switch decision {
+	case icesmtp.PolicyDeny:
+		return false, response(icesmtp.Reply554TransactionFailed, icesmtp.EnhancedPermanent,
+			fmt.Sprintf("Service unavailable; client [%s] blocked using %s", info.RemoteIP, strings.Join(report.Zones(), ", ")))
+	case icesmtp.PolicyDefer:
+		return false, response(icesmtp.Reply421ServiceNotAvailable, icesmtp.EnhancedPersistentTransient,
+			fmt.Sprintf("Service unavailable; client [%s] listed by %s, try again later", info.RemoteIP, strings.Join(report.Zones(), ", ")))
+	}
+	return true, icesmtp.Response{}
+}
+
+// NewSessionFilter returns a filter that checks the client at its first
+// recipient that is not exempt.
+func (p *Policy) NewSessionFilter(ctx context.Context, session icesmtp.SessionInfo) (icesmtp.SessionFilter, error) {
+	return &sessionFilter{policy: p}, nil
+}
+
+// sessionFilter applies a Policy at RCPT TO.
+type sessionFilter struct {
+	icesmtp.NullSessionFilter
+	policy *Policy
+
+	checked bool
+	result  icesmtp.PolicyResult
+}
+
+// RcptTo rejects recipients of a listed client with 550 5.7.1 or defers
+// them with 451 4.7.1. The lists are queried once per session.
+func (f *sessionFilter) RcptTo(ctx context.Context, recipient icesmtp.MailPath, params icesmtp.ESMTPParams, session icesmtp.SessionInfo) icesmtp.PolicyResult {
+	local, _, _ := strings.Cut(recipient.Address, "@")
+	for _, e := range f.policy.exempt {
+		if strings.EqualFold(local, e) {
+			return icesmtp.PolicyAllowed()
+		}
+	}
+	if f.checked {
+		return f.result
+	}
+	f.checked = true
+
+	ip := session.ClientIP()
+	decision, report := f.policy.decide(ctx, ip)
+	zones := strings.Join(report.Zones(), ", ")
+	switch decision {
+	case icesmtp.PolicyDeny:
+		f.result = icesmtp.PolicyDenied(response(icesmtp.Reply550MailboxUnavailable, icesmtp.EnhancedPermanent,
+			fmt.Sprintf("Client [%s] blocked using %s", ip, zones)), "listed by "+zones)
+	case icesmtp.PolicyDefer:
+		f.result = icesmtp.PolicyDeferred(response(icesmtp.Reply451LocalError, icesmtp.EnhancedPersistentTransient,
+			fmt.Sprintf("Client [%s] listed by %s, try again later", ip, zones)), "listed by "+zones)
+	default:
+		f.result = icesmtp.PolicyAllowed()
+	}
+	return f.result
+}
+
+// response builds a policy reply with enhanced code class.7.1.
+func response(code icesmtp.ReplyCode, class icesmtp.EnhancedStatusClass, text string) icesmtp.Response {
+	return icesmtp.NewEnhancedResponse(code,
+		icesmtp.EnhancedStatusCode{Class: class, Subject: icesmtp.EnhancedSubjectPolicy, Detail: 1}, text)
+}
@@ -0,0 +1,256 @@
+// Package emldir provides a Storage implementation that writes each
+// envelope to a directory as <EnvelopeID>.eml with a JSON sidecar.
+//
+// The .eml file contains the message exactly as received. The .json
+// sidecar records the SMTP envelope and session metadata. The sidecar is
+// written last, so its presence marks the message as complete.
+package emldir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// ErrInvalidID indicates an envelope ID that cannot be used as a file name.
+var ErrInvalidID = errors.New("envelope id is not a valid file name")
+
+// File name extensions.
+const (
+	// MessageExt is the extension of the raw message file.
+	MessageExt = ".eml"
+
+	// SidecarExt is the extension of the JSON metadata file.
+	SidecarExt = ".json"
+)
+
+// Sidecar is the JSON document stored next to each message.
+type Sidecar struct {
+	// EnvelopeID is the envelope identifier, also the file base name.
+	EnvelopeID icesmtp.EnvelopeID `json:"envelope_id"`
+
+	// MailFrom is the envelope sender.
+	MailFrom icesmtp.MailPath `json:"mail_from"`
+
+	// Recipients are the envelope recipients.
+	Recipients []icesmtp.MailPath `json:"recipients"`
+
+	// ESMTPParams are the parameters from the MAIL command.
+	ESMTPParams icesmtp.ESMTPParams `json:"esmtp_params,omitempty"`
+
+	// Metadata is the session metadata of the envelope.
+	Metadata icesmtp.EnvelopeMetadata `json:"metadata"`
+
+	// ReceivedAt is when the transaction started.
+	ReceivedAt time.Time `json:"received_at"`
+
+	// StoredAt is when the files were written.
+	StoredAt time.Time `json:"stored_at"`
+
+	// Size is the size of the .eml file in bytes.
+	Size icesmtp.ByteCount `json:"size"`
+}
+
+// Storage writes envelopes into a directory.
+type Storage struct {
+	dir      string
+	fileMode os.FileMode
+
+	mu      sync.Mutex
+	metrics icesmtp.StorageMetrics
+}
+
+// Option configures a Storage.
+type Option func(*Storage)
+
+// WithFileMode sets the permissions for created files. Defaults to 0600.
+func WithFileMode(mode os.FileMode) Option {
+	return func(s *Storage) {
+		s.fileMode = mode
+	}
+}
+
+// NewStorage creates a storage that writes into dir.
+// The directory is created on first use if it does not exist.
+func NewStorage(dir string, opts ...Option) *Storage {
+	s := &Storage{
+		dir:      dir,
+		fileMode: 0600,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Store writes the envelope data and sidecar.
+func (s *Storage) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	return s.store(ctx, envelope, icesmtp.StorageOpStore, bytes.NewReader(envelope.Data()))
+}
+
+// StoreStream writes the streamed data and sidecar.
+func (s *Storage) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	return s.store(ctx, envelope, icesmtp.StorageOpStoreStream, data)
+}
+
+func (s *Storage) store(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, data io.Reader) (icesmtp.StorageReceipt, error) {
+	start := time.Now()
+
+	id := envelope.ID()
+	if !validID(id) {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, ErrInvalidID, true, "cannot store envelope")
+	}
+	if err := ctx.Err(); err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "store cancelled")
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "failed to create directory")
+	}
+
+	size, err := s.writeAtomic(id+MessageExt, data)
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "failed to write message")
+	}
+
+	storedAt := time.Now()
+	sidecar, err := json.MarshalIndent(Sidecar{
+		EnvelopeID:  id,
+		MailFrom:    envelope.MailFrom(),
+		Recipients:  envelope.Recipients(),
+		ESMTPParams: envelope.ESMTPParams(),
+		Metadata:    envelope.Metadata(),
+		ReceivedAt:  envelope.ReceivedAt(),
+		StoredAt:    storedAt,
+		Size:        size,
+	}, "", "  ")
+	if err == nil {
+		_, err = s.writeAtomic(id+SidecarExt, bytes.NewReader(append(sidecar, '\n')))
+	}
+	if err != nil {
+		os.Remove(filepath.Join(s.dir, id+MessageExt))
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "failed to write sidecar")
+	}
+
+	s.mu.Lock()
+	s.metrics.MessagesStored++
+	s.metrics.BytesStored += uint64(size)
+	s.metrics.StoreLatencyNs = int64(time.Since(start))
+	s.mu.Unlock()
+
+	return icesmtp.StorageReceipt{
+		MessageID:    icesmtp.StorageMessageID(id),
+		EnvelopeID:   id,
+		StoredAt:     storedAt.Unix(),
+		BytesWritten: size,
+	}, nil
+}
+
+// writeAtomic writes r to name via a temporary file and rename.
+func (s *Storage) writeAtomic(name string, r io.Reader) (int64, error) {
+	f, err := os.CreateTemp(s.dir, "."+name+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	tmp := f.Name()
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(s.fileMode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
+
+// Load reads the sidecar for an envelope ID.
+func (s *Storage) Load(id icesmtp.EnvelopeID) (*Sidecar, error) {
+	if !validID(id) {
+		return nil, ErrInvalidID
+	}
+	b, err := os.ReadFile(filepath.Join(s.dir, id+SidecarExt))
+	if err != nil {
+		return nil, err
+	}
+	var sc Sidecar
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// Open opens the raw message for an envelope ID.
+func (s *Storage) Open(id icesmtp.EnvelopeID) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrInvalidID
+	}
+	return os.Open(filepath.Join(s.dir, id+MessageExt))
+}
+
+// List returns the IDs of all complete messages in the directory.
+func (s *Storage) List() ([]icesmtp.EnvelopeID, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ids []icesmtp.EnvelopeID
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, SidecarExt) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, SidecarExt))
+	}
+	return ids, nil
+}
+
+// validID reports whether id is safe to use as a file base name.
+func validID(id icesmtp.EnvelopeID) bool {
+	if id == "" || strings.HasPrefix(id, ".") {
+		return false
+	}
+	return !strings.ContainsAny(id, "/\\\x00")
+}
+
+// Metrics returns storage metrics.
+func (s *Storage) Metrics() icesmtp.StorageMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// Healthy checks that the directory exists or can be created.
+func (s *Storage) Healthy(ctx context.Context) error {
+	return os.MkdirAll(s.dir, 0700)
+}
+
+// Ensure Storage implements the interfaces.
+var (
+	_ icesmtp.Storage            = (*Storage)(nil)
+	_ icesmtp.StorageWithMetrics = (*Storage)(nil)
+	_ icesmtp.StorageWithHealth  = (*Storage)(nil)
+)
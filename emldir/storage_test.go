@@ -0,0 +1,74 @@
+package emldir
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+func TestStorage_WritesMessageAndSidecar(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStorage(dir)
+
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{
+		SessionID: "sess-1",
+		ClientIP:  "192.0.2.1",
+	})
+	b.SetMailFrom(icesmtp.MailPath{Address: "a@example.org"}, icesmtp.ESMTPParams{"BODY": "8BITMIME"})
+	b.AddRecipient(icesmtp.MailPath{Address: "b@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte("Subject: eml\r\n\r\nhello\r\n"))
+	w.Close()
+	env, _ := b.Finalize()
+
+	receipt, err := s.Store(context.Background(), env)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if receipt.MessageID != env.ID() {
+		t.Errorf("MessageID = %q, want %q", receipt.MessageID, env.ID())
+	}
+
+	ids, err := s.List()
+	if err != nil || len(ids) != 1 || ids[0] != env.ID() {
+		t.Fatalf("List() = %v, %v", ids, err)
+	}
+
+	sc, err := s.Load(env.ID())
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if sc.MailFrom.Address != "a@example.org" || len(sc.Recipients) != 1 ||
+		sc.ESMTPParams["BODY"] != "8BITMIME" || sc.Metadata.SessionID != "sess-1" {
+		t.Errorf("unexpected sidecar: %+v", sc)
+	}
+
+	f, err := s.Open(env.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	raw, _ := io.ReadAll(f)
+	if string(raw) != "Subject: eml\r\n\r\nhello\r\n" || sc.Size != int64(len(raw)) {
+		t.Errorf("raw message %q, size %d", raw, sc.Size)
+	}
+}
+
+func TestStorage_RejectsUnsafeID(t *testing.T) {
+	s := NewStorage(t.TempDir())
+	_, err := s.Store(context.Background(), &idEnvelope{id: "../escape"})
+	if !errors.Is(err, ErrInvalidID) {
+		t.Fatalf("expected ErrInvalidID, got %v", err)
+	}
+}
+
+// idEnvelope is an Envelope with a caller-chosen ID.
+type idEnvelope struct {
+	icesmtp.StandardEnvelope
+	id string
+}
+
+func (e *idEnvelope) ID() icesmtp.EnvelopeID { return e.id }
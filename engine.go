@@ -1,6 +1,7 @@
 package icesmtp
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
@@ -27,10 +28,14 @@ type Engine struct {
 	sessionID  SessionID
 	clientIP   IPAddress
 	clientAddr RemoteAddress
+	reverseDNS ReverseDNS
 
 	// Current envelope being built
 	envelope EnvelopeBuilder
 
+	// Per-session filter, if SessionFilterFactory is configured
+	filter SessionFilter
+
 	// Synchronization
 	mu     sync.Mutex
 	closed bool
@@ -84,13 +89,18 @@ func NewEngineFromNetConn(netConn net.Conn, config SessionConfig, opts ...Engine
 // NewEngineWithConn creates a new SMTP engine with a Conn.
 func NewEngineWithConn(conn Conn, config SessionConfig, opts ...EngineOption) *Engine {
 	e := &Engine{
-		config:    config,
-		conn:      NewBufferedConn(conn),
-		parser:    NewParser(),
-		sm:        NewStateMachine(),
-		state:     &SessionState{State: StateDisconnected},
-		stats:     SessionStats{StartTime: time.Now()},
-		sessionID: generateSessionID(),
+		config: config,
+		conn:   NewBufferedConn(conn),
+		parser: NewParser(),
+		sm:     NewStateMachine(),
+		state:  &SessionState{State: StateDisconnected},
+		stats:  SessionStats{StartTime: time.Now()},
+	}
+
+	if config.IDGenerator != nil {
+		e.sessionID = config.IDGenerator.NewID()
+	} else {
+		e.sessionID = generateSessionID()
 	}
 
 	if config.Logger != nil {
@@ -130,6 +140,89 @@ func (e *Engine) Run(ctx context.Context) error {
 		e.config.Hooks.OnConnect(ctx, e)
 	}
 
+	// Refuse the connection while storage is down
+	if e.config.LoadShedding == ShedAtConnect && !e.storageHealthy() {
+		e.logger.Warn(ctx, "refusing connection, storage unhealthy",
+			Attr(AttrClientIP, e.clientIP))
+		e.writeResponse(ctx, NewEnhancedResponse(Reply421ServiceNotAvailable,
+			EnhancedStatusCode{Class: EnhancedPersistentTransient, Subject: EnhancedSubjectMailSystem, Detail: 0},
+			fmt.Sprintf("%s Service temporarily unavailable, try again later", e.config.ServerHostname)))
+		e.sm.Abort()
+		return e.handleDisconnect(ctx, DisconnectResourceLimit, ErrStorageUnavailable)
+	}
+
+	// Look up the client's reverse DNS name
+	if e.config.ReverseResolver != nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, reverseLookupTimeout)
+		e.reverseDNS = LookupReverseDNS(lookupCtx, e.config.ReverseResolver, e.clientIP)
+		cancel()
+		e.logger.Debug(ctx, "client reverse DNS",
+			Attr(AttrClientIP, e.clientIP), Attr("name", e.reverseDNS.Name), Attr("confirmed", e.reverseDNS.Confirmed))
+	}
+
+	// Let the connection policy vet the client
+	if e.config.ConnectionPolicy != nil {
+		info := ConnectionInfo{
+			RemoteAddr: e.clientAddr,
+			RemoteIP:   e.clientIP,
+			ReverseDNS: e.reverseDNS,
+			TLS:        e.conn.TLSConnectionState() != nil,
+		}
+		if accept, resp := e.config.ConnectionPolicy.Accept(ctx, info); !accept {
+			resp, _ = connectResponse(e.config.ServerHostname, PolicyDenied(resp, ""))
+			e.logger.Info(ctx, "connection rejected by connection policy",
+				Attr(AttrClientIP, e.clientIP))
+			e.writeResponse(ctx, resp)
+			e.sm.Abort()
+			return e.handleDisconnect(ctx, DisconnectPolicyViolation, ErrConnectionRejected)
+		}
+	}
+
+	// Create the per-session filter and let it vet the connection
+	if e.config.SessionFilterFactory != nil {
+		filter, err := e.config.SessionFilterFactory.NewSessionFilter(ctx, e)
+		if err != nil {
+			e.logger.Error(ctx, "session filter unavailable", Attr(AttrError, err))
+			e.writeResponse(ctx, NewEnhancedResponse(Reply421ServiceNotAvailable,
+				EnhancedStatusCode{Class: EnhancedPersistentTransient, Subject: EnhancedSubjectMailSystem, Detail: 0},
+				fmt.Sprintf("%s Service temporarily unavailable, try again later", e.config.ServerHostname)))
+			e.sm.Abort()
+			return e.handleDisconnect(ctx, DisconnectError, err)
+		}
+		e.filter = filter
+
+		if resp, rejected := connectResponse(e.config.ServerHostname, filter.Connect(ctx, e)); rejected {
+			e.logger.Info(ctx, "connection rejected by session filter",
+				Attr(AttrClientIP, e.clientIP))
+			e.writeResponse(ctx, resp)
+			e.sm.Abort()
+			return e.handleDisconnect(ctx, DisconnectPolicyViolation, ErrConnectionRejected)
+		}
+	}
+
+	// Delay the greeting and reject clients that talk before it
+	if err := e.pregreet(ctx); err != nil {
+		e.sm.Abort()
+		switch {
+		case errors.Is(err, ErrEarlyTalker):
+			e.logger.Info(ctx, "client talked before the greeting",
+				Attr(AttrClientIP, e.clientIP))
+			if len(e.config.Pregreet.Banner) > 0 {
+				// The banner lines opened the greeting reply. Finish it so
+				// that the rejection is a complete reply of its own.
+				e.writeResponse(ctx, e.buildGreeting())
+			}
+			e.writeResponse(ctx, NewEnhancedResponse(Reply554TransactionFailed,
+				EnhancedStatusCode{Class: EnhancedPermanent, Subject: EnhancedSubjectDelivery, Detail: 1},
+				fmt.Sprintf("%s Protocol error: talked before the greeting", e.config.ServerHostname)))
+			return e.handleDisconnect(ctx, DisconnectPolicyViolation, err)
+		case ctx.Err() != nil:
+			return e.handleDisconnect(ctx, DisconnectTimeout, err)
+		default:
+			return e.handleDisconnect(ctx, DisconnectError, err)
+		}
+	}
+
 	// Send greeting
 	greeting := e.buildGreeting()
 	if err := e.writeResponse(ctx, greeting); err != nil {
@@ -288,12 +381,23 @@ func (e *Engine) handleHELO(ctx context.Context, cmd *Command) Response {
 		return ResponseSyntaxErrorParams
 	}
 
+	// The filter sees the greeting being made; a rejected greeting
+	// leaves the previous one in effect.
+	esmtp := e.state.ESMTP
+	e.state.ESMTP = false
+	if e.filter != nil {
+		if resp, rejected := policyResponse(e.filter.Helo(ctx, hostname, e)); rejected {
+			e.state.ESMTP = esmtp
+			return resp
+		}
+	}
+
 	e.state.ClientHostname = hostname
 	e.sm.TransitionForCommand(CmdHELO, true)
 	e.state.State = StateIdentified
 
 	// Reset any existing transaction
-	e.resetTransaction()
+	e.resetTransaction(ctx)
 
 	return NewResponse(Reply250OK, fmt.Sprintf("%s Hello %s", e.config.ServerHostname, hostname))
 }
@@ -304,12 +408,23 @@ func (e *Engine) handleEHLO(ctx context.Context, cmd *Command) Response {
 		return ResponseSyntaxErrorParams
 	}
 
+	// The filter sees the greeting being made; a rejected greeting
+	// leaves the previous one in effect.
+	esmtp := e.state.ESMTP
+	e.state.ESMTP = true
+	if e.filter != nil {
+		if resp, rejected := policyResponse(e.filter.Helo(ctx, hostname, e)); rejected {
+			e.state.ESMTP = esmtp
+			return resp
+		}
+	}
+
 	e.state.ClientHostname = hostname
 	e.sm.TransitionForCommand(CmdEHLO, true)
 	e.state.State = StateIdentified
 
 	// Reset any existing transaction
-	e.resetTransaction()
+	e.resetTransaction(ctx)
 
 	// Build EHLO response with extensions
 	lines := []string{fmt.Sprintf("%s Hello %s", e.config.ServerHostname, hostname)}
@@ -351,6 +466,14 @@ func (e *Engine) handleMAIL(ctx context.Context, cmd *Command) Response {
 		return NewResponse(Reply421ServiceNotAvailable, "Too many transactions")
 	}
 
+	// Refuse new transactions while storage is down
+	if !e.storageHealthy() {
+		e.logger.Warn(ctx, "rejecting MAIL, storage unhealthy")
+		return NewEnhancedResponse(Reply451LocalError,
+			EnhancedStatusCode{Class: EnhancedPersistentTransient, Subject: EnhancedSubjectMailSystem, Detail: 0},
+			"Storage temporarily unavailable, try again later")
+	}
+
 	// Parse the mail path
 	path, err := ParseMailPath(cmd.Argument, "FROM")
 	if err != nil {
@@ -368,12 +491,23 @@ func (e *Engine) handleMAIL(ctx context.Context, cmd *Command) Response {
 		}
 	}
 
-	// Validate sender if policy is configured
+	// Record SMTP AUTH, then validate sender if policy is configured
+	var authResults []AuthResult
+	if e.state.Authenticated {
+		authResults = append(authResults, SMTPAuthResult(e.state.AuthenticatedUser))
+	}
 	if e.config.SenderPolicy != nil {
 		result := e.config.SenderPolicy.ValidateSender(ctx, *path, e)
 		if !result.Accepted {
 			return result.Response
 		}
+		authResults = append(authResults, result.AuthResults...)
+	}
+
+	if e.filter != nil {
+		if resp, rejected := policyResponse(e.filter.MailFrom(ctx, *path, cmd.Params, e)); rejected {
+			return resp
+		}
 	}
 
 	// Create new envelope
@@ -381,9 +515,11 @@ func (e *Engine) handleMAIL(ctx context.Context, cmd *Command) Response {
 		SessionID:         e.sessionID,
 		ClientHostname:    e.state.ClientHostname,
 		ClientIP:          e.clientIP,
+		ClientReverseDNS:  e.reverseDNS,
 		ServerHostname:    e.config.ServerHostname,
 		TLSActive:         e.state.TLSActive,
 		AuthenticatedUser: e.state.AuthenticatedUser,
+		AuthResults:       authResults,
 	}
 	if e.state.TLSState != nil {
 		metadata.TLSVersion = e.state.TLSState.VersionString()
@@ -393,7 +529,7 @@ func (e *Engine) handleMAIL(ctx context.Context, cmd *Command) Response {
 	if e.config.EnvelopeFactory != nil {
 		e.envelope = e.config.EnvelopeFactory.NewBuilder(metadata)
 	} else {
-		e.envelope = NewStandardEnvelopeBuilder(metadata)
+		e.envelope = NewStandardEnvelopeBuilderWithIDs(metadata, e.config.IDGenerator)
 	}
 
 	if err := e.envelope.SetMailFrom(*path, cmd.Params); err != nil {
@@ -433,6 +569,12 @@ func (e *Engine) handleRCPT(ctx context.Context, cmd *Command) Response {
 		return result.Response
 	}
 
+	if e.filter != nil {
+		if resp, rejected := policyResponse(e.filter.RcptTo(ctx, *path, cmd.Params, e)); rejected {
+			return resp
+		}
+	}
+
 	// Add recipient to envelope
 	if err := e.envelope.AddRecipient(*path); err != nil {
 		return ResponseTransactionFailed
@@ -482,9 +624,34 @@ func (e *Engine) handleDATA(ctx context.Context, cmd *Command) Response {
 		return NewResponse(Reply451LocalError, "Unable to accept message")
 	}
 
-	// Stream message data
+	// Start the message with the Received trace field. The data inspector
+	// sees only what the client sent, but the field counts toward
+	// MaxMessageSize so the stored message stays within the limit.
+	protocol := ReceivedProtocol(e.state.ESMTP, e.state.TLSActive, e.state.Authenticated)
+	trace := []byte("Received: " + Received(e.envelope.Build(), protocol) + "\r\n")
+	if _, err := writer.Write(trace); err != nil {
+		writer.Close()
+		e.logger.Error(ctx, "failed to write trace field", Attr(AttrError, err))
+		e.sm.Reset()
+		e.state.State = StateIdentified
+		e.envelope = nil
+		return NewResponse(Reply451LocalError, "Unable to accept message")
+	}
+	headers := NewHeaderParser(e.config.Limits.MaxHeaderSize)
+	for line := range bytes.Lines(trace) {
+		headers.Feed(line)
+	}
+
+	// Stream message data, through the inspector if one is configured
+	var inspector DataInspector
+	var dest io.Writer = writer
+	if e.config.DataInspectorFactory != nil {
+		inspector = e.config.DataInspectorFactory.NewDataInspector(ctx, e)
+		dest = inspectingWriter{w: writer, inspector: inspector}
+	}
+
 	var bytesWritten int64
-	bytesWritten, err = e.streamData(ctx, writer, dataTimeout)
+	bytesWritten, err = e.streamData(ctx, dest, headers, int64(len(trace)), dataTimeout)
 	if err != nil {
 		writer.Close() // Close on error
 		e.logger.Error(ctx, "error receiving message data", Attr(AttrError, err))
@@ -507,6 +674,10 @@ func (e *Engine) handleDATA(ctx context.Context, cmd *Command) Response {
 		return resp
 	}
 
+	if setter, ok := e.envelope.(EnvelopeHeaderSetter); ok {
+		setter.SetHeaders(headers.Headers())
+	}
+
 	// Close writer before finalizing
 	if err := writer.Close(); err != nil {
 		e.logger.Error(ctx, "failed to close data writer", Attr(AttrError, err))
@@ -526,18 +697,75 @@ func (e *Engine) handleDATA(ctx context.Context, cmd *Command) Response {
 		return NewResponse(Reply451LocalError, "Unable to finalize message")
 	}
 
+	if inspector != nil {
+		envelope = withAuthResults(envelope, inspector.Finish(ctx))
+	}
+
+	// Filter message content
+	discard := false
+	if filter := e.contentFilter(); filter != nil {
+		result, err := filter.Filter(ctx, envelope, e)
+		if err != nil {
+			e.sm.Reset()
+			e.state.State = StateIdentified
+			e.envelope = nil
+			e.logger.Error(ctx, "content filter error", Attr(AttrError, err))
+			return NewEnhancedResponse(Reply451LocalError,
+				EnhancedStatusCode{Class: EnhancedPersistentTransient, Subject: EnhancedSubjectMailSystem, Detail: 0},
+				"Content filter unavailable, try again later")
+		}
+
+		if result.Envelope != nil {
+			envelope = result.Envelope
+		}
+
+		switch result.Action {
+		case FilterReject, FilterTempFail:
+			e.sm.Reset()
+			e.state.State = StateIdentified
+			e.envelope = nil
+			e.logger.Info(ctx, "message rejected by content filter",
+				Attr(AttrEnvelopeID, envelope.ID()),
+				Attr("action", result.Action.String()),
+				Attr("reason", result.Reason))
+			return result.response()
+		case FilterDiscard:
+			discard = true
+			e.logger.Info(ctx, "message discarded by content filter",
+				Attr(AttrEnvelopeID, envelope.ID()),
+				Attr("reason", result.Reason))
+		case FilterQuarantine:
+			envelope = quarantine(envelope, result.Reason)
+			e.logger.Info(ctx, "message quarantined by content filter",
+				Attr(AttrEnvelopeID, envelope.ID()),
+				Attr("reason", result.Reason))
+		}
+	}
+
 	// Store message
-	if e.config.Storage != nil {
-		receipt, err := e.config.Storage.Store(ctx, envelope)
+	var receipt StorageReceipt
+	if e.config.Storage != nil && !discard {
+		receipt, err = e.storeEnvelope(ctx, envelope)
 		if err != nil {
 			e.sm.Reset()
 			e.state.State = StateIdentified
 			e.envelope = nil
+			var veto *StorageVetoError
+			if errors.As(err, &veto) {
+				e.logger.Info(ctx, "store vetoed by hook", Attr(AttrError, err))
+				return veto.Response
+			}
 			e.logger.Error(ctx, "storage error", Attr(AttrError, err))
+			// Backends signal permanent rejections with a permanent
+			// StorageError; anything else is treated as temporary.
+			var storageErr *StorageError
+			if errors.As(err, &storageErr) && storageErr.Permanent {
+				return NewResponse(Reply554TransactionFailed, "Message rejected by storage")
+			}
 			return NewResponse(Reply451LocalError, "Unable to store message")
 		}
 		e.logger.Debug(ctx, "message stored",
-			Attr("storage_id", receipt.MessageID),
+			Attr(AttrStorageID, receipt.MessageID),
 			Attr("bytes_written", receipt.BytesWritten))
 	}
 
@@ -551,23 +779,99 @@ func (e *Engine) handleDATA(ctx context.Context, cmd *Command) Response {
 	e.state.State = StateIdentified
 	e.envelope = nil
 
-	if e.config.Hooks != nil {
+	if hooks, ok := e.config.Hooks.(SessionHooksWithReceipt); ok {
+		hooks.OnDataStored(ctx, envelope, receipt, e)
+	} else if e.config.Hooks != nil {
 		e.config.Hooks.OnDataEnd(ctx, envelope, e)
 	}
 
 	e.logger.Info(ctx, "message received",
 		Attr(AttrEnvelopeID, envelope.ID()),
+		Attr(AttrStorageID, receipt.MessageID),
 		Attr(AttrMessageSize, bytesWritten),
 		Attr(AttrRecipients, envelope.RecipientCount()))
 
-	return NewResponse(Reply250OK, fmt.Sprintf("OK, message %s accepted", envelope.ID()))
+	template := e.config.AcceptReply
+	if template == "" {
+		template = DefaultAcceptReply
+	}
+	return NewResponse(Reply250OK, ExpandAcceptReply(template, envelope, receipt))
+}
+
+// contentFilter returns the filters to run at the end of data: the
+// session filter followed by SessionConfig.ContentFilter.
+func (e *Engine) contentFilter() ContentFilter {
+	switch {
+	case e.filter == nil:
+		return e.config.ContentFilter
+	case e.config.ContentFilter == nil:
+		return e.filter
+	default:
+		return NewFilterChain().Add(e.filter).Add(e.config.ContentFilter)
+	}
+}
+
+// headersComplete calls the end-of-headers hook.
+func (e *Engine) headersComplete(ctx context.Context, headers *HeaderParser) {
+	if hooks, ok := e.config.Hooks.(SessionHooksWithHeaders); ok {
+		hooks.OnHeaders(ctx, headers.Headers(), e)
+	}
+}
+
+// storageHealthy reports whether the configured StorageHealth monitor
+// considers storage healthy. Without a monitor storage is assumed healthy.
+func (e *Engine) storageHealthy() bool {
+	return e.config.StorageHealth == nil || e.config.StorageHealth.Healthy()
+}
+
+// storeEnvelope stores the envelope, running the configured StorageHooks
+// around the call.
+func (e *Engine) storeEnvelope(ctx context.Context, envelope Envelope) (StorageReceipt, error) {
+	for _, hook := range e.config.StorageHooks {
+		if err := hook.BeforeStore(ctx, envelope); err != nil {
+			var veto *StorageVetoError
+			if errors.As(err, &veto) {
+				return StorageReceipt{}, err
+			}
+			return StorageReceipt{}, &StorageError{
+				Operation:  StorageOpStore,
+				EnvelopeID: envelope.ID(),
+				Cause:      err,
+				Message:    "storage hook aborted store",
+			}
+		}
+	}
+
+	receipt, err := e.config.Storage.Store(ctx, envelope)
+	if err != nil {
+		var storageErr *StorageError
+		if !errors.As(err, &storageErr) {
+			storageErr = &StorageError{
+				Operation:  StorageOpStore,
+				EnvelopeID: envelope.ID(),
+				Cause:      err,
+				Message:    "store failed",
+			}
+		}
+		for _, hook := range e.config.StorageHooks {
+			hook.OnStoreError(ctx, envelope, storageErr)
+		}
+		return StorageReceipt{}, err
+	}
+
+	for _, hook := range e.config.StorageHooks {
+		hook.AfterStore(ctx, envelope, receipt)
+	}
+	return receipt, nil
 }
 
 // streamData reads message data and writes it directly to the writer.
-// It enforces limits and handles dot-unstuffing.
-func (e *Engine) streamData(ctx context.Context, w io.Writer, timeout time.Duration) (int64, error) {
+// It enforces limits and handles dot-unstuffing. The header block is fed
+// to headers as it arrives. The returned total, which MaxMessageSize
+// bounds, starts from the written bytes already in the message.
+func (e *Engine) streamData(ctx context.Context, w io.Writer, headers *HeaderParser, written int64, timeout time.Duration) (int64, error) {
 	reader := NewDataLineReader()
-	var totalBytes int64
+	totalBytes := written
 
 	// Set initial deadline
 	deadline := time.Now().Add(timeout)
@@ -596,6 +900,10 @@ func (e *Engine) streamData(ctx context.Context, w io.Writer, timeout time.Durat
 
 		// Check for terminator
 		if reader.IsTerminator(line) {
+			if !headers.Done() {
+				headers.Finish()
+				e.headersComplete(ctx, headers)
+			}
 			break
 		}
 
@@ -613,6 +921,14 @@ func (e *Engine) streamData(ctx context.Context, w io.Writer, timeout time.Durat
 			return totalBytes, ErrMessageTooLarge
 		}
 
+		// Parse the header block as it streams
+		if !headers.Done() {
+			headers.Feed(unstuffed)
+			if headers.Done() {
+				e.headersComplete(ctx, headers)
+			}
+		}
+
 		// Write to writer
 		n, err := w.Write(unstuffed)
 		if err != nil {
@@ -624,7 +940,7 @@ func (e *Engine) streamData(ctx context.Context, w io.Writer, timeout time.Durat
 	return totalBytes, nil
 }
 func (e *Engine) handleRSET(ctx context.Context, cmd *Command) Response {
-	e.resetTransaction()
+	e.resetTransaction(ctx)
 	e.sm.Reset()
 	if e.sm.State() == StateGreeted || e.sm.State() == StateIdentified {
 		e.state.State = e.sm.State()
@@ -741,7 +1057,7 @@ func (e *Engine) performTLSUpgrade(ctx context.Context) error {
 	e.state.State = StateGreeted
 
 	// Reset any transaction state
-	e.resetTransaction()
+	e.resetTransaction(ctx)
 	e.state.ClientHostname = ""
 
 	if e.config.Hooks != nil {
@@ -780,8 +1096,11 @@ func (e *Engine) writeResponse(ctx context.Context, resp Response) error {
 }
 
 // resetTransaction resets the current mail transaction.
-func (e *Engine) resetTransaction() {
+func (e *Engine) resetTransaction(ctx context.Context) {
 	if e.envelope != nil {
+		if e.filter != nil {
+			e.filter.Abort(ctx, e)
+		}
 		e.envelope.Reset()
 		e.envelope = nil
 	}
@@ -805,6 +1124,12 @@ func (e *Engine) handleDisconnect(ctx context.Context, reason DisconnectReason,
 
 	e.stats.EndTime = time.Now()
 
+	if e.filter != nil {
+		if err := e.filter.Close(); err != nil {
+			e.logger.Warn(ctx, "session filter close failed", Attr(AttrError, err))
+		}
+	}
+
 	if e.config.Hooks != nil {
 		e.config.Hooks.OnDisconnect(ctx, e, reason)
 	}
@@ -863,6 +1188,17 @@ func (e *Engine) CurrentMailFrom() *MailPath {
 	return &from
 }
 
+// ClientReverseDNS returns the result of the connect-time reverse DNS
+// lookup, which is empty if SessionConfig.ReverseResolver is not set.
+func (e *Engine) ClientReverseDNS() ReverseDNS {
+	return e.reverseDNS
+}
+
+// SessionDetails interface implementation
+
+func (e *Engine) ESMTP() bool                   { return e.state.ESMTP }
+func (e *Engine) TLSState() *TLSConnectionState { return e.state.TLSState }
+
 // Close terminates the session.
 func (e *Engine) Close() error {
 	e.mu.Lock()
@@ -320,6 +320,241 @@ func TestEngineDATAErrorHandling(t *testing.T) {
 		input.WriteString("QUIT\r\n")
 		engine.Close()
 	})
+
+	t.Run("permanent storage error", func(t *testing.T) {
+		input := newTestPipeBuffer()
+		output := newTestPipeBuffer()
+
+		config := SessionConfig{
+			ServerHostname: "test.example.com",
+			Limits:         DefaultSessionLimits(),
+			Extensions:     DefaultExtensions(),
+			Mailbox:        &acceptAllMailbox{},
+			Storage: &failingStorage{err: &StorageError{
+				Operation: StorageOpStore,
+				Cause:     errors.New("rejected"),
+				Permanent: true,
+			}},
+		}
+
+		conn := WrapPipe(input, output)
+		engine := NewEngineWithConn(conn, config)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		go func() {
+			engine.Run(ctx)
+		}()
+
+		readLine(output)
+
+		input.WriteString("EHLO client.example.com\r\n")
+		readMultiLine(output)
+
+		input.WriteString("MAIL FROM:<sender@example.com>\r\n")
+		readLine(output)
+
+		input.WriteString("RCPT TO:<recipient@example.com>\r\n")
+		readLine(output)
+
+		input.WriteString("DATA\r\n")
+		readLine(output)
+
+		input.WriteString("Subject: Test\r\n\r\nTest message.\r\n.\r\n")
+
+		// Permanent storage errors are permanent failures
+		finalResp := readLine(output)
+		if !strings.HasPrefix(finalResp, "554") {
+			t.Errorf("expected 554 response due to permanent storage error, got: %s", finalResp)
+		}
+
+		input.WriteString("QUIT\r\n")
+		engine.Close()
+	})
+
+	t.Run("storage error without Permanent", func(t *testing.T) {
+		// Shaped like the error mem.Storage returns when reading the
+		// message fails; backends that leave Permanent unset get 451.
+		resp := sendTestMessage(t, SessionConfig{
+			Mailbox: &acceptAllMailbox{},
+			Storage: &failingStorage{err: &StorageError{
+				Operation: StorageOpStoreStream,
+				Cause:     io.ErrUnexpectedEOF,
+				Message:   "failed to read message data",
+			}},
+		})
+		if !strings.HasPrefix(resp, "451") {
+			t.Errorf("expected 451 response, got: %s", resp)
+		}
+	})
+}
+
+// TestEngineStorageHooks tests that StorageHooks run around Storage.Store.
+func TestEngineStorageHooks(t *testing.T) {
+	t.Run("after store", func(t *testing.T) {
+		hook := &recordingStorageHook{}
+		resp := sendTestMessage(t, SessionConfig{
+			Storage:      NullStorage{},
+			StorageHooks: []StorageHook{hook},
+		})
+		if !strings.HasPrefix(resp, "250") {
+			t.Fatalf("expected 250 response, got: %s", resp)
+		}
+		if hook.receipt.MessageID != "null" || hook.storeErr != nil {
+			t.Errorf("unexpected hook state: receipt %+v, error %v", hook.receipt, hook.storeErr)
+		}
+	})
+
+	t.Run("veto", func(t *testing.T) {
+		hook := &recordingStorageHook{veto: &StorageVetoError{
+			Response: NewEnhancedResponse(Reply550MailboxUnavailable, EnhancedStatusCode{Class: 5, Subject: 7, Detail: 1}, "Quota exceeded"),
+		}}
+		second := &recordingStorageHook{}
+		resp := sendTestMessage(t, SessionConfig{
+			Storage:      NullStorage{},
+			StorageHooks: []StorageHook{hook, second},
+		})
+		if strings.TrimSpace(resp) != "550 5.7.1 Quota exceeded" {
+			t.Errorf("expected veto response, got: %s", resp)
+		}
+		if second.before {
+			t.Error("hooks after a veto should not run")
+		}
+	})
+
+	t.Run("store error", func(t *testing.T) {
+		hook := &recordingStorageHook{}
+		resp := sendTestMessage(t, SessionConfig{
+			Storage:      &failingStorage{},
+			StorageHooks: []StorageHook{hook},
+		})
+		if !strings.HasPrefix(resp, "451") {
+			t.Fatalf("expected 451 response, got: %s", resp)
+		}
+		if hook.storeErr == nil || hook.storeErr.Permanent || hook.storeErr.EnvelopeID == "" {
+			t.Errorf("expected typed retryable StorageError, got %+v", hook.storeErr)
+		}
+	})
+}
+
+// TestEngineAcceptReply tests the accept reply template and receipt hooks.
+func TestEngineAcceptReply(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		resp := sendTestMessage(t, SessionConfig{Storage: NullStorage{}})
+		if !strings.HasPrefix(resp, "250 OK, message ") || !strings.HasSuffix(strings.TrimSpace(resp), " accepted") {
+			t.Errorf("unexpected default reply: %s", resp)
+		}
+	})
+
+	t.Run("template and receipt hook", func(t *testing.T) {
+		hooks := &receiptHooks{}
+		resp := sendTestMessage(t, SessionConfig{
+			Storage:     NullStorage{},
+			AcceptReply: "Queued as {queue_id} ({bytes} bytes, {recipients} rcpt)",
+			Hooks:       hooks,
+		})
+		// The stored message is the 32 bytes sent plus a 159-byte Received
+		// field: the envelope ID has 24 characters and the date 31.
+		if strings.TrimSpace(resp) != "250 Queued as null (191 bytes, 1 rcpt)" {
+			t.Errorf("unexpected templated reply: %s", resp)
+		}
+		if hooks.receipt.MessageID != "null" || hooks.dataEnd {
+			t.Errorf("expected OnDataStored instead of OnDataEnd, got receipt %+v, OnDataEnd %v", hooks.receipt, hooks.dataEnd)
+		}
+	})
+}
+
+// receiptHooks records the receipt passed to OnDataStored.
+type receiptHooks struct {
+	NullSessionHooks
+	receipt StorageReceipt
+	dataEnd bool
+}
+
+func (h *receiptHooks) OnDataEnd(ctx context.Context, envelope Envelope, session SessionInfo) {
+	h.dataEnd = true
+}
+
+func (h *receiptHooks) OnDataStored(ctx context.Context, envelope Envelope, receipt StorageReceipt, session SessionInfo) {
+	h.receipt = receipt
+}
+
+// recordingStorageHook records the storage callbacks it receives.
+type recordingStorageHook struct {
+	veto     error
+	before   bool
+	receipt  StorageReceipt
+	storeErr *StorageError
+}
+
+func (h *recordingStorageHook) BeforeStore(ctx context.Context, envelope Envelope) error {
+	h.before = true
+	return h.veto
+}
+
+func (h *recordingStorageHook) AfterStore(ctx context.Context, envelope Envelope, receipt StorageReceipt) {
+	h.receipt = receipt
+}
+
+func (h *recordingStorageHook) OnStoreError(ctx context.Context, envelope Envelope, err *StorageError) {
+	h.storeErr = err
+}
+
+// sendTestMessage runs a single mail transaction against an engine with
+// config and returns the reply to the end of data. Unset hostname, limits,
+// extensions and mailbox are filled with test defaults.
+func sendTestMessage(t *testing.T, config SessionConfig) string {
+	t.Helper()
+
+	input := newTestPipeBuffer()
+	output := newTestPipeBuffer()
+
+	if config.ServerHostname == "" {
+		config.ServerHostname = "test.example.com"
+	}
+	if config.Limits == (SessionLimits{}) {
+		config.Limits = DefaultSessionLimits()
+	}
+	if config.Extensions == (ExtensionSet{}) {
+		config.Extensions = DefaultExtensions()
+	}
+	if config.Mailbox == nil {
+		config.Mailbox = &acceptAllMailbox{}
+	}
+
+	conn := WrapPipe(input, output)
+	engine := NewEngineWithConn(conn, config)
+	defer engine.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		engine.Run(ctx)
+	}()
+
+	readLine(output)
+
+	input.WriteString("EHLO client.example.com\r\n")
+	readMultiLine(output)
+
+	input.WriteString("MAIL FROM:<sender@example.com>\r\n")
+	readLine(output)
+
+	input.WriteString("RCPT TO:<recipient@example.com>\r\n")
+	readLine(output)
+
+	input.WriteString("DATA\r\n")
+	if resp := readLine(output); !strings.HasPrefix(resp, "354") {
+		t.Fatalf("expected 354 response to DATA, got: %s", resp)
+	}
+
+	input.WriteString("Subject: Test\r\n\r\nTest message.\r\n.\r\n")
+	resp := readLine(output)
+
+	input.WriteString("QUIT\r\n")
+	return resp
 }
 
 // TestEngineTLSRequired tests that TLS is enforced when required.
@@ -502,15 +737,20 @@ func (m *acceptAllMailbox) ValidateRecipient(ctx context.Context, recipient Mail
 	}
 }
 
-// failingStorage always fails to store messages.
-type failingStorage struct{}
+// failingStorage always fails to store messages, with err if set.
+type failingStorage struct {
+	err error
+}
 
 func (s *failingStorage) Store(ctx context.Context, envelope Envelope) (StorageReceipt, error) {
+	if s.err != nil {
+		return StorageReceipt{}, s.err
+	}
 	return StorageReceipt{}, errors.New("storage failure")
 }
 
 func (s *failingStorage) StoreStream(ctx context.Context, envelope Envelope, data io.Reader) (StorageReceipt, error) {
-	return StorageReceipt{}, errors.New("storage failure")
+	return s.Store(ctx, envelope)
 }
 
 // Helper functions
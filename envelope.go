@@ -2,6 +2,7 @@ package icesmtp
 
 import (
 	"io"
+	"sync"
 	"time"
 )
 
@@ -44,6 +45,10 @@ type Envelope interface {
 
 	// Metadata returns session metadata associated with this envelope.
 	Metadata() EnvelopeMetadata
+
+	// Headers returns the parsed RFC 5322 header block of the message.
+	// Returns nil if no data has been received.
+	Headers() *MessageHeaders
 }
 
 // EnvelopeID is a unique identifier for an envelope.
@@ -69,6 +74,10 @@ type EnvelopeMetadata struct {
 	// ClientIP is the IP address of the client.
 	ClientIP IPAddress
 
+	// ClientReverseDNS is the client's reverse DNS name, if it was looked
+	// up.
+	ClientReverseDNS ReverseDNS
+
 	// ServerHostname is this server's hostname.
 	ServerHostname Hostname
 
@@ -83,6 +92,17 @@ type EnvelopeMetadata struct {
 
 	// AuthenticatedUser is the username if authentication succeeded.
 	AuthenticatedUser Username
+
+	// Quarantined indicates a content filter asked for the message to be
+	// held rather than delivered.
+	Quarantined bool
+
+	// QuarantineReason is the reason given by the quarantining filter.
+	QuarantineReason string
+
+	// AuthResults are the results of message authentication checks such
+	// as SPF and DKIM, in the order they were made.
+	AuthResults []AuthResult
 }
 
 // SessionID is a unique identifier for an SMTP session.
@@ -125,6 +145,14 @@ type EnvelopeBuilder interface {
 	Build() Envelope
 }
 
+// EnvelopeHeaderSetter is implemented by envelope builders that accept
+// the header block parsed while DATA streams, so that the envelope does
+// not have to parse it again.
+type EnvelopeHeaderSetter interface {
+	// SetHeaders sets the parsed header block of the message.
+	SetHeaders(headers *MessageHeaders)
+}
+
 // EnvelopeFactory creates new envelope builders.
 type EnvelopeFactory interface {
 	// NewBuilder creates a new envelope builder with the given metadata.
@@ -141,6 +169,9 @@ type StandardEnvelope struct {
 	data       MessageData
 	finalized  bool
 	metadata   EnvelopeMetadata
+
+	headers     *MessageHeaders
+	headersOnce sync.Once
 }
 
 // ID returns the envelope identifier.
@@ -204,6 +235,17 @@ func (e *StandardEnvelope) Metadata() EnvelopeMetadata {
 	return e.metadata
 }
 
+// Headers returns the parsed header block. If headers were not set while
+// the data streamed, they are parsed from Data on first use.
+func (e *StandardEnvelope) Headers() *MessageHeaders {
+	e.headersOnce.Do(func() {
+		if e.headers == nil && e.data != nil {
+			e.headers = ParseHeaders(e.data, 0)
+		}
+	})
+	return e.headers
+}
+
 // RecipientStatus represents the acceptance status of a recipient.
 type RecipientStatus int
 
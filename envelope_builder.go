@@ -41,16 +41,34 @@ type StandardEnvelopeBuilder struct {
 	dataWriter  *envelopeDataWriter
 	finalized   bool
 	metadata    EnvelopeMetadata
+	headers     *MessageHeaders
+	idGenerator IDGenerator
 }
 
 // NewStandardEnvelopeBuilder creates a new envelope builder.
 func NewStandardEnvelopeBuilder(metadata EnvelopeMetadata) *StandardEnvelopeBuilder {
-	return &StandardEnvelopeBuilder{
-		id:         generateEnvelopeID(),
-		receivedAt: time.Now(),
-		metadata:   metadata,
-		recipients: make([]MailPath, 0),
+	return NewStandardEnvelopeBuilderWithIDs(metadata, nil)
+}
+
+// NewStandardEnvelopeBuilderWithIDs creates a new envelope builder that
+// takes envelope IDs from gen. If gen is nil, random IDs are used.
+func NewStandardEnvelopeBuilderWithIDs(metadata EnvelopeMetadata, gen IDGenerator) *StandardEnvelopeBuilder {
+	b := &StandardEnvelopeBuilder{
+		receivedAt:  time.Now(),
+		metadata:    metadata,
+		recipients:  make([]MailPath, 0),
+		idGenerator: gen,
+	}
+	b.id = b.newID()
+	return b
+}
+
+// newID returns a new envelope ID from the builder's generator.
+func (b *StandardEnvelopeBuilder) newID() EnvelopeID {
+	if b.idGenerator != nil {
+		return b.idGenerator.NewID()
 	}
+	return generateEnvelopeID()
 }
 
 // generateEnvelopeID creates a unique envelope identifier.
@@ -142,6 +160,7 @@ func (b *StandardEnvelopeBuilder) Finalize() (Envelope, error) {
 		data:        b.data.Bytes(),
 		finalized:   true,
 		metadata:    b.metadata,
+		headers:     b.headers,
 	}, nil
 }
 
@@ -150,7 +169,7 @@ func (b *StandardEnvelopeBuilder) Reset() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	b.id = generateEnvelopeID()
+	b.id = b.newID()
 	b.mailFrom = nil
 	b.recipients = make([]MailPath, 0)
 	b.esmtpParams = nil
@@ -158,6 +177,14 @@ func (b *StandardEnvelopeBuilder) Reset() {
 	b.data.Reset()
 	b.dataWriter = nil
 	b.finalized = false
+	b.headers = nil
+}
+
+// SetHeaders sets the parsed header block passed to the envelope.
+func (b *StandardEnvelopeBuilder) SetHeaders(headers *MessageHeaders) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.headers = headers
 }
 
 // Build returns the current envelope state without finalizing.
@@ -182,6 +209,7 @@ func (b *StandardEnvelopeBuilder) Build() Envelope {
 		data:        b.data.Bytes(),
 		finalized:   b.finalized,
 		metadata:    b.metadata,
+		headers:     b.headers,
 	}
 }
 
@@ -205,9 +233,12 @@ func (w *envelopeDataWriter) Close() error {
 }
 
 // StandardEnvelopeFactory is the default EnvelopeFactory implementation.
-type StandardEnvelopeFactory struct{}
+type StandardEnvelopeFactory struct {
+	// IDGenerator creates envelope IDs. If nil, random IDs are used.
+	IDGenerator IDGenerator
+}
 
 // NewBuilder creates a new envelope builder.
 func (f StandardEnvelopeFactory) NewBuilder(metadata EnvelopeMetadata) EnvelopeBuilder {
-	return NewStandardEnvelopeBuilder(metadata)
+	return NewStandardEnvelopeBuilderWithIDs(metadata, f.IDGenerator)
 }
@@ -0,0 +1,260 @@
+package icesmtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrFilterTimeout indicates a content filter did not finish within its
+// timeout.
+var ErrFilterTimeout = errors.New("content filter timed out")
+
+// ContentFilter inspects a complete message after DATA and before it is
+// stored, and decides whether it is accepted. Unlike SessionHooks.OnDataEnd,
+// a filter runs before the final reply and can change it.
+type ContentFilter interface {
+	// Filter inspects the envelope. An error is treated as a temporary
+	// failure unless the filter is configured to fail open in a
+	// FilterChain. Filter must return promptly once ctx is done, and
+	// must not use the envelope or session after it returns.
+	Filter(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error)
+}
+
+// ContentFilterFunc adapts a function to the ContentFilter interface.
+type ContentFilterFunc func(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error)
+
+// Filter calls f.
+func (f ContentFilterFunc) Filter(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error) {
+	return f(ctx, envelope, session)
+}
+
+// FilterAction is the decision of a content filter.
+type FilterAction int
+
+const (
+	// FilterAccept accepts the message, possibly modified.
+	FilterAccept FilterAction = iota
+
+	// FilterReject rejects the message permanently (5xx).
+	FilterReject
+
+	// FilterTempFail rejects the message temporarily (4xx).
+	FilterTempFail
+
+	// FilterDiscard replies as if the message was accepted but does not
+	// store it.
+	FilterDiscard
+
+	// FilterQuarantine stores the message marked as quarantined in
+	// EnvelopeMetadata.
+	FilterQuarantine
+)
+
+// String returns the action name.
+func (a FilterAction) String() string {
+	switch a {
+	case FilterAccept:
+		return "accept"
+	case FilterReject:
+		return "reject"
+	case FilterTempFail:
+		return "tempfail"
+	case FilterDiscard:
+		return "discard"
+	case FilterQuarantine:
+		return "quarantine"
+	default:
+		return "unknown"
+	}
+}
+
+// FilterResult is the outcome of a content filter.
+type FilterResult struct {
+	// Action is the filter's decision.
+	Action FilterAction
+
+	// Response is sent for FilterReject and FilterTempFail. If its Code
+	// is zero, a default response for the action is used.
+	Response Response
+
+	// Reason describes the decision for logs and quarantine metadata.
+	Reason string
+
+	// Envelope, if set, replaces the envelope passed to later filters and
+	// to storage. Use a ModifiedEnvelope to add headers, change
+	// recipients or replace the body.
+	Envelope Envelope
+}
+
+// FilterAccepted returns an accepting result.
+func FilterAccepted() FilterResult {
+	return FilterResult{Action: FilterAccept}
+}
+
+// FilterRejected returns a permanent rejection with a 554 5.7.1 response.
+func FilterRejected(text string) FilterResult {
+	return FilterResult{
+		Action:   FilterReject,
+		Response: NewEnhancedResponse(Reply554TransactionFailed, EnhancedStatusCode{Class: EnhancedPermanent, Subject: EnhancedSubjectPolicy, Detail: 1}, text),
+		Reason:   text,
+	}
+}
+
+// FilterTempFailed returns a temporary rejection with a 451 4.7.1
+// response.
+func FilterTempFailed(text string) FilterResult {
+	return FilterResult{
+		Action:   FilterTempFail,
+		Response: NewEnhancedResponse(Reply451LocalError, EnhancedStatusCode{Class: EnhancedPersistentTransient, Subject: EnhancedSubjectPolicy, Detail: 1}, text),
+		Reason:   text,
+	}
+}
+
+// response returns the SMTP response for a rejecting result.
+func (r FilterResult) response() Response {
+	if r.Response.Code != 0 {
+		return r.Response
+	}
+	if r.Action == FilterTempFail {
+		return FilterTempFailed("Message temporarily rejected, try again later").Response
+	}
+	return FilterRejected("Message content rejected").Response
+}
+
+// quarantine returns env marked as quarantined with reason.
+func quarantine(env Envelope, reason string) Envelope {
+	if env.Metadata().Quarantined {
+		return env
+	}
+	m, ok := env.(*ModifiedEnvelope)
+	if !ok {
+		m = NewModifiedEnvelope(env)
+	}
+	m.Quarantine(reason)
+	return m
+}
+
+// FilterOption configures a filter in a FilterChain.
+type FilterOption func(*chainedFilter)
+
+// WithFilterTimeout bounds the time a filter may take by the deadline of
+// the context passed to it. A filter that times out is treated as failed.
+func WithFilterTimeout(d time.Duration) FilterOption {
+	return func(f *chainedFilter) {
+		f.timeout = d
+	}
+}
+
+// WithFailOpen makes the chain skip a filter that fails or times out
+// instead of failing the message temporarily.
+func WithFailOpen() FilterOption {
+	return func(f *chainedFilter) {
+		f.failOpen = true
+	}
+}
+
+// WithFilterName names a filter in errors and logs.
+func WithFilterName(name string) FilterOption {
+	return func(f *chainedFilter) {
+		f.name = name
+	}
+}
+
+// chainedFilter is a filter with its chain options.
+type chainedFilter struct {
+	filter   ContentFilter
+	name     string
+	timeout  time.Duration
+	failOpen bool
+}
+
+// FilterChain runs content filters in order.
+//
+// Each filter sees the envelope as modified by the filters before it.
+// Reject, tempfail and discard stop the chain. Quarantine marks the
+// envelope and continues, so that a later filter can still reject.
+type FilterChain struct {
+	filters []chainedFilter
+}
+
+// NewFilterChain creates an empty filter chain.
+func NewFilterChain() *FilterChain {
+	return &FilterChain{}
+}
+
+// Add appends a filter to the chain and returns the chain.
+func (c *FilterChain) Add(filter ContentFilter, opts ...FilterOption) *FilterChain {
+	f := chainedFilter{
+		filter: filter,
+		name:   fmt.Sprintf("filter %d", len(c.filters)),
+	}
+	for _, opt := range opts {
+		opt(&f)
+	}
+	c.filters = append(c.filters, f)
+	return c
+}
+
+// Filter runs the chain.
+func (c *FilterChain) Filter(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error) {
+	current := envelope
+	modified := false
+	quarantined := false
+	var reason string
+
+	for _, f := range c.filters {
+		result, err := f.run(ctx, current, session)
+		if err != nil {
+			if f.failOpen {
+				continue
+			}
+			return FilterResult{}, fmt.Errorf("%s: %w", f.name, err)
+		}
+
+		if result.Envelope != nil {
+			current = result.Envelope
+			modified = true
+		}
+
+		switch result.Action {
+		case FilterReject, FilterTempFail, FilterDiscard:
+			return result, nil
+		case FilterQuarantine:
+			current = quarantine(current, result.Reason)
+			modified = true
+			quarantined = true
+			reason = result.Reason
+		}
+	}
+
+	result := FilterResult{Action: FilterAccept}
+	if quarantined {
+		result.Action = FilterQuarantine
+		result.Reason = reason
+	}
+	if modified {
+		result.Envelope = current
+	}
+	return result, nil
+}
+
+// run calls the filter with its timeout. The filter runs on the caller's
+// goroutine, so it is done with the envelope and session when run
+// returns; a result that arrives after the deadline is discarded.
+func (f *chainedFilter) run(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error) {
+	if f.timeout <= 0 {
+		return f.filter.Filter(ctx, envelope, session)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	result, err := f.filter.Filter(ctx, envelope, session)
+	if ctx.Err() != nil && parent.Err() == nil {
+		return FilterResult{}, ErrFilterTimeout
+	}
+	return result, err
+}
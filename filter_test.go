@@ -0,0 +1,161 @@
+package icesmtp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func buildTestEnvelope(t *testing.T, data string) Envelope {
+	t.Helper()
+	b := NewStandardEnvelopeBuilder(EnvelopeMetadata{})
+	b.SetMailFrom(MailPath{Address: "sender@example.com"}, nil)
+	b.AddRecipient(MailPath{Address: "a@example.com"})
+	b.AddRecipient(MailPath{Address: "b@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestModifiedEnvelope(t *testing.T) {
+	base := buildTestEnvelope(t, "Subject: hi\r\nX-Old: 1\r\nX-Old: 2\r\n  folded\r\n\r\nbody\r\n")
+
+	m := NewModifiedEnvelope(base)
+	if string(m.Data()) != string(base.Data()) {
+		t.Fatalf("unmodified data = %q", m.Data())
+	}
+
+	m.PrependHeader("Received", "from test")
+	m.AddHeader("X-New", "yes")
+	m.ChangeHeader("X-Old", 2, "")
+	m.ChangeHeader("subject", 1, "changed")
+	m.RemoveRecipient("A@example.com")
+	m.AddRecipient(MailPath{Address: "c@example.com"})
+	m.AddRecipient(MailPath{Address: "c@example.com"})
+
+	want := "Received: from test\r\nSubject: changed\r\nX-Old: 1\r\nX-New: yes\r\n\r\nbody\r\n"
+	if got := string(m.Data()); got != want {
+		t.Errorf("data = %q, want %q", got, want)
+	}
+	if m.Headers().Get("X-New") != "yes" {
+		t.Errorf("headers = %+v", m.Headers())
+	}
+	if rcpts := m.Recipients(); len(rcpts) != 2 || rcpts[0].Address != "b@example.com" || rcpts[1].Address != "c@example.com" {
+		t.Errorf("recipients = %+v", rcpts)
+	}
+
+	m.ReplaceBody([]byte("new body\r\n"))
+	if got := string(m.Data()); !strings.HasSuffix(got, "X-New: yes\r\n\r\nnew body\r\n") {
+		t.Errorf("data after ReplaceBody = %q", got)
+	}
+
+	if base.RecipientCount() != 2 || base.Headers().Get("Subject") != "hi" {
+		t.Error("base envelope was modified")
+	}
+}
+
+func TestFilterChain(t *testing.T) {
+	env := buildTestEnvelope(t, "Subject: hi\r\n\r\nbody\r\n")
+	ctx := context.Background()
+
+	tagger := ContentFilterFunc(func(ctx context.Context, env Envelope, s SessionInfo) (FilterResult, error) {
+		m := NewModifiedEnvelope(env)
+		m.PrependHeader("X-Tagged", "1")
+		return FilterResult{Action: FilterAccept, Envelope: m}, nil
+	})
+	quarantiner := ContentFilterFunc(func(ctx context.Context, env Envelope, s SessionInfo) (FilterResult, error) {
+		if !env.Headers().Has("X-Tagged") {
+			t.Error("later filter did not see the modified envelope")
+		}
+		return FilterResult{Action: FilterQuarantine, Reason: "suspicious"}, nil
+	})
+	var running atomic.Int32
+	slow := ContentFilterFunc(func(ctx context.Context, env Envelope, s SessionInfo) (FilterResult, error) {
+		running.Add(1)
+		defer running.Add(-1)
+		select {
+		case <-ctx.Done():
+			// Finish up after the deadline.
+			time.Sleep(10 * time.Millisecond)
+			return FilterResult{}, ctx.Err()
+		case <-time.After(time.Second):
+			return FilterRejected("too late"), nil
+		}
+	})
+
+	result, err := NewFilterChain().
+		Add(tagger).
+		Add(quarantiner).
+		Add(slow, WithFilterTimeout(10*time.Millisecond), WithFailOpen()).
+		Filter(ctx, env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Action != FilterQuarantine || result.Envelope == nil {
+		t.Fatalf("result = %+v", result)
+	}
+	md := result.Envelope.Metadata()
+	if !md.Quarantined || md.QuarantineReason != "suspicious" || !result.Envelope.Headers().Has("X-Tagged") {
+		t.Errorf("envelope metadata %+v, headers %+v", md, result.Envelope.Headers())
+	}
+
+	_, err = NewFilterChain().Add(slow, WithFilterTimeout(10*time.Millisecond), WithFilterName("slow")).Filter(ctx, env, nil)
+	if !errors.Is(err, ErrFilterTimeout) || !strings.Contains(err.Error(), "slow") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if running.Load() != 0 {
+		t.Error("timed out filter still running after the chain returned")
+	}
+}
+
+// TestEngineContentFilter tests that content filters decide the reply to DATA.
+func TestEngineContentFilter(t *testing.T) {
+	filter := func(result FilterResult) ContentFilter {
+		return ContentFilterFunc(func(ctx context.Context, env Envelope, s SessionInfo) (FilterResult, error) {
+			return result, nil
+		})
+	}
+
+	tests := []struct {
+		name       string
+		filter     ContentFilter
+		wantReply  string
+		wantStored bool
+	}{
+		{"accept", filter(FilterAccepted()), "250", true},
+		{"reject", filter(FilterRejected("Virus found")), "554 5.7.1 Virus found", false},
+		{"tempfail default", filter(FilterResult{Action: FilterTempFail}), "451 4.7.1", false},
+		{"discard", filter(FilterResult{Action: FilterDiscard}), "250", false},
+		{"quarantine", filter(FilterResult{Action: FilterQuarantine, Reason: "spam"}), "250", true},
+		{"error", ContentFilterFunc(func(ctx context.Context, env Envelope, s SessionInfo) (FilterResult, error) {
+			return FilterResult{}, errors.New("scanner down")
+		}), "451 4.3.0", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &envelopeCapture{}
+			resp := sendTestMessage(t, SessionConfig{
+				Storage:       storage,
+				ContentFilter: tt.filter,
+			})
+			if !strings.HasPrefix(resp, tt.wantReply) {
+				t.Errorf("expected %q reply, got: %s", tt.wantReply, resp)
+			}
+			if (storage.envelope != nil) != tt.wantStored {
+				t.Errorf("stored = %v, want %v", storage.envelope != nil, tt.wantStored)
+			}
+			if tt.name == "quarantine" && !storage.envelope.Metadata().Quarantined {
+				t.Error("stored envelope is not quarantined")
+			}
+		})
+	}
+}
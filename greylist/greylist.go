@@ -0,0 +1,255 @@
+// Package greylist implements greylisting: the first attempt to deliver
+// mail for a new (client network, sender, recipient) triplet is
+// temporarily refused, and accepted once the client retries after a
+// delay. Legitimate mail servers retry; most spam software does not.
+//
+// Policy implements icesmtp.SessionFilterFactory and greylists at RCPT
+// TO with 451 4.7.1. Clients whose triplets pass often enough are
+// whitelisted, so that their new triplets are not delayed. State is kept
+// in a Store: MemoryStore, or FileStore to survive restarts.
+//
+// To greylist alongside other session filters, such as helo.Policy,
+// dnsbl.Policy or a milter, combine them with icesmtp.SessionFilterChain.
+// Put greylisting after the checks that reject outright, so that clients
+// they refuse do not create triplets.
+package greylist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Status is the outcome of a greylisting check.
+type Status int
+
+// Statuses.
+const (
+	// Greylisted means the attempt is refused for now.
+	Greylisted Status = iota
+
+	// Passed means the triplet was retried after the delay.
+	Passed
+
+	// Whitelisted means the client has been whitelisted.
+	Whitelisted
+)
+
+// String returns the status name.
+func (s Status) String() string {
+	switch s {
+	case Greylisted:
+		return "greylisted"
+	case Passed:
+		return "passed"
+	case Whitelisted:
+		return "whitelisted"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Policy greylists recipients. It is safe for concurrent use.
+type Policy struct {
+	store Store
+
+	delay      time.Duration
+	retry      time.Duration
+	lifetime   time.Duration
+	whitelist  int
+	v4Prefix   int
+	v6Prefix   int
+	sweepEvery time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// Option configures a Policy.
+type Option func(*Policy)
+
+// WithDelay sets how long a client must wait before its retry is
+// accepted. Defaults to 5 minutes.
+func WithDelay(d time.Duration) Option {
+	return func(p *Policy) {
+		p.delay = d
+	}
+}
+
+// WithRetryWindow sets how long after the first attempt a retry is
+// accepted. A triplet that is not retried in time is forgotten and
+// greylisted again. Defaults to 24 hours.
+func WithRetryWindow(d time.Duration) Option {
+	return func(p *Policy) {
+		p.retry = d
+	}
+}
+
+// WithLifetime sets how long passed triplets and whitelisted clients are
+// remembered after they were last seen. Defaults to 35 days.
+func WithLifetime(d time.Duration) Option {
+	return func(p *Policy) {
+		p.lifetime = d
+	}
+}
+
+// WithAutoWhitelist whitelists a client once n of its triplets have
+// passed. Zero disables whitelisting. Defaults to 5.
+func WithAutoWhitelist(n int) Option {
+	return func(p *Policy) {
+		p.whitelist = n
+	}
+}
+
+// WithNetworkPrefix sets the prefix lengths that group client addresses
+// into networks, since mail servers often retry from another address in
+// the same pool. Defaults to /24 for IPv4 and /64 for IPv6.
+func WithNetworkPrefix(v4, v6 int) Option {
+	return func(p *Policy) {
+		p.v4Prefix = v4
+		p.v6Prefix = v6
+	}
+}
+
+// NewPolicy creates a Policy that keeps its state in store.
+func NewPolicy(store Store, opts ...Option) *Policy {
+	p := &Policy{
+		store:      store,
+		delay:      5 * time.Minute,
+		retry:      24 * time.Hour,
+		lifetime:   35 * 24 * time.Hour,
+		whitelist:  5,
+		v4Prefix:   24,
+		v6Prefix:   64,
+		sweepEvery: time.Hour,
+		now:        time.Now,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// network returns the client network of ip.
+func (p *Policy) network(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(p.v4Prefix, 32)), Mask: net.CIDRMask(p.v4Prefix, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(p.v6Prefix, 128)), Mask: net.CIDRMask(p.v6Prefix, 128)}).String()
+}
+
+// Check records an attempt to deliver mail from sender to recipient from
+// ip and returns its status. When the status is Greylisted, it also
+// returns how long the client must still wait.
+func (p *Policy) Check(ctx context.Context, ip net.IP, sender, recipient string) (Status, time.Duration, error) {
+	now := p.now()
+	p.sweep(ctx, now)
+
+	network := p.network(ip)
+	clientKey := "client " + network
+	if p.whitelist > 0 {
+		client, ok, err := p.store.Get(ctx, clientKey)
+		if err != nil {
+			return Passed, 0, err
+		}
+		if ok && client.Expires.After(now) && client.Count >= p.whitelist {
+			client.Expires = now.Add(p.lifetime)
+			return Whitelisted, 0, p.store.Put(ctx, clientKey, client)
+		}
+	}
+
+	key := "triplet " + network + " " + strings.ToLower(sender) + " " + strings.ToLower(recipient)
+	e, ok, err := p.store.Get(ctx, key)
+	if err != nil {
+		return Passed, 0, err
+	}
+	if !ok || !e.Expires.After(now) {
+		e = Entry{First: now, Expires: now.Add(p.retry)}
+	}
+	e.Count++
+
+	if e.Passed {
+		e.Expires = now.Add(p.lifetime)
+		return Passed, 0, p.store.Put(ctx, key, e)
+	}
+	if wait := e.First.Add(p.delay).Sub(now); wait > 0 {
+		return Greylisted, wait, p.store.Put(ctx, key, e)
+	}
+
+	e.Passed = true
+	e.Expires = now.Add(p.lifetime)
+	if err := p.store.Put(ctx, key, e); err != nil {
+		return Passed, 0, err
+	}
+	if p.whitelist > 0 {
+		client, ok, err := p.store.Get(ctx, clientKey)
+		if err != nil {
+			return Passed, 0, err
+		}
+		if !ok || !client.Expires.After(now) {
+			client = Entry{First: now}
+		}
+		client.Count++
+		client.Expires = now.Add(p.lifetime)
+		if err := p.store.Put(ctx, clientKey, client); err != nil {
+			return Passed, 0, err
+		}
+	}
+	return Passed, 0, nil
+}
+
+// sweep expires old entries at most once per sweepEvery.
+func (p *Policy) sweep(ctx context.Context, now time.Time) {
+	p.mu.Lock()
+	due := now.Sub(p.lastSweep) >= p.sweepEvery
+	if due {
+		p.lastSweep = now
+	}
+	p.mu.Unlock()
+	if due {
+		p.store.Expire(ctx, now)
+	}
+}
+
+// Ensure Policy implements the interface.
+var _ icesmtp.SessionFilterFactory = (*Policy)(nil)
+
+// NewSessionFilter returns a filter that greylists the session's
+// recipients.
+func (p *Policy) NewSessionFilter(ctx context.Context, session icesmtp.SessionInfo) (icesmtp.SessionFilter, error) {
+	return &sessionFilter{policy: p}, nil
+}
+
+// sessionFilter applies a Policy at RCPT TO.
+type sessionFilter struct {
+	icesmtp.NullSessionFilter
+	policy *Policy
+}
+
+// RcptTo defers a greylisted recipient with 451 4.7.1. Authenticated
+// sessions and clients without a known IP address are not greylisted,
+// and a store error lets the recipient through.
+func (f *sessionFilter) RcptTo(ctx context.Context, recipient icesmtp.MailPath, params icesmtp.ESMTPParams, session icesmtp.SessionInfo) icesmtp.PolicyResult {
+	ip := net.ParseIP(session.ClientIP())
+	if ip == nil || session.Authenticated() {
+		return icesmtp.PolicyAllowed()
+	}
+	var sender string
+	if from := session.CurrentMailFrom(); from != nil {
+		sender = from.Address
+	}
+
+	status, wait, err := f.policy.Check(ctx, ip, sender, recipient.Address)
+	if err != nil || status != Greylisted {
+		return icesmtp.PolicyAllowed()
+	}
+	seconds := int((wait + time.Second - 1) / time.Second)
+	return icesmtp.PolicyDeferred(icesmtp.NewEnhancedResponse(icesmtp.Reply451LocalError,
+		icesmtp.EnhancedStatusCode{Class: icesmtp.EnhancedPersistentTransient, Subject: icesmtp.EnhancedSubjectPolicy, Detail: 1},
+		fmt.Sprintf("Greylisted, please try again in %d seconds", seconds)), "greylisted")
+}
@@ -0,0 +1,232 @@
+package greylist
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/harness"
+	"github.com/iceisfun/icesmtp/helo"
+)
+
+// clock is a settable time source.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newPolicy(store Store, opts ...Option) (*Policy, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	p := NewPolicy(store, opts...)
+	p.now = c.now
+	return p, c
+}
+
+func TestCheck(t *testing.T) {
+	p, c := newPolicy(NewMemoryStore(), WithAutoWhitelist(2))
+	ctx := context.Background()
+	ip := net.ParseIP("192.0.2.10")
+
+	check := func(ip net.IP, sender, rcpt string, want Status) time.Duration {
+		t.Helper()
+		status, wait, err := p.Check(ctx, ip, sender, rcpt)
+		if err != nil || status != want {
+			t.Fatalf("Check(%s, %s, %s) = %v, %v, %v, want %v", ip, sender, rcpt, status, wait, err, want)
+		}
+		return wait
+	}
+
+	if wait := check(ip, "a@example.org", "x@example.com", Greylisted); wait != 5*time.Minute {
+		t.Errorf("wait = %v", wait)
+	}
+	c.advance(time.Minute)
+	if wait := check(ip, "a@example.org", "x@example.com", Greylisted); wait != 4*time.Minute {
+		t.Errorf("wait on early retry = %v", wait)
+	}
+
+	// The retry may come from another address in the network, and
+	// addresses are compared case-insensitively.
+	c.advance(4 * time.Minute)
+	check(net.ParseIP("192.0.2.99"), "A@example.org", "x@example.com", Passed)
+	check(ip, "a@example.org", "x@example.com", Passed)
+	check(net.ParseIP("192.0.3.10"), "a@example.org", "x@example.com", Greylisted)
+
+	// A second passed triplet whitelists the client.
+	check(ip, "b@example.org", "x@example.com", Greylisted)
+	c.advance(10 * time.Minute)
+	check(ip, "b@example.org", "x@example.com", Passed)
+	check(ip, "new@example.net", "y@example.com", Whitelisted)
+
+	// A triplet not retried within the window starts over.
+	check(net.ParseIP("2001:db8::1"), "a@example.org", "x@example.com", Greylisted)
+	c.advance(25 * time.Hour)
+	check(net.ParseIP("2001:db8::2"), "a@example.org", "x@example.com", Greylisted)
+}
+
+func TestExpire(t *testing.T) {
+	store := NewMemoryStore()
+	p, c := newPolicy(store, WithDelay(time.Minute), WithRetryWindow(time.Hour), WithLifetime(24*time.Hour))
+	ctx := context.Background()
+
+	p.Check(ctx, net.ParseIP("192.0.2.1"), "a@example.org", "x@example.com")
+	c.advance(2 * time.Minute)
+	p.Check(ctx, net.ParseIP("192.0.2.1"), "a@example.org", "x@example.com")
+	p.Check(ctx, net.ParseIP("198.51.100.1"), "a@example.org", "x@example.com")
+	if n := store.Len(); n != 3 {
+		t.Fatalf("entries = %d, want triplets and client", n)
+	}
+
+	// The unretried triplet expires after the retry window, the passed
+	// one and the client after their lifetime.
+	c.advance(2 * time.Hour)
+	p.Check(ctx, net.ParseIP("203.0.113.1"), "a@example.org", "x@example.com")
+	if n := store.Len(); n != 3 {
+		t.Errorf("entries after retry window = %d", n)
+	}
+	c.advance(24 * time.Hour)
+	store.Expire(ctx, c.now())
+	if n := store.Len(); n != 0 {
+		t.Errorf("entries after lifetime = %d", n)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.db")
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0).UTC()
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "a", Entry{First: now, Count: 1, Expires: now.Add(time.Hour)})
+	s.Put(ctx, "b", Entry{First: now, Count: 1, Expires: now.Add(time.Minute)})
+	s.Put(ctx, "a", Entry{First: now, Passed: true, Count: 2, Expires: now.Add(2 * time.Hour)})
+	s.Close()
+	if err := s.Put(ctx, "c", Entry{}); err != ErrClosed {
+		t.Errorf("Put after Close = %v", err)
+	}
+
+	// Simulate a torn write.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"key":"c","ent`)
+	f.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok, _ := s.Get(ctx, "a"); !ok || !e.Passed || e.Count != 2 || !e.Expires.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("a = %+v, %v", e, ok)
+	}
+	if _, ok, _ := s.Get(ctx, "c"); ok {
+		t.Error("torn record was loaded")
+	}
+	s.Put(ctx, "d", Entry{Expires: now.Add(time.Hour)})
+
+	if err := s.Expire(ctx, now.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(ctx, "e", Entry{Expires: now.Add(time.Hour)})
+
+	// A failed reopen after expiry is retried by the next Put rather
+	// than closing the store.
+	data, _ := os.ReadFile(path)
+	os.Remove(path)
+	if err := s.reopen(); err == nil {
+		t.Fatal("reopen of a missing file succeeded")
+	}
+	if err := s.Put(ctx, "f", Entry{Expires: now.Add(time.Minute)}); err == nil || err == ErrClosed {
+		t.Errorf("Put with the file missing = %v", err)
+	}
+	os.WriteFile(path, data, 0600)
+	if err := s.Put(ctx, "f", Entry{Expires: now.Add(time.Minute)}); err != nil {
+		t.Errorf("Put after the file is back = %v", err)
+	}
+	s.Close()
+
+	data, _ = os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 4 {
+		t.Errorf("file after Expire has %d lines:\n%s", lines, data)
+	}
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for key, want := range map[string]bool{"a": true, "b": false, "d": true, "e": true, "f": true} {
+		if _, ok, _ := s.Get(ctx, key); ok != want {
+			t.Errorf("%s present = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestSessionFilter(t *testing.T) {
+	p, c := newPolicy(NewMemoryStore())
+	ctx := context.Background()
+
+	deliver := func(rcpt string, want icesmtp.ReplyCode) string {
+		t.Helper()
+		h := harness.NewHarness(harness.WithClientIP("192.0.2.1"))
+		h.Config.SessionFilterFactory = p
+		h.Mailbox.AddDomain("example.com")
+		h.Mailbox.SetCatchAll(true)
+		h.Start(ctx)
+		defer h.Close()
+
+		h.Expect(220)
+		h.Send("EHLO client.example.org")
+		h.Expect(250)
+		h.Send("MAIL FROM:<a@example.org>")
+		h.Expect(250)
+		h.Send("RCPT TO:<" + rcpt + ">")
+		lines, err := h.Expect(want)
+		if err != nil {
+			t.Fatalf("RCPT TO:<%s>: expected %d: %v (%v)", rcpt, want, err, lines)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	if resp := deliver("x@example.com", 451); !strings.Contains(resp, "4.7.1 Greylisted, please try again in 300 seconds") {
+		t.Errorf("response = %q", resp)
+	}
+	c.advance(5 * time.Minute)
+	deliver("x@example.com", 250)
+}
+
+func TestSessionFilterChain(t *testing.T) {
+	p, _ := newPolicy(NewMemoryStore())
+	ctx := context.Background()
+
+	h := harness.NewHarness(harness.WithClientIP("192.0.2.1"), harness.WithServerHostname("mx.example.com"))
+	h.Config.SessionFilterFactory = icesmtp.SessionFilterChain(
+		helo.NewPolicy(helo.WithRequireFQDN()),
+		p,
+	)
+	h.Mailbox.AddDomain("example.com")
+	h.Mailbox.SetCatchAll(true)
+	h.Start(ctx)
+	defer h.Close()
+
+	expect := func(code icesmtp.ReplyCode) {
+		t.Helper()
+		if lines, err := h.Expect(code); err != nil {
+			t.Fatalf("expected %d: %v (%v)", code, err, lines)
+		}
+	}
+
+	expect(220)
+	h.Send("EHLO localhost")
+	expect(504)
+	h.Send("EHLO client.example.org")
+	expect(250)
+	h.Send("MAIL FROM:<a@example.org>")
+	expect(250)
+	h.Send("RCPT TO:<x@example.com>")
+	expect(451)
+}
@@ -0,0 +1,271 @@
+package greylist
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrClosed indicates use of a closed FileStore.
+var ErrClosed = errors.New("greylist: store closed")
+
+// Entry is the state of a triplet or a client.
+type Entry struct {
+	// First is when the triplet or client was first seen.
+	First time.Time `json:"first"`
+
+	// Passed reports whether a triplet has been retried after the delay.
+	Passed bool `json:"passed,omitempty"`
+
+	// Count is the number of attempts for a triplet, or the number of
+	// triplets that passed for a client.
+	Count int `json:"count"`
+
+	// Expires is when the entry is forgotten.
+	Expires time.Time `json:"expires"`
+}
+
+// Store holds greylisting state. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Get returns the entry for key. Expired entries may still be
+	// returned until Expire removes them.
+	Get(ctx context.Context, key string) (Entry, bool, error)
+
+	// Put sets the entry for key.
+	Put(ctx context.Context, key string, e Entry) error
+
+	// Expire removes the entries that expire at or before now.
+	Expire(ctx context.Context, now time.Time) error
+}
+
+// MemoryStore is a Store held in memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]Entry{}}
+}
+
+// Ensure MemoryStore implements the interface.
+var _ Store = (*MemoryStore)(nil)
+
+// Get returns the entry for key.
+func (s *MemoryStore) Get(ctx context.Context, key string) (Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return e, ok, nil
+}
+
+// Put sets the entry for key.
+func (s *MemoryStore) Put(ctx context.Context, key string, e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = e
+	return nil
+}
+
+// Expire removes the entries that expire at or before now.
+func (s *MemoryStore) Expire(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, e := range s.entries {
+		if !e.Expires.After(now) {
+			delete(s.entries, k)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// FileStore is a Store kept in memory and persisted to a file, so that
+// greylisting state survives restarts.
+//
+// The file holds one JSON record per line. Put appends a record, later
+// records overriding earlier ones, and Expire rewrites the file with only
+// the live entries.
+type FileStore struct {
+	MemoryStore
+
+	path   string
+	f      *os.File
+	closed bool
+}
+
+// record is a line of a FileStore file.
+type record struct {
+	Key   string `json:"key"`
+	Entry Entry  `json:"entry"`
+}
+
+// OpenFileStore opens or creates the store file at path and loads its
+// entries. Lines that cannot be parsed, such as one torn by a crash, are
+// skipped.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: MemoryStore{entries: map[string]Entry{}},
+		path:        path,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the file into memory and opens it for appending.
+func (s *FileStore) load() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r record
+		if json.Unmarshal(sc.Bytes(), &r) == nil && r.Key != "" {
+			s.entries[r.Key] = r.Entry
+		}
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return fmt.Errorf("greylist: read %s: %w", s.path, err)
+	}
+
+	// End a torn last line so the next record starts on its own line.
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+			f.Close()
+			return err
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	s.f = f
+	return nil
+}
+
+// Ensure FileStore implements the interface.
+var _ Store = (*FileStore)(nil)
+
+// Put sets the entry for key and appends it to the file.
+func (s *FileStore) Put(ctx context.Context, key string, e Entry) error {
+	line, err := json.Marshal(record{Key: key, Entry: e})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.f == nil {
+		// A reopen after expiry failed; try again.
+		if err := s.reopen(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.entries[key] = e
+	return nil
+}
+
+// Expire removes the entries that expire at or before now and rewrites
+// the file with the rest.
+func (s *FileStore) Expire(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for k, e := range s.entries {
+		if !e.Expires.After(now) {
+			delete(s.entries, k)
+		}
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for k, e := range s.entries {
+		if err = enc.Encode(record{Key: k, Entry: e}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if s.f != nil {
+		s.f.Close()
+	}
+	return s.reopen()
+}
+
+// reopen opens the rewritten file for appending. On failure s.f is left
+// nil and the next Put tries again.
+func (s *FileStore) reopen() error {
+	s.f = nil
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("greylist: reopen %s: %w", s.path, err)
+	}
+	s.f = f
+	return nil
+}
+
+// Close closes the file.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
@@ -43,6 +43,9 @@ type Harness struct {
 	// Errors collects any errors that occurred.
 	Errors []error
 
+	// clientIP is the client address reported to the engine.
+	clientIP icesmtp.IPAddress
+
 	mu sync.Mutex
 }
 
@@ -56,6 +59,14 @@ func WithServerHostname(hostname icesmtp.Hostname) HarnessOption {
 	}
 }
 
+// WithClientIP sets the client IP address the engine reports to
+// policies.
+func WithClientIP(ip icesmtp.IPAddress) HarnessOption {
+	return func(h *Harness) {
+		h.clientIP = ip
+	}
+}
+
 // WithMailbox sets the mailbox implementation.
 func WithMailbox(mailbox icesmtp.Mailbox) HarnessOption {
 	return func(h *Harness) {
@@ -130,7 +141,7 @@ func NewHarness(opts ...HarnessOption) *Harness {
 func (h *Harness) Start(ctx context.Context) {
 	// Create a PipeConn with deadline support
 	conn := icesmtp.WrapPipe(h.Input, h.Output)
-	h.Engine = icesmtp.NewEngineWithConn(conn, h.Config)
+	h.Engine = icesmtp.NewEngineWithConn(conn, h.Config, h.engineOptions()...)
 
 	go func() {
 		if err := h.Engine.Run(ctx); err != nil && err != context.Canceled {
@@ -146,7 +157,7 @@ func (h *Harness) Start(ctx context.Context) {
 func (h *Harness) StartWithTLS(ctx context.Context, tlsUpgrader func(*crypto_tls.Config) (io.Reader, io.Writer, icesmtp.TLSConnectionState, error)) {
 	conn := icesmtp.WrapPipe(h.Input, h.Output)
 	conn.SetTLSUpgrader(tlsUpgrader)
-	h.Engine = icesmtp.NewEngineWithConn(conn, h.Config)
+	h.Engine = icesmtp.NewEngineWithConn(conn, h.Config, h.engineOptions()...)
 
 	go func() {
 		if err := h.Engine.Run(ctx); err != nil && err != context.Canceled {
@@ -157,6 +168,14 @@ func (h *Harness) StartWithTLS(ctx context.Context, tlsUpgrader func(*crypto_tls
 	}()
 }
 
+// engineOptions returns the options for the engine under test.
+func (h *Harness) engineOptions() []icesmtp.EngineOption {
+	if h.clientIP == "" {
+		return nil
+	}
+	return []icesmtp.EngineOption{icesmtp.WithClientIP(h.clientIP)}
+}
+
 // Send sends a command line to the server.
 // The CRLF terminator is added automatically.
 func (h *Harness) Send(line string) {
@@ -0,0 +1,242 @@
+package icesmtp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// HeaderField is a single RFC 5322 header field.
+type HeaderField struct {
+	// Name is the field name as it appeared, e.g. "Subject".
+	Name string
+
+	// Value is the unfolded field body with surrounding whitespace
+	// removed.
+	Value string
+
+	// Raw is the exact bytes of the field, including folding and the
+	// trailing line ending.
+	Raw []byte
+}
+
+// MessageHeaders is the parsed header block of a message.
+// A nil *MessageHeaders behaves as an empty header block.
+type MessageHeaders struct {
+	// Fields are the header fields in message order.
+	Fields []HeaderField
+
+	// Size is the number of bytes of the header block that were parsed.
+	Size int64
+
+	// Truncated indicates the header block exceeded the size limit and
+	// later fields were not parsed.
+	Truncated bool
+
+	// Malformed is the number of lines in the header block that were not
+	// valid header fields and were skipped.
+	Malformed int
+}
+
+// Get returns the value of the first field with the given name,
+// compared case-insensitively, or "" if there is none.
+func (h *MessageHeaders) Get(name string) string {
+	if h == nil {
+		return ""
+	}
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Values returns the values of all fields with the given name, in order.
+func (h *MessageHeaders) Values(name string) []string {
+	if h == nil {
+		return nil
+	}
+	var values []string
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Has reports whether a field with the given name is present.
+func (h *MessageHeaders) Has(name string) bool {
+	if h == nil {
+		return false
+	}
+	for _, f := range h.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of fields.
+func (h *MessageHeaders) Len() int {
+	if h == nil {
+		return 0
+	}
+	return len(h.Fields)
+}
+
+// HeaderParser incrementally parses the header block of a message fed to
+// it one line at a time, so that headers are available without buffering
+// the body.
+//
+// Parsing is tolerant: bare LF line endings are accepted, whitespace
+// before the colon is ignored, and lines with an invalid field name or a
+// continuation line with no preceding field are counted as malformed and
+// skipped. A line without a colon is taken as the start of the body.
+type HeaderParser struct {
+	maxSize int64
+	headers MessageHeaders
+	pending []byte
+	done    bool
+}
+
+// NewHeaderParser creates a parser that stops after maxSize bytes of
+// header block (0 = unlimited).
+func NewHeaderParser(maxSize int64) *HeaderParser {
+	return &HeaderParser{maxSize: maxSize}
+}
+
+// Feed parses one line, including its line ending. Lines fed after the
+// header block has ended are ignored.
+func (p *HeaderParser) Feed(line []byte) {
+	if p.done {
+		return
+	}
+
+	content := bytes.TrimRight(line, "\r\n")
+	if len(content) == 0 {
+		p.finish()
+		return
+	}
+
+	if p.maxSize > 0 && p.headers.Size+int64(len(line)) > p.maxSize {
+		p.headers.Truncated = true
+		p.finish()
+		return
+	}
+	p.headers.Size += int64(len(line))
+
+	// Continuation of the previous field
+	if content[0] == ' ' || content[0] == '\t' {
+		if p.pending == nil {
+			p.headers.Malformed++
+			return
+		}
+		p.pending = append(p.pending, line...)
+		return
+	}
+
+	p.flush()
+
+	colon := bytes.IndexByte(content, ':')
+	if colon < 0 {
+		// Not a header field: the body started without a blank line
+		p.headers.Malformed++
+		p.finish()
+		return
+	}
+	if !validFieldName(bytes.TrimRight(content[:colon], " \t")) {
+		p.headers.Malformed++
+		return
+	}
+
+	p.pending = append([]byte(nil), line...)
+}
+
+// Done reports whether the end of the header block has been reached.
+func (p *HeaderParser) Done() bool {
+	return p.done
+}
+
+// Finish ends the header block, e.g. when the message ended without a
+// body. It is safe to call more than once.
+func (p *HeaderParser) Finish() {
+	p.finish()
+}
+
+// Headers returns the parsed header block. Once Done, the same value is
+// returned on every call; before that, a snapshot of the fields parsed so
+// far is returned.
+func (p *HeaderParser) Headers() *MessageHeaders {
+	if p.done {
+		return &p.headers
+	}
+	h := p.headers
+	if p.pending != nil {
+		h.Fields = append(h.Fields[:len(h.Fields):len(h.Fields)], parseField(p.pending))
+	}
+	return &h
+}
+
+func (p *HeaderParser) finish() {
+	p.flush()
+	p.done = true
+}
+
+// flush appends the pending field.
+func (p *HeaderParser) flush() {
+	if p.pending == nil {
+		return
+	}
+	p.headers.Fields = append(p.headers.Fields, parseField(p.pending))
+	p.pending = nil
+}
+
+// parseField splits a raw field into name and unfolded value.
+func parseField(raw []byte) HeaderField {
+	colon := bytes.IndexByte(raw, ':')
+	name := bytes.TrimRight(raw[:colon], " \t")
+
+	// Unfolding removes line endings; the whitespace that follows them
+	// is kept (RFC 5322 Section 2.2.3).
+	value := raw[colon+1:]
+	value = bytes.ReplaceAll(value, []byte("\r\n"), nil)
+	value = bytes.ReplaceAll(value, []byte("\n"), nil)
+
+	return HeaderField{
+		Name:  string(name),
+		Value: strings.TrimSpace(string(value)),
+		Raw:   raw,
+	}
+}
+
+// validFieldName reports whether name consists of printable US-ASCII
+// characters other than colon (RFC 5322 Section 2.2).
+func validFieldName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseHeaders parses the header block at the start of data.
+// maxSize limits the parsed header bytes (0 = unlimited).
+func ParseHeaders(data []byte, maxSize int64) *MessageHeaders {
+	p := NewHeaderParser(maxSize)
+	for len(data) > 0 && !p.Done() {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			end = len(data) - 1
+		}
+		p.Feed(data[:end+1])
+		data = data[end+1:]
+	}
+	p.Finish()
+	return p.Headers()
+}
@@ -0,0 +1,109 @@
+package icesmtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	data := []byte("From: Alice <alice@example.org>\r\n" +
+		"Subject: a long\r\n" +
+		"\tfolded subject\r\n" +
+		"Received: one\r\n" +
+		"Received: two\n" +
+		"Bad Name: skipped\r\n" +
+		"Message-ID : <id@example.org>\r\n" +
+		"\r\n" +
+		"Body: not a header\r\n")
+
+	h := ParseHeaders(data, 0)
+	if h.Len() != 5 {
+		t.Fatalf("got %d fields: %+v", h.Len(), h.Fields)
+	}
+	if got := h.Get("subject"); got != "a long\tfolded subject" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := h.Values("Received"); len(got) != 2 || got[1] != "two" {
+		t.Errorf("Received = %q", got)
+	}
+	if got := h.Get("Message-Id"); got != "<id@example.org>" {
+		t.Errorf("Message-ID = %q", got)
+	}
+	if h.Has("Body") || h.Malformed != 1 || h.Truncated {
+		t.Errorf("unexpected state: %+v", h)
+	}
+	if string(h.Fields[1].Raw) != "Subject: a long\r\n\tfolded subject\r\n" {
+		t.Errorf("raw Subject = %q", h.Fields[1].Raw)
+	}
+}
+
+func TestParseHeaders_Tolerance(t *testing.T) {
+	t.Run("size limit", func(t *testing.T) {
+		h := ParseHeaders([]byte("A: 1\r\nB: 2\r\nC: 3\r\n\r\n"), 12)
+		if !h.Truncated || h.Len() != 2 || h.Get("C") != "" {
+			t.Errorf("unexpected result: %+v", h)
+		}
+	})
+
+	t.Run("body without separator", func(t *testing.T) {
+		h := ParseHeaders([]byte("Subject: x\r\nhello world\r\nTo: y\r\n"), 0)
+		if h.Len() != 1 || h.Has("To") || h.Malformed != 1 {
+			t.Errorf("unexpected result: %+v", h)
+		}
+	})
+
+	t.Run("leading continuation and no final newline", func(t *testing.T) {
+		h := ParseHeaders([]byte(" stray\r\nSubject: x"), 0)
+		if h.Get("Subject") != "x" || h.Malformed != 1 {
+			t.Errorf("unexpected result: %+v", h)
+		}
+	})
+
+	t.Run("nil headers", func(t *testing.T) {
+		var h *MessageHeaders
+		if h.Get("Subject") != "" || h.Has("Subject") || h.Len() != 0 || h.Values("A") != nil {
+			t.Error("nil headers should be empty")
+		}
+	})
+}
+
+// TestEngineHeaders tests that headers are parsed while DATA streams.
+func TestEngineHeaders(t *testing.T) {
+	hooks := &headerHooks{}
+	storage := &envelopeCapture{}
+	resp := sendTestMessage(t, SessionConfig{
+		Storage: storage,
+		Hooks:   hooks,
+	})
+	if !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250 response, got: %s", resp)
+	}
+	if hooks.headers.Get("Subject") != "Test" {
+		t.Errorf("OnHeaders got %+v", hooks.headers)
+	}
+	if storage.envelope.Headers() != hooks.headers {
+		t.Error("envelope should carry the headers parsed while streaming")
+	}
+}
+
+// headerHooks records the headers passed to OnHeaders.
+type headerHooks struct {
+	NullSessionHooks
+	headers *MessageHeaders
+}
+
+func (h *headerHooks) OnHeaders(ctx context.Context, headers *MessageHeaders, session SessionInfo) {
+	h.headers = headers
+}
+
+// envelopeCapture is a NullStorage that keeps the last stored envelope.
+type envelopeCapture struct {
+	NullStorage
+	envelope Envelope
+}
+
+func (s *envelopeCapture) Store(ctx context.Context, envelope Envelope) (StorageReceipt, error) {
+	s.envelope = envelope
+	return s.NullStorage.Store(ctx, envelope)
+}
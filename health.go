@@ -0,0 +1,107 @@
+package icesmtp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStorageUnavailable indicates a session was refused because storage
+// is reported unhealthy.
+var ErrStorageUnavailable = errors.New("storage unavailable")
+
+// LoadShedMode selects where the engine refuses work while storage is
+// unhealthy.
+type LoadShedMode int
+
+const (
+	// ShedAtMail rejects MAIL FROM with 451 4.3.0. Connections are still
+	// accepted so that clients can finish other commands.
+	ShedAtMail LoadShedMode = iota
+
+	// ShedAtConnect greets new connections with 421 4.3.0 and closes
+	// them. Sessions that are already open reject MAIL FROM as with
+	// ShedAtMail.
+	ShedAtConnect
+)
+
+// HealthMonitor periodically probes a storage backend and caches the
+// result, so that sessions can check storage health without waiting on
+// the backend. A single monitor is typically shared by all sessions of a
+// server via SessionConfig.StorageHealth.
+type HealthMonitor struct {
+	storage  StorageWithHealth
+	interval time.Duration
+	timeout  time.Duration
+
+	mu        sync.RWMutex
+	err       error
+	checkedAt time.Time
+}
+
+// NewHealthMonitor creates a monitor that probes storage every interval.
+// Each probe is bounded by timeout; if timeout is zero, interval is used.
+// Storage is considered healthy until the first probe completes.
+func NewHealthMonitor(storage StorageWithHealth, interval, timeout time.Duration) *HealthMonitor {
+	if timeout == 0 {
+		timeout = interval
+	}
+	return &HealthMonitor{
+		storage:  storage,
+		interval: interval,
+		timeout:  timeout,
+	}
+}
+
+// Run probes storage immediately and then every interval until ctx is
+// cancelled.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check probes storage now, records the result and returns it.
+func (m *HealthMonitor) Check(ctx context.Context) error {
+	probeCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	err := m.storage.Healthy(probeCtx)
+
+	m.mu.Lock()
+	m.err = err
+	m.checkedAt = time.Now()
+	m.mu.Unlock()
+
+	return err
+}
+
+// Err returns the result of the last probe.
+func (m *HealthMonitor) Err() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.err
+}
+
+// Healthy reports whether the last probe succeeded.
+func (m *HealthMonitor) Healthy() bool {
+	return m.Err() == nil
+}
+
+// CheckedAt returns the time of the last probe, or the zero time if
+// storage has not been probed yet.
+func (m *HealthMonitor) CheckedAt() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.checkedAt
+}
@@ -0,0 +1,114 @@
+package icesmtp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unhealthyStorage is a NullStorage that reports err from Healthy.
+type unhealthyStorage struct {
+	NullStorage
+	err error
+}
+
+func (s *unhealthyStorage) Healthy(ctx context.Context) error { return s.err }
+
+func TestHealthMonitor(t *testing.T) {
+	storage := &unhealthyStorage{}
+	monitor := NewHealthMonitor(storage, time.Millisecond, 0)
+	if !monitor.Healthy() || !monitor.CheckedAt().IsZero() {
+		t.Fatal("monitor should start healthy and unprobed")
+	}
+
+	storage.err = errors.New("disk full")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		monitor.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for monitor.Healthy() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if monitor.Err() == nil {
+		t.Fatal("monitor did not observe unhealthy storage")
+	}
+}
+
+func TestEngineLoadShedding(t *testing.T) {
+	unhealthy := func() *HealthMonitor {
+		m := NewHealthMonitor(&unhealthyStorage{err: errors.New("down")}, time.Minute, 0)
+		m.Check(context.Background())
+		return m
+	}
+
+	t.Run("at mail", func(t *testing.T) {
+		input := newTestPipeBuffer()
+		output := newTestPipeBuffer()
+
+		config := SessionConfig{
+			ServerHostname: "test.example.com",
+			Limits:         DefaultSessionLimits(),
+			Extensions:     DefaultExtensions(),
+			Mailbox:        &acceptAllMailbox{},
+			Storage:        NullStorage{},
+			StorageHealth:  unhealthy(),
+		}
+
+		engine := NewEngineWithConn(WrapPipe(input, output), config)
+		defer engine.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		go func() {
+			engine.Run(ctx)
+		}()
+
+		if resp := readLine(output); !strings.HasPrefix(resp, "220") {
+			t.Fatalf("expected 220 greeting, got: %s", resp)
+		}
+
+		input.WriteString("EHLO client.example.com\r\n")
+		readMultiLine(output)
+
+		input.WriteString("MAIL FROM:<sender@example.com>\r\n")
+		if resp := readLine(output); !strings.HasPrefix(resp, "451 4.3.0") {
+			t.Errorf("expected 451 4.3.0 response to MAIL, got: %s", resp)
+		}
+
+		input.WriteString("QUIT\r\n")
+	})
+
+	t.Run("at connect", func(t *testing.T) {
+		input := newTestPipeBuffer()
+		output := newTestPipeBuffer()
+
+		config := SessionConfig{
+			ServerHostname: "test.example.com",
+			Limits:         DefaultSessionLimits(),
+			Storage:        NullStorage{},
+			StorageHealth:  unhealthy(),
+			LoadShedding:   ShedAtConnect,
+		}
+
+		engine := NewEngineWithConn(WrapPipe(input, output), config)
+
+		err := engine.Run(context.Background())
+		if !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("expected ErrStorageUnavailable, got %v", err)
+		}
+		if resp := readLine(output); !strings.HasPrefix(resp, "421 4.3.0") {
+			t.Errorf("expected 421 4.3.0 greeting, got: %s", resp)
+		}
+	})
+}
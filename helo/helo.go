@@ -0,0 +1,206 @@
+// Package helo checks the hostname clients give in HELO and EHLO.
+//
+// Policy implements icesmtp.SessionFilterFactory and rejects the greeting
+// when a check fails. Each check is enabled by an option; with none, every
+// name that icesmtp.ParseHeloHostname accepts is allowed. Replies follow
+// Postfix's reject_invalid_helo_hostname, reject_non_fqdn_helo_hostname
+// and reject_unknown_helo_hostname.
+//
+// To check HELO names alongside other session filters, such as
+// dnsbl.Policy, greylisting or a milter, combine them with
+// icesmtp.SessionFilterChain.
+package helo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Resolver looks up address and MX records. *net.Resolver implements it.
+// A name with no records must be reported as a *net.DNSError with
+// IsNotFound set.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Policy checks HELO and EHLO hostnames.
+type Policy struct {
+	rejectBareIP bool
+	requireFQDN  bool
+	ownNames     []string
+	resolver     Resolver
+}
+
+// Option configures a Policy.
+type Option func(*Policy)
+
+// WithRejectBareIP rejects an IPv4 address given without the brackets of
+// an address literal, e.g. "192.0.2.1" instead of "[192.0.2.1]", with
+// 501 5.5.2.
+func WithRejectBareIP() Option {
+	return func(p *Policy) {
+		p.rejectBareIP = true
+	}
+}
+
+// WithRejectOwnName rejects clients that greet with one of this server's
+// names or address literals, as spam software often does, with 550
+// 5.7.1. Names are compared case-insensitively; a literal such as
+// "[192.0.2.25]" matches the equivalent address however it is written.
+func WithRejectOwnName(names ...string) Option {
+	return func(p *Policy) {
+		p.ownNames = append(p.ownNames, names...)
+	}
+}
+
+// WithRequireFQDN rejects names that are not fully qualified, such as
+// "localhost" or "mail", with 504 5.5.2. Address literals are allowed.
+func WithRequireFQDN() Option {
+	return func(p *Policy) {
+		p.requireFQDN = true
+	}
+}
+
+// WithRequireResolvable rejects names with no A, AAAA or MX record with
+// 550 5.7.1, looking them up with resolver, or net.DefaultResolver if
+// resolver is nil. A lookup that fails temporarily defers the greeting
+// with 450 4.7.1. Address literals are not looked up.
+func WithRequireResolvable(resolver Resolver) Option {
+	return func(p *Policy) {
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		p.resolver = resolver
+	}
+}
+
+// NewPolicy creates a Policy with the given checks.
+func NewPolicy(opts ...Option) *Policy {
+	p := &Policy{}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Check returns the decision for hostname.
+func (p *Policy) Check(ctx context.Context, hostname icesmtp.Hostname) icesmtp.PolicyResult {
+	literal := strings.HasPrefix(hostname, "[")
+	name := strings.ToLower(strings.TrimSuffix(hostname, "."))
+
+	if p.rejectBareIP && !literal && net.ParseIP(name) != nil {
+		return reject(icesmtp.PolicyDeny, icesmtp.Reply501SyntaxErrorParams, icesmtp.EnhancedSubjectDelivery, 2,
+			hostname, "Invalid name, use an address literal", "bare IP address")
+	}
+	for _, own := range p.ownNames {
+		if sameName(name, own) {
+			return reject(icesmtp.PolicyDeny, icesmtp.Reply550MailboxUnavailable, icesmtp.EnhancedSubjectPolicy, 1,
+				hostname, "You are not me", "own hostname")
+		}
+	}
+	if literal {
+		return icesmtp.PolicyAllowed()
+	}
+	if p.requireFQDN && !fullyQualified(name) {
+		return reject(icesmtp.PolicyDeny, icesmtp.Reply504ParamNotImplemented, icesmtp.EnhancedSubjectDelivery, 2,
+			hostname, "need fully-qualified hostname", "not fully qualified")
+	}
+	if p.resolver != nil && net.ParseIP(name) == nil {
+		switch err := p.resolve(ctx, name); {
+		case err == nil:
+		case isNotFound(err):
+			return reject(icesmtp.PolicyDeny, icesmtp.Reply550MailboxUnavailable, icesmtp.EnhancedSubjectPolicy, 1,
+				hostname, "Host not found", "host not found")
+		default:
+			return reject(icesmtp.PolicyDefer, icesmtp.Reply450MailboxUnavailable, icesmtp.EnhancedSubjectPolicy, 1,
+				hostname, "Host not found, try again later", err.Error())
+		}
+	}
+	return icesmtp.PolicyAllowed()
+}
+
+// resolve looks up the addresses of name, then its MX records.
+func (p *Policy) resolve(ctx context.Context, name string) error {
+	_, err := p.resolver.LookupIP(ctx, "ip", name)
+	if err == nil || !isNotFound(err) {
+		return err
+	}
+	_, err = p.resolver.LookupMX(ctx, name)
+	return err
+}
+
+// sameName reports whether a HELO name, lowercased and without a trailing
+// dot, is own. Address literals are compared by address.
+func sameName(name, own string) bool {
+	own = strings.ToLower(strings.TrimSuffix(own, "."))
+	if strings.HasPrefix(name, "[") && strings.HasPrefix(own, "[") {
+		a, b := literalIP(name), literalIP(own)
+		return a != nil && a.Equal(b)
+	}
+	return name == own
+}
+
+// literalIP returns the address of an address literal such as
+// "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+func literalIP(literal string) net.IP {
+	s := strings.TrimSuffix(strings.TrimPrefix(literal, "["), "]")
+	if len(s) > 5 && strings.EqualFold(s[:5], "ipv6:") {
+		s = s[5:]
+	}
+	return net.ParseIP(s)
+}
+
+// fullyQualified reports whether name has at least two labels and a top
+// level label that is not numeric.
+func fullyQualified(name string) bool {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 || i == len(name)-1 {
+		return false
+	}
+	return strings.Trim(name[i+1:], "0123456789") != ""
+}
+
+// isNotFound reports whether err means the name has no records.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// reject builds a rejection in Postfix's "<name>: Helo command rejected:
+// text" form.
+func reject(d icesmtp.PolicyDecision, code icesmtp.ReplyCode, subject icesmtp.EnhancedStatusSubject, detail icesmtp.EnhancedStatusDetail, hostname, text, reason string) icesmtp.PolicyResult {
+	class := icesmtp.EnhancedPermanent
+	if d == icesmtp.PolicyDefer {
+		class = icesmtp.EnhancedPersistentTransient
+	}
+	resp := icesmtp.NewEnhancedResponse(code,
+		icesmtp.EnhancedStatusCode{Class: class, Subject: subject, Detail: detail},
+		fmt.Sprintf("<%s>: Helo command rejected: %s", hostname, text))
+	return icesmtp.PolicyResult{Decision: d, Response: resp, Reason: reason}
+}
+
+// Ensure Policy implements the interface.
+var _ icesmtp.SessionFilterFactory = (*Policy)(nil)
+
+// NewSessionFilter returns a filter that checks the session's HELO and
+// EHLO names.
+func (p *Policy) NewSessionFilter(ctx context.Context, session icesmtp.SessionInfo) (icesmtp.SessionFilter, error) {
+	return sessionFilter{policy: p}, nil
+}
+
+// sessionFilter applies a Policy at HELO and EHLO.
+type sessionFilter struct {
+	icesmtp.NullSessionFilter
+	policy *Policy
+}
+
+// Helo checks hostname.
+func (f sessionFilter) Helo(ctx context.Context, hostname icesmtp.Hostname, session icesmtp.SessionInfo) icesmtp.PolicyResult {
+	return f.policy.Check(ctx, hostname)
+}
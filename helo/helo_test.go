@@ -0,0 +1,118 @@
+package helo
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/dnsbl"
+	"github.com/iceisfun/icesmtp/harness"
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+)
+
+func TestCheck(t *testing.T) {
+	r := &dnstest.Resolver{
+		IP:     map[string][]string{"mail.example.org": {"192.0.2.1"}},
+		MX:     map[string][]string{"example.net": {"mx.example.net"}},
+		Errors: map[string]error{"slow.example.org": dnstest.Temporary("slow.example.org")},
+	}
+	p := NewPolicy(WithRejectBareIP(), WithRequireFQDN(), WithRequireResolvable(r),
+		WithRejectOwnName("mx.example.com", "[192.0.2.25]", "[IPv6:2001:db8::25]"))
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{"mail.example.org", ""},
+		{"Mail.Example.Org.", ""},
+		{"example.net", ""},
+		{"[192.0.2.1]", ""},
+		{"[IPv6:2001:db8::1]", ""},
+		{"192.0.2.1", "501 5.5.2 <192.0.2.1>: Helo command rejected: Invalid name, use an address literal"},
+		{"MX.example.com", "550 5.7.1 <MX.example.com>: Helo command rejected: You are not me"},
+		{"[192.0.2.25]", "550 5.7.1 <[192.0.2.25]>: Helo command rejected: You are not me"},
+		{"[ipv6:2001:DB8:0::25]", "550 5.7.1 <[ipv6:2001:DB8:0::25]>: Helo command rejected: You are not me"},
+		{"localhost", "504 5.5.2 <localhost>: Helo command rejected: need fully-qualified hostname"},
+		{"host.123", "504 5.5.2 <host.123>: Helo command rejected: need fully-qualified hostname"},
+		{"unknown.example.org", "550 5.7.1 <unknown.example.org>: Helo command rejected: Host not found"},
+		{"slow.example.org", "450 4.7.1 <slow.example.org>: Helo command rejected: Host not found, try again later"},
+	}
+	for _, tt := range tests {
+		result := p.Check(ctx, tt.name)
+		got := ""
+		if result.Decision == icesmtp.PolicyDeny || result.Decision == icesmtp.PolicyDefer {
+			got = strings.TrimSpace(result.Response.String())
+		}
+		if got != tt.reply {
+			t.Errorf("Check(%q) = %q, want %q", tt.name, got, tt.reply)
+		}
+	}
+
+	// Without options everything is allowed.
+	for _, name := range []string{"192.0.2.1", "localhost", "unknown.example.org"} {
+		if result := NewPolicy().Check(ctx, name); result.Decision != icesmtp.PolicyAllow {
+			t.Errorf("default Check(%q) = %+v", name, result)
+		}
+	}
+}
+
+func TestSessionFilter(t *testing.T) {
+	h := harness.NewHarness(harness.WithServerHostname("mx.example.com"))
+	h.Config.SessionFilterFactory = NewPolicy(WithRequireFQDN(), WithRejectOwnName("mx.example.com"))
+	h.Start(context.Background())
+	defer h.Close()
+
+	expect := func(code icesmtp.ReplyCode) {
+		t.Helper()
+		if lines, err := h.Expect(code); err != nil {
+			t.Fatalf("expected %d: %v (%v)", code, err, lines)
+		}
+	}
+
+	expect(220)
+	h.Send("EHLO mx.example.com")
+	expect(550)
+	h.Send("HELO localhost")
+	expect(504)
+	h.Send("MAIL FROM:<a@example.org>")
+	expect(503)
+	h.Send("EHLO client.example.org")
+	expect(250)
+}
+
+func TestSessionFilterChain(t *testing.T) {
+	r := &dnstest.Resolver{IP: map[string][]string{"1.2.0.192.bl.example": {"127.0.0.2"}}}
+	c, err := dnsbl.NewChecker(r, []dnsbl.List{{Zone: "bl.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := harness.NewHarness(harness.WithClientIP("192.0.2.1"), harness.WithServerHostname("mx.example.com"))
+	h.Config.SessionFilterFactory = icesmtp.SessionFilterChain(NewPolicy(WithRequireFQDN()), dnsbl.NewPolicy(c))
+	h.Mailbox.AddDomain("example.com")
+	h.Mailbox.SetCatchAll(true)
+	h.Start(context.Background())
+	defer h.Close()
+
+	expect := func(code icesmtp.ReplyCode) string {
+		t.Helper()
+		lines, err := h.Expect(code)
+		if err != nil {
+			t.Fatalf("expected %d: %v (%v)", code, err, lines)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	expect(220)
+	h.Send("EHLO localhost")
+	expect(504)
+	h.Send("EHLO client.example.org")
+	expect(250)
+	h.Send("MAIL FROM:<a@example.org>")
+	expect(250)
+	h.Send("RCPT TO:<user@example.com>")
+	if resp := expect(550); !strings.Contains(resp, "blocked using bl.example") {
+		t.Errorf("response = %q", resp)
+	}
+}
@@ -0,0 +1,112 @@
+package icesmtp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IDGenerator creates session and envelope identifiers.
+// Implementations must be safe for concurrent use.
+type IDGenerator interface {
+	// NewID returns a new unique identifier.
+	NewID() string
+}
+
+// IDGeneratorFunc adapts a function to the IDGenerator interface.
+type IDGeneratorFunc func() string
+
+// NewID calls f.
+func (f IDGeneratorFunc) NewID() string { return f() }
+
+// ErrInvalidSortableID indicates a string is not a SortableIDGenerator ID.
+var ErrInvalidSortableID = errors.New("invalid sortable ID")
+
+// crockford is the Crockford base32 alphabet. Its characters are in
+// ascending ASCII order, so fixed-width encodings sort like the numbers
+// they encode.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// SortableIDLength is the length of IDs created by SortableIDGenerator.
+const SortableIDLength = 26
+
+// SortableIDGenerator creates 26-character, ULID-style identifiers that
+// sort lexicographically by creation time.
+//
+// Each ID encodes 128 bits in Crockford base32: a 48-bit millisecond Unix
+// timestamp, a 16-bit node identifier and a 64-bit sequence. The sequence
+// starts at a random value each millisecond and is incremented for every
+// further ID in the same millisecond, so IDs from one generator are
+// strictly increasing even if the clock steps backwards. Giving each
+// server in a cluster a distinct node keeps IDs unique across the
+// cluster.
+type SortableIDGenerator struct {
+	node uint16
+
+	mu     sync.Mutex
+	lastMs uint64
+	seq    uint64
+}
+
+// NewSortableIDGenerator creates a generator for the given node.
+func NewSortableIDGenerator(node uint16) *SortableIDGenerator {
+	return &SortableIDGenerator{node: node}
+}
+
+// NewID returns a new identifier.
+func (g *SortableIDGenerator) NewID() string {
+	ms := uint64(time.Now().UnixMilli())
+
+	g.mu.Lock()
+	if ms > g.lastMs {
+		g.lastMs = ms
+		var b [8]byte
+		rand.Read(b[:])
+		// Leave headroom so the sequence rarely wraps within a millisecond.
+		g.seq = binary.BigEndian.Uint64(b[:]) >> 1
+	} else {
+		g.seq++
+		if g.seq == 0 {
+			g.lastMs++
+		}
+	}
+	ms, seq := g.lastMs, g.seq
+	g.mu.Unlock()
+
+	hi := ms<<16 | uint64(g.node)
+	return encodeSortableID(hi, seq)
+}
+
+// encodeSortableID encodes the 128-bit value hi:lo as 26 base32 digits.
+func encodeSortableID(hi, lo uint64) string {
+	var out [SortableIDLength]byte
+	for i := SortableIDLength - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// ParseSortableID returns the creation time and node encoded in an ID
+// created by SortableIDGenerator.
+func ParseSortableID(id string) (time.Time, uint16, error) {
+	if len(id) != SortableIDLength {
+		return time.Time{}, 0, ErrInvalidSortableID
+	}
+
+	var hi, lo uint64
+	for i := 0; i < len(id); i++ {
+		v := strings.IndexByte(crockford, id[i])
+		if v < 0 || (i == 0 && v > 3) {
+			return time.Time{}, 0, ErrInvalidSortableID
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(v)
+	}
+
+	return time.UnixMilli(int64(hi >> 16)), uint16(hi), nil
+}
@@ -0,0 +1,104 @@
+package icesmtp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSortableIDGenerator_Concurrent(t *testing.T) {
+	const goroutines = 16
+	const perGoroutine = 2000
+
+	// Two nodes sharing a clock must never collide
+	gens := []*SortableIDGenerator{NewSortableIDGenerator(1), NewSortableIDGenerator(2)}
+
+	var mu sync.Mutex
+	seen := make(map[string]bool, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gen := gens[i%len(gens)]
+			ids := make([]string, perGoroutine)
+			for j := range ids {
+				ids[j] = gen.NewID()
+			}
+			if !sort.StringsAreSorted(ids) {
+				t.Error("IDs from one generator are not increasing")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("duplicate ID %s", id)
+				}
+				seen[id] = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != goroutines*perGoroutine {
+		t.Errorf("got %d unique IDs, want %d", len(seen), goroutines*perGoroutine)
+	}
+}
+
+func TestSortableIDGenerator_SortsByTime(t *testing.T) {
+	a := NewSortableIDGenerator(9).NewID()
+	time.Sleep(2 * time.Millisecond)
+	b := NewSortableIDGenerator(1).NewID()
+	if a >= b {
+		t.Errorf("expected %s < %s", a, b)
+	}
+
+	ts, node, err := ParseSortableID(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node != 9 || time.Since(ts) > time.Second || len(a) != SortableIDLength {
+		t.Errorf("ParseSortableID(%s) = %v, %d", a, ts, node)
+	}
+
+	for _, bad := range []string{"", "short", strings.Repeat("Z", SortableIDLength), strings.Repeat("U", SortableIDLength)} {
+		if _, _, err := ParseSortableID(bad); err != ErrInvalidSortableID {
+			t.Errorf("ParseSortableID(%q) error = %v", bad, err)
+		}
+	}
+}
+
+func TestEngineUsesIDGenerator(t *testing.T) {
+	var n int
+	var mu sync.Mutex
+	gen := IDGeneratorFunc(func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return fmt.Sprintf("id-%d", n)
+	})
+
+	engine := NewEngineWithConn(WrapPipe(newTestPipeBuffer(), newTestPipeBuffer()), SessionConfig{IDGenerator: gen})
+	if engine.ID() != "id-1" {
+		t.Errorf("session ID = %q, want id-1", engine.ID())
+	}
+
+	resp := sendTestMessage(t, SessionConfig{
+		Storage:     NullStorage{},
+		IDGenerator: gen,
+		AcceptReply: "{envelope_id}",
+	})
+	// id-2 is the second session, id-3 its envelope
+	if strings.TrimSpace(resp) != "250 id-3" {
+		t.Errorf("unexpected reply: %s", resp)
+	}
+
+	b := StandardEnvelopeFactory{IDGenerator: gen}.NewBuilder(EnvelopeMetadata{})
+	b.Reset()
+	if id := b.Build().ID(); id != "id-5" {
+		t.Errorf("envelope ID after Reset = %q, want id-5", id)
+	}
+}
@@ -0,0 +1,60 @@
+package icesmtp
+
+import (
+	"context"
+	"io"
+)
+
+// DataInspector examines a message while DATA streams, so that checks
+// over the whole message, such as DKIM body hashes, do not read it again
+// after it has been received. A new DataInspector is created for every
+// message by the DataInspectorFactory in SessionConfig.
+//
+// The results of Finish are recorded in the envelope's
+// EnvelopeMetadata.AuthResults before content filters run. An inspector
+// whose message is aborted is dropped without a call to Finish.
+type DataInspector interface {
+	// Write receives the message data after dot-unstuffing, in order,
+	// usually one line per call. Errors are ignored; an inspector that
+	// fails should report the failure in its results.
+	io.Writer
+
+	// Finish is called after the last line.
+	Finish(ctx context.Context) []AuthResult
+}
+
+// DataInspectorFactory creates a DataInspector for each message.
+type DataInspectorFactory interface {
+	// NewDataInspector creates the inspector for a message of session.
+	NewDataInspector(ctx context.Context, session SessionInfo) DataInspector
+}
+
+// inspectingWriter writes to w and copies everything written to an
+// inspector, ignoring its errors.
+type inspectingWriter struct {
+	w         io.Writer
+	inspector DataInspector
+}
+
+func (iw inspectingWriter) Write(p []byte) (int, error) {
+	n, err := iw.w.Write(p)
+	if n > 0 {
+		iw.inspector.Write(p[:n])
+	}
+	return n, err
+}
+
+// withAuthResults returns env with results added to its metadata.
+func withAuthResults(env Envelope, results []AuthResult) Envelope {
+	if len(results) == 0 {
+		return env
+	}
+	m, ok := env.(*ModifiedEnvelope)
+	if !ok {
+		m = NewModifiedEnvelope(env)
+	}
+	for _, r := range results {
+		m.AddAuthResult(r)
+	}
+	return m
+}
@@ -0,0 +1,49 @@
+package icesmtp
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// recordingInspector keeps the data it sees and reports one result.
+type recordingInspector struct {
+	data bytes.Buffer
+}
+
+func (i *recordingInspector) Write(p []byte) (int, error) { return i.data.Write(p) }
+
+func (i *recordingInspector) Finish(ctx context.Context) []AuthResult {
+	return []AuthResult{{Method: "test", Result: "pass"}}
+}
+
+func TestEngineDataInspector(t *testing.T) {
+	inspector := &recordingInspector{}
+	factory := dataInspectorFunc(func(ctx context.Context, session SessionInfo) DataInspector {
+		return inspector
+	})
+	storage := &envelopeCapture{}
+	resp := sendTestMessage(t, SessionConfig{
+		Storage:              storage,
+		DataInspectorFactory: factory,
+	})
+	if !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250 response, got: %s", resp)
+	}
+
+	if got := inspector.data.String(); got != "Subject: Test\r\n\r\nTest message.\r\n" {
+		t.Errorf("inspected data = %q", got)
+	}
+	results := storage.envelope.Metadata().AuthResults
+	if len(results) != 1 || results[0].String() != "test=pass" {
+		t.Errorf("AuthResults = %+v", results)
+	}
+}
+
+// dataInspectorFunc adapts a function to DataInspectorFactory.
+type dataInspectorFunc func(ctx context.Context, session SessionInfo) DataInspector
+
+func (f dataInspectorFunc) NewDataInspector(ctx context.Context, session SessionInfo) DataInspector {
+	return f(ctx, session)
+}
@@ -0,0 +1,137 @@
+// Package dnstest provides an in-memory DNS resolver for tests. It has the
+// lookup methods of *net.Resolver and returns the same error types, so it
+// can stand in for the resolver interfaces of the spf, dkim and related
+// packages.
+package dnstest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Resolver answers lookups from its maps. Names are matched
+// case-insensitively, with or without a trailing dot. A name with no
+// records of the requested type is not found.
+type Resolver struct {
+	// TXT maps a name to its TXT records.
+	TXT map[string][]string
+
+	// IP maps a name to its A and AAAA addresses.
+	IP map[string][]string
+
+	// MX maps a name to its mail exchangers, most preferred first.
+	MX map[string][]string
+
+	// PTR maps an address to its names.
+	PTR map[string][]string
+
+	// Errors maps a name or address to an error returned by every lookup
+	// of it, e.g. Temporary(name).
+	Errors map[string]error
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// Temporary returns a temporary DNS error, as for a SERVFAIL or timeout.
+func Temporary(name string) error {
+	return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+}
+
+// NotFound returns the error for a name with no records.
+func NotFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// Queries returns the lookups made so far, e.g. "TXT example.com".
+func (r *Resolver) Queries() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.queries...)
+}
+
+// lookup records a query and returns the records for name in m.
+func lookup[T any](r *Resolver, kind string, m map[string][]T, name string) ([]T, error) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+
+	r.mu.Lock()
+	r.queries = append(r.queries, kind+" "+key)
+	r.mu.Unlock()
+
+	if err := r.Errors[key]; err != nil {
+		return nil, err
+	}
+	for k, v := range m {
+		if strings.ToLower(strings.TrimSuffix(k, ".")) == key && len(v) > 0 {
+			return v, nil
+		}
+	}
+	return nil, NotFound(name)
+}
+
+// LookupTXT returns the TXT records for name.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return lookup(r, "TXT", r.TXT, name)
+}
+
+// LookupIP returns the addresses of host. network is "ip", "ip4" or
+// "ip6".
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	kind := map[string]string{"ip4": "A", "ip6": "AAAA"}[network]
+	if kind == "" {
+		kind = "A/AAAA"
+	}
+	addrs, err := lookup(r, kind, r.IP, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		switch {
+		case ip == nil:
+		case network == "ip4" && ip.To4() == nil:
+		case network == "ip6" && ip.To4() != nil:
+		default:
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, NotFound(host)
+	}
+	return ips, nil
+}
+
+// LookupHost returns the addresses of host as strings.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips, err := r.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	return addrs, nil
+}
+
+// LookupMX returns the mail exchangers for name with preferences 10, 20
+// and so on.
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, err := lookup(r, "MX", r.MX, name)
+	if err != nil {
+		return nil, err
+	}
+	mx := make([]*net.MX, len(hosts))
+	for i, h := range hosts {
+		mx[i] = &net.MX{Host: h, Pref: uint16(10 * (i + 1))}
+	}
+	return mx, nil
+}
+
+// LookupAddr returns the names of addr.
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return lookup(r, "PTR", r.PTR, addr)
+}
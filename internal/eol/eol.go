@@ -0,0 +1,58 @@
+// Package eol converts between SMTP (CRLF) and Unix (LF) line endings.
+package eol
+
+import "io"
+
+// LFWriter converts CRLF line endings to LF while writing.
+// A trailing CR at the end of one Write is held back until the next
+// Write (or Flush) so that CRLF pairs split across writes are handled.
+type LFWriter struct {
+	w       io.Writer
+	pending bool
+}
+
+// NewLFWriter returns a writer that converts CRLF to LF before writing to w.
+func NewLFWriter(w io.Writer) *LFWriter {
+	return &LFWriter{w: w}
+}
+
+// Write converts p and writes it to the underlying writer.
+// The returned count refers to bytes consumed from p.
+func (l *LFWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	if l.pending {
+		l.pending = false
+		if len(p) == 0 || p[0] != '\n' {
+			out = append(out, '\r')
+		}
+	}
+
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '\r' {
+			if i+1 == len(p) {
+				l.pending = true
+				continue
+			}
+			if p[i+1] == '\n' {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+
+	if _, err := l.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes any held-back CR.
+func (l *LFWriter) Flush() error {
+	if !l.pending {
+		return nil
+	}
+	l.pending = false
+	_, err := l.w.Write([]byte{'\r'})
+	return err
+}
@@ -0,0 +1,44 @@
+// Package storeutil provides helpers shared by the storage backends.
+package storeutil
+
+import (
+	"io"
+	"sync"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Error wraps cause as a *icesmtp.StorageError for envelope. The engine
+// replies 554 to a permanent error and 451 to any other.
+func Error(envelope icesmtp.Envelope, op icesmtp.StorageOperation, cause error, permanent bool, msg string) *icesmtp.StorageError {
+	return &icesmtp.StorageError{
+		Operation:  op,
+		EnvelopeID: envelope.ID(),
+		Cause:      cause,
+		Permanent:  permanent,
+		Message:    msg,
+	}
+}
+
+// Fail counts a store error in metrics, which mu guards, and returns it
+// as built by Error.
+func Fail(mu sync.Locker, metrics *icesmtp.StorageMetrics, envelope icesmtp.Envelope, op icesmtp.StorageOperation, cause error, permanent bool, msg string) (icesmtp.StorageReceipt, error) {
+	mu.Lock()
+	metrics.StoreErrors++
+	mu.Unlock()
+
+	return icesmtp.StorageReceipt{}, Error(envelope, op, cause, permanent, msg)
+}
+
+// CountingWriter counts the bytes written to W.
+type CountingWriter struct {
+	W io.Writer
+	N int64
+}
+
+// Write writes p to W and adds the bytes written to N.
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
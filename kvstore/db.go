@@ -0,0 +1,610 @@
+// Package kvstore provides an embedded, single-file message database that
+// implements icesmtp.Storage.
+//
+// Messages and their envelope metadata are appended to one file. Indexes
+// on recipient, sender, received time and session ID are rebuilt in memory
+// when the file is opened, and the query API (List, Get, Delete, Sweep)
+// lets administrative tools search mail without a separate database
+// service. It is pure Go and intended for small deployments: every index
+// entry is held in memory, and message data is read from disk on demand.
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// Database errors.
+var (
+	// ErrNotFound indicates no message with the given ID.
+	ErrNotFound = errors.New("kvstore: message not found")
+
+	// ErrClosed indicates the database has been closed.
+	ErrClosed = errors.New("kvstore: database closed")
+)
+
+// Record is the envelope metadata stored for each message.
+type Record struct {
+	// ID is the database message ID, returned as StorageReceipt.MessageID.
+	ID icesmtp.StorageMessageID `json:"id"`
+
+	// EnvelopeID is the original envelope identifier.
+	EnvelopeID icesmtp.EnvelopeID `json:"envelope_id"`
+
+	// SessionID is the session that received the message.
+	SessionID icesmtp.SessionID `json:"session_id"`
+
+	// MailFrom is the envelope sender address ("" for the null sender).
+	MailFrom icesmtp.EmailAddress `json:"mail_from"`
+
+	// Recipients are the envelope recipient addresses.
+	Recipients []icesmtp.EmailAddress `json:"recipients"`
+
+	// ESMTPParams are the parameters from the MAIL command.
+	ESMTPParams icesmtp.ESMTPParams `json:"esmtp_params,omitempty"`
+
+	// Metadata is the session metadata of the envelope.
+	Metadata icesmtp.EnvelopeMetadata `json:"metadata"`
+
+	// ReceivedAt is when the transaction started.
+	ReceivedAt time.Time `json:"received_at"`
+
+	// StoredAt is when the message was written.
+	StoredAt time.Time `json:"stored_at"`
+
+	// Size is the size of the message data in bytes.
+	Size icesmtp.ByteCount `json:"size"`
+}
+
+// Filter selects messages in List. Zero fields match everything.
+type Filter struct {
+	// Recipient matches messages with this recipient (case-insensitive).
+	Recipient icesmtp.EmailAddress
+
+	// Sender matches messages from this sender (case-insensitive).
+	Sender icesmtp.EmailAddress
+
+	// SessionID matches messages received in this session.
+	SessionID icesmtp.SessionID
+
+	// Since matches messages received at or after this time.
+	Since time.Time
+
+	// Until matches messages received before this time.
+	Until time.Time
+
+	// Descending returns the newest messages first.
+	Descending bool
+
+	// Limit caps the number of results (0 = unlimited).
+	Limit int
+}
+
+// DB is an embedded message database.
+type DB struct {
+	path   string
+	noSync bool
+	ids    *icesmtp.SortableIDGenerator
+
+	mu      sync.RWMutex
+	f       *os.File
+	size    int64
+	dead    int64
+	idx     *index
+	closed  bool
+	metrics icesmtp.StorageMetrics
+}
+
+// Option configures a DB.
+type Option func(*DB)
+
+// WithNoSync disables the fsync after each write. Writes are faster but
+// recently acknowledged messages may be lost on power failure.
+func WithNoSync() Option {
+	return func(db *DB) {
+		db.noSync = true
+	}
+}
+
+// Open opens or creates the database file at path and rebuilds its
+// indexes. A record torn by a crash at the end of the file is discarded.
+func Open(path string, opts ...Option) (*DB, error) {
+	db := &DB{path: path, ids: icesmtp.NewSortableIDGenerator(0)}
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// load opens the file and replays it into a fresh index.
+func (db *DB) load() error {
+	f, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if info.Size() == 0 {
+		if _, err := f.Write(magic); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		head := make([]byte, len(magic))
+		if _, err := io.ReadFull(f, head); err != nil || !bytes.Equal(head, magic) {
+			f.Close()
+			return ErrCorrupt
+		}
+	}
+
+	idx := newIndex()
+	var dead int64
+	size := max(info.Size(), int64(len(magic)))
+	end, err := scanRecords(f, int64(len(magic)), size, func(op byte, payload []byte, offset int64) error {
+		size := int64(headerSize + len(payload) + 1)
+		switch op {
+		case opPut:
+			e, err := decodePut(payload, offset)
+			if err != nil {
+				return err
+			}
+			e.recordSize = size
+			if old := idx.put(e); old != nil {
+				dead += old.recordSize
+			}
+		case opDelete:
+			if old := idx.remove(string(payload)); old != nil {
+				dead += old.recordSize
+			}
+			dead += size
+		default:
+			return ErrCorrupt
+		}
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if end < info.Size() {
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	db.f = f
+	db.size = max(end, int64(len(magic)))
+	db.dead = dead
+	db.idx = idx
+	return nil
+}
+
+// decodePut parses a put payload whose first byte is at offset.
+func decodePut(payload []byte, offset int64) (*entry, error) {
+	nl := bytes.IndexByte(payload, '\n')
+	if nl < 0 {
+		return nil, ErrCorrupt
+	}
+	var rec Record
+	if err := json.Unmarshal(payload[:nl], &rec); err != nil {
+		return nil, ErrCorrupt
+	}
+	return &entry{
+		rec:        rec,
+		dataOffset: offset + int64(nl) + 1,
+		dataSize:   int64(len(payload) - nl - 1),
+	}, nil
+}
+
+// Close closes the database file.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.f.Close()
+}
+
+// Store writes the envelope to the database.
+func (db *DB) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	return db.store(ctx, envelope, icesmtp.StorageOpStore, envelope.Data())
+}
+
+// StoreStream reads the data and writes the envelope to the database.
+func (db *DB) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return storeutil.Fail(&db.mu, &db.metrics, envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
+	}
+	return db.store(ctx, envelope, icesmtp.StorageOpStoreStream, buf)
+}
+
+func (db *DB) store(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, data []byte) (icesmtp.StorageReceipt, error) {
+	start := time.Now()
+
+	if err := ctx.Err(); err != nil {
+		return storeutil.Fail(&db.mu, &db.metrics, envelope, op, err, false, "store cancelled")
+	}
+
+	from := envelope.MailFrom()
+	rec := Record{
+		ID:          db.ids.NewID(),
+		EnvelopeID:  envelope.ID(),
+		SessionID:   envelope.Metadata().SessionID,
+		ESMTPParams: envelope.ESMTPParams(),
+		Metadata:    envelope.Metadata(),
+		ReceivedAt:  envelope.ReceivedAt(),
+		StoredAt:    time.Now().UTC(),
+		Size:        int64(len(data)),
+	}
+	if !from.IsNull {
+		rec.MailFrom = from.Address
+	}
+	for _, r := range envelope.Recipients() {
+		rec.Recipients = append(rec.Recipients, r.Address)
+	}
+	if rec.ReceivedAt.IsZero() {
+		rec.ReceivedAt = rec.StoredAt
+	}
+
+	header, err := json.Marshal(rec)
+	if err != nil {
+		return storeutil.Fail(&db.mu, &db.metrics, envelope, op, err, false, "failed to encode record")
+	}
+	payload := make([]byte, 0, len(header)+1+len(data))
+	payload = append(payload, header...)
+	payload = append(payload, '\n')
+	payload = append(payload, data...)
+
+	db.mu.Lock()
+	e, err := db.appendLocked(opPut, payload)
+	if err == nil {
+		e.rec = rec
+		e.dataOffset += int64(len(header)) + 1
+		e.dataSize = int64(len(data))
+		db.idx.put(e)
+		db.metrics.MessagesStored++
+		db.metrics.BytesStored += uint64(len(data))
+		db.metrics.StoreLatencyNs = int64(time.Since(start))
+	}
+	db.mu.Unlock()
+
+	if err != nil {
+		return storeutil.Fail(&db.mu, &db.metrics, envelope, op, err, false, "failed to write record")
+	}
+
+	return icesmtp.StorageReceipt{
+		MessageID:    rec.ID,
+		EnvelopeID:   rec.EnvelopeID,
+		StoredAt:     rec.StoredAt.Unix(),
+		BytesWritten: rec.Size,
+	}, nil
+}
+
+// appendLocked appends a record at the end of the file. On failure the
+// file is truncated back so that later appends stay parseable.
+// The returned entry has dataOffset set to the payload offset.
+func (db *DB) appendLocked(op byte, payload []byte) (*entry, error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	var buf bytes.Buffer
+	n, _ := appendRecord(&buf, op, payload)
+
+	if _, err := db.f.WriteAt(buf.Bytes(), db.size); err != nil {
+		db.f.Truncate(db.size)
+		return nil, err
+	}
+	if !db.noSync {
+		if err := db.f.Sync(); err != nil {
+			db.f.Truncate(db.size)
+			return nil, err
+		}
+	}
+
+	e := &entry{dataOffset: db.size + headerSize, recordSize: n}
+	db.size += n
+	return e, nil
+}
+
+// Get returns the record for a message ID.
+func (db *DB) Get(id icesmtp.StorageMessageID) (*Record, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	e, ok := db.idx.byID[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rec := e.rec
+	return &rec, nil
+}
+
+// Data returns the message data for a message ID.
+func (db *DB) Data(id icesmtp.StorageMessageID) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	e, ok := db.idx.byID[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	data := make([]byte, e.dataSize)
+	if _, err := db.f.ReadAt(data, e.dataOffset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Delete removes a message.
+func (db *DB) Delete(id icesmtp.StorageMessageID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.idx.byID[id]; !ok {
+		if db.closed {
+			return ErrClosed
+		}
+		return ErrNotFound
+	}
+	return db.deleteLocked(id)
+}
+
+func (db *DB) deleteLocked(id string) error {
+	e, err := db.appendLocked(opDelete, []byte(id))
+	if err != nil {
+		return err
+	}
+	if old := db.idx.remove(id); old != nil {
+		db.dead += old.recordSize
+	}
+	db.dead += e.recordSize
+	return nil
+}
+
+// List returns the records matching the filter, ordered by received time.
+func (db *DB) List(filter Filter) ([]*Record, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	var candidates []string
+	switch {
+	case filter.SessionID != "":
+		candidates = keys(db.idx.bySession[filter.SessionID])
+	case filter.Recipient != "":
+		candidates = keys(db.idx.byRcpt[normalize(filter.Recipient)])
+	case filter.Sender != "":
+		candidates = keys(db.idx.bySender[normalize(filter.Sender)])
+	default:
+		candidates = db.idx.timeRange(filter.Since, filter.Until)
+	}
+
+	results := make([]*Record, 0, len(candidates))
+	for _, id := range candidates {
+		e := db.idx.byID[id]
+		if e == nil || !matches(&e.rec, filter) {
+			continue
+		}
+		rec := e.rec
+		results = append(results, &rec)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a := timeKey{at: results[i].ReceivedAt, id: results[i].ID}
+		b := timeKey{at: results[j].ReceivedAt, id: results[j].ID}
+		if filter.Descending {
+			return b.less(a)
+		}
+		return a.less(b)
+	})
+
+	if filter.Limit > 0 && len(results) > filter.Limit {
+		results = results[:filter.Limit]
+	}
+	return results, nil
+}
+
+// matches reports whether rec satisfies every set field of the filter.
+func matches(rec *Record, f Filter) bool {
+	if f.SessionID != "" && rec.SessionID != f.SessionID {
+		return false
+	}
+	if f.Sender != "" && normalize(rec.MailFrom) != normalize(f.Sender) {
+		return false
+	}
+	if f.Recipient != "" {
+		found := false
+		for _, r := range rec.Recipients {
+			if normalize(r) == normalize(f.Recipient) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && rec.ReceivedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !rec.ReceivedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func keys(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	return out
+}
+
+// Count returns the number of stored messages.
+func (db *DB) Count() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.idx.byID)
+}
+
+// Sweep deletes every message received before the cutoff and returns the
+// number deleted. Use it to enforce a retention period. A zero cutoff
+// deletes nothing.
+func (db *DB) Sweep(ctx context.Context, before time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return 0, ErrClosed
+	}
+	if before.IsZero() {
+		return 0, nil
+	}
+
+	deleted := 0
+	for _, id := range db.idx.timeRange(time.Time{}, before) {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		if err := db.deleteLocked(id); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Garbage returns the number of bytes in the file occupied by deleted or
+// superseded records. Compact reclaims them.
+func (db *DB) Garbage() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.dead
+}
+
+// Compact rewrites the database file with only live messages.
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	tmpPath := db.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = db.copyLive(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, db.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	db.f.Close()
+	if err := db.load(); err != nil {
+		db.closed = true
+		return fmt.Errorf("kvstore: reopen after compaction: %w", err)
+	}
+	return nil
+}
+
+// copyLive writes the magic line and one put record per live message.
+func (db *DB) copyLive(w io.Writer) error {
+	if _, err := w.Write(magic); err != nil {
+		return err
+	}
+	for _, k := range db.idx.byTime {
+		e := db.idx.byID[k.id]
+		header, err := json.Marshal(e.rec)
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, len(header)+1+int(e.dataSize))
+		copy(payload, header)
+		payload[len(header)] = '\n'
+		if _, err := db.f.ReadAt(payload[len(header)+1:], e.dataOffset); err != nil {
+			return err
+		}
+		if _, err := appendRecord(w, opPut, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Metrics returns storage metrics.
+func (db *DB) Metrics() icesmtp.StorageMetrics {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.metrics
+}
+
+// Healthy returns ErrClosed once the database has been closed.
+func (db *DB) Healthy(ctx context.Context) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Ensure DB implements the interfaces.
+var (
+	_ icesmtp.Storage            = (*DB)(nil)
+	_ icesmtp.StorageWithMetrics = (*DB)(nil)
+	_ icesmtp.StorageWithHealth  = (*DB)(nil)
+)
@@ -0,0 +1,220 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+func storeMessage(t *testing.T, db *DB, session, from, data string, rcpts ...string) icesmtp.StorageReceipt {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{SessionID: session})
+	b.SetMailFrom(icesmtp.MailPath{Address: from}, nil)
+	for _, r := range rcpts {
+		b.AddRecipient(icesmtp.MailPath{Address: r})
+	}
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt, err := db.Store(context.Background(), env)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	return receipt
+}
+
+func TestDB_QueryIndexes(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "mail.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	first := storeMessage(t, db, "s1", "Alice@example.org", "one", "bob@example.com")
+	storeMessage(t, db, "s1", "carol@example.org", "two", "Bob@Example.com", "dave@example.com")
+	storeMessage(t, db, "s2", "alice@example.org", "three", "dave@example.com")
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"all", Filter{}, 3},
+		{"recipient", Filter{Recipient: "bob@example.com"}, 2},
+		{"sender", Filter{Sender: "alice@example.org"}, 2},
+		{"session", Filter{SessionID: "s1"}, 2},
+		{"combined", Filter{SessionID: "s1", Recipient: "dave@example.com"}, 1},
+		{"limit", Filter{Limit: 1}, 1},
+		{"future", Filter{Since: time.Now().Add(time.Hour)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.List(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d records, want %d", len(got), tt.want)
+			}
+		})
+	}
+
+	newest, _ := db.List(Filter{Descending: true, Limit: 1})
+	if len(newest) != 1 || newest[0].SessionID != "s2" {
+		t.Errorf("unexpected newest record: %+v", newest)
+	}
+
+	rec, err := db.Get(first.MessageID)
+	if err != nil || rec.MailFrom != "Alice@example.org" {
+		t.Fatalf("Get: %+v, %v", rec, err)
+	}
+	data, err := db.Data(first.MessageID)
+	if err != nil || string(data) != "one" {
+		t.Fatalf("Data: %q, %v", data, err)
+	}
+}
+
+func TestDB_PersistDeleteAndCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keep := storeMessage(t, db, "s", "a@example.org", "keep", "b@example.com")
+	drop := storeMessage(t, db, "s", "a@example.org", "drop", "b@example.com")
+	if err := db.Delete(drop.MessageID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(drop.MessageID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second delete: %v", err)
+	}
+	db.Close()
+
+	// Simulate a crash in the middle of an append.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("P 000000000000000")
+	f.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+
+	if db.Count() != 1 {
+		t.Fatalf("Count = %d, want 1", db.Count())
+	}
+	if db.Garbage() == 0 {
+		t.Error("expected garbage after delete")
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if db.Garbage() != 0 {
+		t.Errorf("Garbage = %d after compaction", db.Garbage())
+	}
+	data, err := db.Data(keep.MessageID)
+	if err != nil || string(data) != "keep" {
+		t.Fatalf("Data after compaction: %q, %v", data, err)
+	}
+
+	// The file remains appendable after compaction.
+	storeMessage(t, db, "s", "a@example.org", "more", "b@example.com")
+	if db.Count() != 2 {
+		t.Errorf("Count = %d, want 2", db.Count())
+	}
+}
+
+func TestDB_Damaged(t *testing.T) {
+	// write stores three messages and returns the file contents.
+	write := func(t *testing.T, path string) []byte {
+		db, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []string{"one", "two", "three"} {
+			storeMessage(t, db, "s", "a@example.org", data, "b@example.com")
+		}
+		db.Close()
+		data, _ := os.ReadFile(path)
+		return data
+	}
+
+	t.Run("length in the middle", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "mail.db")
+		data := write(t, path)
+		copy(data[len(magic)+2:], "09223372036854775807")
+		os.WriteFile(path, data, 0600)
+
+		if _, err := Open(path); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("Open = %v, want ErrCorrupt", err)
+		}
+		if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+			t.Errorf("file truncated to %d bytes", info.Size())
+		}
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			damage func([]byte) []byte
+			want   int
+		}{
+			{"checksum", func(data []byte) []byte {
+				data[len(data)-2] ^= 1
+				return data
+			}, 2},
+			{"length", func(data []byte) []byte {
+				return append(data, "P 00000000001000000000 00000000\n{"...)
+			}, 3},
+		}
+		for _, tt := range tests {
+			path := filepath.Join(t.TempDir(), "mail.db")
+			os.WriteFile(path, tt.damage(write(t, path)), 0600)
+
+			db, err := Open(path)
+			if err != nil {
+				t.Fatalf("%s: Open = %v", tt.name, err)
+			}
+			if db.Count() != tt.want {
+				t.Errorf("%s: Count = %d, want %d", tt.name, db.Count(), tt.want)
+			}
+			db.Close()
+		}
+	})
+}
+
+func TestDB_Sweep(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "mail.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storeMessage(t, db, "s", "a@example.org", "old", "b@example.com")
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	storeMessage(t, db, "s", "a@example.org", "new", "b@example.com")
+
+	if n, err := db.Sweep(context.Background(), time.Time{}); err != nil || n != 0 {
+		t.Fatalf("Sweep with a zero cutoff = %d, %v", n, err)
+	}
+	n, err := db.Sweep(context.Background(), cutoff)
+	if err != nil || n != 1 {
+		t.Fatalf("Sweep = %d, %v", n, err)
+	}
+	if got, _ := db.List(Filter{Recipient: "b@example.com"}); len(got) != 1 {
+		t.Errorf("expected 1 remaining record, got %d", len(got))
+	}
+}
@@ -0,0 +1,123 @@
+package kvstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// The database file is the magic line followed by records. Each record is
+//
+//	<type> SP <20-digit decimal length> SP <8-digit hex CRC-32> LF <payload> LF
+//
+// A put record's payload is the JSON Record, an LF, and the message data.
+// A delete record's payload is the message ID. Later records override
+// earlier ones; Compact rewrites the file with only live puts.
+
+// magic is the first line of a database file.
+var magic = []byte("ICEKV/1\n")
+
+// Record types.
+const (
+	opPut    byte = 'P'
+	opDelete byte = 'X'
+)
+
+// headerSize is the size of a record header.
+const headerSize = 1 + 1 + 20 + 1 + 8 + 1
+
+// ErrCorrupt indicates a database file that cannot be parsed.
+var ErrCorrupt = errors.New("kvstore: corrupt database file")
+
+// appendRecord writes a record to w.
+func appendRecord(w io.Writer, op byte, payload []byte) (int64, error) {
+	n, err := fmt.Fprintf(w, "%c %020d %08x\n", op, len(payload), crc32.ChecksumIEEE(payload))
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(payload)
+	if err != nil {
+		return int64(n + m), err
+	}
+	_, err = w.Write([]byte{'\n'})
+	return int64(n + m + 1), err
+}
+
+// scanRecords reads the records of r from start up to size, calling fn
+// with each record's type, payload and payload offset. It returns the
+// offset of the end of the last valid record.
+//
+// A damaged record that no valid record follows is the torn tail of an
+// append interrupted by a crash; it stops the scan without error. A
+// damaged record followed by a valid one is reported as ErrCorrupt.
+func scanRecords(r io.ReaderAt, start, size int64, fn func(op byte, payload []byte, offset int64) error) (int64, error) {
+	br := bufio.NewReaderSize(io.NewSectionReader(r, start, size-start), 64*1024)
+	offset := start
+
+	for offset < size {
+		op, payload, err := readRecord(br, size-offset)
+		if err != nil {
+			if recordFollows(r, offset+1, size) {
+				return offset, ErrCorrupt
+			}
+			return offset, nil
+		}
+		if err := fn(op, payload, offset+headerSize); err != nil {
+			return offset, err
+		}
+		offset += headerSize + int64(len(payload)) + 1
+	}
+	return offset, nil
+}
+
+// readRecord reads a record, which must fit in the remaining bytes of the
+// file, and verifies its checksum.
+func readRecord(br *bufio.Reader, remaining int64) (byte, []byte, error) {
+	var h [headerSize]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	if h[1] != ' ' || h[22] != ' ' || h[31] != '\n' {
+		return 0, nil, ErrCorrupt
+	}
+	length, err := strconv.ParseInt(string(h[2:22]), 10, 64)
+	if err != nil || length < 0 || length >= remaining-headerSize {
+		return 0, nil, ErrCorrupt
+	}
+	sum, err := strconv.ParseUint(string(h[23:31]), 16, 32)
+	if err != nil {
+		return 0, nil, ErrCorrupt
+	}
+
+	payload := make([]byte, length+1)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return 0, nil, err
+	}
+	if payload[length] != '\n' || crc32.ChecksumIEEE(payload[:length]) != uint32(sum) {
+		return 0, nil, ErrCorrupt
+	}
+	return h[0], payload[:length], nil
+}
+
+// recordFollows reports whether a valid record starts after any LF at or
+// after from.
+func recordFollows(r io.ReaderAt, from, size int64) bool {
+	br := bufio.NewReaderSize(io.NewSectionReader(r, from, size-from), 64*1024)
+	pos := from
+	for {
+		line, err := br.ReadSlice('\n')
+		pos += int64(len(line))
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			op, _, recErr := readRecord(bufio.NewReader(io.NewSectionReader(r, pos, size-pos)), size-pos)
+			if recErr == nil && (op == opPut || op == opDelete) {
+				return true
+			}
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return false
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package kvstore
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// entry is the in-memory index entry for a stored message.
+type entry struct {
+	rec        Record
+	dataOffset int64
+	dataSize   int64
+	recordSize int64
+}
+
+// timeKey orders entries by received time, then ID.
+type timeKey struct {
+	at time.Time
+	id string
+}
+
+func (k timeKey) less(o timeKey) bool {
+	if k.at.Equal(o.at) {
+		return k.id < o.id
+	}
+	return k.at.Before(o.at)
+}
+
+// index holds the secondary indexes over live entries.
+type index struct {
+	byID      map[string]*entry
+	byRcpt    map[string]map[string]struct{}
+	bySender  map[string]map[string]struct{}
+	bySession map[string]map[string]struct{}
+	byTime    []timeKey
+}
+
+func newIndex() *index {
+	return &index{
+		byID:      make(map[string]*entry),
+		byRcpt:    make(map[string]map[string]struct{}),
+		bySender:  make(map[string]map[string]struct{}),
+		bySession: make(map[string]map[string]struct{}),
+	}
+}
+
+// normalize returns the index key for an address.
+func normalize(addr string) string {
+	return strings.ToLower(addr)
+}
+
+func addTo(m map[string]map[string]struct{}, key, id string) {
+	set, ok := m[key]
+	if !ok {
+		set = make(map[string]struct{})
+		m[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+func removeFrom(m map[string]map[string]struct{}, key, id string) {
+	if set, ok := m[key]; ok {
+		delete(set, id)
+		if len(set) == 0 {
+			delete(m, key)
+		}
+	}
+}
+
+// put adds e, replacing any entry with the same ID. It returns the
+// replaced entry, if any.
+func (ix *index) put(e *entry) *entry {
+	old := ix.remove(e.rec.ID)
+
+	id := e.rec.ID
+	ix.byID[id] = e
+	for _, r := range e.rec.Recipients {
+		addTo(ix.byRcpt, normalize(r), id)
+	}
+	addTo(ix.bySender, normalize(e.rec.MailFrom), id)
+	addTo(ix.bySession, e.rec.SessionID, id)
+
+	k := timeKey{at: e.rec.ReceivedAt, id: id}
+	i := sort.Search(len(ix.byTime), func(i int) bool { return k.less(ix.byTime[i]) })
+	ix.byTime = append(ix.byTime, timeKey{})
+	copy(ix.byTime[i+1:], ix.byTime[i:])
+	ix.byTime[i] = k
+
+	return old
+}
+
+// remove deletes the entry with the given ID and returns it.
+func (ix *index) remove(id string) *entry {
+	e, ok := ix.byID[id]
+	if !ok {
+		return nil
+	}
+
+	delete(ix.byID, id)
+	for _, r := range e.rec.Recipients {
+		removeFrom(ix.byRcpt, normalize(r), id)
+	}
+	removeFrom(ix.bySender, normalize(e.rec.MailFrom), id)
+	removeFrom(ix.bySession, e.rec.SessionID, id)
+
+	k := timeKey{at: e.rec.ReceivedAt, id: id}
+	i := sort.Search(len(ix.byTime), func(i int) bool { return !ix.byTime[i].less(k) })
+	if i < len(ix.byTime) && ix.byTime[i] == k {
+		ix.byTime = append(ix.byTime[:i], ix.byTime[i+1:]...)
+	}
+
+	return e
+}
+
+// timeRange returns the IDs received in [since, until), in time order.
+// Zero bounds are open.
+func (ix *index) timeRange(since, until time.Time) []string {
+	lo := 0
+	if !since.IsZero() {
+		lo = sort.Search(len(ix.byTime), func(i int) bool { return !ix.byTime[i].at.Before(since) })
+	}
+	hi := len(ix.byTime)
+	if !until.IsZero() {
+		hi = sort.Search(len(ix.byTime), func(i int) bool { return !ix.byTime[i].at.Before(until) })
+	}
+
+	ids := make([]string, 0, max(hi-lo, 0))
+	for _, k := range ix.byTime[lo:max(hi, lo)] {
+		ids = append(ids, k.id)
+	}
+	return ids
+}
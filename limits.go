@@ -148,6 +148,9 @@ type ConnectionInfo struct {
 	// RemoteIP is just the IP portion.
 	RemoteIP IPAddress
 
+	// ReverseDNS is the client's reverse DNS name, if it was looked up.
+	ReverseDNS ReverseDNS
+
 	// LocalAddr is the local address (IP:port).
 	LocalAddr LocalAddress
 
@@ -61,6 +61,7 @@ const (
 	AttrCipherSuite  LogAttrKey = "cipher_suite"
 	AttrDuration     LogAttrKey = "duration_ms"
 	AttrEnvelopeID   LogAttrKey = "envelope_id"
+	AttrStorageID    LogAttrKey = "storage_id"
 )
 
 // LogLevel represents a logging level.
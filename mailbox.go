@@ -26,6 +26,10 @@ type SessionInfo interface {
 	// ClientIP returns the client's IP address.
 	ClientIP() IPAddress
 
+	// ClientReverseDNS returns the client's reverse DNS name, if it was
+	// looked up.
+	ClientReverseDNS() ReverseDNS
+
 	// TLSActive returns true if TLS is active.
 	TLSActive() bool
 
@@ -42,6 +46,17 @@ type SessionInfo interface {
 	CurrentRecipientCount() RecipientCount
 }
 
+// SessionDetails is optionally implemented by a SessionInfo, such as the
+// Engine, to report details that external policy services ask for.
+type SessionDetails interface {
+	// ESMTP returns true if the client greeted with EHLO.
+	ESMTP() bool
+
+	// TLSState returns the TLS connection state, or nil if TLS is not
+	// active.
+	TLSState() *TLSConnectionState
+}
+
 // MailboxExtended provides additional optional operations beyond basic validation.
 type MailboxExtended interface {
 	Mailbox
@@ -129,6 +144,10 @@ type SenderResult struct {
 
 	// RequireAuth indicates authentication is required for this sender.
 	RequireAuth bool
+
+	// AuthResults are authentication checks made on the sender, such as
+	// SPF. They are recorded in the envelope's metadata.
+	AuthResults []AuthResult
 }
 
 // SenderResultAccepted returns a successful sender validation result.
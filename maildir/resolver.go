@@ -0,0 +1,74 @@
+package maildir
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// ErrUnresolvable indicates a recipient could not be mapped to a Maildir.
+var ErrUnresolvable = errors.New("recipient has no maildir")
+
+// Resolver maps a recipient to the Maildir directory that receives its mail.
+// The returned path is the Maildir root (the directory containing
+// tmp, new and cur), not one of its subdirectories.
+type Resolver interface {
+	// Resolve returns the Maildir root for the recipient.
+	Resolve(ctx context.Context, recipient icesmtp.MailPath) (string, error)
+}
+
+// ResolverFunc adapts a function to the Resolver interface.
+type ResolverFunc func(ctx context.Context, recipient icesmtp.MailPath) (string, error)
+
+// Resolve calls f.
+func (f ResolverFunc) Resolve(ctx context.Context, recipient icesmtp.MailPath) (string, error) {
+	return f(ctx, recipient)
+}
+
+// DomainResolver lays out Maildirs as <Root>/<domain>/<local-part>.
+// Addresses are lowercased and path separators are rejected so that a
+// recipient can never escape Root.
+type DomainResolver struct {
+	// Root is the directory containing one subdirectory per domain.
+	Root string
+}
+
+// Resolve returns <Root>/<domain>/<local-part> for the recipient.
+func (r DomainResolver) Resolve(_ context.Context, recipient icesmtp.MailPath) (string, error) {
+	addr := strings.ToLower(recipient.Address)
+	idx := strings.LastIndex(addr, "@")
+	if idx <= 0 || idx == len(addr)-1 {
+		return "", ErrUnresolvable
+	}
+
+	local, domain := addr[:idx], addr[idx+1:]
+	if !safePathElement(local) || !safePathElement(domain) {
+		return "", ErrUnresolvable
+	}
+
+	return filepath.Join(r.Root, domain, local), nil
+}
+
+// Healthy reports whether Root exists and is a directory.
+func (r DomainResolver) Healthy(_ context.Context) error {
+	info, err := os.Stat(r.Root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("maildir root is not a directory")
+	}
+	return nil
+}
+
+// safePathElement reports whether s can be used as a single path element.
+func safePathElement(s string) bool {
+	if s == "" || s == "." || s == ".." {
+		return false
+	}
+	return !strings.ContainsAny(s, "/\\\x00")
+}
@@ -0,0 +1,388 @@
+// Package maildir provides a Storage implementation that delivers messages
+// into per-recipient Maildir directories.
+//
+// Each recipient receives its own copy of the message with Return-Path and
+// Delivered-To headers prepended. Files are written to tmp/, synced, and
+// atomically renamed into new/ as described by the Maildir specification.
+package maildir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/eol"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// Storage delivers envelopes into Maildir directories.
+type Storage struct {
+	resolver     Resolver
+	hostname     string
+	dirMode      os.FileMode
+	fileMode     os.FileMode
+	keepCRLF     bool
+	allowPartial bool
+	tempDir      string
+
+	mu      sync.Mutex
+	metrics icesmtp.StorageMetrics
+}
+
+// Option configures a Storage.
+type Option func(*Storage)
+
+// WithHostname sets the hostname used in generated file names.
+// Defaults to os.Hostname().
+func WithHostname(hostname string) Option {
+	return func(s *Storage) {
+		s.hostname = hostname
+	}
+}
+
+// WithModes sets the permissions for created directories and message files.
+// Defaults are 0700 and 0600.
+func WithModes(dirMode, fileMode os.FileMode) Option {
+	return func(s *Storage) {
+		s.dirMode = dirMode
+		s.fileMode = fileMode
+	}
+}
+
+// WithCRLF stores messages with their SMTP CRLF line endings.
+// By default line endings are converted to LF.
+func WithCRLF() Option {
+	return func(s *Storage) {
+		s.keepCRLF = true
+	}
+}
+
+// WithPartialDelivery makes a store succeed when at least one recipient
+// was delivered. Failed recipients are reported in the Receipt.
+// By default any failure fails the whole store, which causes the client to
+// retry and may duplicate the message for recipients that succeeded.
+func WithPartialDelivery() Option {
+	return func(s *Storage) {
+		s.allowPartial = true
+	}
+}
+
+// WithTempDir sets the directory used to spool StoreStream data before it
+// is copied to each recipient. Defaults to os.TempDir().
+func WithTempDir(dir string) Option {
+	return func(s *Storage) {
+		s.tempDir = dir
+	}
+}
+
+// NewStorage creates a Maildir storage that maps recipients with resolver.
+func NewStorage(resolver Resolver, opts ...Option) *Storage {
+	s := &Storage{
+		resolver: resolver,
+		dirMode:  0700,
+		fileMode: 0600,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.hostname == "" {
+		s.hostname, _ = os.Hostname()
+		if s.hostname == "" {
+			s.hostname = "localhost"
+		}
+	}
+
+	return s
+}
+
+// Delivery records the outcome of delivering to one recipient.
+type Delivery struct {
+	// Recipient is the envelope recipient.
+	Recipient icesmtp.MailPath
+
+	// Path is the final location of the message file, if delivered.
+	Path string
+
+	// Err is the delivery error, or nil on success.
+	Err error
+}
+
+// Receipt is the backend receipt returned in StorageReceipt.Backend.
+type Receipt struct {
+	// Deliveries lists the outcome for every recipient, in envelope order.
+	Deliveries []Delivery
+}
+
+// PartialDeliveryError reports that some recipients could not be delivered.
+type PartialDeliveryError struct {
+	// Deliveries lists the outcome for every recipient, in envelope order.
+	Deliveries []Delivery
+}
+
+func (e *PartialDeliveryError) Error() string {
+	failed := e.Failed()
+	parts := make([]string, 0, len(failed))
+	for _, d := range failed {
+		parts = append(parts, d.Recipient.Address+": "+d.Err.Error())
+	}
+	return fmt.Sprintf("delivered to %d of %d recipients (%s)",
+		len(e.Deliveries)-len(failed), len(e.Deliveries), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the individual delivery errors.
+func (e *PartialDeliveryError) Unwrap() []error {
+	var errs []error
+	for _, d := range e.Failed() {
+		errs = append(errs, d.Err)
+	}
+	return errs
+}
+
+// Failed returns the deliveries that did not succeed.
+func (e *PartialDeliveryError) Failed() []Delivery {
+	var failed []Delivery
+	for _, d := range e.Deliveries {
+		if d.Err != nil {
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
+
+// Store delivers the envelope data to every recipient.
+func (s *Storage) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	data := envelope.Data()
+	return s.deliver(ctx, envelope, icesmtp.StorageOpStore, func() io.Reader {
+		return bytes.NewReader(data)
+	})
+}
+
+// StoreStream delivers streamed data to every recipient.
+// The stream is spooled to a temporary file first so that each recipient
+// can be written independently.
+func (s *Storage) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	spool, err := os.CreateTemp(s.tempDir, "icesmtp-maildir-*")
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, icesmtp.StorageOpStoreStream, err, false, "failed to create spool file")
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	size, err := io.Copy(spool, data)
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
+	}
+
+	return s.deliver(ctx, envelope, icesmtp.StorageOpStoreStream, func() io.Reader {
+		return io.NewSectionReader(spool, 0, size)
+	})
+}
+
+// bodySource returns a fresh reader over the message data for one recipient.
+type bodySource func() io.Reader
+
+// deliver writes one file per recipient and aggregates the results.
+func (s *Storage) deliver(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, body bodySource) (icesmtp.StorageReceipt, error) {
+	start := time.Now()
+
+	recipients := envelope.Recipients()
+	deliveries := make([]Delivery, len(recipients))
+
+	var (
+		messageID icesmtp.StorageMessageID
+		written   int64
+		failed    int
+		retryable bool
+	)
+
+	for i, rcpt := range recipients {
+		deliveries[i].Recipient = rcpt
+
+		path, n, err := s.deliverOne(ctx, envelope, rcpt, body)
+		if err != nil {
+			deliveries[i].Err = err
+			failed++
+			if !errors.Is(err, ErrUnresolvable) {
+				retryable = true
+			}
+			continue
+		}
+
+		deliveries[i].Path = path
+		written += n
+		if messageID == "" {
+			messageID = filepath.Base(path)
+		}
+	}
+
+	partial := &PartialDeliveryError{Deliveries: deliveries}
+
+	if failed == len(recipients) && failed > 0 {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, partial, !retryable, "maildir delivery failed")
+	}
+	if failed > 0 && !s.allowPartial {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, partial, false, "maildir delivery incomplete")
+	}
+
+	s.mu.Lock()
+	s.metrics.MessagesStored++
+	s.metrics.BytesStored += uint64(written)
+	s.metrics.StoreLatencyNs = int64(time.Since(start))
+	s.mu.Unlock()
+
+	return icesmtp.StorageReceipt{
+		MessageID:    messageID,
+		EnvelopeID:   envelope.ID(),
+		StoredAt:     time.Now().Unix(),
+		BytesWritten: written,
+		Backend:      &Receipt{Deliveries: deliveries},
+	}, nil
+}
+
+// deliverOne writes the message for a single recipient and returns its path.
+func (s *Storage) deliverOne(ctx context.Context, envelope icesmtp.Envelope, rcpt icesmtp.MailPath, body bodySource) (string, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	dir, err := s.resolver.Resolve(ctx, rcpt)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := s.ensureMaildir(dir); err != nil {
+		return "", 0, err
+	}
+
+	name := s.uniqueName()
+	tmpPath := filepath.Join(dir, "tmp", name)
+	newPath := filepath.Join(dir, "new", name)
+
+	n, err := s.writeFile(tmpPath, traceHeader(envelope.MailFrom(), rcpt), body())
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", 0, err
+	}
+
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		os.Remove(tmpPath)
+		return "", 0, err
+	}
+	syncDir(filepath.Join(dir, "new"))
+
+	return newPath, n, nil
+}
+
+// writeFile creates path exclusively and writes header and body to it.
+func (s *Storage) writeFile(path string, header string, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, s.fileMode)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &storeutil.CountingWriter{W: f}
+	var w io.Writer = cw
+	var lf *eol.LFWriter
+	if !s.keepCRLF {
+		lf = eol.NewLFWriter(cw)
+		w = lf
+	}
+
+	_, err = io.WriteString(w, header)
+	if err == nil {
+		_, err = io.Copy(w, body)
+	}
+	if err == nil && lf != nil {
+		err = lf.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return cw.N, err
+}
+
+// ensureMaildir creates the tmp, new and cur subdirectories if missing.
+func (s *Storage) ensureMaildir(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), s.dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliveryCounter makes file names unique within this process.
+var deliveryCounter atomic.Uint64
+
+// uniqueName returns a Maildir file name of the form
+// <seconds>.M<microseconds>P<pid>Q<counter>.<hostname>.
+func (s *Storage) uniqueName() string {
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveryCounter.Add(1),
+		sanitizeHostname(s.hostname))
+}
+
+// sanitizeHostname escapes characters that are not allowed in Maildir names.
+func sanitizeHostname(h string) string {
+	h = strings.ReplaceAll(h, "/", `\057`)
+	return strings.ReplaceAll(h, ":", `\072`)
+}
+
+// traceHeader returns the Return-Path and Delivered-To header lines.
+func traceHeader(from icesmtp.MailPath, rcpt icesmtp.MailPath) string {
+	returnPath := "<>"
+	if !from.IsNull {
+		returnPath = "<" + from.Address + ">"
+	}
+	return "Return-Path: " + returnPath + "\r\n" +
+		"Delivered-To: " + rcpt.Address + "\r\n"
+}
+
+// syncDir fsyncs a directory so that a rename into it is durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Metrics returns storage metrics.
+func (s *Storage) Metrics() icesmtp.StorageMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// Healthy reports the health of the resolver, if it can report one.
+// DomainResolver checks that its root directory exists.
+func (s *Storage) Healthy(ctx context.Context) error {
+	if h, ok := s.resolver.(interface{ Healthy(context.Context) error }); ok {
+		return h.Healthy(ctx)
+	}
+	return nil
+}
+
+// Ensure Storage implements the interfaces.
+var (
+	_ icesmtp.Storage            = (*Storage)(nil)
+	_ icesmtp.StorageWithMetrics = (*Storage)(nil)
+	_ icesmtp.StorageWithHealth  = (*Storage)(nil)
+)
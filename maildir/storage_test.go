@@ -0,0 +1,155 @@
+package maildir
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+func buildEnvelope(t *testing.T, from string, data string, rcpts ...string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{})
+	b.SetMailFrom(icesmtp.MailPath{Address: from, IsNull: from == ""}, nil)
+	for _, r := range rcpts {
+		b.AddRecipient(icesmtp.MailPath{Address: r})
+	}
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("finalize: %v", err)
+	}
+	return env
+}
+
+func readNew(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("read new: %v", err)
+	}
+	var contents []string
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, "new", e.Name()))
+		if err != nil {
+			t.Fatalf("read message: %v", err)
+		}
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func TestStorage_DeliversToEachRecipient(t *testing.T) {
+	root := t.TempDir()
+	s := NewStorage(DomainResolver{Root: root}, WithHostname("mx.example.com"))
+
+	env := buildEnvelope(t, "sender@example.org", "Subject: hi\r\n\r\nbody\r\n",
+		"alice@example.com", "Bob@Example.com")
+
+	receipt, err := s.Store(context.Background(), env)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if !strings.HasSuffix(receipt.MessageID, ".mx.example.com") {
+		t.Errorf("unexpected message id %q", receipt.MessageID)
+	}
+
+	alice := readNew(t, filepath.Join(root, "example.com", "alice"))
+	if len(alice) != 1 {
+		t.Fatalf("expected 1 message for alice, got %d", len(alice))
+	}
+	want := "Return-Path: <sender@example.org>\nDelivered-To: alice@example.com\nSubject: hi\n\nbody\n"
+	if alice[0] != want {
+		t.Errorf("alice message = %q, want %q", alice[0], want)
+	}
+
+	bob := readNew(t, filepath.Join(root, "example.com", "bob"))
+	if len(bob) != 1 || !strings.Contains(bob[0], "Delivered-To: Bob@Example.com\n") {
+		t.Errorf("unexpected bob delivery: %q", bob)
+	}
+
+	for _, sub := range []string{"tmp", "cur"} {
+		if _, err := os.Stat(filepath.Join(root, "example.com", "alice", sub)); err != nil {
+			t.Errorf("missing %s: %v", sub, err)
+		}
+	}
+
+	if m := s.Metrics(); m.MessagesStored != 1 {
+		t.Errorf("MessagesStored = %d, want 1", m.MessagesStored)
+	}
+}
+
+func TestStorage_StoreStreamKeepsCRLF(t *testing.T) {
+	root := t.TempDir()
+	s := NewStorage(DomainResolver{Root: root}, WithCRLF())
+
+	env := buildEnvelope(t, "", "", "user@example.com")
+	_, err := s.StoreStream(context.Background(), env, strings.NewReader("Subject: x\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatalf("store stream: %v", err)
+	}
+
+	msgs := readNew(t, filepath.Join(root, "example.com", "user"))
+	want := "Return-Path: <>\r\nDelivered-To: user@example.com\r\nSubject: x\r\n\r\nhello\r\n"
+	if len(msgs) != 1 || msgs[0] != want {
+		t.Errorf("got %q, want %q", msgs, want)
+	}
+}
+
+func TestStorage_PartialFailure(t *testing.T) {
+	root := t.TempDir()
+	errDown := errors.New("quota service down")
+	resolver := ResolverFunc(func(ctx context.Context, rcpt icesmtp.MailPath) (string, error) {
+		if rcpt.Address == "broken@example.com" {
+			return "", errDown
+		}
+		return DomainResolver{Root: root}.Resolve(ctx, rcpt)
+	})
+
+	env := buildEnvelope(t, "s@example.org", "x\r\n", "ok@example.com", "broken@example.com")
+
+	_, err := NewStorage(resolver).Store(context.Background(), env)
+	var serr *icesmtp.StorageError
+	if !errors.As(err, &serr) || serr.Permanent {
+		t.Fatalf("expected retryable StorageError, got %v", err)
+	}
+	var perr *PartialDeliveryError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected PartialDeliveryError, got %v", err)
+	}
+	if failed := perr.Failed(); len(failed) != 1 || !errors.Is(failed[0].Err, errDown) {
+		t.Errorf("unexpected failures: %+v", failed)
+	}
+
+	receipt, err := NewStorage(resolver, WithPartialDelivery()).Store(context.Background(), env)
+	if err != nil {
+		t.Fatalf("partial delivery: %v", err)
+	}
+	backend := receipt.Backend.(*Receipt)
+	if backend.Deliveries[0].Err != nil || backend.Deliveries[1].Err == nil {
+		t.Errorf("unexpected deliveries: %+v", backend.Deliveries)
+	}
+}
+
+func TestStorage_UnresolvableIsPermanent(t *testing.T) {
+	s := NewStorage(DomainResolver{Root: t.TempDir()})
+	env := buildEnvelope(t, "s@example.org", "x\r\n", "../../etc@example.com")
+
+	_, err := s.Store(context.Background(), env)
+	var serr *icesmtp.StorageError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected StorageError, got %v", err)
+	}
+	if !serr.Permanent {
+		t.Error("unresolvable recipient should not be retryable")
+	}
+	if !errors.Is(err, ErrUnresolvable) {
+		t.Errorf("expected ErrUnresolvable, got %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package mbox
+
+import "os"
+
+// lockFile is a no-op on platforms without flock. Writers within one
+// process are still serialized by the Storage's in-process lock.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile is a no-op on platforms without flock.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,383 @@
+// Package mbox provides a Storage implementation that appends messages to
+// mbox files in the mboxrd format.
+//
+// Messages may be written to one shared file or to one file per recipient.
+// Appends are serialized within the process and, on Unix, with flock(2)
+// so that concurrent sessions and external readers see whole messages.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// Resolver maps a recipient to the mbox file that receives its mail.
+type Resolver interface {
+	// Resolve returns the path of the mbox file for the recipient.
+	Resolve(ctx context.Context, recipient icesmtp.MailPath) (string, error)
+}
+
+// ResolverFunc adapts a function to the Resolver interface.
+type ResolverFunc func(ctx context.Context, recipient icesmtp.MailPath) (string, error)
+
+// Resolve calls f.
+func (f ResolverFunc) Resolve(ctx context.Context, recipient icesmtp.MailPath) (string, error) {
+	return f(ctx, recipient)
+}
+
+// fromLineLayout is the asctime layout used in From_ separator lines.
+const fromLineLayout = "Mon Jan _2 15:04:05 2006"
+
+// Storage appends envelopes to mbox files.
+type Storage struct {
+	shared   string
+	resolver Resolver
+	fileMode os.FileMode
+	tempDir  string
+
+	mu      sync.Mutex
+	locks   map[string]*pathLock
+	metrics icesmtp.StorageMetrics
+}
+
+// pathLock serializes writers to one file. refs counts the writers
+// holding or waiting for it; the lock is dropped from the map at zero.
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Option configures a Storage.
+type Option func(*Storage)
+
+// WithFileMode sets the permissions for newly created mbox files.
+// Defaults to 0600.
+func WithFileMode(mode os.FileMode) Option {
+	return func(s *Storage) {
+		s.fileMode = mode
+	}
+}
+
+// WithTempDir sets the directory used to spool StoreStream data when it
+// must be written to more than one file. Defaults to os.TempDir().
+func WithTempDir(dir string) Option {
+	return func(s *Storage) {
+		s.tempDir = dir
+	}
+}
+
+// NewStorage creates a storage that appends every message to one shared
+// mbox file at path.
+func NewStorage(path string, opts ...Option) *Storage {
+	s := newStorage(opts)
+	s.shared = path
+	return s
+}
+
+// NewPerRecipientStorage creates a storage that appends a copy of each
+// message to the mbox file of every recipient.
+func NewPerRecipientStorage(resolver Resolver, opts ...Option) *Storage {
+	s := newStorage(opts)
+	s.resolver = resolver
+	return s
+}
+
+func newStorage(opts []Option) *Storage {
+	s := &Storage{
+		fileMode: 0600,
+		locks:    make(map[string]*pathLock),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// target is one mbox file write for a message.
+type target struct {
+	path      string
+	recipient *icesmtp.MailPath
+}
+
+// Store appends the envelope data to the target mbox file(s).
+func (s *Storage) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	data := envelope.Data()
+	return s.store(ctx, envelope, icesmtp.StorageOpStore, func() io.Reader {
+		return bytes.NewReader(data)
+	})
+}
+
+// StoreStream appends streamed data to the target mbox file(s).
+// When more than one file is written the stream is spooled first.
+func (s *Storage) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	if s.shared != "" || envelope.RecipientCount() == 1 {
+		return s.store(ctx, envelope, icesmtp.StorageOpStoreStream, func() io.Reader {
+			return data
+		})
+	}
+
+	spool, err := os.CreateTemp(s.tempDir, "icesmtp-mbox-*")
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, icesmtp.StorageOpStoreStream, err, false, "failed to create spool file")
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
+	size, err := io.Copy(spool, data)
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
+	}
+
+	return s.store(ctx, envelope, icesmtp.StorageOpStoreStream, func() io.Reader {
+		return io.NewSectionReader(spool, 0, size)
+	})
+}
+
+// store resolves targets and appends the message to each of them.
+func (s *Storage) store(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, body func() io.Reader) (icesmtp.StorageReceipt, error) {
+	start := time.Now()
+
+	targets, err := s.targets(ctx, envelope)
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "failed to resolve mbox")
+	}
+
+	var (
+		written int64
+		errs    []error
+	)
+	for _, t := range targets {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		header := returnPath(envelope.MailFrom())
+		if t.recipient != nil {
+			header += "Delivered-To: " + t.recipient.Address + "\r\n"
+		}
+
+		n, err := s.appendMessage(t.path, envelope.MailFrom(), envelope.ReceivedAt(), header, body())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.path, err))
+			continue
+		}
+		written += n
+	}
+
+	if len(errs) > 0 {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, errors.Join(errs...), false, "mbox delivery failed")
+	}
+
+	s.mu.Lock()
+	s.metrics.MessagesStored++
+	s.metrics.BytesStored += uint64(written)
+	s.metrics.StoreLatencyNs = int64(time.Since(start))
+	s.mu.Unlock()
+
+	return icesmtp.StorageReceipt{
+		MessageID:    icesmtp.StorageMessageID(envelope.ID()),
+		EnvelopeID:   envelope.ID(),
+		StoredAt:     time.Now().Unix(),
+		BytesWritten: written,
+	}, nil
+}
+
+// targets returns the files the envelope must be appended to.
+func (s *Storage) targets(ctx context.Context, envelope icesmtp.Envelope) ([]target, error) {
+	if s.shared != "" {
+		return []target{{path: s.shared}}, nil
+	}
+
+	recipients := envelope.Recipients()
+	targets := make([]target, 0, len(recipients))
+	for i := range recipients {
+		path, err := s.resolver.Resolve(ctx, recipients[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", recipients[i].Address, err)
+		}
+		targets = append(targets, target{path: path, recipient: &recipients[i]})
+	}
+	return targets, nil
+}
+
+// appendMessage appends one mboxrd message to path under lock.
+// On failure the file is truncated back to its previous length.
+func (s *Storage) appendMessage(path string, from icesmtp.MailPath, receivedAt time.Time, header string, body io.Reader) (int64, error) {
+	unlock := s.lockPath(path)
+	defer unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, s.fileMode)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return 0, err
+	}
+	defer unlockFile(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset := info.Size()
+
+	cw := &storeutil.CountingWriter{W: f}
+	bw := bufio.NewWriter(cw)
+
+	err = writeMessage(bw, from, receivedAt, io.MultiReader(bytes.NewReader([]byte(header)), body))
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(offset)
+		return 0, err
+	}
+
+	return cw.N, nil
+}
+
+// lockPath serializes writers to the same file within this process. The
+// returned function releases the lock.
+func (s *Storage) lockPath(path string) func() {
+	key := filepath.Clean(path)
+
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &pathLock{}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		s.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// writeMessage writes a From_ line followed by the mboxrd-quoted message
+// and a terminating blank line. CRLF line endings are converted to LF.
+func writeMessage(w *bufio.Writer, from icesmtp.MailPath, receivedAt time.Time, r io.Reader) error {
+	sender := from.Address
+	if from.IsNull || sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	fmt.Fprintf(w, "From %s %s\n", sender, receivedAt.UTC().Format(fromLineLayout))
+
+	br := bufio.NewReader(r)
+	terminated := true
+	// A CR ending a chunk of a long line is held back until the next
+	// chunk shows whether it is part of the CRLF.
+	pendingCR := false
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if terminated && isFromLine(line) {
+				w.WriteByte('>')
+			}
+			terminated = line[len(line)-1] == '\n'
+			if terminated {
+				line = line[:len(line)-1]
+				if pendingCR && len(line) > 0 {
+					w.WriteByte('\r')
+				}
+				w.Write(bytes.TrimSuffix(line, []byte{'\r'}))
+				w.WriteByte('\n')
+				pendingCR = false
+			} else {
+				if pendingCR {
+					w.WriteByte('\r')
+				}
+				line, pendingCR = bytes.CutSuffix(line, []byte{'\r'})
+				w.Write(line)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if pendingCR {
+		w.WriteByte('\r')
+	}
+	if !terminated {
+		w.WriteByte('\n')
+	}
+	return w.WriteByte('\n')
+}
+
+// isFromLine reports whether line matches ^>*From and needs mboxrd quoting.
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// returnPath returns the Return-Path header line for the sender.
+func returnPath(from icesmtp.MailPath) string {
+	if from.IsNull {
+		return "Return-Path: <>\r\n"
+	}
+	return "Return-Path: <" + from.Address + ">\r\n"
+}
+
+// Metrics returns storage metrics.
+func (s *Storage) Metrics() icesmtp.StorageMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// Healthy checks that the directory of the shared mbox file exists.
+// Per-recipient storages defer to the resolver if it can report health.
+func (s *Storage) Healthy(ctx context.Context) error {
+	if s.shared != "" {
+		_, err := os.Stat(filepath.Dir(s.shared))
+		return err
+	}
+	if h, ok := s.resolver.(interface{ Healthy(context.Context) error }); ok {
+		return h.Healthy(ctx)
+	}
+	return nil
+}
+
+// Ensure Storage implements the interfaces.
+var (
+	_ icesmtp.Storage            = (*Storage)(nil)
+	_ icesmtp.StorageWithMetrics = (*Storage)(nil)
+	_ icesmtp.StorageWithHealth  = (*Storage)(nil)
+)
@@ -0,0 +1,146 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+func buildEnvelope(t *testing.T, from string, data string, rcpts ...string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{})
+	b.SetMailFrom(icesmtp.MailPath{Address: from, IsNull: from == ""}, nil)
+	for _, r := range rcpts {
+		b.AddRecipient(icesmtp.MailPath{Address: r})
+	}
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("finalize: %v", err)
+	}
+	return env
+}
+
+func TestStorage_MboxrdQuoting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	s := NewStorage(path)
+
+	data := "Subject: quoting\r\n\r\nFrom the start\r\n>From quoted\r\nnot From here\r\n"
+	if _, err := s.Store(context.Background(), buildEnvelope(t, "a@example.org", data, "b@example.com")); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(b), "\n")
+	if !strings.HasPrefix(lines[0], "From a@example.org ") {
+		t.Errorf("bad separator line %q", lines[0])
+	}
+	body := strings.Join(lines[1:], "\n")
+	want := "Return-Path: <a@example.org>\nSubject: quoting\n\n>From the start\n>>From quoted\nnot From here\n\n"
+	if body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestWriteMessage_LongLines(t *testing.T) {
+	// Lines longer than the 4096-byte read buffer arrive in chunks; put
+	// a CR at the end of the first chunk.
+	long := strings.Repeat("x", 4095)
+	tests := []struct {
+		data, want string
+	}{
+		{long + "\r\nnext\r\n", long + "\nnext\n"},
+		{long + "\ry\r\n", long + "\ry\n"},
+		{long + "\r", long + "\r\n"},
+	}
+	for i, tt := range tests {
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		if err := writeMessage(w, icesmtp.MailPath{Address: "a@example.org"}, time.Now(), strings.NewReader(tt.data)); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		_, got, _ := strings.Cut(b.String(), "\n")
+		if got != tt.want+"\n" {
+			t.Errorf("%d: message = %q", i, got)
+		}
+	}
+}
+
+func TestStorage_PerRecipient(t *testing.T) {
+	dir := t.TempDir()
+	s := NewPerRecipientStorage(ResolverFunc(func(_ context.Context, rcpt icesmtp.MailPath) (string, error) {
+		return filepath.Join(dir, strings.SplitN(rcpt.Address, "@", 2)[0]), nil
+	}))
+
+	env := buildEnvelope(t, "", "Subject: x\r\n\r\nno newline", "alice@example.com", "bob@example.com")
+	if _, err := s.StoreStream(context.Background(), env, strings.NewReader(string(env.Data()))); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	for _, name := range []string{"alice", "bob"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := string(b)
+		if !strings.HasPrefix(msg, "From MAILER-DAEMON ") {
+			t.Errorf("%s: bad separator: %q", name, msg)
+		}
+		if !strings.Contains(msg, "Delivered-To: "+name+"@example.com\n") {
+			t.Errorf("%s: missing Delivered-To: %q", name, msg)
+		}
+		if !strings.HasSuffix(msg, "no newline\n\n") {
+			t.Errorf("%s: message not terminated: %q", name, msg)
+		}
+	}
+	if len(s.locks) != 0 {
+		t.Errorf("%d path locks left after the store", len(s.locks))
+	}
+}
+
+func TestStorage_ConcurrentAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.mbox")
+	s := NewStorage(path)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			env := buildEnvelope(t, "a@example.org", "Subject: c\r\n\r\n"+strings.Repeat("x", 10000)+"\r\n", "b@example.com")
+			if _, err := s.Store(context.Background(), env); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\nFrom a@example.org ") + 1; got != n {
+		t.Errorf("found %d messages, want %d", got, n)
+	}
+	if s.Metrics().MessagesStored != n {
+		t.Errorf("MessagesStored = %d, want %d", s.Metrics().MessagesStored, n)
+	}
+	if len(s.locks) != 0 {
+		t.Errorf("%d path locks left after the appends", len(s.locks))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
 )
 
 // Storage is an in-memory Storage implementation.
@@ -72,15 +73,7 @@ func (s *Storage) StoreStream(ctx context.Context, envelope icesmtp.Envelope, da
 	// Read all data into memory
 	buf, err := io.ReadAll(data)
 	if err != nil {
-		s.mu.Lock()
-		s.metrics.StoreErrors++
-		s.mu.Unlock()
-		return icesmtp.StorageReceipt{}, &icesmtp.StorageError{
-			Operation:  icesmtp.StorageOpStoreStream,
-			EnvelopeID: envelope.ID(),
-			Cause:      err,
-			Message:    "failed to read message data",
-		}
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
 	}
 
 	s.mu.Lock()
@@ -0,0 +1,157 @@
+// Package milter implements the MTA side of the Sendmail milter protocol,
+// so that existing milters (OpenDKIM, rspamd, custom filters) can inspect
+// and modify mail received by icesmtp.
+//
+// A Client is an icesmtp.SessionFilterFactory: set it as
+// SessionConfig.SessionFilterFactory, alone or in an
+// icesmtp.SessionFilterChain, and every SMTP session opens its own
+// milter connection, which is consulted at connect, HELO, MAIL, RCPT and
+// end of message (headers, body and end-of-body). Protocol version 6 is
+// negotiated, including the "no" and "no reply" stage options.
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Client creates a milter connection for each SMTP session.
+type Client struct {
+	network string
+	address string
+
+	dialTimeout    time.Duration
+	commandTimeout time.Duration
+	actions        uint32
+	protocol       uint32
+	failOpen       bool
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithDialTimeout bounds connecting to the milter and option negotiation.
+// Defaults to 10 seconds.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// WithCommandTimeout bounds each exchange with the milter. Defaults to
+// 30 seconds.
+func WithCommandTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.commandTimeout = d
+	}
+}
+
+// WithActions limits the modifications offered to the milter. Defaults
+// to ActionAll.
+func WithActions(actions uint32) Option {
+	return func(c *Client) {
+		c.actions = actions & ActionAll
+	}
+}
+
+// WithProtocol limits the protocol options offered to the milter.
+// Defaults to ProtoAll.
+func WithProtocol(protocol uint32) Option {
+	return func(c *Client) {
+		c.protocol = protocol & ProtoAll
+	}
+}
+
+// WithFailOpen lets sessions continue unfiltered if the milter cannot be
+// reached or fails. By default such sessions are tempfailed.
+func WithFailOpen() Option {
+	return func(c *Client) {
+		c.failOpen = true
+	}
+}
+
+// New creates a Client for the milter listening at address, e.g.
+// New("tcp", "127.0.0.1:8891") or New("unix", "/run/opendkim.sock").
+func New(network, address string, opts ...Option) *Client {
+	c := &Client{
+		network:        network,
+		address:        address,
+		dialTimeout:    10 * time.Second,
+		commandTimeout: 30 * time.Second,
+		actions:        ActionAll,
+		protocol:       ProtoAll,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewSessionFilter connects to the milter and negotiates options.
+func (c *Client) NewSessionFilter(ctx context.Context, info icesmtp.SessionInfo) (icesmtp.SessionFilter, error) {
+	s, err := c.dial(ctx)
+	if err != nil {
+		if c.failOpen {
+			return icesmtp.NullSessionFilter{}, nil
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// dial connects and negotiates.
+func (c *Client) dial(ctx context.Context) (*session, error) {
+	dialer := net.Dialer{Timeout: c.dialTimeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("milter: dial %s: %w", c.address, err)
+	}
+
+	s := &session{
+		client: c,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+	}
+
+	conn.SetDeadline(time.Now().Add(c.dialTimeout))
+	if err := s.negotiate(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("milter: negotiate with %s: %w", c.address, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return s, nil
+}
+
+// negotiate performs the option negotiation.
+func (s *session) negotiate() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], Version)
+	binary.BigEndian.PutUint32(data[4:], s.client.actions)
+	binary.BigEndian.PutUint32(data[8:], s.client.protocol)
+	if err := writePacket(s.conn, cmdOptNeg, data); err != nil {
+		return err
+	}
+
+	p, err := readPacket(s.r)
+	if err != nil {
+		return err
+	}
+	if p.code != cmdOptNeg || len(p.data) < 12 {
+		return fmt.Errorf("%w: unexpected negotiation reply %q", ErrProtocol, p.code)
+	}
+
+	version := binary.BigEndian.Uint32(p.data[0:])
+	if version < 2 {
+		return fmt.Errorf("%w: unsupported version %d", ErrProtocol, version)
+	}
+	s.actions = binary.BigEndian.Uint32(p.data[4:]) & s.client.actions
+	s.protocol = binary.BigEndian.Uint32(p.data[8:]) & s.client.protocol
+	return nil
+}
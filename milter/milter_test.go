@@ -0,0 +1,360 @@
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// fakeMilter is an in-process milter. respond returns the replies to
+// each command that expects one.
+type fakeMilter struct {
+	ln       net.Listener
+	actions  uint32
+	protocol uint32
+	respond  func(p packet) []packet
+
+	mu       sync.Mutex
+	received []packet
+}
+
+func newFakeMilter(t *testing.T, respond func(p packet) []packet) *fakeMilter {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMilter{ln: ln, actions: ActionAll, respond: respond}
+	t.Cleanup(func() { ln.Close() })
+	go m.serve()
+	return m
+}
+
+func (m *fakeMilter) serve() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *fakeMilter) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.received = append(m.received, p)
+		m.mu.Unlock()
+
+		var replies []packet
+		switch p.code {
+		case cmdOptNeg:
+			data := make([]byte, 12)
+			binary.BigEndian.PutUint32(data[0:], Version)
+			binary.BigEndian.PutUint32(data[4:], m.actions)
+			binary.BigEndian.PutUint32(data[8:], m.protocol)
+			replies = []packet{{code: cmdOptNeg, data: data}}
+		case cmdMacro, cmdAbort:
+		case cmdQuit:
+			return
+		default:
+			replies = m.respond(p)
+			if replies == nil {
+				replies = []packet{{code: respContinue}}
+			}
+			if p.code == cmdHeader && m.protocol&ProtoNoReplyHeader != 0 {
+				replies = nil
+			}
+		}
+		for _, reply := range replies {
+			writePacket(conn, reply.code, reply.data)
+		}
+	}
+}
+
+// commands returns the codes of the commands received so far.
+func (m *fakeMilter) commands() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	for _, p := range m.received {
+		b.WriteByte(p.code)
+	}
+	return b.String()
+}
+
+// testSession is a minimal icesmtp.SessionInfo.
+type testSession struct{}
+
+func (testSession) ID() icesmtp.SessionID                         { return "sess-1" }
+func (testSession) State() icesmtp.State                          { return icesmtp.StateGreeted }
+func (testSession) ClientHostname() icesmtp.Hostname              { return "client.example.com" }
+func (testSession) ClientIP() icesmtp.IPAddress                   { return "192.0.2.1" }
+func (testSession) ClientReverseDNS() icesmtp.ReverseDNS          { return icesmtp.ReverseDNS{} }
+func (testSession) TLSActive() bool                               { return false }
+func (testSession) Authenticated() bool                           { return false }
+func (testSession) AuthenticatedUser() icesmtp.Username           { return "" }
+func (testSession) CurrentMailFrom() *icesmtp.MailPath            { return nil }
+func (testSession) CurrentRecipientCount() icesmtp.RecipientCount { return 0 }
+
+// confirmedSession is a testSession with a forward-confirmed reverse DNS
+// name.
+type confirmedSession struct{ testSession }
+
+func (confirmedSession) ClientReverseDNS() icesmtp.ReverseDNS {
+	return icesmtp.ReverseDNS{Name: "mail.example.com", Confirmed: true}
+}
+
+func TestConnectData(t *testing.T) {
+	if got := string(connectData(confirmedSession{})); got != "mail.example.com\x004\x00\x00192.0.2.1\x00" {
+		t.Errorf("connect data with reverse DNS = %q", got)
+	}
+}
+
+func TestPathData(t *testing.T) {
+	params := icesmtp.ESMTPParams{"SIZE": "1000", "BODY": "8BITMIME", "SMTPUTF8": ""}
+	want := "<a@example.org>\x00BODY=8BITMIME\x00SIZE=1000\x00SMTPUTF8\x00"
+	for range 10 {
+		if got := string(pathData(icesmtp.MailPath{Address: "a@example.org"}, params)); got != want {
+			t.Fatalf("pathData = %q, want %q", got, want)
+		}
+	}
+}
+
+func buildEnvelope(t *testing.T, data string, rcpts ...string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{SessionID: "sess-1"})
+	b.SetMailFrom(icesmtp.MailPath{Address: "sender@example.org"}, nil)
+	for _, r := range rcpts {
+		b.AddRecipient(icesmtp.MailPath{Address: r})
+	}
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestClient_StageReplies(t *testing.T) {
+	var connect []byte
+	m := newFakeMilter(t, func(p packet) []packet {
+		switch p.code {
+		case cmdConnect:
+			connect = p.data
+		case cmdRcpt:
+			if strings.HasPrefix(string(p.data), "<bad@") {
+				return []packet{{code: respReplyCode, data: cstrings("550 5.7.1 No thanks")}}
+			}
+			if strings.HasPrefix(string(p.data), "<later@") {
+				return []packet{{code: respProgress}, {code: respTempFail}}
+			}
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	f, err := New("tcp", m.ln.Addr().String()).NewSessionFilter(ctx, testSession{})
+	if err != nil {
+		t.Fatalf("NewSessionFilter: %v", err)
+	}
+	defer f.Close()
+
+	if r := f.Connect(ctx, testSession{}); r.Decision != icesmtp.PolicyAllow {
+		t.Errorf("Connect = %+v", r)
+	}
+	if !strings.HasPrefix(string(connect), "[192.0.2.1]\x004") {
+		t.Errorf("connect data = %q", connect)
+	}
+	if r := f.Helo(ctx, "client.example.com", testSession{}); r.Decision != icesmtp.PolicyAllow {
+		t.Errorf("Helo = %+v", r)
+	}
+	if r := f.MailFrom(ctx, icesmtp.MailPath{Address: "sender@example.org"}, nil, testSession{}); r.Decision != icesmtp.PolicyAllow {
+		t.Errorf("MailFrom = %+v", r)
+	}
+
+	r := f.RcptTo(ctx, icesmtp.MailPath{Address: "bad@example.com"}, nil, testSession{})
+	if r.Decision != icesmtp.PolicyDeny || r.Response.Code != 550 || r.Response.EnhancedCode == nil {
+		t.Errorf("RcptTo(bad) = %+v", r)
+	}
+	if r := f.RcptTo(ctx, icesmtp.MailPath{Address: "later@example.com"}, nil, testSession{}); r.Decision != icesmtp.PolicyDefer {
+		t.Errorf("RcptTo(later) = %+v", r)
+	}
+	if r := f.RcptTo(ctx, icesmtp.MailPath{Address: "good@example.com"}, nil, testSession{}); r.Decision != icesmtp.PolicyAllow {
+		t.Errorf("RcptTo(good) = %+v", r)
+	}
+
+	if got := m.commands(); got != "OCHDMDRDRDR" {
+		t.Errorf("commands = %q", got)
+	}
+}
+
+func TestClient_EndOfMessageModifications(t *testing.T) {
+	var headers []string
+	var body []byte
+	m := newFakeMilter(t, func(p packet) []packet {
+		switch p.code {
+		case cmdHeader:
+			headers = append(headers, strings.Join(splitCStrings(p.data), ": "))
+		case cmdBody:
+			body = append(body, p.data...)
+		case cmdEOB:
+			chg := binary.BigEndian.AppendUint32(nil, 1)
+			chg = append(chg, cstrings("Subject", "[SPAM] Hello")...)
+			return []packet{
+				{code: respAddHeader, data: cstrings("X-Milter", "checked")},
+				{code: respChgHeader, data: chg},
+				{code: respAddRcpt, data: cstrings("<c@example.com>")},
+				{code: respDelRcpt, data: cstrings("<a@example.com>")},
+				{code: respQuarantine, data: cstrings("looks spammy")},
+				{code: respContinue},
+			}
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	f, err := New("tcp", m.ln.Addr().String()).NewSessionFilter(ctx, testSession{})
+	if err != nil {
+		t.Fatalf("NewSessionFilter: %v", err)
+	}
+	defer f.Close()
+
+	env := buildEnvelope(t, "Subject: Hello\r\nX-Long: a\r\n b\r\n\r\nBody line.\r\n", "a@example.com", "b@example.com")
+	result, err := f.Filter(ctx, env, testSession{})
+	if err != nil {
+		t.Fatalf("Filter: %v", err)
+	}
+
+	if len(headers) != 2 || headers[0] != "Subject: Hello" || headers[1] != "X-Long: a\n b" {
+		t.Errorf("headers sent = %q", headers)
+	}
+	if string(body) != "Body line.\r\n" {
+		t.Errorf("body sent = %q", body)
+	}
+
+	if result.Action != icesmtp.FilterQuarantine || result.Reason != "looks spammy" {
+		t.Errorf("result = %+v", result)
+	}
+	out := result.Envelope
+	if out == nil {
+		t.Fatal("no modified envelope")
+	}
+	h := out.Headers()
+	if h.Get("X-Milter") != "checked" || h.Get("Subject") != "[SPAM] Hello" {
+		t.Errorf("modified headers = %+v", h.Fields)
+	}
+	rcpts := out.Recipients()
+	if len(rcpts) != 2 || rcpts[0].Address != "b@example.com" || rcpts[1].Address != "c@example.com" {
+		t.Errorf("recipients = %+v", rcpts)
+	}
+	if !out.Metadata().Quarantined {
+		t.Error("envelope not quarantined")
+	}
+}
+
+func TestClient_EndOfMessageReject(t *testing.T) {
+	m := newFakeMilter(t, func(p packet) []packet {
+		if p.code == cmdEOB {
+			return []packet{{code: respReplyCode, data: cstrings("554 5.7.1 Virus found")}}
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	f, err := New("tcp", m.ln.Addr().String()).NewSessionFilter(ctx, testSession{})
+	if err != nil {
+		t.Fatalf("NewSessionFilter: %v", err)
+	}
+	defer f.Close()
+
+	result, err := f.Filter(ctx, buildEnvelope(t, "Subject: x\r\n\r\nbody\r\n", "a@example.com"), testSession{})
+	if err != nil {
+		t.Fatalf("Filter: %v", err)
+	}
+	if result.Action != icesmtp.FilterReject || result.Response.Code != 554 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestClient_NegotiatedProtocolSkipsStages(t *testing.T) {
+	m := newFakeMilter(t, func(p packet) []packet { return nil })
+	m.protocol = ProtoNoConnect | ProtoNoHelo | ProtoNoBody | ProtoNoReplyHeader
+
+	ctx := context.Background()
+	f, err := New("tcp", m.ln.Addr().String()).NewSessionFilter(ctx, testSession{})
+	if err != nil {
+		t.Fatalf("NewSessionFilter: %v", err)
+	}
+	defer f.Close()
+
+	f.Connect(ctx, testSession{})
+	f.Helo(ctx, "client.example.com", testSession{})
+	if _, err := f.Filter(ctx, buildEnvelope(t, "Subject: x\r\n\r\nbody\r\n", "a@example.com"), testSession{}); err != nil {
+		t.Fatalf("Filter: %v", err)
+	}
+	if got := m.commands(); got != "OTLNDE" {
+		t.Errorf("commands = %q", got)
+	}
+}
+
+func TestClient_Unavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx := context.Background()
+	if _, err := New("tcp", addr).NewSessionFilter(ctx, testSession{}); err == nil {
+		t.Error("expected dial error")
+	}
+
+	f, err := New("tcp", addr, WithFailOpen()).NewSessionFilter(ctx, testSession{})
+	if err != nil {
+		t.Fatalf("fail open: %v", err)
+	}
+	if r := f.Connect(ctx, testSession{}); r.Decision != icesmtp.PolicyAllow {
+		t.Errorf("Connect = %+v", r)
+	}
+}
+
+func TestClient_MilterFailsMidSession(t *testing.T) {
+	m := newFakeMilter(t, func(p packet) []packet {
+		if p.code == cmdMail {
+			return []packet{{code: 'Z'}}
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	f, err := New("tcp", m.ln.Addr().String()).NewSessionFilter(ctx, testSession{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := f.MailFrom(ctx, icesmtp.MailPath{Address: "sender@example.org"}, nil, testSession{})
+	if r.Decision != icesmtp.PolicyDefer || r.Response.Code != 451 {
+		t.Errorf("MailFrom = %+v", r)
+	}
+	if _, err := f.Filter(ctx, buildEnvelope(t, "Subject: x\r\n\r\nbody\r\n", "a@example.com"), testSession{}); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Filter error = %v, want ErrProtocol", err)
+	}
+}
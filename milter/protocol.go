@@ -0,0 +1,171 @@
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the milter protocol version offered by the client.
+const Version = 6
+
+// Commands sent from the MTA to the milter.
+const (
+	cmdAbort   byte = 'A'
+	cmdBody    byte = 'B'
+	cmdConnect byte = 'C'
+	cmdMacro   byte = 'D'
+	cmdEOB     byte = 'E'
+	cmdHelo    byte = 'H'
+	cmdHeader  byte = 'L'
+	cmdMail    byte = 'M'
+	cmdEOH     byte = 'N'
+	cmdOptNeg  byte = 'O'
+	cmdQuit    byte = 'Q'
+	cmdRcpt    byte = 'R'
+	cmdData    byte = 'T'
+)
+
+// Responses sent from the milter to the MTA.
+const (
+	respAddRcpt    byte = '+'
+	respDelRcpt    byte = '-'
+	respAddRcptPar byte = '2'
+	respShutdown   byte = '4'
+	respAccept     byte = 'a'
+	respReplBody   byte = 'b'
+	respContinue   byte = 'c'
+	respDiscard    byte = 'd'
+	respChgFrom    byte = 'e'
+	respConnFail   byte = 'f'
+	respAddHeader  byte = 'h'
+	respInsHeader  byte = 'i'
+	respSetSymList byte = 'l'
+	respChgHeader  byte = 'm'
+	respProgress   byte = 'p'
+	respQuarantine byte = 'q'
+	respReject     byte = 'r'
+	respSkip       byte = 's'
+	respTempFail   byte = 't'
+	respReplyCode  byte = 'y'
+)
+
+// Action flags: modifications a milter may make at end of message.
+const (
+	ActionAddHeader  uint32 = 0x01
+	ActionChgBody    uint32 = 0x02
+	ActionAddRcpt    uint32 = 0x04
+	ActionDelRcpt    uint32 = 0x08
+	ActionChgHeader  uint32 = 0x10
+	ActionQuarantine uint32 = 0x20
+	ActionChgFrom    uint32 = 0x40
+	ActionAddRcptPar uint32 = 0x80
+	ActionSetSymList uint32 = 0x100
+
+	// ActionAll is every action this client can apply.
+	ActionAll = ActionAddHeader | ActionChgBody | ActionAddRcpt | ActionDelRcpt |
+		ActionChgHeader | ActionQuarantine | ActionChgFrom | ActionAddRcptPar
+)
+
+// Protocol flags: stages a milter does not want to see (No*) or will not
+// reply to (NoReply*).
+const (
+	ProtoNoConnect      uint32 = 0x01
+	ProtoNoHelo         uint32 = 0x02
+	ProtoNoMail         uint32 = 0x04
+	ProtoNoRcpt         uint32 = 0x08
+	ProtoNoBody         uint32 = 0x10
+	ProtoNoHeaders      uint32 = 0x20
+	ProtoNoEOH          uint32 = 0x40
+	ProtoNoReplyHeader  uint32 = 0x80
+	ProtoNoUnknown      uint32 = 0x100
+	ProtoNoData         uint32 = 0x200
+	ProtoSkip           uint32 = 0x400
+	ProtoRcptRejected   uint32 = 0x800
+	ProtoNoReplyConnect uint32 = 0x1000
+	ProtoNoReplyHelo    uint32 = 0x2000
+	ProtoNoReplyMail    uint32 = 0x4000
+	ProtoNoReplyRcpt    uint32 = 0x8000
+	ProtoNoReplyData    uint32 = 0x10000
+	ProtoNoReplyUnknown uint32 = 0x20000
+	ProtoNoReplyEOH     uint32 = 0x40000
+	ProtoNoReplyBody    uint32 = 0x80000
+
+	// ProtoAll is every protocol flag this client supports. Rejected
+	// recipients are never sent, so ProtoRcptRejected is not offered.
+	ProtoAll = ProtoNoConnect | ProtoNoHelo | ProtoNoMail | ProtoNoRcpt | ProtoNoBody |
+		ProtoNoHeaders | ProtoNoEOH | ProtoNoReplyHeader | ProtoNoUnknown | ProtoNoData |
+		ProtoSkip | ProtoNoReplyConnect | ProtoNoReplyHelo | ProtoNoReplyMail |
+		ProtoNoReplyRcpt | ProtoNoReplyData | ProtoNoReplyUnknown | ProtoNoReplyEOH |
+		ProtoNoReplyBody
+)
+
+// maxBodyChunk is the largest body chunk sent in one packet.
+const maxBodyChunk = 65535
+
+// maxPacket bounds the size of a packet read from a milter.
+const maxPacket = 64 << 20
+
+// ErrProtocol indicates the milter sent something the client could not
+// understand.
+var ErrProtocol = errors.New("milter protocol error")
+
+// packet is a single milter protocol message.
+type packet struct {
+	code byte
+	data []byte
+}
+
+// writePacket writes a packet with the given code and data.
+func writePacket(w io.Writer, code byte, data []byte) error {
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = code
+	copy(buf[5:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readPacket reads a single packet.
+func readPacket(r *bufio.Reader) (packet, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return packet{}, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > maxPacket {
+		return packet{}, fmt.Errorf("%w: packet length %d", ErrProtocol, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return packet{}, err
+	}
+	return packet{code: buf[0], data: buf[1:]}, nil
+}
+
+// cstrings encodes strings as consecutive NUL-terminated strings.
+func cstrings(s ...string) []byte {
+	var b bytes.Buffer
+	for _, v := range s {
+		b.WriteString(v)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// splitCStrings decodes consecutive NUL-terminated strings.
+func splitCStrings(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
+	}
+	parts := bytes.Split(data, []byte{0})
+	out := make([]string, len(parts))
+	for i, p := range parts {
+		out[i] = string(p)
+	}
+	return out
+}
@@ -0,0 +1,569 @@
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// session is the milter connection of a single SMTP session. It
+// implements icesmtp.SessionFilter.
+type session struct {
+	client *Client
+	conn   net.Conn
+	r      *bufio.Reader
+
+	// Negotiated actions and protocol flags
+	actions  uint32
+	protocol uint32
+
+	mu sync.Mutex
+
+	// skipSession is set when the milter accepted the connection and
+	// wants to see nothing more.
+	skipSession bool
+
+	// skipMessage is set when the milter accepted the current message.
+	skipMessage bool
+
+	// discard is set when the milter asked to discard the current
+	// message before the end of data.
+	discard bool
+
+	// err is the first failure talking to the milter; the connection is
+	// not used after it.
+	err error
+}
+
+// Ensure session implements the interface.
+var _ icesmtp.SessionFilter = (*session)(nil)
+
+// Connect sends the client's address.
+func (s *session) Connect(ctx context.Context, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.protocol&ProtoNoConnect != 0 {
+		return icesmtp.PolicyAllowed()
+	}
+	p, err := s.exchange(cmdConnect, connectData(info), s.protocol&ProtoNoReplyConnect != 0)
+	if err != nil {
+		// The engine replaces a deferred greeting with its own 421.
+		return s.failure(err, icesmtp.Response{})
+	}
+	return s.stageResult(p, &s.skipSession)
+}
+
+// Helo sends the HELO or EHLO hostname.
+func (s *session) Helo(ctx context.Context, hostname icesmtp.Hostname, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.skipSession || s.protocol&ProtoNoHelo != 0 {
+		return icesmtp.PolicyAllowed()
+	}
+	p, err := s.exchange(cmdHelo, cstrings(hostname), s.protocol&ProtoNoReplyHelo != 0)
+	if err != nil {
+		return s.failure(err, unavailable())
+	}
+	return s.stageResult(p, &s.skipSession)
+}
+
+// MailFrom sends the reverse-path and its ESMTP parameters.
+func (s *session) MailFrom(ctx context.Context, sender icesmtp.MailPath, params icesmtp.ESMTPParams, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skipMessage = false
+	s.discard = false
+	if s.skipSession || s.protocol&ProtoNoMail != 0 {
+		return icesmtp.PolicyAllowed()
+	}
+
+	macros := []string{"{mail_addr}", sender.Address}
+	if info.Authenticated() {
+		macros = append(macros, "{auth_authen}", info.AuthenticatedUser())
+	}
+	if err := s.macros(cmdMail, macros...); err != nil {
+		return s.failure(err, unavailable())
+	}
+
+	p, err := s.exchange(cmdMail, pathData(sender, params), s.protocol&ProtoNoReplyMail != 0)
+	if err != nil {
+		return s.failure(err, unavailable())
+	}
+	return s.stageResult(p, &s.skipMessage)
+}
+
+// RcptTo sends a recipient and its ESMTP parameters.
+func (s *session) RcptTo(ctx context.Context, recipient icesmtp.MailPath, params icesmtp.ESMTPParams, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.skipSession || s.skipMessage || s.protocol&ProtoNoRcpt != 0 {
+		return icesmtp.PolicyAllowed()
+	}
+	if err := s.macros(cmdRcpt, "{rcpt_addr}", recipient.Address); err != nil {
+		return s.failure(err, unavailable())
+	}
+
+	p, err := s.exchange(cmdRcpt, pathData(recipient, params), s.protocol&ProtoNoReplyRcpt != 0)
+	if err != nil {
+		return s.failure(err, unavailable())
+	}
+	// Accepting a recipient accepts only that recipient.
+	var skip bool
+	return s.stageResult(p, &skip)
+}
+
+// Filter sends the message and applies the milter's modifications.
+func (s *session) Filter(ctx context.Context, envelope icesmtp.Envelope, info icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer func() {
+		s.skipMessage = false
+		s.discard = false
+	}()
+
+	if s.discard {
+		return icesmtp.FilterResult{Action: icesmtp.FilterDiscard, Reason: "discarded by milter"}, nil
+	}
+	if s.err != nil {
+		if s.client.failOpen {
+			return icesmtp.FilterAccepted(), nil
+		}
+		return icesmtp.FilterResult{}, s.err
+	}
+	if s.skipSession || s.skipMessage {
+		return icesmtp.FilterAccepted(), nil
+	}
+
+	result, err := s.endOfMessage(envelope)
+	if err != nil {
+		s.fail(err)
+		if s.client.failOpen {
+			return icesmtp.FilterAccepted(), nil
+		}
+		return icesmtp.FilterResult{}, err
+	}
+	return result, nil
+}
+
+// endOfMessage sends DATA, the headers, the body and end of body, and
+// collects the milter's decision.
+func (s *session) endOfMessage(envelope icesmtp.Envelope) (icesmtp.FilterResult, error) {
+	done := func(p packet) (icesmtp.FilterResult, bool) {
+		var skip bool
+		result := s.stageResult(p, &skip)
+		switch {
+		case s.discard:
+			return icesmtp.FilterResult{Action: icesmtp.FilterDiscard, Reason: "discarded by milter"}, true
+		case skip:
+			return icesmtp.FilterAccepted(), true
+		}
+		if resp, rejected := rejection(result); rejected {
+			return rejectResult(resp), true
+		}
+		return icesmtp.FilterResult{}, false
+	}
+
+	if s.protocol&ProtoNoData == 0 {
+		p, err := s.exchange(cmdData, nil, s.protocol&ProtoNoReplyData != 0)
+		if err != nil {
+			return icesmtp.FilterResult{}, err
+		}
+		if result, stop := done(p); stop {
+			return result, nil
+		}
+	}
+
+	if s.protocol&ProtoNoHeaders == 0 {
+		for _, f := range envelope.Headers().Fields {
+			p, err := s.exchange(cmdHeader, cstrings(f.Name, headerValue(f)), s.protocol&ProtoNoReplyHeader != 0)
+			if err != nil {
+				return icesmtp.FilterResult{}, err
+			}
+			if result, stop := done(p); stop {
+				return result, nil
+			}
+		}
+	}
+
+	if s.protocol&ProtoNoEOH == 0 {
+		p, err := s.exchange(cmdEOH, nil, s.protocol&ProtoNoReplyEOH != 0)
+		if err != nil {
+			return icesmtp.FilterResult{}, err
+		}
+		if result, stop := done(p); stop {
+			return result, nil
+		}
+	}
+
+	if s.protocol&ProtoNoBody == 0 {
+		_, body := icesmtp.SplitMessage(envelope.Data())
+		for len(body) > 0 {
+			n := min(len(body), maxBodyChunk)
+			p, err := s.exchange(cmdBody, body[:n], s.protocol&ProtoNoReplyBody != 0)
+			if err != nil {
+				return icesmtp.FilterResult{}, err
+			}
+			body = body[n:]
+			if p.code == respSkip {
+				break
+			}
+			if result, stop := done(p); stop {
+				return result, nil
+			}
+		}
+	}
+
+	if err := s.macros(cmdEOB, "i", envelope.ID()); err != nil {
+		return icesmtp.FilterResult{}, err
+	}
+	if err := s.send(cmdEOB, nil); err != nil {
+		return icesmtp.FilterResult{}, err
+	}
+	return s.modifications(envelope)
+}
+
+// modifications reads modification requests until the final reply to end
+// of body, and applies them to a copy of envelope.
+func (s *session) modifications(envelope icesmtp.Envelope) (icesmtp.FilterResult, error) {
+	var (
+		modified *icesmtp.ModifiedEnvelope
+		body     []byte
+		replaced bool
+		result   icesmtp.FilterResult
+	)
+	modify := func(action uint32) (*icesmtp.ModifiedEnvelope, error) {
+		if s.actions&action == 0 {
+			return nil, fmt.Errorf("%w: modification 0x%x was not negotiated", ErrProtocol, action)
+		}
+		if modified == nil {
+			modified = icesmtp.NewModifiedEnvelope(envelope)
+		}
+		return modified, nil
+	}
+
+	for {
+		p, err := s.read()
+		if err != nil {
+			return icesmtp.FilterResult{}, err
+		}
+
+		var m *icesmtp.ModifiedEnvelope
+		switch p.code {
+		case respAddHeader:
+			args := splitCStrings(p.data)
+			if len(args) != 2 {
+				return icesmtp.FilterResult{}, fmt.Errorf("%w: malformed add header", ErrProtocol)
+			}
+			if m, err = modify(ActionAddHeader); err == nil {
+				m.AddHeader(args[0], fieldValue(args[1]))
+			}
+		case respInsHeader, respChgHeader:
+			if len(p.data) < 4 {
+				return icesmtp.FilterResult{}, fmt.Errorf("%w: malformed header change", ErrProtocol)
+			}
+			index := int(binary.BigEndian.Uint32(p.data))
+			args := splitCStrings(p.data[4:])
+			if len(args) == 1 {
+				args = append(args, "")
+			}
+			if len(args) != 2 {
+				return icesmtp.FilterResult{}, fmt.Errorf("%w: malformed header change", ErrProtocol)
+			}
+			if p.code == respInsHeader {
+				if m, err = modify(ActionAddHeader); err == nil {
+					m.InsertHeader(index, args[0], fieldValue(args[1]))
+				}
+			} else if m, err = modify(ActionChgHeader); err == nil {
+				m.ChangeHeader(args[0], index, fieldValue(args[1]))
+			}
+		case respAddRcpt, respAddRcptPar:
+			action := ActionAddRcpt
+			if p.code == respAddRcptPar {
+				action = ActionAddRcptPar
+			}
+			args := splitCStrings(p.data)
+			if len(args) == 0 {
+				return icesmtp.FilterResult{}, fmt.Errorf("%w: malformed add recipient", ErrProtocol)
+			}
+			if m, err = modify(action); err == nil {
+				m.AddRecipient(icesmtp.MailPath{Address: address(args[0])})
+			}
+		case respDelRcpt:
+			args := splitCStrings(p.data)
+			if len(args) == 0 {
+				return icesmtp.FilterResult{}, fmt.Errorf("%w: malformed delete recipient", ErrProtocol)
+			}
+			if m, err = modify(ActionDelRcpt); err == nil {
+				m.RemoveRecipient(address(args[0]))
+			}
+		case respChgFrom:
+			args := splitCStrings(p.data)
+			if len(args) == 0 {
+				return icesmtp.FilterResult{}, fmt.Errorf("%w: malformed change sender", ErrProtocol)
+			}
+			if m, err = modify(ActionChgFrom); err == nil {
+				addr := address(args[0])
+				m.SetMailFrom(icesmtp.MailPath{Address: addr, IsNull: addr == ""})
+			}
+		case respReplBody:
+			if _, err = modify(ActionChgBody); err == nil {
+				body = append(body, p.data...)
+				replaced = true
+			}
+		case respQuarantine:
+			if m, err = modify(ActionQuarantine); err == nil {
+				reason := strings.TrimRight(string(p.data), "\x00")
+				m.Quarantine(reason)
+				result.Action = icesmtp.FilterQuarantine
+				result.Reason = reason
+			}
+		default:
+			// Any other reply is the final decision.
+			var skip bool
+			decision := s.stageResult(p, &skip)
+			if s.discard {
+				return icesmtp.FilterResult{Action: icesmtp.FilterDiscard, Reason: "discarded by milter"}, nil
+			}
+			if resp, rejected := rejection(decision); rejected {
+				return rejectResult(resp), nil
+			}
+			if s.err != nil {
+				return icesmtp.FilterResult{}, s.err
+			}
+			if replaced {
+				modified.ReplaceBody(body)
+			}
+			if modified != nil {
+				result.Envelope = modified
+			}
+			return result, nil
+		}
+		if err != nil {
+			return icesmtp.FilterResult{}, err
+		}
+	}
+}
+
+// Abort tells the milter the current message was abandoned.
+func (s *session) Abort(ctx context.Context, info icesmtp.SessionInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skipMessage = false
+	s.discard = false
+	if s.err == nil && !s.skipSession {
+		if err := s.send(cmdAbort, nil); err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+// Close ends the milter session and closes the connection.
+func (s *session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.conn.SetDeadline(time.Now().Add(s.client.commandTimeout))
+		writePacket(s.conn, cmdQuit, nil)
+	}
+	return s.conn.Close()
+}
+
+// send writes a packet that has no reply.
+func (s *session) send(code byte, data []byte) error {
+	s.conn.SetDeadline(time.Now().Add(s.client.commandTimeout))
+	return writePacket(s.conn, code, data)
+}
+
+// macros sends macro values for the command code as name, value pairs.
+func (s *session) macros(code byte, pairs ...string) error {
+	return s.send(cmdMacro, append([]byte{code}, cstrings(pairs...)...))
+}
+
+// exchange sends a command and reads its reply. If noReply is set, the
+// milter does not reply and continue is returned.
+func (s *session) exchange(code byte, data []byte, noReply bool) (packet, error) {
+	if err := s.send(code, data); err != nil {
+		return packet{}, err
+	}
+	if noReply {
+		return packet{code: respContinue}, nil
+	}
+	return s.read()
+}
+
+// read reads the next reply, skipping progress notifications, each of
+// which extends the command timeout.
+func (s *session) read() (packet, error) {
+	for {
+		s.conn.SetDeadline(time.Now().Add(s.client.commandTimeout))
+		p, err := readPacket(s.r)
+		if err != nil {
+			return packet{}, err
+		}
+		if p.code != respProgress {
+			return p, nil
+		}
+	}
+}
+
+// stageResult converts a reply to a stage command. skip is set when the
+// milter accepts and wants no further commands for the stage's scope.
+func (s *session) stageResult(p packet, skip *bool) icesmtp.PolicyResult {
+	switch p.code {
+	case respContinue, respSkip:
+		return icesmtp.PolicyAllowed()
+	case respAccept:
+		*skip = true
+		return icesmtp.PolicyAllowed()
+	case respDiscard:
+		s.discard = true
+		return icesmtp.PolicyAllowed()
+	case respReject:
+		return icesmtp.PolicyResult{Decision: icesmtp.PolicyDeny, Reason: "rejected by milter"}
+	case respTempFail:
+		return icesmtp.PolicyResult{Decision: icesmtp.PolicyDefer, Reason: "deferred by milter"}
+	case respReplyCode:
+		text := strings.TrimRight(string(p.data), "\x00")
+		resp, err := icesmtp.ParseReplyText(text)
+		if err != nil || resp.Code < 400 || resp.Code > 599 {
+			return icesmtp.PolicyResult{Decision: icesmtp.PolicyDefer, Reason: "invalid milter reply: " + text}
+		}
+		decision := icesmtp.PolicyDeny
+		if resp.Code < 500 {
+			decision = icesmtp.PolicyDefer
+		}
+		return icesmtp.PolicyResult{Decision: decision, Response: resp, Reason: text}
+	case respConnFail, respShutdown:
+		return s.failure(errors.New("milter: filter failed"), unavailable())
+	default:
+		return s.failure(fmt.Errorf("%w: unexpected reply %q", ErrProtocol, p.code), unavailable())
+	}
+}
+
+// fail records the first error and closes the connection.
+func (s *session) fail(err error) {
+	if s.err == nil {
+		s.err = err
+		s.conn.Close()
+	}
+}
+
+// failure records err and returns the stage result: allow when failing
+// open, otherwise a deferral with resp.
+func (s *session) failure(err error, resp icesmtp.Response) icesmtp.PolicyResult {
+	s.fail(err)
+	if s.client.failOpen {
+		return icesmtp.PolicyAllowed()
+	}
+	return icesmtp.PolicyResult{Decision: icesmtp.PolicyDefer, Response: resp, Reason: s.err.Error()}
+}
+
+// unavailable is the reply when the milter cannot be used.
+func unavailable() icesmtp.Response {
+	return icesmtp.NewEnhancedResponse(icesmtp.Reply451LocalError,
+		icesmtp.EnhancedStatusCode{Class: icesmtp.EnhancedPersistentTransient, Subject: icesmtp.EnhancedSubjectMailSystem, Detail: 0},
+		"Mail filter unavailable, try again later")
+}
+
+// rejection returns the response for a rejecting stage result.
+func rejection(result icesmtp.PolicyResult) (icesmtp.Response, bool) {
+	switch result.Decision {
+	case icesmtp.PolicyDeny, icesmtp.PolicyDefer:
+		return result.Response, true
+	default:
+		return icesmtp.Response{}, false
+	}
+}
+
+// rejectResult converts a rejection to a filter result. A zero resp
+// selects the filter's default response.
+func rejectResult(resp icesmtp.Response) icesmtp.FilterResult {
+	action := icesmtp.FilterReject
+	if resp.Code != 0 && resp.Code < 500 {
+		action = icesmtp.FilterTempFail
+	}
+	return icesmtp.FilterResult{Action: action, Response: resp, Reason: "rejected by milter"}
+}
+
+// connectData encodes the connect command: hostname, family, port and
+// address. The hostname is the client's forward-confirmed reverse DNS
+// name, or its address in brackets as sendmail sends it. SessionInfo
+// has no client port, so port 0 is sent.
+func connectData(info icesmtp.SessionInfo) []byte {
+	host := info.ClientIP()
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return append(cstrings("unknown"), 'U')
+	}
+
+	family := byte('4')
+	if ip.To4() == nil {
+		family = '6'
+	}
+
+	name := "[" + host + "]"
+	if rdns := info.ClientReverseDNS(); rdns.Confirmed {
+		name = rdns.Name
+	}
+	data := cstrings(name)
+	data = append(data, family)
+	data = binary.BigEndian.AppendUint16(data, 0)
+	return append(data, cstrings(host)...)
+}
+
+// pathData encodes a MAIL or RCPT command: the path followed by its
+// ESMTP parameters in name order.
+func pathData(path icesmtp.MailPath, params icesmtp.ESMTPParams) []byte {
+	args := []string{"<" + path.Address + ">"}
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		if value := params[name]; value == "" {
+			args = append(args, name)
+		} else {
+			args = append(args, name+"="+value)
+		}
+	}
+	return cstrings(args...)
+}
+
+// headerValue returns a field's value as milters expect it: folding
+// kept, leading whitespace removed and lines separated by LF.
+func headerValue(f icesmtp.HeaderField) string {
+	value := f.Raw
+	if i := bytes.IndexByte(value, ':'); i >= 0 {
+		value = value[i+1:]
+	}
+	value = bytes.TrimLeft(value, " \t")
+	value = bytes.TrimRight(value, "\r\n")
+	return strings.ReplaceAll(string(value), "\r\n", "\n")
+}
+
+// fieldValue converts a header value from a milter to CRLF line endings.
+func fieldValue(v string) string {
+	v = strings.ReplaceAll(v, "\r\n", "\n")
+	return strings.ReplaceAll(v, "\n", "\r\n")
+}
+
+// address strips angle brackets from an address sent by a milter.
+func address(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "<")
+	return strings.TrimSuffix(s, ">")
+}
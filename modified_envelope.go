@@ -0,0 +1,343 @@
+package icesmtp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModifiedEnvelope is an Envelope that applies changes to a base envelope:
+// added, changed and removed header fields, changed recipients, a replaced
+// body and quarantine. Content filters return one to modify the message.
+//
+// The base envelope is not changed. Data is rebuilt on first use after a
+// change; unchanged header fields keep their original bytes. Methods are
+// safe for concurrent use.
+type ModifiedEnvelope struct {
+	base Envelope
+
+	mu         sync.Mutex
+	mailFrom   MailPath
+	fields     []HeaderField
+	separator  []byte
+	body       []byte
+	recipients []MailPath
+	metadata   EnvelopeMetadata
+
+	data    []byte
+	headers *MessageHeaders
+}
+
+// NewModifiedEnvelope creates a ModifiedEnvelope with no changes. If base
+// is itself a *ModifiedEnvelope, its current state is copied.
+func NewModifiedEnvelope(base Envelope) *ModifiedEnvelope {
+	fields, separator, body := splitMessage(base.Data())
+	return &ModifiedEnvelope{
+		base:       base,
+		mailFrom:   base.MailFrom(),
+		fields:     fields,
+		separator:  separator,
+		body:       body,
+		recipients: base.Recipients(),
+		metadata:   base.Metadata(),
+	}
+}
+
+// splitMessage splits data into header fields, the blank line separating
+// them from the body, and the body. Each field's Raw keeps its
+// continuation lines. The header block ends at the first empty line or at
+// the first line that is neither a field nor a continuation.
+func splitMessage(data []byte) ([]HeaderField, []byte, []byte) {
+	var fields []HeaderField
+	var separator []byte
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		content := bytes.TrimRight(line, "\r\n")
+
+		if len(content) == 0 {
+			separator = line
+			rest = rest[end:]
+			break
+		}
+		if (content[0] == ' ' || content[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.Raw = append(last.Raw, line...)
+			rest = rest[end:]
+			continue
+		}
+		if bytes.IndexByte(content, ':') < 0 {
+			break
+		}
+		fields = append(fields, HeaderField{Raw: append([]byte(nil), line...)})
+		rest = rest[end:]
+	}
+
+	for i := range fields {
+		// A final field without a line ending would run into fields
+		// added after it.
+		if !bytes.HasSuffix(fields[i].Raw, []byte("\n")) {
+			fields[i].Raw = append(fields[i].Raw, '\r', '\n')
+		}
+		fields[i] = parseField(fields[i].Raw)
+	}
+	return fields, separator, rest
+}
+
+// SplitMessage splits a message into its header block and body. The
+// blank line between them belongs to neither; if there is no blank line,
+// the header block ends at the first line that is not a header field.
+func SplitMessage(data []byte) (header, body []byte) {
+	fields, _, body := splitMessage(data)
+	n := 0
+	for _, f := range fields {
+		n += len(f.Raw)
+	}
+	return data[:min(n, len(data))], body
+}
+
+// newField builds a header field with a CRLF line ending.
+func newField(name, value string) HeaderField {
+	return HeaderField{
+		Name:  name,
+		Value: value,
+		Raw:   []byte(name + ": " + value + "\r\n"),
+	}
+}
+
+// changed invalidates the rebuilt data. The caller holds mu.
+func (e *ModifiedEnvelope) changed() {
+	e.data = nil
+	e.headers = nil
+}
+
+// InsertHeader inserts a field before the field at index (0 = first).
+// An index past the end appends the field.
+func (e *ModifiedEnvelope) InsertHeader(index int, name, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	index = max(0, min(index, len(e.fields)))
+	e.fields = append(e.fields[:index], append([]HeaderField{newField(name, value)}, e.fields[index:]...)...)
+	e.changed()
+}
+
+// PrependHeader adds a field at the top of the header block, where trace
+// fields such as Received and Authentication-Results belong.
+func (e *ModifiedEnvelope) PrependHeader(name, value string) {
+	e.InsertHeader(0, name, value)
+}
+
+// AddHeader adds a field at the end of the header block.
+func (e *ModifiedEnvelope) AddHeader(name, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.fields = append(e.fields, newField(name, value))
+	e.changed()
+}
+
+// ChangeHeader replaces the value of the index'th field (1-based) named
+// name. An empty value deletes the field. If there are fewer than index
+// such fields, a non-empty value is added at the end of the header block.
+func (e *ModifiedEnvelope) ChangeHeader(name string, index int, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := 0
+	for i, f := range e.fields {
+		if !strings.EqualFold(f.Name, name) {
+			continue
+		}
+		n++
+		if n != index {
+			continue
+		}
+		if value == "" {
+			e.fields = append(e.fields[:i], e.fields[i+1:]...)
+		} else {
+			e.fields[i] = newField(f.Name, value)
+		}
+		e.changed()
+		return
+	}
+
+	if value != "" {
+		e.fields = append(e.fields, newField(name, value))
+		e.changed()
+	}
+}
+
+// RemoveHeader deletes every field named name.
+func (e *ModifiedEnvelope) RemoveHeader(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kept := e.fields[:0]
+	for _, f := range e.fields {
+		if !strings.EqualFold(f.Name, name) {
+			kept = append(kept, f)
+		}
+	}
+	e.fields = kept
+	e.changed()
+}
+
+// SetMailFrom replaces the reverse-path.
+func (e *ModifiedEnvelope) SetMailFrom(path MailPath) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mailFrom = path
+}
+
+// AddRecipient adds a recipient if it is not already present.
+func (e *ModifiedEnvelope) AddRecipient(path MailPath) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, r := range e.recipients {
+		if strings.EqualFold(r.Address, path.Address) {
+			return
+		}
+	}
+	e.recipients = append(e.recipients, path)
+}
+
+// RemoveRecipient removes the recipient with the given address, compared
+// case-insensitively.
+func (e *ModifiedEnvelope) RemoveRecipient(address EmailAddress) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kept := e.recipients[:0]
+	for _, r := range e.recipients {
+		if !strings.EqualFold(r.Address, address) {
+			kept = append(kept, r)
+		}
+	}
+	e.recipients = kept
+}
+
+// ReplaceBody replaces the message body, keeping the header block.
+func (e *ModifiedEnvelope) ReplaceBody(body []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.body = body
+	if e.separator == nil {
+		e.separator = []byte("\r\n")
+	}
+	e.changed()
+}
+
+// Quarantine marks the envelope as quarantined.
+func (e *ModifiedEnvelope) Quarantine(reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.metadata.Quarantined = true
+	e.metadata.QuarantineReason = reason
+}
+
+// AddAuthResult records an authentication result in the metadata.
+func (e *ModifiedEnvelope) AddAuthResult(r AuthResult) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := len(e.metadata.AuthResults)
+	e.metadata.AuthResults = append(e.metadata.AuthResults[:n:n], r)
+}
+
+// Base returns the unmodified envelope.
+func (e *ModifiedEnvelope) Base() Envelope { return e.base }
+
+// ID returns the base envelope ID.
+func (e *ModifiedEnvelope) ID() EnvelopeID { return e.base.ID() }
+
+// MailFrom returns the modified reverse-path.
+func (e *ModifiedEnvelope) MailFrom() MailPath {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.mailFrom
+}
+
+// Recipients returns the modified recipients.
+func (e *ModifiedEnvelope) Recipients() []MailPath {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]MailPath(nil), e.recipients...)
+}
+
+// RecipientCount returns the number of modified recipients.
+func (e *ModifiedEnvelope) RecipientCount() RecipientCount {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.recipients)
+}
+
+// ESMTPParams returns the base ESMTP parameters.
+func (e *ModifiedEnvelope) ESMTPParams() ESMTPParams { return e.base.ESMTPParams() }
+
+// DeclaredSize returns the base declared size.
+func (e *ModifiedEnvelope) DeclaredSize() MessageSize { return e.base.DeclaredSize() }
+
+// ReceivedAt returns the base creation time.
+func (e *ModifiedEnvelope) ReceivedAt() time.Time { return e.base.ReceivedAt() }
+
+// IsFinalized returns whether the base envelope is finalized.
+func (e *ModifiedEnvelope) IsFinalized() bool { return e.base.IsFinalized() }
+
+// Metadata returns the base metadata with any quarantine and added
+// authentication results applied.
+func (e *ModifiedEnvelope) Metadata() EnvelopeMetadata {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.metadata
+}
+
+// Data returns the modified message.
+func (e *ModifiedEnvelope) Data() MessageData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.build()
+}
+
+// DataSize returns the size of the modified message.
+func (e *ModifiedEnvelope) DataSize() MessageSize {
+	return MessageSize(len(e.Data()))
+}
+
+// Headers returns the parsed header block of the modified message.
+func (e *ModifiedEnvelope) Headers() *MessageHeaders {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.headers == nil {
+		e.headers = ParseHeaders(e.build(), 0)
+	}
+	return e.headers
+}
+
+// build returns the message, rebuilding it if needed. The caller holds mu.
+func (e *ModifiedEnvelope) build() []byte {
+	if e.data != nil {
+		return e.data
+	}
+
+	size := len(e.separator) + len(e.body)
+	for _, f := range e.fields {
+		size += len(f.Raw)
+	}
+	buf := make([]byte, 0, size)
+	for _, f := range e.fields {
+		buf = append(buf, f.Raw...)
+	}
+	buf = append(buf, e.separator...)
+	buf = append(buf, e.body...)
+	e.data = buf
+	return buf
+}
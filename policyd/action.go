@@ -0,0 +1,95 @@
+package policyd
+
+import (
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// DefaultAction is used when the policy server cannot be reached or
+// replies with an error, as Postfix's policy_default_action.
+const DefaultAction = "451 4.3.5 Server configuration problem"
+
+// decision is a parsed policy server action.
+type decision struct {
+	// result is the outcome of the stage.
+	result icesmtp.PolicyResult
+
+	// prepend is a header field to add to the message.
+	prepend string
+
+	// hold quarantines the message; discard drops it.
+	hold    bool
+	discard bool
+}
+
+// parseAction interprets an access(5) action as returned in "action=".
+//
+// OK and DUNNO let the command proceed; REJECT, DEFER and explicit 4xx or
+// 5xx replies reject it. PREPEND, HOLD and DISCARD let it proceed and
+// apply to the message at end of data. WARN and INFO are ignored, as are
+// FILTER, REDIRECT and BCC, which need a queue this server does not have.
+// Anything else is treated as a configuration error.
+func parseAction(action string) decision {
+	action = strings.TrimSpace(action)
+	verb, text, _ := strings.Cut(action, " ")
+	text = strings.TrimSpace(text)
+
+	switch strings.ToUpper(verb) {
+	case "OK":
+		return decision{result: icesmtp.PolicyAllowed()}
+	case "DUNNO", "DEFER_IF_REJECT", "WARN", "INFO", "FILTER", "REDIRECT", "BCC":
+		return decision{result: icesmtp.PolicyResult{Decision: icesmtp.PolicyContinue, Reason: action}}
+	case "REJECT":
+		return decision{result: reply(icesmtp.PolicyDeny, icesmtp.Reply554TransactionFailed, text)}
+	case "DEFER", "DEFER_IF_PERMIT":
+		return decision{result: reply(icesmtp.PolicyDefer, icesmtp.Reply450MailboxUnavailable, text)}
+	case "PREPEND":
+		return decision{result: icesmtp.PolicyAllowed(), prepend: text}
+	case "HOLD":
+		return decision{result: icesmtp.PolicyAllowed(), hold: true}
+	case "DISCARD":
+		return decision{result: icesmtp.PolicyAllowed(), discard: true}
+	}
+
+	if len(verb) == 3 && (verb[0] == '4' || verb[0] == '5') {
+		resp, err := icesmtp.ParseReplyText(action)
+		if err == nil {
+			d := icesmtp.PolicyDeny
+			if resp.Code < 500 {
+				d = icesmtp.PolicyDefer
+			}
+			if resp.EnhancedCode == nil {
+				resp.EnhancedCode = defaultEnhanced(d)
+			}
+			return decision{result: icesmtp.PolicyResult{Decision: d, Response: resp, Reason: action}}
+		}
+	}
+
+	return decision{result: icesmtp.PolicyDeferred(configProblem(), "unknown policy action: "+action)}
+}
+
+// reply builds a rejection with code and an access(5) style default text.
+func reply(d icesmtp.PolicyDecision, code icesmtp.ReplyCode, text string) icesmtp.PolicyResult {
+	if text == "" {
+		text = "Access denied"
+	}
+	resp := icesmtp.NewEnhancedResponse(code, *defaultEnhanced(d), text)
+	return icesmtp.PolicyResult{Decision: d, Response: resp, Reason: text}
+}
+
+// defaultEnhanced returns 5.7.1 or 4.7.1.
+func defaultEnhanced(d icesmtp.PolicyDecision) *icesmtp.EnhancedStatusCode {
+	class := icesmtp.EnhancedPermanent
+	if d == icesmtp.PolicyDefer {
+		class = icesmtp.EnhancedPersistentTransient
+	}
+	return &icesmtp.EnhancedStatusCode{Class: class, Subject: icesmtp.EnhancedSubjectPolicy, Detail: 1}
+}
+
+// configProblem is the reply for an unusable policy server.
+func configProblem() icesmtp.Response {
+	return icesmtp.NewEnhancedResponse(icesmtp.Reply451LocalError,
+		icesmtp.EnhancedStatusCode{Class: icesmtp.EnhancedPersistentTransient, Subject: icesmtp.EnhancedSubjectMailSystem, Detail: 5},
+		"Server configuration problem")
+}
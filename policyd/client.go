@@ -0,0 +1,392 @@
+// Package policyd delegates access decisions to policy servers that speak
+// the Postfix SMTPD access policy delegation protocol, such as postfwd,
+// policyd-spf or quota services.
+//
+// A Client is an icesmtp.SessionFilterFactory. At each configured stage it
+// sends a block of name=value attributes describing the session and the
+// current transaction, and maps the server's action= reply onto the SMTP
+// response. Each session keeps one connection open to the server and
+// reuses it for all of its requests, as Postfix does.
+package policyd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// ErrNoAction indicates the policy server's reply had no action attribute.
+var ErrNoAction = errors.New("policyd: reply has no action")
+
+// Stage selects the SMTP stages at which the policy server is queried.
+type Stage uint
+
+const (
+	// StageConnect queries with protocol_state=CONNECT.
+	StageConnect Stage = 1 << iota
+
+	// StageHelo queries with protocol_state=HELO or EHLO.
+	StageHelo
+
+	// StageMail queries with protocol_state=MAIL.
+	StageMail
+
+	// StageRcpt queries with protocol_state=RCPT, once per recipient.
+	StageRcpt
+
+	// StageEndOfMessage queries with protocol_state=END-OF-MESSAGE.
+	StageEndOfMessage
+)
+
+// Client queries a policy server for each session.
+type Client struct {
+	network string
+	address string
+
+	stages        Stage
+	timeout       time.Duration
+	defaultAction string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithStages sets the stages at which the server is queried. Defaults to
+// StageRcpt, where most policy servers expect to be called.
+func WithStages(stages Stage) Option {
+	return func(c *Client) {
+		c.stages = stages
+	}
+}
+
+// WithTimeout bounds connecting and each query. Defaults to 100 seconds,
+// as Postfix's smtpd_policy_service_timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithDefaultAction sets the action used when the server cannot be
+// reached or replies with garbage. Defaults to DefaultAction; use "DUNNO"
+// to fail open.
+func WithDefaultAction(action string) Option {
+	return func(c *Client) {
+		c.defaultAction = action
+	}
+}
+
+// New creates a Client for the policy server at address, e.g.
+// New("tcp", "127.0.0.1:10040") or New("unix", "/run/policyd.sock").
+func New(network, address string, opts ...Option) *Client {
+	c := &Client{
+		network:       network,
+		address:       address,
+		stages:        StageRcpt,
+		timeout:       100 * time.Second,
+		defaultAction: DefaultAction,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewSessionFilter returns the filter for a session. The connection to
+// the server is opened on the first query.
+func (c *Client) NewSessionFilter(ctx context.Context, info icesmtp.SessionInfo) (icesmtp.SessionFilter, error) {
+	return &session{client: c}, nil
+}
+
+// attributes is a policy request: name=value pairs in order.
+type attributes [][2]string
+
+// set sets an attribute, replacing an earlier value.
+func (a *attributes) set(name, value string) {
+	for i, kv := range *a {
+		if kv[0] == name {
+			(*a)[i][1] = value
+			return
+		}
+	}
+	*a = append(*a, [2]string{name, value})
+}
+
+// encode writes the request block. Values cannot contain newlines.
+func (a attributes) encode() []byte {
+	var b strings.Builder
+	for _, kv := range a {
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(kv[1])
+		b.WriteString(kv[0] + "=" + value + "\n")
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// session is the policy state of a single SMTP session. It implements
+// icesmtp.SessionFilter.
+type session struct {
+	client *Client
+	conn   net.Conn
+	r      *bufio.Reader
+
+	// transactions numbers the session's transactions for the instance
+	// attribute.
+	transactions int
+
+	// helo is the most recent HELO/EHLO name.
+	helo string
+
+	// size is the SIZE declared with MAIL FROM.
+	size string
+
+	// Actions that apply to the current message at end of data.
+	prepend []string
+	hold    bool
+	discard bool
+}
+
+// Ensure session implements the interface.
+var _ icesmtp.SessionFilter = (*session)(nil)
+
+// Connect queries at connect.
+func (s *session) Connect(ctx context.Context, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	if s.client.stages&StageConnect == 0 {
+		return icesmtp.PolicyAllowed()
+	}
+	return s.check(ctx, s.request("CONNECT", info))
+}
+
+// Helo queries after HELO or EHLO.
+func (s *session) Helo(ctx context.Context, hostname icesmtp.Hostname, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	s.helo = hostname
+	if s.client.stages&StageHelo == 0 {
+		return icesmtp.PolicyAllowed()
+	}
+	state := "HELO"
+	if d, ok := info.(icesmtp.SessionDetails); ok && d.ESMTP() {
+		state = "EHLO"
+	}
+	return s.check(ctx, s.request(state, info))
+}
+
+// MailFrom queries after MAIL FROM.
+func (s *session) MailFrom(ctx context.Context, sender icesmtp.MailPath, params icesmtp.ESMTPParams, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	s.reset()
+	s.transactions++
+	s.size = params["SIZE"]
+	if s.client.stages&StageMail == 0 {
+		return icesmtp.PolicyAllowed()
+	}
+	req := s.request("MAIL", info)
+	req.set("sender", sender.Address)
+	return s.check(ctx, req)
+}
+
+// RcptTo queries for each recipient.
+func (s *session) RcptTo(ctx context.Context, recipient icesmtp.MailPath, params icesmtp.ESMTPParams, info icesmtp.SessionInfo) icesmtp.PolicyResult {
+	if s.client.stages&StageRcpt == 0 {
+		return icesmtp.PolicyAllowed()
+	}
+	req := s.request("RCPT", info)
+	if from := info.CurrentMailFrom(); from != nil {
+		req.set("sender", from.Address)
+	}
+	req.set("recipient", recipient.Address)
+	return s.check(ctx, req)
+}
+
+// Filter queries at end of message and applies PREPEND, HOLD and DISCARD
+// actions collected during the transaction.
+func (s *session) Filter(ctx context.Context, envelope icesmtp.Envelope, info icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	defer s.reset()
+
+	if s.client.stages&StageEndOfMessage != 0 {
+		s.size = strconv.FormatInt(envelope.DataSize(), 10)
+		req := s.request("END-OF-MESSAGE", info)
+		req.set("queue_id", envelope.ID())
+		req.set("sender", envelope.MailFrom().Address)
+		req.set("recipient_count", strconv.Itoa(envelope.RecipientCount()))
+		if resp, rejected := rejection(s.check(ctx, req)); rejected {
+			action := icesmtp.FilterReject
+			if resp.Code < 500 {
+				action = icesmtp.FilterTempFail
+			}
+			return icesmtp.FilterResult{Action: action, Response: resp, Reason: "rejected by policy server"}, nil
+		}
+	}
+
+	if s.discard {
+		return icesmtp.FilterResult{Action: icesmtp.FilterDiscard, Reason: "discarded by policy server"}, nil
+	}
+
+	result := icesmtp.FilterAccepted()
+	if len(s.prepend) > 0 {
+		m := icesmtp.NewModifiedEnvelope(envelope)
+		for i := len(s.prepend) - 1; i >= 0; i-- {
+			name, value, ok := strings.Cut(s.prepend[i], ":")
+			if !ok {
+				continue
+			}
+			m.PrependHeader(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		result.Envelope = m
+	}
+	if s.hold {
+		result.Action = icesmtp.FilterQuarantine
+		result.Reason = "held by policy server"
+	}
+	return result, nil
+}
+
+// Abort forgets actions collected for the abandoned transaction.
+func (s *session) Abort(ctx context.Context, info icesmtp.SessionInfo) {
+	s.reset()
+}
+
+// Close closes the connection to the server.
+func (s *session) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// reset clears the per-message actions.
+func (s *session) reset() {
+	s.prepend = nil
+	s.hold = false
+	s.discard = false
+}
+
+// request builds the attributes common to every stage.
+func (s *session) request(state string, info icesmtp.SessionInfo) attributes {
+	protocol := "SMTP"
+	var tls *icesmtp.TLSConnectionState
+	if d, ok := info.(icesmtp.SessionDetails); ok {
+		if d.ESMTP() {
+			protocol = "ESMTP"
+		}
+		tls = d.TLSState()
+	}
+
+	var req attributes
+	req.set("request", "smtpd_access_policy")
+	req.set("protocol_state", state)
+	req.set("protocol_name", protocol)
+	req.set("helo_name", s.helo)
+	req.set("queue_id", "")
+	req.set("instance", fmt.Sprintf("%s.%d", info.ID(), s.transactions))
+	req.set("client_address", info.ClientIP())
+	req.set("client_name", info.ClientReverseDNS().Verified())
+	req.set("reverse_client_name", info.ClientReverseDNS().Unverified())
+	req.set("sender", "")
+	req.set("recipient", "")
+	req.set("recipient_count", "0")
+	req.set("size", s.size)
+	req.set("sasl_username", info.AuthenticatedUser())
+	if tls != nil {
+		req.set("encryption_protocol", strings.Replace(tls.VersionString(), " ", "v", 1))
+		req.set("encryption_cipher", tls.CipherSuiteString())
+	}
+	return req
+}
+
+// check queries the server and interprets its action, recording message
+// actions for end of data.
+func (s *session) check(ctx context.Context, req attributes) icesmtp.PolicyResult {
+	action, err := s.query(ctx, req)
+	if err != nil {
+		action = s.client.defaultAction
+	}
+
+	d := parseAction(action)
+	if d.prepend != "" {
+		s.prepend = append(s.prepend, d.prepend)
+	}
+	s.hold = s.hold || d.hold
+	s.discard = s.discard || d.discard
+	return d.result
+}
+
+// query sends a request and returns the action. A broken connection is
+// reopened once.
+func (s *session) query(ctx context.Context, req attributes) (string, error) {
+	action, err := s.exchange(ctx, req)
+	if err != nil && ctx.Err() == nil {
+		action, err = s.exchange(ctx, req)
+	}
+	return action, err
+}
+
+// exchange performs one request on the session's connection.
+func (s *session) exchange(ctx context.Context, req attributes) (string, error) {
+	if s.conn == nil {
+		dialer := net.Dialer{Timeout: s.client.timeout}
+		conn, err := dialer.DialContext(ctx, s.client.network, s.client.address)
+		if err != nil {
+			return "", fmt.Errorf("policyd: dial %s: %w", s.client.address, err)
+		}
+		s.conn = conn
+		s.r = bufio.NewReader(conn)
+	}
+
+	deadline := time.Now().Add(s.client.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	s.conn.SetDeadline(deadline)
+
+	action, err := s.roundTrip(req)
+	if err != nil {
+		s.Close()
+	}
+	return action, err
+}
+
+// roundTrip writes the request and reads the reply block.
+func (s *session) roundTrip(req attributes) (string, error) {
+	if _, err := s.conn.Write(req.encode()); err != nil {
+		return "", fmt.Errorf("policyd: %w", err)
+	}
+
+	var action string
+	found := false
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("policyd: read reply: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "action="); ok && !found {
+			action = v
+			found = true
+		}
+	}
+	if !found {
+		return "", ErrNoAction
+	}
+	return action, nil
+}
+
+// rejection returns the response for a rejecting stage result.
+func rejection(result icesmtp.PolicyResult) (icesmtp.Response, bool) {
+	switch result.Decision {
+	case icesmtp.PolicyDeny, icesmtp.PolicyDefer:
+		return result.Response, true
+	default:
+		return icesmtp.Response{}, false
+	}
+}
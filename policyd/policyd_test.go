@@ -0,0 +1,328 @@
+package policyd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/harness"
+)
+
+// fakePolicyServer answers each request with decide(attrs). It records
+// requests and the number of connections accepted.
+type fakePolicyServer struct {
+	ln     net.Listener
+	decide func(attrs map[string]string) string
+
+	mu       sync.Mutex
+	requests []map[string]string
+	conns    int
+}
+
+func newFakePolicyServer(t *testing.T, decide func(attrs map[string]string) string) *fakePolicyServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &fakePolicyServer{ln: ln, decide: decide}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakePolicyServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		attrs := map[string]string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			if line == "" {
+				break
+			}
+			name, value, _ := strings.Cut(line, "=")
+			attrs[name] = value
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, attrs)
+		action := s.decide(attrs)
+		s.mu.Unlock()
+
+		if action == "" {
+			// Simulate a server that drops the connection.
+			return
+		}
+		conn.Write([]byte("action=" + action + "\n\n"))
+	}
+}
+
+func (s *fakePolicyServer) addr() string { return s.ln.Addr().String() }
+
+func (s *fakePolicyServer) counts() (conns, requests int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, len(s.requests)
+}
+
+func (s *fakePolicyServer) last() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		action   string
+		decision icesmtp.PolicyDecision
+		reply    string
+	}{
+		{"OK", icesmtp.PolicyAllow, ""},
+		{"dunno", icesmtp.PolicyContinue, ""},
+		{"DEFER_IF_REJECT later", icesmtp.PolicyContinue, ""},
+		{"REJECT", icesmtp.PolicyDeny, "554 5.7.1 Access denied"},
+		{"REJECT Over quota", icesmtp.PolicyDeny, "554 5.7.1 Over quota"},
+		{"DEFER Try later", icesmtp.PolicyDefer, "450 4.7.1 Try later"},
+		{"DEFER_IF_PERMIT Greylisted", icesmtp.PolicyDefer, "450 4.7.1 Greylisted"},
+		{"550 5.7.23 SPF fail", icesmtp.PolicyDeny, "550 5.7.23 SPF fail"},
+		{"450 Greylisted", icesmtp.PolicyDefer, "450 4.7.1 Greylisted"},
+		{"PREPEND X-Policy: checked", icesmtp.PolicyAllow, ""},
+		{"BOGUS", icesmtp.PolicyDefer, "451 4.3.5 Server configuration problem"},
+		{"250 fine", icesmtp.PolicyDefer, "451 4.3.5 Server configuration problem"},
+	}
+
+	for _, tt := range tests {
+		d := parseAction(tt.action)
+		if d.result.Decision != tt.decision {
+			t.Errorf("%q: decision = %v, want %v", tt.action, d.result.Decision, tt.decision)
+		}
+		if got := strings.TrimSpace(d.result.Response.String()); tt.reply != "" && got != tt.reply {
+			t.Errorf("%q: reply = %q, want %q", tt.action, got, tt.reply)
+		}
+	}
+}
+
+// testReverseDNS is the testSession client's reverse DNS name.
+var testReverseDNS = icesmtp.ReverseDNS{Name: "client.example.org", Confirmed: true}
+
+// testSession is a minimal SessionInfo with SessionDetails.
+type testSession struct {
+	from *icesmtp.MailPath
+}
+
+func (testSession) ID() icesmtp.SessionID                         { return "sess-1" }
+func (testSession) State() icesmtp.State                          { return icesmtp.StateIdentified }
+func (testSession) ClientHostname() icesmtp.Hostname              { return "client.example.org" }
+func (testSession) ClientIP() icesmtp.IPAddress                   { return "192.0.2.1" }
+func (testSession) ClientReverseDNS() icesmtp.ReverseDNS          { return testReverseDNS }
+func (testSession) TLSActive() bool                               { return true }
+func (testSession) Authenticated() bool                           { return true }
+func (testSession) AuthenticatedUser() icesmtp.Username           { return "alice" }
+func (s testSession) CurrentMailFrom() *icesmtp.MailPath          { return s.from }
+func (testSession) CurrentRecipientCount() icesmtp.RecipientCount { return 0 }
+func (testSession) ESMTP() bool                                   { return true }
+func (testSession) TLSState() *icesmtp.TLSConnectionState {
+	return &icesmtp.TLSConnectionState{Version: icesmtp.TLSVersion13, CipherSuite: 0x1301}
+}
+
+func TestSession_Attributes(t *testing.T) {
+	srv := newFakePolicyServer(t, func(attrs map[string]string) string { return "DUNNO" })
+	ctx := context.Background()
+	info := testSession{from: &icesmtp.MailPath{Address: "sender@example.org"}}
+
+	f, _ := New("tcp", srv.addr(), WithStages(StageHelo|StageMail|StageRcpt)).NewSessionFilter(ctx, info)
+	defer f.Close()
+
+	f.Helo(ctx, "client.example.org", info)
+	f.MailFrom(ctx, *info.from, icesmtp.ESMTPParams{"SIZE": "1234"}, info)
+	r := f.RcptTo(ctx, icesmtp.MailPath{Address: "rcpt@example.com"}, nil, info)
+	if r.Decision != icesmtp.PolicyContinue {
+		t.Errorf("RcptTo = %+v", r)
+	}
+
+	want := map[string]string{
+		"request":             "smtpd_access_policy",
+		"protocol_state":      "RCPT",
+		"protocol_name":       "ESMTP",
+		"helo_name":           "client.example.org",
+		"client_address":      "192.0.2.1",
+		"client_name":         "client.example.org",
+		"reverse_client_name": "client.example.org",
+		"sender":              "sender@example.org",
+		"recipient":           "rcpt@example.com",
+		"size":                "1234",
+		"sasl_username":       "alice",
+		"instance":            "sess-1.1",
+		"encryption_protocol": "TLSv1.3",
+	}
+	got := srv.last()
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %q, want %q", name, got[name], value)
+		}
+	}
+	if conns, requests := srv.counts(); conns != 1 || requests != 3 {
+		t.Errorf("%d connections, %d requests; want 1 and 3", conns, requests)
+	}
+}
+
+func TestSession_ReconnectAndDefault(t *testing.T) {
+	calls := 0
+	srv := newFakePolicyServer(t, func(attrs map[string]string) string {
+		calls++
+		if calls == 2 {
+			return "" // drop the connection
+		}
+		return "OK"
+	})
+	ctx := context.Background()
+	info := testSession{}
+
+	f, _ := New("tcp", srv.addr()).NewSessionFilter(ctx, info)
+	defer f.Close()
+
+	for i := 0; i < 2; i++ {
+		if r := f.RcptTo(ctx, icesmtp.MailPath{Address: "rcpt@example.com"}, nil, info); r.Decision != icesmtp.PolicyAllow {
+			t.Errorf("RcptTo %d = %+v", i, r)
+		}
+	}
+	if conns, _ := srv.counts(); conns != 2 {
+		t.Errorf("connections = %d, want 2", conns)
+	}
+
+	// An unreachable server uses the default action.
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	f, _ = New("tcp", addr, WithTimeout(time.Second)).NewSessionFilter(ctx, info)
+	r := f.RcptTo(ctx, icesmtp.MailPath{Address: "rcpt@example.com"}, nil, info)
+	if r.Decision != icesmtp.PolicyDefer || r.Response.Code != 451 {
+		t.Errorf("unreachable = %+v", r)
+	}
+
+	f, _ = New("tcp", addr, WithDefaultAction("DUNNO")).NewSessionFilter(ctx, info)
+	if r := f.RcptTo(ctx, icesmtp.MailPath{Address: "rcpt@example.com"}, nil, info); r.Decision != icesmtp.PolicyContinue {
+		t.Errorf("fail open = %+v", r)
+	}
+}
+
+func TestEngineWithPolicyServer(t *testing.T) {
+	srv := newFakePolicyServer(t, func(attrs map[string]string) string {
+		switch {
+		case attrs["recipient"] == "blocked@example.com":
+			return "REJECT Recipient blocked"
+		case attrs["protocol_state"] == "RCPT":
+			return "PREPEND X-Policy: checked"
+		}
+		return "DUNNO"
+	})
+
+	h := harness.NewHarness()
+	h.Mailbox.AddDomain("example.com")
+	h.Mailbox.SetCatchAll(true)
+	h.Config.SessionFilterFactory = New("tcp", srv.addr(), WithStages(StageRcpt|StageEndOfMessage))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.Start(ctx)
+	defer h.Close()
+
+	steps := []struct {
+		send string
+		code icesmtp.ReplyCode
+	}{
+		{"", 220},
+		{"EHLO client.example.org", 250},
+		{"MAIL FROM:<sender@example.org>", 250},
+		{"RCPT TO:<blocked@example.com>", 554},
+		{"RCPT TO:<ok@example.com>", 250},
+		{"DATA", 354},
+	}
+	for _, step := range steps {
+		if step.send != "" {
+			h.Send(step.send)
+		}
+		if lines, err := h.Expect(step.code); err != nil {
+			t.Fatalf("%q: %v (%v)", step.send, err, lines)
+		}
+	}
+	h.SendData("Subject: policy\r\n\r\nHello.\r\n")
+	if lines, err := h.Expect(250); err != nil {
+		t.Fatalf("end of data: %v (%v)", err, lines)
+	}
+
+	if got := srv.last(); got["protocol_state"] != "END-OF-MESSAGE" || got["recipient_count"] != "1" || got["queue_id"] == "" {
+		t.Errorf("end of message request = %v", got)
+	}
+	msgs := h.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("stored %d messages", len(msgs))
+	}
+	if !strings.HasPrefix(string(msgs[0].Data), "X-Policy: checked\r\n") {
+		t.Errorf("stored message = %q", msgs[0].Data)
+	}
+}
+
+func TestEngineWithPolicyServerHelo(t *testing.T) {
+	srv := newFakePolicyServer(t, func(attrs map[string]string) string {
+		if attrs["helo_name"] == "bad.example.org" {
+			return "REJECT Bad HELO"
+		}
+		return "DUNNO"
+	})
+
+	h := harness.NewHarness()
+	h.Config.SessionFilterFactory = New("tcp", srv.addr(), WithStages(StageHelo))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.Start(ctx)
+	defer h.Close()
+
+	steps := []struct {
+		send  string
+		code  icesmtp.ReplyCode
+		state string
+		name  string
+	}{
+		{"EHLO client.example.org", 250, "EHLO", "ESMTP"},
+		{"HELO bad.example.org", 554, "HELO", "SMTP"},
+		{"HELO client.example.org", 250, "HELO", "SMTP"},
+		{"EHLO client.example.org", 250, "EHLO", "ESMTP"},
+	}
+	if lines, err := h.Expect(220); err != nil {
+		t.Fatalf("greeting: %v (%v)", err, lines)
+	}
+	for _, step := range steps {
+		h.Send(step.send)
+		if lines, err := h.Expect(step.code); err != nil {
+			t.Fatalf("%q: %v (%v)", step.send, err, lines)
+		}
+		if got := srv.last(); got["protocol_state"] != step.state || got["protocol_name"] != step.name {
+			t.Errorf("%q: protocol_state=%s protocol_name=%s, want %s and %s",
+				step.send, got["protocol_state"], got["protocol_name"], step.state, step.name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package icesmtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrEarlyTalker indicates the client sent data before the greeting.
+var ErrEarlyTalker = errors.New("client talked before the greeting")
+
+// PregreetConfig configures the optional pre-greeting phase, in which the
+// greeting is delayed and clients that send anything before it are
+// rejected. RFC 5321 section 4.3.1 requires clients to wait for the
+// greeting; spam software often does not.
+type PregreetConfig struct {
+	// Delay is how long to wait before the greeting. Zero disables the
+	// phase.
+	Delay Duration
+
+	// Banner, if set, is sent as "220-" continuation lines before the
+	// delay, with the greeting as the final line after it. Clients that
+	// answer the first line instead of waiting for the last are caught;
+	// they receive the final line and then a 554 reply.
+	Banner []string
+
+	// Cache remembers clients that passed, so that they skip the phase
+	// on later connections. If nil, every client waits.
+	Cache PregreetCache
+}
+
+// PregreetCache remembers clients that passed the pre-greeting phase.
+// Implementations must be safe for concurrent use.
+type PregreetCache interface {
+	// Passed reports whether ip passed recently.
+	Passed(ctx context.Context, ip IPAddress) bool
+
+	// Pass records that ip passed.
+	Pass(ctx context.Context, ip IPAddress)
+}
+
+// MemoryPregreetCache is a PregreetCache held in memory.
+type MemoryPregreetCache struct {
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[IPAddress]time.Time
+}
+
+// NewMemoryPregreetCache creates a cache that remembers clients for ttl
+// and holds at most maxSize of them (0 = unlimited). When it is full,
+// expired entries are dropped, and then all of them if none had expired.
+func NewMemoryPregreetCache(ttl time.Duration, maxSize int) *MemoryPregreetCache {
+	return &MemoryPregreetCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+		entries: make(map[IPAddress]time.Time),
+	}
+}
+
+// Passed reports whether ip passed within the TTL.
+func (c *MemoryPregreetCache) Passed(ctx context.Context, ip IPAddress) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.entries[ip]
+	return ok && c.now().Before(expires)
+}
+
+// Pass records that ip passed.
+func (c *MemoryPregreetCache) Pass(ctx context.Context, ip IPAddress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.maxSize > 0 && len(c.entries) >= c.maxSize {
+		for k, expires := range c.entries {
+			if !now.Before(expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxSize {
+			clear(c.entries)
+		}
+	}
+	c.entries[ip] = now.Add(c.ttl)
+}
+
+// Ensure MemoryPregreetCache implements the interface.
+var _ PregreetCache = (*MemoryPregreetCache)(nil)
+
+// pregreet runs the pre-greeting phase. It returns ErrEarlyTalker if the
+// client sent data during the delay, or the read error if the connection
+// failed.
+func (e *Engine) pregreet(ctx context.Context) error {
+	cfg := e.config.Pregreet
+	if cfg.Delay <= 0 {
+		return nil
+	}
+	if cfg.Cache != nil && e.clientIP != "" && cfg.Cache.Passed(ctx, e.clientIP) {
+		return nil
+	}
+
+	for _, line := range cfg.Banner {
+		n, err := fmt.Fprintf(e.conn, "%d-%s\r\n", Reply220ServiceReady, line)
+		e.stats.BytesWritten += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	delay := cfg.Delay
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		delay = time.Until(deadline)
+	}
+	e.conn.SetReadDeadline(time.Now().Add(delay))
+	_, err := e.conn.Reader().Peek(1)
+	e.conn.SetReadDeadline(time.Time{})
+	switch {
+	case err == nil:
+		return ErrEarlyTalker
+	case errors.Is(err, ErrDeadlineExceeded) || isTimeoutError(err):
+	default:
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if cfg.Cache != nil && e.clientIP != "" {
+		cfg.Cache.Pass(ctx, e.clientIP)
+	}
+	return nil
+}
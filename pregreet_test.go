@@ -0,0 +1,134 @@
+package icesmtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runPregreet starts a session from 192.0.2.1 with cfg and returns its
+// input, output and the channel Run's error is sent on.
+func runPregreet(t *testing.T, cfg PregreetConfig, early string) (input, output *testPipeBuffer, done chan error) {
+	t.Helper()
+	input = newTestPipeBuffer()
+	output = newTestPipeBuffer()
+	if early != "" {
+		input.WriteString(early)
+	}
+	config := SessionConfig{
+		ServerHostname: "test.example.com",
+		Limits:         DefaultSessionLimits(),
+		Extensions:     DefaultExtensions(),
+		Mailbox:        &acceptAllMailbox{},
+		Pregreet:       cfg,
+	}
+	engine := NewEngineWithConn(WrapPipe(input, output), config, WithClientIP("192.0.2.1"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	done = make(chan error, 1)
+	go func() {
+		done <- engine.Run(ctx)
+		cancel()
+		engine.Close()
+	}()
+	return input, output, done
+}
+
+func TestPregreetEarlyTalker(t *testing.T) {
+	cfg := PregreetConfig{Delay: 200 * time.Millisecond, Cache: NewMemoryPregreetCache(time.Hour, 0)}
+	_, output, done := runPregreet(t, cfg, "EHLO bot.example.net\r\n")
+
+	if resp := readLine(output); !strings.HasPrefix(resp, "554 5.5.1 test.example.com Protocol error") {
+		t.Errorf("expected 554 instead of greeting, got: %q", resp)
+	}
+	if err := <-done; err != ErrEarlyTalker {
+		t.Errorf("Run() = %v, want ErrEarlyTalker", err)
+	}
+	if cfg.Cache.Passed(context.Background(), "192.0.2.1") {
+		t.Error("early talker was cached as passed")
+	}
+}
+
+func TestPregreetBanner(t *testing.T) {
+	cache := NewMemoryPregreetCache(time.Hour, 0)
+	cfg := PregreetConfig{
+		Delay:  100 * time.Millisecond,
+		Banner: []string{"test.example.com ESMTP", "Please wait for the greeting"},
+		Cache:  cache,
+	}
+	input, output, done := runPregreet(t, cfg, "")
+
+	start := time.Now()
+	if resp := readMultiLine(output); resp != "220-test.example.com ESMTP\r\n220-Please wait for the greeting\r\n220 test.example.com ESMTP icesmtp\r\n" {
+		t.Errorf("greeting = %q", resp)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("greeting after %v, want the delay", d)
+	}
+	input.WriteString("QUIT\r\n")
+	if resp := readLine(output); !strings.HasPrefix(resp, "221") {
+		t.Errorf("QUIT = %q", resp)
+	}
+	<-done
+	if !cache.Passed(context.Background(), "192.0.2.1") {
+		t.Fatal("client was not cached as passed")
+	}
+
+	// A client that passed is greeted at once, so talking early is not
+	// caught.
+	cfg.Delay = time.Hour
+	input, output, done = runPregreet(t, cfg, "QUIT\r\n")
+	if resp := readLine(output); resp != "220 test.example.com ESMTP icesmtp\r\n" {
+		t.Errorf("cached client greeting = %q", resp)
+	}
+	if resp := readLine(output); !strings.HasPrefix(resp, "221") {
+		t.Errorf("QUIT = %q", resp)
+	}
+	input.Close()
+	<-done
+}
+
+// TestPregreetBannerEarlyTalker tests that a client answering the banner
+// gets the rejection as a reply of its own.
+func TestPregreetBannerEarlyTalker(t *testing.T) {
+	cfg := PregreetConfig{
+		Delay:  time.Second,
+		Banner: []string{"test.example.com ESMTP"},
+	}
+	input, output, done := runPregreet(t, cfg, "")
+
+	if resp := readLine(output); resp != "220-test.example.com ESMTP\r\n" {
+		t.Fatalf("banner = %q", resp)
+	}
+	input.WriteString("EHLO bot.example.net\r\n")
+	if resp := readLine(output); resp != "220 test.example.com ESMTP icesmtp\r\n" {
+		t.Errorf("end of greeting = %q", resp)
+	}
+	if resp := readLine(output); !strings.HasPrefix(resp, "554 5.5.1 test.example.com Protocol error") {
+		t.Errorf("expected 554 reply, got: %q", resp)
+	}
+	if err := <-done; err != ErrEarlyTalker {
+		t.Errorf("Run() = %v, want ErrEarlyTalker", err)
+	}
+}
+
+func TestMemoryPregreetCache(t *testing.T) {
+	c := NewMemoryPregreetCache(time.Minute, 2)
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	c.Pass(ctx, "192.0.2.1")
+	now = now.Add(30 * time.Second)
+	c.Pass(ctx, "192.0.2.2")
+	if !c.Passed(ctx, "192.0.2.1") || c.Passed(ctx, "192.0.2.3") {
+		t.Error("Passed before expiry")
+	}
+
+	// The first entry has expired, so it makes room for the third.
+	now = now.Add(30 * time.Second)
+	c.Pass(ctx, "192.0.2.3")
+	if c.Passed(ctx, "192.0.2.1") || !c.Passed(ctx, "192.0.2.2") || !c.Passed(ctx, "192.0.2.3") {
+		t.Errorf("entries after eviction = %v", c.entries)
+	}
+}
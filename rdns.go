@@ -0,0 +1,108 @@
+package icesmtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// ReverseResolver looks up PTR and address records. *net.Resolver
+// implements it. A name with no records must be reported as a
+// *net.DNSError with IsNotFound set.
+type ReverseResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// ReverseDNS is the result of looking up a client's reverse DNS name.
+type ReverseDNS struct {
+	// Name is the client's PTR name without the trailing dot, preferring
+	// one that resolves back to the client. It is empty if the address
+	// has no PTR record or was not looked up.
+	Name Hostname
+
+	// Confirmed reports whether Name resolves back to the client's
+	// address (forward-confirmed reverse DNS).
+	Confirmed bool
+
+	// TempError reports whether a lookup failed temporarily, so the
+	// result may be incomplete.
+	TempError bool
+}
+
+// Verified returns the forward-confirmed name, or "unknown" if there is
+// none, as in the Received header and in Postfix's client_name.
+func (r ReverseDNS) Verified() Hostname {
+	if r.Confirmed {
+		return r.Name
+	}
+	return "unknown"
+}
+
+// Unverified returns the PTR name whether or not it was confirmed, or
+// "unknown" if there is none, as in Postfix's reverse_client_name.
+func (r ReverseDNS) Unverified() Hostname {
+	if r.Name != "" {
+		return r.Name
+	}
+	return "unknown"
+}
+
+// reverseLookupTimeout bounds the connect-time reverse DNS lookup.
+const reverseLookupTimeout = 10 * time.Second
+
+// maxReverseNames is the number of PTR names that are checked for a
+// forward match (RFC 7208 section 4.6.4 uses the same limit).
+const maxReverseNames = 10
+
+// LookupReverseDNS looks up the PTR names of ip and checks whether any of
+// them resolves back to ip.
+func LookupReverseDNS(ctx context.Context, resolver ReverseResolver, ip IPAddress) ReverseDNS {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ReverseDNS{}
+	}
+	names, err := resolver.LookupAddr(ctx, addr.String())
+	if err != nil {
+		return ReverseDNS{TempError: !isNotFound(err)}
+	}
+
+	network := "ip6"
+	if addr.To4() != nil {
+		network = "ip4"
+	}
+	var result ReverseDNS
+	for i, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if name == "" {
+			continue
+		}
+		if result.Name == "" {
+			result.Name = name
+		}
+		if i >= maxReverseNames {
+			break
+		}
+		ips, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			if !isNotFound(err) {
+				result.TempError = true
+			}
+			continue
+		}
+		for _, forward := range ips {
+			if forward.Equal(addr) {
+				return ReverseDNS{Name: name, Confirmed: true}
+			}
+		}
+	}
+	return result
+}
+
+// isNotFound reports whether err means the name has no records.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
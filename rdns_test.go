@@ -0,0 +1,84 @@
+package icesmtp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+)
+
+func reverseZone() *dnstest.Resolver {
+	return &dnstest.Resolver{
+		PTR: map[string][]string{
+			"192.0.2.1":   {"mail.example.org."},
+			"192.0.2.2":   {"forged.example.org."},
+			"192.0.2.3":   {"other.example.net.", "mx.example.net."},
+			"2001:db8::1": {"mail6.example.org."},
+		},
+		IP: map[string][]string{
+			"mail.example.org":   {"192.0.2.1"},
+			"forged.example.org": {"198.51.100.1"},
+			"mx.example.net":     {"192.0.2.3"},
+			"mail6.example.org":  {"2001:db8::1"},
+		},
+		Errors: map[string]error{
+			"192.0.2.4":         dnstest.Temporary("192.0.2.4"),
+			"other.example.net": dnstest.Temporary("other.example.net"),
+		},
+	}
+}
+
+func TestLookupReverseDNS(t *testing.T) {
+	r := reverseZone()
+	ctx := context.Background()
+
+	tests := []struct {
+		ip   string
+		want ReverseDNS
+	}{
+		{"192.0.2.1", ReverseDNS{Name: "mail.example.org", Confirmed: true}},
+		{"192.0.2.2", ReverseDNS{Name: "forged.example.org"}},
+		{"192.0.2.3", ReverseDNS{Name: "mx.example.net", Confirmed: true}},
+		{"192.0.2.4", ReverseDNS{TempError: true}},
+		{"192.0.2.5", ReverseDNS{}},
+		{"2001:db8::1", ReverseDNS{Name: "mail6.example.org", Confirmed: true}},
+		{"not an address", ReverseDNS{}},
+	}
+	for _, tt := range tests {
+		if got := LookupReverseDNS(ctx, r, tt.ip); got != tt.want {
+			t.Errorf("LookupReverseDNS(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+
+	forged := ReverseDNS{Name: "forged.example.org"}
+	if forged.Verified() != "unknown" || forged.Unverified() != "forged.example.org" {
+		t.Errorf("Verified, Unverified = %q, %q", forged.Verified(), forged.Unverified())
+	}
+}
+
+func TestEngineReverseDNS(t *testing.T) {
+	policy := &denyPolicy{}
+	config := SessionConfig{
+		ServerHostname:   "test.example.com",
+		Limits:           DefaultSessionLimits(),
+		Extensions:       DefaultExtensions(),
+		Mailbox:          &acceptAllMailbox{},
+		ReverseResolver:  reverseZone(),
+		ConnectionPolicy: policy,
+	}
+	engine := NewEngineWithConn(WrapPipe(newTestPipeBuffer(), newTestPipeBuffer()), config, WithClientIP("192.0.2.1"))
+	defer engine.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	engine.Run(ctx)
+
+	want := ReverseDNS{Name: "mail.example.org", Confirmed: true}
+	if policy.info.ReverseDNS != want {
+		t.Errorf("ConnectionInfo.ReverseDNS = %+v", policy.info.ReverseDNS)
+	}
+	if got := engine.ClientReverseDNS(); got != want {
+		t.Errorf("ClientReverseDNS = %+v", got)
+	}
+}
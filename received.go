@@ -0,0 +1,55 @@
+package icesmtp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReceivedProtocol returns the protocol named in the "with" clause of a
+// Received field (RFC 3848): SMTP after HELO, and after EHLO ESMTP with S
+// appended for TLS and A for an authenticated client.
+func ReceivedProtocol(esmtp, tls, authenticated bool) string {
+	if !esmtp {
+		return "SMTP"
+	}
+	protocol := "ESMTP"
+	if tls {
+		protocol += "S"
+	}
+	if authenticated {
+		protocol += "A"
+	}
+	return protocol
+}
+
+// Received formats a Received trace field value (RFC 5321 section 4.4)
+// recording that envelope reached its ServerHostname from the client in
+// its metadata with protocol. The client is named by its HELO name, its
+// verified reverse DNS name and its address; a missing HELO name is given
+// as "unknown" and a missing server name as "localhost". A sole recipient
+// is named in a "for" clause.
+func Received(envelope Envelope, protocol string) string {
+	md := envelope.Metadata()
+
+	helo := md.ClientHostname
+	if helo == "" {
+		helo = "unknown"
+	}
+	by := md.ServerHostname
+	if by == "" {
+		by = "localhost"
+	}
+
+	var b strings.Builder
+	b.WriteString("from " + helo)
+	if md.ClientIP != "" {
+		fmt.Fprintf(&b, " (%s [%s])", md.ClientReverseDNS.Verified(), md.ClientIP)
+	}
+	fmt.Fprintf(&b, "\r\n\tby %s with %s id %s", by, protocol, envelope.ID())
+	if rcpts := envelope.Recipients(); len(rcpts) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", rcpts[0].Address)
+	}
+	b.WriteString("; " + envelope.ReceivedAt().Format(time.RFC1123Z))
+	return b.String()
+}
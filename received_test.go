@@ -0,0 +1,80 @@
+package icesmtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReceived(t *testing.T) {
+	b := NewStandardEnvelopeBuilder(EnvelopeMetadata{
+		ClientHostname:   "client.example.org",
+		ClientIP:         "192.0.2.1",
+		ClientReverseDNS: ReverseDNS{Name: "mail.example.org", Confirmed: true},
+		ServerHostname:   "mx.example.com",
+	})
+	b.SetMailFrom(MailPath{Address: "sender@example.org"}, nil)
+	b.AddRecipient(MailPath{Address: "user@example.com"})
+	env := b.Build()
+
+	want := "from client.example.org (mail.example.org [192.0.2.1])\r\n" +
+		"\tby mx.example.com with ESMTPSA id " + env.ID() + "\r\n" +
+		"\tfor <user@example.com>; " + env.ReceivedAt().Format(time.RFC1123Z)
+	if got := Received(env, ReceivedProtocol(true, true, true)); got != want {
+		t.Errorf("Received = %q, want %q", got, want)
+	}
+
+	// An unconfirmed PTR name is not trusted, and there is no "for"
+	// clause for several recipients.
+	b = NewStandardEnvelopeBuilder(EnvelopeMetadata{
+		ClientIP:         "192.0.2.1",
+		ClientReverseDNS: ReverseDNS{Name: "forged.example.org"},
+	})
+	b.AddRecipient(MailPath{Address: "a@example.com"})
+	b.AddRecipient(MailPath{Address: "b@example.com"})
+	got := Received(b.Build(), ReceivedProtocol(false, false, false))
+	if !strings.HasPrefix(got, "from unknown (unknown [192.0.2.1])\r\n\tby localhost with SMTP id ") || strings.Contains(got, "for <") {
+		t.Errorf("Received = %q", got)
+	}
+}
+
+// TestEngineReceived tests that stored messages start with a Received
+// field.
+func TestEngineReceived(t *testing.T) {
+	storage := &envelopeCapture{}
+	resp := sendTestMessage(t, SessionConfig{Storage: storage})
+	if !strings.HasPrefix(resp, "250") {
+		t.Fatalf("expected 250 response, got: %s", resp)
+	}
+
+	env := storage.envelope
+	data := string(env.Data())
+	want := "Received: from client.example.com\r\n\tby test.example.com with ESMTP id " + env.ID() + "\r\n\tfor <recipient@example.com>; "
+	if !strings.HasPrefix(data, want) || !strings.HasSuffix(data, "\r\nSubject: Test\r\n\r\nTest message.\r\n") {
+		t.Errorf("stored message = %q", data)
+	}
+	if h := env.Headers(); !strings.HasPrefix(h.Get("Received"), "from client.example.com\tby test.example.com") || h.Get("Subject") != "Test" {
+		t.Errorf("headers = %+v", h.Fields)
+	}
+}
+
+// TestEngineReceivedSize tests that the Received field counts toward
+// MaxMessageSize.
+func TestEngineReceivedSize(t *testing.T) {
+	// The 32-byte test message is stored with a 159-byte Received field.
+	tests := []struct {
+		limit MessageSize
+		want  string
+	}{
+		{191, "250"},
+		{190, "552"},
+	}
+	for _, tt := range tests {
+		limits := DefaultSessionLimits()
+		limits.MaxMessageSize = tt.limit
+		resp := sendTestMessage(t, SessionConfig{Storage: NullStorage{}, Limits: limits})
+		if !strings.HasPrefix(resp, tt.want) {
+			t.Errorf("MaxMessageSize %d: got %s, want %s", tt.limit, resp, tt.want)
+		}
+	}
+}
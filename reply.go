@@ -1,7 +1,9 @@
 package icesmtp
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -258,3 +260,106 @@ var (
 	// ResponseTransactionFailed is a 554 transaction failed response.
 	ResponseTransactionFailed = NewResponse(Reply554TransactionFailed, "Transaction failed")
 )
+
+// DefaultAcceptReply is the default text of the 250 reply to a stored
+// message.
+const DefaultAcceptReply = "OK, message {envelope_id} accepted"
+
+// ExpandAcceptReply fills the placeholders of an accept reply template:
+//
+//	{envelope_id}  the envelope ID
+//	{queue_id}     the storage message ID, or the envelope ID if the
+//	               backend did not assign one
+//	{message_id}   the storage message ID (StorageReceipt.MessageID)
+//	{bytes}        the stored size in bytes, or the message size if the
+//	               backend did not report it
+//	{recipients}   the number of recipients
+//
+// Unknown placeholders are left as they are.
+func ExpandAcceptReply(template string, envelope Envelope, receipt StorageReceipt) string {
+	queueID := receipt.MessageID
+	if queueID == "" {
+		queueID = envelope.ID()
+	}
+	size := receipt.BytesWritten
+	if size == 0 {
+		size = envelope.DataSize()
+	}
+
+	return strings.NewReplacer(
+		"{envelope_id}", envelope.ID(),
+		"{queue_id}", queueID,
+		"{message_id}", receipt.MessageID,
+		"{bytes}", strconv.FormatInt(size, 10),
+		"{recipients}", strconv.Itoa(envelope.RecipientCount()),
+	).Replace(template)
+}
+
+// ErrInvalidReply indicates reply text could not be parsed.
+var ErrInvalidReply = errors.New("invalid SMTP reply")
+
+// ParseReplyText parses reply text as produced by external policy
+// services, such as "550 5.7.1 Rejected", into a Response. The enhanced
+// status code is optional. Multi-line replies ("550-...") separated by
+// CRLF or LF are accepted; every line must carry the same code.
+func ParseReplyText(text string) (Response, error) {
+	text = strings.TrimRight(text, "\r\n")
+	if text == "" {
+		return Response{}, ErrInvalidReply
+	}
+
+	var resp Response
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if len(line) < 3 {
+			return Response{}, ErrInvalidReply
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || code < 200 || code > 599 {
+			return Response{}, ErrInvalidReply
+		}
+		if resp.Code != 0 && ReplyCode(code) != resp.Code {
+			return Response{}, ErrInvalidReply
+		}
+		resp.Code = ReplyCode(code)
+
+		rest := line[3:]
+		if rest != "" && rest[0] != ' ' && rest[0] != '-' {
+			return Response{}, ErrInvalidReply
+		}
+		rest = strings.TrimLeft(rest, " -")
+
+		if enhanced, tail, ok := parseEnhancedCode(rest); ok {
+			if resp.EnhancedCode == nil {
+				resp.EnhancedCode = &enhanced
+			}
+			rest = tail
+		}
+		resp.Lines = append(resp.Lines, rest)
+	}
+	return resp, nil
+}
+
+// parseEnhancedCode splits a leading "x.y.z " enhanced status code from s.
+func parseEnhancedCode(s string) (EnhancedStatusCode, string, bool) {
+	word, tail, _ := strings.Cut(s, " ")
+	parts := strings.Split(word, ".")
+	if len(parts) != 3 {
+		return EnhancedStatusCode{}, s, false
+	}
+	var n [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return EnhancedStatusCode{}, s, false
+		}
+		n[i] = v
+	}
+	if n[0] != 2 && n[0] != 4 && n[0] != 5 {
+		return EnhancedStatusCode{}, s, false
+	}
+	return EnhancedStatusCode{
+		Class:   EnhancedStatusClass(n[0]),
+		Subject: EnhancedStatusSubject(n[1]),
+		Detail:  EnhancedStatusDetail(n[2]),
+	}, tail, true
+}
@@ -55,13 +55,65 @@ type SessionConfig struct {
 	// If nil, all senders are accepted.
 	SenderPolicy SenderPolicy
 
+	// ReverseResolver, if set, is used to look up the client's reverse DNS
+	// name before the greeting. The result is available from
+	// SessionInfo.ClientReverseDNS and in the envelope metadata.
+	// If nil, no lookup is made.
+	ReverseResolver ReverseResolver
+
+	// ConnectionPolicy decides whether to accept each connection before
+	// the greeting.
+	// If nil, all connections are accepted.
+	ConnectionPolicy ConnectionPolicy
+
+	// Pregreet configures an optional delay before the greeting during
+	// which clients that talk early are rejected. Disabled by default.
+	Pregreet PregreetConfig
+
+	// SessionFilterFactory creates a SessionFilter for each session that
+	// is consulted at connect, HELO, MAIL, RCPT and end of data. Use
+	// SessionFilterChain to combine several.
+	// If nil, no session filter is used.
+	SessionFilterFactory SessionFilterFactory
+
+	// DataInspectorFactory creates a DataInspector for each message that
+	// sees the data as it streams. Its results are recorded in the
+	// envelope metadata before filtering.
+	// If nil, messages are not inspected.
+	DataInspectorFactory DataInspectorFactory
+
+	// ContentFilter inspects each message after DATA and before it is
+	// stored. Use a FilterChain to run several filters.
+	// If nil, messages are not filtered.
+	ContentFilter ContentFilter
+
 	// Storage handles message persistence.
 	Storage Storage
 
+	// StorageHooks are called around each Storage.Store, in order.
+	StorageHooks []StorageHook
+
+	// AcceptReply is the text of the 250 reply sent after a message is
+	// stored. See ExpandAcceptReply for the placeholders. If empty,
+	// DefaultAcceptReply is used.
+	AcceptReply string
+
+	// StorageHealth, if set, is consulted to refuse work while storage is
+	// unhealthy instead of failing after DATA has been received.
+	StorageHealth *HealthMonitor
+
+	// LoadShedding selects where work is refused while StorageHealth
+	// reports unhealthy storage.
+	LoadShedding LoadShedMode
+
 	// EnvelopeFactory creates envelope builders.
 	// If nil, a default factory is used.
 	EnvelopeFactory EnvelopeFactory
 
+	// IDGenerator creates session IDs and, with the default envelope
+	// factory, envelope IDs. If nil, random hex IDs are used.
+	IDGenerator IDGenerator
+
 	// Extensions specifies which SMTP extensions are enabled.
 	Extensions ExtensionSet
 
@@ -76,6 +128,7 @@ type SessionConfig struct {
 // SessionLimits contains resource limits for DoS protection.
 type SessionLimits struct {
 	// MaxMessageSize is the maximum message size in bytes (0 = unlimited).
+	// It includes the Received field the server adds to the message.
 	MaxMessageSize MessageSize
 
 	// MaxRecipients is the maximum recipients per message (0 = unlimited).
@@ -89,6 +142,11 @@ type SessionLimits struct {
 	// RFC 5321 specifies 998 bytes for message lines.
 	MaxLineLength LineLength
 
+	// MaxHeaderSize is the maximum size of the header block that is parsed
+	// for Envelope.Headers (0 = unlimited). Larger header blocks are
+	// accepted but truncated in the parsed view.
+	MaxHeaderSize MessageSize
+
 	// CommandTimeout is the timeout for reading a command.
 	CommandTimeout Duration
 
@@ -133,6 +191,7 @@ func DefaultSessionLimits() SessionLimits {
 		MaxRecipients:    100,
 		MaxCommandLength: 512,
 		MaxLineLength:    998,
+		MaxHeaderSize:    256 * 1024, // 256 KB
 		CommandTimeout:   5 * time.Minute,
 		DataTimeout:      10 * time.Minute,
 		IdleTimeout:      5 * time.Minute,
@@ -270,6 +329,27 @@ func (d DisconnectReason) String() string {
 	}
 }
 
+// SessionHooksWithReceipt extends SessionHooks with access to the storage
+// receipt. If Hooks implements it, OnDataStored is called instead of
+// OnDataEnd once a message has been accepted.
+type SessionHooksWithReceipt interface {
+	SessionHooks
+
+	// OnDataStored is called when message data is complete and stored.
+	// receipt is the zero value when no Storage is configured.
+	OnDataStored(ctx context.Context, envelope Envelope, receipt StorageReceipt, session SessionInfo)
+}
+
+// SessionHooksWithHeaders extends SessionHooks with an end-of-headers
+// callback. If Hooks implements it, OnHeaders is called as soon as the
+// header block of a message has been received, before the body.
+type SessionHooksWithHeaders interface {
+	SessionHooks
+
+	// OnHeaders is called with the parsed header block.
+	OnHeaders(ctx context.Context, headers *MessageHeaders, session SessionInfo)
+}
+
 // NullSessionHooks is a no-op implementation of SessionHooks.
 type NullSessionHooks struct{}
 
@@ -327,6 +407,9 @@ type SessionState struct {
 	// ClientHostname is the hostname from HELO/EHLO.
 	ClientHostname Hostname
 
+	// ESMTP indicates the client greeted with EHLO.
+	ESMTP bool
+
 	// TLSActive indicates TLS is active.
 	TLSActive bool
 
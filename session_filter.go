@@ -0,0 +1,196 @@
+package icesmtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrConnectionRejected indicates the connection policy or a session
+// filter rejected the connection.
+var ErrConnectionRejected = errors.New("connection rejected")
+
+// SessionFilter follows a single session through its SMTP stages and can
+// reject at each of them. A new SessionFilter is created for every session
+// by the SessionFilterFactory in SessionConfig; filters that speak an
+// external protocol, such as milter, keep their connection in it.
+//
+// A PolicyDeny or PolicyDefer result rejects the command with the
+// result's Response, or a default 550 5.7.1 or 451 4.7.1 reply if it has
+// none. PolicyAllow and PolicyContinue let the command proceed.
+type SessionFilter interface {
+	// Connect is called before the greeting is sent. A rejection is sent
+	// in place of the greeting and the connection is closed.
+	Connect(ctx context.Context, session SessionInfo) PolicyResult
+
+	// Helo is called after a valid HELO or EHLO.
+	Helo(ctx context.Context, hostname Hostname, session SessionInfo) PolicyResult
+
+	// MailFrom is called after MAIL FROM has passed the SenderPolicy.
+	MailFrom(ctx context.Context, sender MailPath, params ESMTPParams, session SessionInfo) PolicyResult
+
+	// RcptTo is called after a recipient has been accepted by the Mailbox.
+	RcptTo(ctx context.Context, recipient MailPath, params ESMTPParams, session SessionInfo) PolicyResult
+
+	// ContentFilter inspects the complete message (headers, body and end
+	// of message). It runs before SessionConfig.ContentFilter.
+	ContentFilter
+
+	// Abort is called when a transaction is abandoned with RSET or
+	// replaced by a new HELO or EHLO.
+	Abort(ctx context.Context, session SessionInfo)
+
+	// Close is called when the session ends.
+	Close() error
+}
+
+// SessionFilterFactory creates a SessionFilter for each session.
+type SessionFilterFactory interface {
+	// NewSessionFilter creates the filter for a new session. An error
+	// refuses the connection with 421.
+	NewSessionFilter(ctx context.Context, session SessionInfo) (SessionFilter, error)
+}
+
+// SessionFilterFactoryFunc adapts a function to SessionFilterFactory.
+type SessionFilterFactoryFunc func(ctx context.Context, session SessionInfo) (SessionFilter, error)
+
+// NewSessionFilter calls f.
+func (f SessionFilterFactoryFunc) NewSessionFilter(ctx context.Context, session SessionInfo) (SessionFilter, error) {
+	return f(ctx, session)
+}
+
+// NullSessionFilter is a SessionFilter that allows everything.
+// Embed it to implement only some of the stages.
+type NullSessionFilter struct{}
+
+func (NullSessionFilter) Connect(_ context.Context, _ SessionInfo) PolicyResult {
+	return PolicyAllowed()
+}
+func (NullSessionFilter) Helo(_ context.Context, _ Hostname, _ SessionInfo) PolicyResult {
+	return PolicyAllowed()
+}
+func (NullSessionFilter) MailFrom(_ context.Context, _ MailPath, _ ESMTPParams, _ SessionInfo) PolicyResult {
+	return PolicyAllowed()
+}
+func (NullSessionFilter) RcptTo(_ context.Context, _ MailPath, _ ESMTPParams, _ SessionInfo) PolicyResult {
+	return PolicyAllowed()
+}
+func (NullSessionFilter) Filter(_ context.Context, _ Envelope, _ SessionInfo) (FilterResult, error) {
+	return FilterAccepted(), nil
+}
+func (NullSessionFilter) Abort(_ context.Context, _ SessionInfo) {}
+func (NullSessionFilter) Close() error                           { return nil }
+
+// SessionFilterChain combines several session filter factories into one,
+// so that e.g. HELO checks, greylisting and a milter can run in the same
+// session.
+//
+// At each stage the filters are consulted in order and the first
+// PolicyDeny or PolicyDefer result is returned; the filters after it are
+// not consulted. The filters' content filters run as a FilterChain.
+// Abort and Close are passed to every filter.
+func SessionFilterChain(factories ...SessionFilterFactory) SessionFilterFactory {
+	return SessionFilterFactoryFunc(func(ctx context.Context, session SessionInfo) (SessionFilter, error) {
+		c := &sessionFilterChain{content: NewFilterChain()}
+		for _, factory := range factories {
+			filter, err := factory.NewSessionFilter(ctx, session)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			c.filters = append(c.filters, filter)
+			c.content.Add(filter)
+		}
+		return c, nil
+	})
+}
+
+// sessionFilterChain is the SessionFilter created by SessionFilterChain.
+type sessionFilterChain struct {
+	filters []SessionFilter
+	content *FilterChain
+}
+
+// first returns the first rejecting result of stage over the filters.
+func (c *sessionFilterChain) first(stage func(SessionFilter) PolicyResult) PolicyResult {
+	for _, f := range c.filters {
+		if result := stage(f); result.Decision == PolicyDeny || result.Decision == PolicyDefer {
+			return result
+		}
+	}
+	return PolicyAllowed()
+}
+
+func (c *sessionFilterChain) Connect(ctx context.Context, session SessionInfo) PolicyResult {
+	return c.first(func(f SessionFilter) PolicyResult { return f.Connect(ctx, session) })
+}
+
+func (c *sessionFilterChain) Helo(ctx context.Context, hostname Hostname, session SessionInfo) PolicyResult {
+	return c.first(func(f SessionFilter) PolicyResult { return f.Helo(ctx, hostname, session) })
+}
+
+func (c *sessionFilterChain) MailFrom(ctx context.Context, sender MailPath, params ESMTPParams, session SessionInfo) PolicyResult {
+	return c.first(func(f SessionFilter) PolicyResult { return f.MailFrom(ctx, sender, params, session) })
+}
+
+func (c *sessionFilterChain) RcptTo(ctx context.Context, recipient MailPath, params ESMTPParams, session SessionInfo) PolicyResult {
+	return c.first(func(f SessionFilter) PolicyResult { return f.RcptTo(ctx, recipient, params, session) })
+}
+
+func (c *sessionFilterChain) Filter(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error) {
+	return c.content.Filter(ctx, envelope, session)
+}
+
+func (c *sessionFilterChain) Abort(ctx context.Context, session SessionInfo) {
+	for _, f := range c.filters {
+		f.Abort(ctx, session)
+	}
+}
+
+func (c *sessionFilterChain) Close() error {
+	var errs []error
+	for _, f := range c.filters {
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// policyResponse returns the response for a rejecting policy result.
+func policyResponse(result PolicyResult) (Response, bool) {
+	switch result.Decision {
+	case PolicyDeny:
+		if result.Response.Code != 0 {
+			return result.Response, true
+		}
+		return NewEnhancedResponse(Reply550MailboxUnavailable,
+			EnhancedStatusCode{Class: EnhancedPermanent, Subject: EnhancedSubjectPolicy, Detail: 1},
+			"Rejected by policy"), true
+	case PolicyDefer:
+		if result.Response.Code != 0 {
+			return result.Response, true
+		}
+		return NewEnhancedResponse(Reply451LocalError,
+			EnhancedStatusCode{Class: EnhancedPersistentTransient, Subject: EnhancedSubjectPolicy, Detail: 1},
+			"Deferred by policy, try again later"), true
+	default:
+		return Response{}, false
+	}
+}
+
+// connectResponse returns the reply that replaces the greeting for a
+// rejecting connect-stage result.
+func connectResponse(hostname Hostname, result PolicyResult) (Response, bool) {
+	if result.Response.Code != 0 || (result.Decision != PolicyDeny && result.Decision != PolicyDefer) {
+		return policyResponse(result)
+	}
+	if result.Decision == PolicyDeny {
+		return NewEnhancedResponse(Reply554TransactionFailed,
+			EnhancedStatusCode{Class: EnhancedPermanent, Subject: EnhancedSubjectPolicy, Detail: 1},
+			fmt.Sprintf("%s Connection rejected", hostname)), true
+	}
+	return NewEnhancedResponse(Reply421ServiceNotAvailable,
+		EnhancedStatusCode{Class: EnhancedPersistentTransient, Subject: EnhancedSubjectPolicy, Detail: 1},
+		fmt.Sprintf("%s Service temporarily unavailable, try again later", hostname)), true
+}
@@ -0,0 +1,349 @@
+package icesmtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stageFilter records the stages it sees and rejects the configured ones.
+type stageFilter struct {
+	NullSessionFilter
+	stages      []string
+	rejectConn  bool
+	rejectHelo  Hostname
+	rejectRcpt  EmailAddress
+	filterCalls int
+	closed      bool
+}
+
+func (f *stageFilter) Connect(ctx context.Context, session SessionInfo) PolicyResult {
+	f.stages = append(f.stages, "connect")
+	if f.rejectConn {
+		return PolicyResult{Decision: PolicyDeny}
+	}
+	return PolicyAllowed()
+}
+
+func (f *stageFilter) Helo(ctx context.Context, hostname Hostname, session SessionInfo) PolicyResult {
+	f.stages = append(f.stages, "helo "+hostname)
+	if hostname == f.rejectHelo {
+		return PolicyResult{Decision: PolicyDeny}
+	}
+	return PolicyAllowed()
+}
+
+func (f *stageFilter) RcptTo(ctx context.Context, recipient MailPath, params ESMTPParams, session SessionInfo) PolicyResult {
+	f.stages = append(f.stages, "rcpt "+recipient.Address)
+	if recipient.Address == f.rejectRcpt {
+		return PolicyDenied(NewResponse(Reply550MailboxUnavailable, "No thanks"), "test")
+	}
+	return PolicyAllowed()
+}
+
+func (f *stageFilter) Filter(ctx context.Context, envelope Envelope, session SessionInfo) (FilterResult, error) {
+	f.filterCalls++
+	return FilterAccepted(), nil
+}
+
+func (f *stageFilter) Abort(ctx context.Context, session SessionInfo) {
+	f.stages = append(f.stages, "abort")
+}
+
+func (f *stageFilter) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestEngineSessionFilter(t *testing.T) {
+	t.Run("connect rejected", func(t *testing.T) {
+		filter := &stageFilter{rejectConn: true}
+		input := newTestPipeBuffer()
+		output := newTestPipeBuffer()
+
+		config := SessionConfig{
+			ServerHostname: "test.example.com",
+			Limits:         DefaultSessionLimits(),
+			Extensions:     DefaultExtensions(),
+			Mailbox:        &acceptAllMailbox{},
+			SessionFilterFactory: SessionFilterFactoryFunc(func(ctx context.Context, session SessionInfo) (SessionFilter, error) {
+				return filter, nil
+			}),
+		}
+		engine := NewEngineWithConn(WrapPipe(input, output), config)
+		defer engine.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := engine.Run(ctx)
+		if resp := readLine(output); !strings.HasPrefix(resp, "554 5.7.1 test.example.com") {
+			t.Errorf("expected 554 instead of greeting, got: %s", resp)
+		}
+		if err != ErrConnectionRejected {
+			t.Errorf("Run() = %v, want ErrConnectionRejected", err)
+		}
+		if !filter.closed {
+			t.Error("filter was not closed")
+		}
+	})
+
+	t.Run("stages", func(t *testing.T) {
+		filter := &stageFilter{rejectRcpt: "bad@example.com"}
+		input := newTestPipeBuffer()
+		output := newTestPipeBuffer()
+
+		config := SessionConfig{
+			ServerHostname: "test.example.com",
+			Limits:         DefaultSessionLimits(),
+			Extensions:     DefaultExtensions(),
+			Mailbox:        &acceptAllMailbox{},
+			Storage:        NullStorage{},
+			SessionFilterFactory: SessionFilterFactoryFunc(func(ctx context.Context, session SessionInfo) (SessionFilter, error) {
+				return filter, nil
+			}),
+		}
+		engine := NewEngineWithConn(WrapPipe(input, output), config)
+		defer engine.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		done := make(chan struct{})
+		go func() {
+			engine.Run(ctx)
+			close(done)
+		}()
+
+		readLine(output)
+		input.WriteString("EHLO client.example.com\r\n")
+		readMultiLine(output)
+
+		input.WriteString("MAIL FROM:<sender@example.com>\r\n")
+		readLine(output)
+
+		input.WriteString("RCPT TO:<bad@example.com>\r\n")
+		if resp := readLine(output); !strings.HasPrefix(resp, "550 No thanks") {
+			t.Errorf("expected filter rejection, got: %s", resp)
+		}
+
+		input.WriteString("RCPT TO:<good@example.com>\r\n")
+		if resp := readLine(output); !strings.HasPrefix(resp, "250") {
+			t.Errorf("expected 250, got: %s", resp)
+		}
+
+		input.WriteString("DATA\r\n")
+		readLine(output)
+		input.WriteString("Subject: Test\r\n\r\nTest message.\r\n.\r\n")
+		if resp := readLine(output); !strings.HasPrefix(resp, "250") {
+			t.Errorf("expected 250 after data, got: %s", resp)
+		}
+
+		input.WriteString("MAIL FROM:<sender@example.com>\r\n")
+		readLine(output)
+		input.WriteString("RSET\r\n")
+		readLine(output)
+
+		input.WriteString("QUIT\r\n")
+		readLine(output)
+		<-done
+
+		want := []string{"connect", "helo client.example.com", "rcpt bad@example.com", "rcpt good@example.com", "abort"}
+		if strings.Join(filter.stages, ",") != strings.Join(want, ",") {
+			t.Errorf("stages = %v, want %v", filter.stages, want)
+		}
+		if filter.filterCalls != 1 {
+			t.Errorf("Filter called %d times, want 1", filter.filterCalls)
+		}
+		if !filter.closed {
+			t.Error("filter was not closed")
+		}
+	})
+}
+
+// TestEngineSessionFilterHelo tests that a rejected HELO leaves the
+// session as the previous greeting left it.
+func TestEngineSessionFilterHelo(t *testing.T) {
+	filter := &stageFilter{rejectHelo: "bad.example.com"}
+	input := newTestPipeBuffer()
+	output := newTestPipeBuffer()
+
+	config := SessionConfig{
+		ServerHostname: "test.example.com",
+		Limits:         DefaultSessionLimits(),
+		Extensions:     DefaultExtensions(),
+		Mailbox:        &acceptAllMailbox{},
+		SessionFilterFactory: SessionFilterFactoryFunc(func(ctx context.Context, session SessionInfo) (SessionFilter, error) {
+			return filter, nil
+		}),
+	}
+	engine := NewEngineWithConn(WrapPipe(input, output), config)
+	defer engine.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		engine.Run(ctx)
+		close(done)
+	}()
+
+	readLine(output)
+	input.WriteString("EHLO client.example.com\r\n")
+	readMultiLine(output)
+
+	input.WriteString("HELO bad.example.com\r\n")
+	if resp := readLine(output); !strings.HasPrefix(resp, "550") {
+		t.Errorf("expected filter rejection, got: %s", resp)
+	}
+
+	input.WriteString("QUIT\r\n")
+	readLine(output)
+	<-done
+
+	if !engine.state.ESMTP || engine.ClientHostname() != "client.example.com" {
+		t.Errorf("after rejected HELO: ESMTP %v, hostname %q", engine.state.ESMTP, engine.ClientHostname())
+	}
+}
+
+func TestSessionFilterChain(t *testing.T) {
+	ctx := context.Background()
+	a := &stageFilter{rejectRcpt: "a@example.com"}
+	b := &stageFilter{rejectRcpt: "b@example.com"}
+	factory := func(f SessionFilter) SessionFilterFactory {
+		return SessionFilterFactoryFunc(func(ctx context.Context, session SessionInfo) (SessionFilter, error) {
+			return f, nil
+		})
+	}
+
+	chain, err := SessionFilterChain(factory(a), factory(b)).NewSessionFilter(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := chain.Helo(ctx, "client.example.org", nil); r.Decision != PolicyAllow {
+		t.Errorf("Helo = %+v", r)
+	}
+	if r := chain.RcptTo(ctx, MailPath{Address: "a@example.com"}, nil, nil); r.Decision != PolicyDeny {
+		t.Errorf("RcptTo a = %+v", r)
+	}
+	if r := chain.RcptTo(ctx, MailPath{Address: "b@example.com"}, nil, nil); r.Decision != PolicyDeny {
+		t.Errorf("RcptTo b = %+v", r)
+	}
+	if _, err := chain.Filter(ctx, buildTestEnvelope(t, "Subject: hi\r\n\r\nHello.\r\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	chain.Abort(ctx, nil)
+	chain.Close()
+
+	// The second filter is not consulted once the first rejects.
+	wantA := []string{"helo client.example.org", "rcpt a@example.com", "rcpt b@example.com", "abort"}
+	wantB := []string{"helo client.example.org", "rcpt b@example.com", "abort"}
+	if strings.Join(a.stages, ",") != strings.Join(wantA, ",") || strings.Join(b.stages, ",") != strings.Join(wantB, ",") {
+		t.Errorf("stages = %v, %v", a.stages, b.stages)
+	}
+	if a.filterCalls != 1 || b.filterCalls != 1 || !a.closed || !b.closed {
+		t.Errorf("filter calls %d, %d; closed %v, %v", a.filterCalls, b.filterCalls, a.closed, b.closed)
+	}
+
+	// A factory error closes the filters already created.
+	c := &stageFilter{}
+	failing := SessionFilterFactoryFunc(func(ctx context.Context, session SessionInfo) (SessionFilter, error) {
+		return nil, ErrConnectionRejected
+	})
+	if _, err := SessionFilterChain(factory(c), failing).NewSessionFilter(ctx, nil); err != ErrConnectionRejected || !c.closed {
+		t.Errorf("NewSessionFilter = %v, closed %v", err, c.closed)
+	}
+}
+
+// denyPolicy rejects every connection with resp.
+type denyPolicy struct {
+	resp Response
+	info ConnectionInfo
+}
+
+func (p *denyPolicy) Accept(ctx context.Context, info ConnectionInfo) (bool, Response) {
+	p.info = info
+	return false, p.resp
+}
+
+func TestEngineConnectionPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		resp Response
+		want string
+	}{
+		{"default reply", Response{}, "554 5.7.1 test.example.com Connection rejected"},
+		{"policy reply", NewResponse(Reply421ServiceNotAvailable, "Busy"), "421 Busy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &denyPolicy{resp: tt.resp}
+			input := newTestPipeBuffer()
+			output := newTestPipeBuffer()
+
+			config := SessionConfig{
+				ServerHostname:   "test.example.com",
+				Limits:           DefaultSessionLimits(),
+				Extensions:       DefaultExtensions(),
+				Mailbox:          &acceptAllMailbox{},
+				ConnectionPolicy: policy,
+			}
+			engine := NewEngineWithConn(WrapPipe(input, output), config,
+				WithClientIP("192.0.2.1"), WithClientAddr("192.0.2.1:25000"))
+			defer engine.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err := engine.Run(ctx)
+			if resp := readLine(output); !strings.HasPrefix(resp, tt.want) {
+				t.Errorf("expected %q instead of greeting, got: %s", tt.want, resp)
+			}
+			if err != ErrConnectionRejected {
+				t.Errorf("Run() = %v, want ErrConnectionRejected", err)
+			}
+			if policy.info.RemoteIP != "192.0.2.1" || policy.info.RemoteAddr != "192.0.2.1:25000" {
+				t.Errorf("ConnectionInfo = %+v", policy.info)
+			}
+		})
+	}
+}
+
+func TestParseReplyText(t *testing.T) {
+	tests := []struct {
+		text     string
+		code     ReplyCode
+		enhanced string
+		lines    int
+		wantErr  bool
+	}{
+		{"550 5.7.1 Rejected", 550, "5.7.1", 1, false},
+		{"451 Try later", 451, "", 1, false},
+		{"550-5.7.1 First\r\n550 5.7.1 Second", 550, "5.7.1", 2, false},
+		{"550-First\n451 Second", 0, "", 0, true},
+		{"hello", 0, "", 0, true},
+		{"", 0, "", 0, true},
+	}
+
+	for _, tt := range tests {
+		resp, err := ParseReplyText(tt.text)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseReplyText(%q) succeeded, want error", tt.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseReplyText(%q): %v", tt.text, err)
+			continue
+		}
+		if resp.Code != tt.code || len(resp.Lines) != tt.lines {
+			t.Errorf("ParseReplyText(%q) = %+v", tt.text, resp)
+		}
+		if tt.enhanced != "" && (resp.EnhancedCode == nil || resp.EnhancedCode.String() != tt.enhanced) {
+			t.Errorf("ParseReplyText(%q) enhanced code = %v, want %s", tt.text, resp.EnhancedCode, tt.enhanced)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package spam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// ErrRspamd is returned when rspamd replies with an error.
+var ErrRspamd = errors.New("spam: rspamd error")
+
+// Rspamd scores messages with rspamd's /checkv2 HTTP API. The scan
+// context is sent as request headers (IP, Helo, From, Rcpt, User,
+// Queue-Id).
+type Rspamd struct {
+	url  string
+	opts options
+}
+
+// NewRspamd creates a filter for the rspamd worker at baseURL, e.g.
+// NewRspamd("http://127.0.0.1:11333").
+func NewRspamd(baseURL string, opts ...Option) *Rspamd {
+	return &Rspamd{
+		url:  strings.TrimRight(baseURL, "/") + "/checkv2",
+		opts: newOptions(opts),
+	}
+}
+
+// Filter scores the message and applies the thresholds.
+func (s *Rspamd) Filter(ctx context.Context, envelope icesmtp.Envelope, session icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	return filter(ctx, s, s.opts, envelope)
+}
+
+// rspamdReply is the part of the /checkv2 reply that is used.
+type rspamdReply struct {
+	Score         float64                    `json:"score"`
+	RequiredScore float64                    `json:"required_score"`
+	Symbols       map[string]json.RawMessage `json:"symbols"`
+	Error         string                     `json:"error"`
+}
+
+// Check scores the message.
+func (s *Rspamd) Check(ctx context.Context, envelope icesmtp.Envelope) (Report, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(envelope.Data()))
+	if err != nil {
+		return Report{}, fmt.Errorf("spam: %w", err)
+	}
+
+	md := envelope.Metadata()
+	req.Header.Set("Queue-Id", envelope.ID())
+	req.Header.Set("From", envelope.MailFrom().Address)
+	for _, rcpt := range envelope.Recipients() {
+		req.Header.Add("Rcpt", rcpt.Address)
+	}
+	if md.ClientIP != "" {
+		req.Header.Set("IP", md.ClientIP)
+	}
+	if md.ClientHostname != "" {
+		req.Header.Set("Helo", md.ClientHostname)
+	}
+	if md.ServerHostname != "" {
+		req.Header.Set("MTA-Name", md.ServerHostname)
+	}
+	if user := s.opts.userFor(envelope); user != "" {
+		req.Header.Set("User", user)
+	}
+	if s.opts.password != "" {
+		req.Header.Set("Password", s.opts.password)
+	}
+
+	resp, err := s.opts.client.Do(req)
+	if err != nil {
+		return Report{}, fmt.Errorf("spam: rspamd request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Report{}, fmt.Errorf("spam: read rspamd reply: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Report{}, fmt.Errorf("%w: HTTP %d: %s", ErrRspamd, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var reply rspamdReply
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return Report{}, fmt.Errorf("%w: %v", ErrRspamd, err)
+	}
+	if reply.Error != "" {
+		return Report{}, fmt.Errorf("%w: %s", ErrRspamd, reply.Error)
+	}
+
+	report := Report{Score: reply.Score, Required: reply.RequiredScore}
+	for name := range reply.Symbols {
+		report.Symbols = append(report.Symbols, name)
+	}
+	sort.Strings(report.Symbols)
+	return report, nil
+}
+
+// Ensure Rspamd implements the interface.
+var _ icesmtp.ContentFilter = (*Rspamd)(nil)
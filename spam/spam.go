@@ -0,0 +1,288 @@
+// Package spam provides ContentFilter adapters that score messages with
+// SpamAssassin's spamd or with rspamd.
+//
+// Both adapters add X-Spam-* headers to every scanned message and map the
+// score onto an action with configurable Thresholds: accept, accept with
+// X-Spam-Flag, temporary failure (greylisting) or rejection. The
+// envelope sender, recipients, client IP, HELO name and authenticated
+// user are passed to the scanner as scan context.
+package spam
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Report is the result of scanning a message.
+type Report struct {
+	// Score is the message's spam score.
+	Score float64
+
+	// Required is the score the scanner considers spam.
+	Required float64
+
+	// Symbols are the names of the rules that matched.
+	Symbols []string
+}
+
+// Action is what to do with a scored message.
+type Action int
+
+const (
+	// ActionAccept accepts the message.
+	ActionAccept Action = iota
+
+	// ActionGreylist tempfails the message so the sender retries.
+	ActionGreylist
+
+	// ActionAddHeader accepts the message marked with X-Spam-Flag: YES.
+	ActionAddHeader
+
+	// ActionReject rejects the message.
+	ActionReject
+)
+
+// String returns the action name.
+func (a Action) String() string {
+	switch a {
+	case ActionAccept:
+		return "accept"
+	case ActionGreylist:
+		return "greylist"
+	case ActionAddHeader:
+		return "add header"
+	case ActionReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// Thresholds map scores to actions. The highest threshold a score reaches
+// selects the action, as in rspamd. A zero threshold disables its action.
+type Thresholds struct {
+	// Greylist is the score at which messages are tempfailed.
+	Greylist float64
+
+	// AddHeader is the score at which messages are flagged as spam.
+	AddHeader float64
+
+	// Reject is the score at which messages are rejected.
+	Reject float64
+}
+
+// DefaultThresholds flags messages at 5 (SpamAssassin's required_score)
+// and rejects them at 15. Greylisting is disabled.
+var DefaultThresholds = Thresholds{
+	AddHeader: 5,
+	Reject:    15,
+}
+
+// Action returns the action for score. Of equal thresholds, the more
+// severe action is taken.
+func (t Thresholds) Action(score float64) Action {
+	action, reached := ActionAccept, 0.0
+	for _, c := range []struct {
+		threshold float64
+		action    Action
+	}{
+		{t.Greylist, ActionGreylist},
+		{t.AddHeader, ActionAddHeader},
+		{t.Reject, ActionReject},
+	} {
+		if c.threshold == 0 || score < c.threshold {
+			continue
+		}
+		if action == ActionAccept || c.threshold >= reached {
+			action, reached = c.action, c.threshold
+		}
+	}
+	return action
+}
+
+// Headers added to scanned messages.
+const (
+	// HeaderFlag is "YES" for messages at or above the AddHeader
+	// threshold.
+	HeaderFlag = "X-Spam-Flag"
+
+	// HeaderScore is the score with one decimal.
+	HeaderScore = "X-Spam-Score"
+
+	// HeaderStatus is "Yes" or "No" followed by the score, required
+	// score and matched rules, in SpamAssassin's format.
+	HeaderStatus = "X-Spam-Status"
+
+	// HeaderAction is the action taken.
+	HeaderAction = "X-Spam-Action"
+
+	// headerPrefix starts every header field name above. Fields with
+	// it are removed from scanned messages before ours are added.
+	headerPrefix = "X-Spam-"
+)
+
+// options holds the settings shared by both adapters.
+type options struct {
+	thresholds Thresholds
+	timeout    time.Duration
+	maxSize    int64
+	user       string
+	password   string
+	client     *http.Client
+}
+
+// Option configures a Spamd or Rspamd filter.
+type Option func(*options)
+
+// WithThresholds sets the score thresholds. Defaults to
+// DefaultThresholds.
+func WithThresholds(t Thresholds) Option {
+	return func(o *options) {
+		o.thresholds = t
+	}
+}
+
+// WithTimeout bounds each scan. Defaults to 30 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithMaxSize skips scanning messages larger than n bytes; they are
+// accepted unscanned, as spamc does. Defaults to 1 MB (0 = unlimited).
+func WithMaxSize(n int64) Option {
+	return func(o *options) {
+		o.maxSize = n
+	}
+}
+
+// WithUser sets the user whose preferences spamd applies, or the User
+// header sent to rspamd. Defaults to the authenticated user, if any.
+func WithUser(user string) Option {
+	return func(o *options) {
+		o.user = user
+	}
+}
+
+// WithPassword sets the rspamd controller password.
+func WithPassword(password string) Option {
+	return func(o *options) {
+		o.password = password
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for rspamd.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// newOptions applies opts over the defaults.
+func newOptions(opts []Option) options {
+	o := options{
+		thresholds: DefaultThresholds,
+		timeout:    30 * time.Second,
+		maxSize:    1 << 20,
+		client:     http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// checker scans a message.
+type checker interface {
+	Check(ctx context.Context, envelope icesmtp.Envelope) (Report, error)
+}
+
+// filter scans envelope with c and converts the report to a filter
+// result.
+func filter(ctx context.Context, c checker, o options, envelope icesmtp.Envelope) (icesmtp.FilterResult, error) {
+	if o.maxSize > 0 && envelope.DataSize() > o.maxSize {
+		return icesmtp.FilterAccepted(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+
+	report, err := c.Check(ctx, envelope)
+	if err != nil {
+		return icesmtp.FilterResult{}, err
+	}
+
+	action := o.thresholds.Action(report.Score)
+	reason := fmt.Sprintf("spam score %.1f", report.Score)
+
+	switch action {
+	case ActionReject:
+		result := icesmtp.FilterRejected("Message rejected as spam")
+		result.Reason = reason
+		return result, nil
+	case ActionGreylist:
+		result := icesmtp.FilterTempFailed("Message deferred, try again later")
+		result.Reason = reason
+		return result, nil
+	}
+
+	// Drop X-Spam fields the sender supplied so that only ours remain.
+	m := icesmtp.NewModifiedEnvelope(envelope)
+	for _, f := range envelope.Headers().Fields {
+		if len(f.Name) >= len(headerPrefix) && strings.EqualFold(f.Name[:len(headerPrefix)], headerPrefix) {
+			m.RemoveHeader(f.Name)
+		}
+	}
+	if action == ActionAddHeader {
+		m.PrependHeader(HeaderFlag, "YES")
+	}
+	m.PrependHeader(HeaderScore, strconv.FormatFloat(report.Score, 'f', 1, 64))
+	m.PrependHeader(HeaderStatus, status(report, action == ActionAddHeader))
+	m.PrependHeader(HeaderAction, action.String())
+	return icesmtp.FilterResult{Action: icesmtp.FilterAccept, Reason: reason, Envelope: m}, nil
+}
+
+// status formats an X-Spam-Status value, folding the rule list to keep
+// lines short.
+func status(r Report, spam bool) string {
+	verdict := "No"
+	if spam {
+		verdict = "Yes"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, score=%.1f required=%.1f", verdict, r.Score, r.Required)
+	if len(r.Symbols) == 0 {
+		return b.String()
+	}
+
+	b.WriteString(" tests=")
+	line := len(HeaderStatus) + 2 + b.Len()
+	for i, sym := range r.Symbols {
+		if i > 0 {
+			b.WriteByte(',')
+			line++
+			if line+len(sym) > 78 {
+				b.WriteString("\r\n\t")
+				line = 1
+			}
+		}
+		b.WriteString(sym)
+		line += len(sym)
+	}
+	return b.String()
+}
+
+// userFor returns the configured user or the authenticated user.
+func (o options) userFor(envelope icesmtp.Envelope) string {
+	if o.user != "" {
+		return o.user
+	}
+	return envelope.Metadata().AuthenticatedUser
+}
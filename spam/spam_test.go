@@ -0,0 +1,327 @@
+package spam
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+func buildEnvelope(t *testing.T, data string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{
+		ClientIP:          "192.0.2.1",
+		ClientHostname:    "client.example.org",
+		ClientReverseDNS:  icesmtp.ReverseDNS{Name: "client.example.org", Confirmed: true},
+		ServerHostname:    "mx.example.com",
+		AuthenticatedUser: "alice",
+	})
+	b.SetMailFrom(icesmtp.MailPath{Address: "sender@example.org"}, nil)
+	b.AddRecipient(icesmtp.MailPath{Address: "a@example.com"})
+	b.AddRecipient(icesmtp.MailPath{Address: "b@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// scoreOf returns the score requested by a "Subject: score N" message.
+func scoreOf(msg string) float64 {
+	i := strings.Index(msg, "Subject: score ")
+	if i < 0 {
+		return 0
+	}
+	line, _, _ := strings.Cut(msg[i+len("Subject: score "):], "\r\n")
+	f, _ := strconv.ParseFloat(line, 64)
+	return f
+}
+
+func TestThresholds_Action(t *testing.T) {
+	th := Thresholds{Greylist: 4, AddHeader: 6, Reject: 15}
+	tests := []struct {
+		score float64
+		want  Action
+	}{
+		{-1, ActionAccept},
+		{3.9, ActionAccept},
+		{4, ActionGreylist},
+		{6.5, ActionAddHeader},
+		{15, ActionReject},
+	}
+	for _, tt := range tests {
+		if got := th.Action(tt.score); got != tt.want {
+			t.Errorf("Action(%v) = %v, want %v", tt.score, got, tt.want)
+		}
+	}
+	if got := DefaultThresholds.Action(4.5); got != ActionAccept {
+		t.Errorf("default thresholds greylisted: %v", got)
+	}
+
+	// The highest threshold reached wins, whatever the action.
+	th = Thresholds{Greylist: 10, AddHeader: 5, Reject: 10}
+	for score, want := range map[float64]Action{4: ActionAccept, 6: ActionAddHeader, 12: ActionReject} {
+		if got := th.Action(score); got != want {
+			t.Errorf("reordered Action(%v) = %v, want %v", score, got, want)
+		}
+	}
+	th = Thresholds{Greylist: 10, AddHeader: 5}
+	if got := th.Action(12); got != ActionGreylist {
+		t.Errorf("Action(12) = %v, want greylist", got)
+	}
+}
+
+// fakeSpamd answers SYMBOLS requests with the score from the message's
+// Subject and sends each request on the returned channel.
+func fakeSpamd(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	requests := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			var head strings.Builder
+			length := 0
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				head.WriteString(line)
+				if line == "\r\n" {
+					break
+				}
+				if v, ok := strings.CutPrefix(line, "Content-length: "); ok {
+					length, _ = strconv.Atoi(strings.TrimSpace(v))
+				}
+			}
+			body := make([]byte, length)
+			io.ReadFull(r, body)
+			requests <- head.String() + string(body)
+
+			score := scoreOf(string(body))
+			verdict := "False"
+			if score >= 5 {
+				verdict = "True"
+			}
+			symbols := "BAYES_50,HTML_MESSAGE"
+			fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %s ; %.1f / 5.0\r\n\r\n%s",
+				len(symbols), verdict, score, symbols)
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), requests
+}
+
+func TestSpamd_Filter(t *testing.T) {
+	addr, requests := fakeSpamd(t)
+	s := NewSpamd("tcp", addr)
+	ctx := context.Background()
+
+	result, err := s.Filter(ctx, buildEnvelope(t, "Subject: score 1.2\r\n\r\nHello.\r\n"), nil)
+	if err != nil {
+		t.Fatalf("Filter: %v", err)
+	}
+	if result.Action != icesmtp.FilterAccept || result.Envelope == nil {
+		t.Fatalf("result = %+v", result)
+	}
+	h := result.Envelope.Headers()
+	if h.Get(HeaderScore) != "1.2" || h.Has(HeaderFlag) ||
+		h.Get(HeaderStatus) != "No, score=1.2 required=5.0 tests=BAYES_50,HTML_MESSAGE" {
+		t.Errorf("headers = %+v", h.Fields)
+	}
+
+	req := <-requests
+	for _, want := range []string{
+		"SYMBOLS SPAMC/1.5\r\n",
+		"User: alice\r\n",
+		"Return-Path: <sender@example.org>\r\n",
+		"Received: from client.example.org (client.example.org [192.0.2.1])\r\n\tby mx.example.com with ESMTPA",
+		"Subject: score 1.2",
+	} {
+		if !strings.Contains(req, want) {
+			t.Errorf("request missing %q:\n%s", want, req)
+		}
+	}
+
+	result, err = s.Filter(ctx, buildEnvelope(t, "Subject: score 7\r\n\r\nBuy now.\r\n"), nil)
+	if err != nil || result.Envelope.Headers().Get(HeaderFlag) != "YES" {
+		t.Errorf("add header result = %+v, %v", result, err)
+	}
+
+	result, err = s.Filter(ctx, buildEnvelope(t, "Subject: score 20\r\n\r\nBuy now.\r\n"), nil)
+	if err != nil || result.Action != icesmtp.FilterReject || result.Response.Code != 554 {
+		t.Errorf("reject result = %+v, %v", result, err)
+	}
+}
+
+func TestSpamd_Received(t *testing.T) {
+	addr, requests := fakeSpamd(t)
+	s := NewSpamd("tcp", addr)
+
+	// A Received field from the sender does not replace ours.
+	env := buildEnvelope(t, "Received: from trusted.example.com\r\nSubject: score 1\r\n\r\nHi.\r\n")
+	if _, err := s.Check(context.Background(), env); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-requests; !strings.Contains(req, "\r\n\r\nReturn-Path: <sender@example.org>\r\nReceived: from client.example.org ") {
+		t.Errorf("forged Received not preceded by ours:\n%s", req)
+	}
+
+	// The engine's own field is not repeated.
+	own := icesmtp.Received(env, "ESMTPA")
+	m := icesmtp.NewModifiedEnvelope(env)
+	m.PrependHeader("Received", own)
+	if _, err := s.Check(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-requests; strings.Count(req, "by mx.example.com") != 1 || !strings.Contains(req, "Return-Path: <sender@example.org>\r\nReceived: "+own+"\r\n") {
+		t.Errorf("own Received repeated:\n%s", req)
+	}
+}
+
+func TestFilter_StripsSpamHeaders(t *testing.T) {
+	addr, _ := fakeSpamd(t)
+	s := NewSpamd("tcp", addr)
+
+	env := buildEnvelope(t, "X-Spam-Flag: NO\r\nx-spam-level: \r\nSubject: score 7\r\nX-Spam-Score: -100\r\n\r\nBuy now.\r\n")
+	result, err := s.Filter(context.Background(), env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := result.Envelope.Headers()
+	if got := h.Values(HeaderFlag); len(got) != 1 || got[0] != "YES" {
+		t.Errorf("%s = %q", HeaderFlag, got)
+	}
+	if got := h.Values(HeaderScore); len(got) != 1 || got[0] != "7.0" {
+		t.Errorf("%s = %q", HeaderScore, got)
+	}
+	if h.Has("X-Spam-Level") || h.Get("Subject") != "score 7" {
+		t.Errorf("headers = %+v", h.Fields)
+	}
+}
+
+func TestSpamd_Error(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, io.LimitReader(conn, 10))
+		fmt.Fprint(conn, "SPAMD/1.0 76 Bad header line\r\n")
+		conn.Close()
+	}()
+
+	_, err = NewSpamd("tcp", ln.Addr().String()).Check(context.Background(), buildEnvelope(t, "Subject: x\r\n\r\nx\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "Bad header line") {
+		t.Errorf("expected spamd error, got %v", err)
+	}
+}
+
+func TestRspamd_Filter(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" {
+			http.NotFound(w, r)
+			return
+		}
+		got = r.Header.Clone()
+		body, _ := io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(map[string]any{
+			"score":          scoreOf(string(body)),
+			"required_score": 15,
+			"action":         "no action",
+			"symbols": map[string]any{
+				"R_SPF_ALLOW": map[string]any{"score": -0.2},
+				"ARC_NA":      map[string]any{"score": 0},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	s := NewRspamd(srv.URL+"/", WithThresholds(Thresholds{Greylist: 4, AddHeader: 6, Reject: 15}), WithPassword("secret"))
+	ctx := context.Background()
+
+	result, err := s.Filter(ctx, buildEnvelope(t, "Subject: score 6.5\r\n\r\nHello.\r\n"), nil)
+	if err != nil {
+		t.Fatalf("Filter: %v", err)
+	}
+	h := result.Envelope.Headers()
+	if h.Get(HeaderFlag) != "YES" || h.Get(HeaderAction) != "add header" ||
+		h.Get(HeaderStatus) != "Yes, score=6.5 required=15.0 tests=ARC_NA,R_SPF_ALLOW" {
+		t.Errorf("headers = %+v", h.Fields)
+	}
+
+	if got.Get("IP") != "192.0.2.1" || got.Get("Helo") != "client.example.org" ||
+		got.Get("From") != "sender@example.org" || len(got.Values("Rcpt")) != 2 ||
+		got.Get("User") != "alice" || got.Get("Password") != "secret" || got.Get("Queue-Id") == "" {
+		t.Errorf("request headers = %v", got)
+	}
+
+	result, err = s.Filter(ctx, buildEnvelope(t, "Subject: score 4.5\r\n\r\nHello.\r\n"), nil)
+	if err != nil || result.Action != icesmtp.FilterTempFail || result.Response.Code != 451 {
+		t.Errorf("greylist result = %+v, %v", result, err)
+	}
+}
+
+func TestRspamd_HTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := NewRspamd(srv.URL).Filter(context.Background(), buildEnvelope(t, "Subject: x\r\n\r\nx\r\n"), nil)
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMaxSizeSkipsScan(t *testing.T) {
+	s := NewRspamd("http://127.0.0.1:1", WithMaxSize(8))
+	result, err := s.Filter(context.Background(), buildEnvelope(t, "Subject: score 20\r\n\r\nlong body\r\n"), nil)
+	if err != nil || result.Action != icesmtp.FilterAccept || result.Envelope != nil {
+		t.Errorf("oversize result = %+v, %v", result, err)
+	}
+}
+
+func TestStatusFolding(t *testing.T) {
+	var symbols []string
+	for i := 0; i < 20; i++ {
+		symbols = append(symbols, fmt.Sprintf("SOME_LONG_RULE_NAME_%02d", i))
+	}
+	s := status(Report{Score: 3, Required: 5, Symbols: symbols}, false)
+	for _, line := range strings.Split(s, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line too long (%d): %q", len(line), line)
+		}
+	}
+	if strings.ReplaceAll(s, "\r\n\t", "") != "No, score=3.0 required=5.0 tests="+strings.Join(symbols, ",") {
+		t.Errorf("unfolded status = %q", s)
+	}
+}
@@ -0,0 +1,157 @@
+package spam
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// ErrSpamd is returned when spamd replies with an error.
+var ErrSpamd = errors.New("spam: spamd error")
+
+// Spamd scores messages with SpamAssassin's spamd using the SPAMC/SPAMD
+// protocol.
+//
+// spamd has no fields for envelope data, so the scan context is passed as
+// a Return-Path header field prepended to the scanned copy of the message,
+// as an MTA delivering to spamc would have added it, together with a
+// Received field unless the message already starts with the one the
+// engine added.
+type Spamd struct {
+	network string
+	address string
+	opts    options
+}
+
+// NewSpamd creates a filter for the spamd listening at address, e.g.
+// NewSpamd("tcp", "127.0.0.1:783").
+func NewSpamd(network, address string, opts ...Option) *Spamd {
+	return &Spamd{
+		network: network,
+		address: address,
+		opts:    newOptions(opts),
+	}
+}
+
+// Filter scores the message and applies the thresholds.
+func (s *Spamd) Filter(ctx context.Context, envelope icesmtp.Envelope, session icesmtp.SessionInfo) (icesmtp.FilterResult, error) {
+	return filter(ctx, s, s.opts, envelope)
+}
+
+// Check scores the message with the SYMBOLS command.
+func (s *Spamd) Check(ctx context.Context, envelope icesmtp.Envelope) (Report, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return Report{}, fmt.Errorf("spam: dial spamd %s: %w", s.address, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := append(scanContext(envelope), envelope.Data()...)
+
+	var req bytes.Buffer
+	req.WriteString("SYMBOLS SPAMC/1.5\r\n")
+	fmt.Fprintf(&req, "Content-length: %d\r\n", len(msg))
+	if user := s.opts.userFor(envelope); user != "" {
+		fmt.Fprintf(&req, "User: %s\r\n", user)
+	}
+	req.WriteString("\r\n")
+	req.Write(msg)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return Report{}, fmt.Errorf("spam: write to spamd: %w", err)
+	}
+
+	return readSpamdReply(bufio.NewReader(conn))
+}
+
+// readSpamdReply parses a SPAMD reply to SYMBOLS.
+func readSpamdReply(r *bufio.Reader) (Report, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Report{}, fmt.Errorf("spam: read spamd reply: %w", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return Report{}, fmt.Errorf("%w: bad status line %q", ErrSpamd, strings.TrimSpace(line))
+	}
+	if fields[1] != "0" {
+		return Report{}, fmt.Errorf("%w: %s", ErrSpamd, strings.Join(fields[1:], " "))
+	}
+
+	var report Report
+	var found bool
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return Report{}, fmt.Errorf("spam: read spamd reply: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(name, "Spam") {
+			continue
+		}
+		// Spam: True ; 15.0 / 5.0
+		_, scores, _ := strings.Cut(value, ";")
+		score, required, _ := strings.Cut(scores, "/")
+		report.Score, err = strconv.ParseFloat(strings.TrimSpace(score), 64)
+		if err != nil {
+			return Report{}, fmt.Errorf("%w: bad Spam header %q", ErrSpamd, value)
+		}
+		report.Required, _ = strconv.ParseFloat(strings.TrimSpace(required), 64)
+		found = true
+	}
+	if !found {
+		return Report{}, fmt.Errorf("%w: no Spam header", ErrSpamd)
+	}
+
+	body, _ := io.ReadAll(r)
+	for _, sym := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if sym = strings.TrimSpace(sym); sym != "" {
+			report.Symbols = append(report.Symbols, sym)
+		}
+	}
+	return report, nil
+}
+
+// scanContext returns a Return-Path field, and a Received field
+// describing how the message arrived unless its topmost Received field
+// was added by an icesmtp.Engine for this envelope. Without that, a
+// Received field forged by the sender would be taken for ours.
+func scanContext(envelope icesmtp.Envelope) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Return-Path: <%s>\r\n", envelope.MailFrom().Address)
+	if !hasOwnReceived(envelope) {
+		md := envelope.Metadata()
+		protocol := icesmtp.ReceivedProtocol(true, md.TLSActive, md.AuthenticatedUser != "")
+		fmt.Fprintf(&b, "Received: %s\r\n", icesmtp.Received(envelope, protocol))
+	}
+	return b.Bytes()
+}
+
+// hasOwnReceived reports whether the topmost Received field of envelope
+// names it by its ID, as the field added by an icesmtp.Engine does.
+func hasOwnReceived(envelope icesmtp.Envelope) bool {
+	for _, f := range envelope.Headers().Fields {
+		if strings.EqualFold(f.Name, "Received") {
+			return strings.Contains(f.Value, " id "+envelope.ID())
+		}
+	}
+	return false
+}
+
+// Ensure Spamd implements the interface.
+var _ icesmtp.ContentFilter = (*Spamd)(nil)
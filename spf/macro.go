@@ -0,0 +1,230 @@
+package spf
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// checkMacros reports whether s is a valid macro-string, without
+// expanding it.
+func checkMacros(s string) error {
+	e := &eval{checker: &Checker{}}
+	_, err := e.expandWith(context.Background(), s, "", false, func(byte) string { return "" })
+	return err
+}
+
+// expandDomain expands a domain-spec and shortens the result to 253
+// characters by dropping labels from the left (RFC 7208 section 7.3).
+func (e *eval) expandDomain(ctx context.Context, spec, domain string) (string, error) {
+	name, err := e.expand(ctx, spec, domain, false)
+	if err != nil {
+		return "", err
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for len(name) > 253 {
+		_, rest, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = rest
+	}
+	if name == "" {
+		return "", fmt.Errorf("%w: %q expands to an empty name", ErrSyntax, spec)
+	}
+	return name, nil
+}
+
+// expand expands the macros in s (RFC 7208 section 7). The c, r and t
+// macros are only allowed in explanations.
+func (e *eval) expand(ctx context.Context, s, domain string, explanation bool) (string, error) {
+	return e.expandWith(ctx, s, domain, explanation, nil)
+}
+
+// expandWith expands s using value for the macro letters, or the check's
+// values if value is nil.
+func (e *eval) expandWith(ctx context.Context, s, domain string, explanation bool, value func(letter byte) string) (string, error) {
+	if value == nil {
+		value = func(letter byte) string { return e.macro(ctx, letter, domain) }
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("%w: %q ends with %%", ErrSyntax, s)
+		}
+		i++
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("%w: unterminated macro in %q", ErrSyntax, s)
+			}
+			v, err := expandMacro(s[i+1:i+end], explanation, value)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i += end
+		default:
+			return "", fmt.Errorf("%w: invalid macro %%%c in %q", ErrSyntax, s[i], s)
+		}
+	}
+	return b.String(), nil
+}
+
+// expandMacro expands the body of a %{...} macro: a letter, an optional
+// number of parts to keep, an optional "r" to reverse the parts and
+// optional delimiters.
+func expandMacro(body string, explanation bool, value func(byte) string) (string, error) {
+	invalid := func() (string, error) {
+		return "", fmt.Errorf("%w: invalid macro %%{%s}", ErrSyntax, body)
+	}
+	if body == "" {
+		return invalid()
+	}
+
+	letter := body[0]
+	lower := letter | 0x20
+	switch {
+	case strings.IndexByte("slodiphv", lower) >= 0:
+	case strings.IndexByte("crt", lower) >= 0 && explanation:
+	default:
+		return invalid()
+	}
+
+	rest := body[1:]
+	digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return invalid()
+		}
+		keep = n
+	}
+	rest = rest[digits:]
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return invalid()
+		}
+		delimiters = rest
+	}
+
+	v := value(lower)
+	if keep > 0 || reverse || delimiters != "." {
+		parts := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+		if reverse {
+			slices.Reverse(parts)
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		v = strings.Join(parts, ".")
+	}
+	if letter != lower {
+		v = urlEscape(v)
+	}
+	return v, nil
+}
+
+// macro returns the value of a macro letter.
+func (e *eval) macro(ctx context.Context, letter byte, domain string) string {
+	local, senderDomain := "postmaster", e.sender
+	if i := strings.LastIndex(e.sender, "@"); i >= 0 {
+		local, senderDomain = e.sender[:i], e.sender[i+1:]
+	}
+
+	switch letter {
+	case 's':
+		return e.sender
+	case 'l':
+		return local
+	case 'o':
+		return senderDomain
+	case 'd':
+		return domain
+	case 'i':
+		return dotted(e.ip)
+	case 'p':
+		return e.validatedName(ctx, domain)
+	case 'v':
+		if e.ip.To4() != nil {
+			return "in-addr"
+		}
+		return "ip6"
+	case 'h':
+		return e.helo
+	case 'c':
+		return e.ip.String()
+	case 'r':
+		return e.checker.receiver
+	case 't':
+		return strconv.FormatInt(e.checker.now().Unix(), 10)
+	}
+	return ""
+}
+
+// validatedName returns the client's validated reverse name for the %{p}
+// macro, preferring domain or a subdomain of it, or "unknown".
+func (e *eval) validatedName(ctx context.Context, domain string) string {
+	names := e.validatedNames(ctx)
+	for _, name := range names {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return name
+		}
+	}
+	if len(names) > 0 {
+		return names[0]
+	}
+	return "unknown"
+}
+
+// dotted returns ip in the form used by %{i}: dotted quads for IPv4 and
+// dot-separated nibbles for IPv6.
+func dotted(ip []byte) string {
+	if len(ip) == 4 {
+		return fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3])
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// urlEscape escapes the characters outside RFC 3986's unreserved set.
+func urlEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
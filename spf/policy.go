@@ -0,0 +1,116 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// Policy checks SPF at MAIL FROM. It implements icesmtp.SenderPolicy.
+//
+// By default every sender is accepted and the result is only recorded in
+// the envelope metadata, leaving the decision to DMARC or a later filter.
+// Options reject or defer senders by result.
+type Policy struct {
+	checker *Checker
+
+	rejectFail      bool
+	rejectPermError bool
+	deferTempError  bool
+}
+
+// PolicyOption configures a Policy.
+type PolicyOption func(*Policy)
+
+// WithRejectFail rejects senders whose result is fail with 550 5.7.23,
+// giving the domain's explanation if it publishes one.
+func WithRejectFail() PolicyOption {
+	return func(p *Policy) {
+		p.rejectFail = true
+	}
+}
+
+// WithRejectPermError rejects senders whose domain publishes an invalid
+// record with 550 5.7.24.
+func WithRejectPermError() PolicyOption {
+	return func(p *Policy) {
+		p.rejectPermError = true
+	}
+}
+
+// WithDeferTempError defers senders whose check failed on a DNS error
+// with 451 4.7.24, so that the client retries.
+func WithDeferTempError() PolicyOption {
+	return func(p *Policy) {
+		p.deferTempError = true
+	}
+}
+
+// NewPolicy creates a Policy that checks senders with checker.
+func NewPolicy(checker *Checker, opts ...PolicyOption) *Policy {
+	p := &Policy{checker: checker}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Ensure Policy implements the interface.
+var _ icesmtp.SenderPolicy = (*Policy)(nil)
+
+// ValidateSender checks the sender, or the HELO name for the null
+// reverse-path, and records the result. Clients without a known IP
+// address are accepted unchecked.
+func (p *Policy) ValidateSender(ctx context.Context, sender icesmtp.MailPath, session icesmtp.SessionInfo) icesmtp.SenderResult {
+	ip := net.ParseIP(session.ClientIP())
+	if ip == nil {
+		return icesmtp.SenderResultAccepted()
+	}
+
+	helo := session.ClientHostname()
+	out := p.checker.Check(ctx, ip, helo, sender.Address)
+
+	result := icesmtp.SenderResultAccepted()
+	result.AuthResults = []icesmtp.AuthResult{AuthResult(out, sender.Address, helo)}
+
+	switch {
+	case out.Result == Fail && p.rejectFail:
+		text := "SPF validation failed"
+		if out.Explanation != "" {
+			text += ": " + out.Explanation
+		}
+		result.Accepted = false
+		result.Response = response(icesmtp.Reply550MailboxUnavailable, icesmtp.EnhancedPermanent, 23, text)
+	case out.Result == PermError && p.rejectPermError:
+		result.Accepted = false
+		result.Response = response(icesmtp.Reply550MailboxUnavailable, icesmtp.EnhancedPermanent, 24, "SPF validation error")
+	case out.Result == TempError && p.deferTempError:
+		result.Accepted = false
+		result.Response = response(icesmtp.Reply451LocalError, icesmtp.EnhancedPersistentTransient, 24, "SPF validation temporarily failed")
+	}
+	return result
+}
+
+// response builds a policy reply with enhanced code class.7.detail.
+func response(code icesmtp.ReplyCode, class icesmtp.EnhancedStatusClass, detail icesmtp.EnhancedStatusDetail, text string) icesmtp.Response {
+	return icesmtp.NewEnhancedResponse(code,
+		icesmtp.EnhancedStatusCode{Class: class, Subject: icesmtp.EnhancedSubjectPolicy, Detail: detail}, text)
+}
+
+// AuthResult converts an outcome for sender (or helo, for the null
+// reverse-path) to an Authentication-Results entry, with the identity in
+// smtp.mailfrom or smtp.helo (RFC 8601 section 2.7.2).
+func AuthResult(out Outcome, sender, helo string) icesmtp.AuthResult {
+	r := icesmtp.AuthResult{Method: "spf", Result: string(out.Result)}
+	if out.Err != nil {
+		r.Reason = strings.TrimPrefix(out.Err.Error(), "spf: ")
+	}
+	if sender == "" {
+		r.Properties = []icesmtp.AuthProperty{{Type: "smtp", Name: "helo", Value: helo}}
+	} else {
+		r.Properties = []icesmtp.AuthProperty{{Type: "smtp", Name: "mailfrom", Value: sender}}
+	}
+	return r
+}
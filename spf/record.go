@@ -0,0 +1,199 @@
+package spf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// record is a parsed SPF record.
+type record struct {
+	directives []directive
+
+	// redirect and exp are the modifiers' domain-specs.
+	redirect string
+	exp      string
+}
+
+// directive is a mechanism with its qualifier.
+type directive struct {
+	// text is the directive as written.
+	text string
+
+	// qualifier is one of '+', '-', '~' or '?'.
+	qualifier byte
+
+	// mechanism is the lower-case mechanism name.
+	mechanism string
+
+	// domain is the domain-spec of include, exists, a, mx and ptr.
+	domain string
+
+	// ip is the network address of ip4 and ip6.
+	ip net.IP
+
+	// prefix4 and prefix6 are the CIDR prefix lengths.
+	prefix4, prefix6 int
+}
+
+// result returns the result the directive produces when it matches.
+func (d directive) result() Result {
+	switch d.qualifier {
+	case '-':
+		return Fail
+	case '~':
+		return SoftFail
+	case '?':
+		return Neutral
+	default:
+		return Pass
+	}
+}
+
+// prefix returns the prefix length for the family of ip.
+func (d directive) prefix(ip net.IP) int {
+	if ip.To4() != nil {
+		return d.prefix4
+	}
+	return d.prefix6
+}
+
+// cidrSuffix splits a domain-spec from a dual-cidr-length.
+var cidrSuffix = regexp.MustCompile(`^(.*?)(?:/(0|[1-9][0-9]*))?(?://(0|[1-9][0-9]*))?$`)
+
+// modifierName matches the name of a modifier (RFC 7208 section 12).
+var modifierName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9\-_.]*=`)
+
+// parseRecord parses an SPF record. Any syntax error makes the whole
+// record invalid, as RFC 7208 section 4.6 requires.
+func parseRecord(txt string) (*record, error) {
+	rec := &record{}
+	for _, term := range strings.Fields(txt[len("v=spf1"):]) {
+		if m := modifierName.FindString(term); m != "" {
+			name, value := strings.ToLower(m[:len(m)-1]), term[len(m):]
+			if err := checkMacros(value); err != nil {
+				return nil, err
+			}
+			switch name {
+			case "redirect", "exp":
+				if value == "" {
+					return nil, fmt.Errorf("%w: empty %s modifier", ErrSyntax, name)
+				}
+				target := &rec.redirect
+				if name == "exp" {
+					target = &rec.exp
+				}
+				if *target != "" {
+					return nil, fmt.Errorf("%w: repeated %s modifier", ErrSyntax, name)
+				}
+				*target = value
+			}
+			// Unknown modifiers are ignored.
+			continue
+		}
+
+		d, err := parseDirective(term)
+		if err != nil {
+			return nil, err
+		}
+		rec.directives = append(rec.directives, d)
+	}
+	return rec, nil
+}
+
+// parseDirective parses a mechanism with an optional qualifier.
+func parseDirective(term string) (directive, error) {
+	d := directive{text: term, qualifier: '+', prefix4: 32, prefix6: 128}
+	rest := term
+	if strings.ContainsRune("+-~?", rune(rest[0])) {
+		d.qualifier = rest[0]
+		rest = rest[1:]
+	}
+
+	end := strings.IndexAny(rest, ":/")
+	if end < 0 {
+		end = len(rest)
+	}
+	d.mechanism, rest = strings.ToLower(rest[:end]), rest[end:]
+
+	invalid := func() (directive, error) {
+		return directive{}, fmt.Errorf("%w: invalid term %q", ErrSyntax, term)
+	}
+
+	switch d.mechanism {
+	case "all":
+		if rest != "" {
+			return invalid()
+		}
+
+	case "include", "exists":
+		spec, ok := strings.CutPrefix(rest, ":")
+		if !ok || spec == "" || checkMacros(spec) != nil {
+			return invalid()
+		}
+		d.domain = spec
+
+	case "a", "mx", "ptr":
+		if d.mechanism != "ptr" {
+			m := cidrSuffix.FindStringSubmatch(rest)
+			var err error
+			if d.prefix4, err = prefixLength(m[2], 32); err != nil {
+				return invalid()
+			}
+			if d.prefix6, err = prefixLength(m[3], 128); err != nil {
+				return invalid()
+			}
+			rest = m[1]
+		}
+		if rest != "" {
+			spec, ok := strings.CutPrefix(rest, ":")
+			if !ok || spec == "" || checkMacros(spec) != nil {
+				return invalid()
+			}
+			d.domain = spec
+		}
+
+	case "ip4", "ip6":
+		spec, ok := strings.CutPrefix(rest, ":")
+		if !ok {
+			return invalid()
+		}
+		addr, length, hasLength := strings.Cut(spec, "/")
+		d.ip = net.ParseIP(addr)
+		v4 := d.mechanism == "ip4"
+		if d.ip == nil || v4 != (d.ip.To4() != nil && !strings.Contains(addr, ":")) {
+			return invalid()
+		}
+		bits := 128
+		if v4 {
+			bits = 32
+		}
+		if hasLength {
+			n, err := prefixLength(length, bits)
+			if err != nil || length == "" {
+				return invalid()
+			}
+			d.prefix4, d.prefix6 = n, n
+		} else {
+			d.prefix4, d.prefix6 = bits, bits
+		}
+
+	default:
+		return directive{}, fmt.Errorf("%w: unknown mechanism %q", ErrSyntax, d.mechanism)
+	}
+	return d, nil
+}
+
+// prefixLength parses a CIDR prefix length up to max; "" means max.
+func prefixLength(s string, max int) (int, error) {
+	if s == "" {
+		return max, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("%w: invalid prefix length %q", ErrSyntax, s)
+	}
+	return n, nil
+}
@@ -0,0 +1,524 @@
+// Package spf evaluates Sender Policy Framework records (RFC 7208).
+//
+// A Checker runs the check_host() function against a Resolver, which
+// *net.Resolver implements. All mechanisms, the redirect and exp
+// modifiers and macros are supported, and the processing limits of RFC
+// 7208 section 4.6.4 are enforced: at most 10 terms that query DNS and 2
+// void lookups per check.
+//
+// Policy adapts a Checker to icesmtp.SenderPolicy. It checks the MAIL FROM
+// identity, or the HELO identity for the null reverse-path, and records
+// the result in the envelope metadata, from where
+// icesmtp.AuthResultsFilter writes it to an Authentication-Results header.
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Result is the result of an SPF check.
+type Result string
+
+// Results defined by RFC 7208 section 2.6.
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Errors reported in Outcome.Err. An error wrapping ErrDNS produces
+// TempError; any other error produces PermError.
+var (
+	// ErrDNS indicates a temporary DNS failure.
+	ErrDNS = errors.New("spf: DNS error")
+
+	// ErrLookupLimit indicates the record needs too many DNS lookups.
+	ErrLookupLimit = errors.New("spf: too many DNS lookups")
+
+	// ErrVoidLimit indicates too many lookups returned no records.
+	ErrVoidLimit = errors.New("spf: too many void DNS lookups")
+
+	// ErrMultipleRecords indicates a domain publishes more than one SPF
+	// record.
+	ErrMultipleRecords = errors.New("spf: multiple SPF records")
+
+	// ErrSyntax indicates a malformed record.
+	ErrSyntax = errors.New("spf: syntax error")
+)
+
+// Resolver looks up DNS records. *net.Resolver implements it. A name with
+// no records must be reported as a *net.DNSError with IsNotFound set.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Outcome is the result of a check with the details behind it.
+type Outcome struct {
+	// Result is the SPF result.
+	Result Result
+
+	// Domain is the domain that was checked.
+	Domain string
+
+	// Mechanism is the directive that matched, e.g. "-all". It is empty
+	// if none matched.
+	Mechanism string
+
+	// Explanation is the domain's explanation for a Fail result, from
+	// the exp modifier.
+	Explanation string
+
+	// Err is the cause of a TempError or PermError result.
+	Err error
+}
+
+// Checker evaluates SPF records.
+type Checker struct {
+	resolver Resolver
+
+	lookupLimit int
+	voidLimit   int
+	receiver    string
+	now         func() time.Time
+}
+
+// Option configures a Checker.
+type Option func(*Checker)
+
+// WithLookupLimit sets the number of terms that may query DNS in one
+// check. Defaults to 10, as required by RFC 7208.
+func WithLookupLimit(n int) Option {
+	return func(c *Checker) {
+		c.lookupLimit = n
+	}
+}
+
+// WithVoidLookupLimit sets the number of lookups that may return no
+// records in one check. Defaults to 2, as recommended by RFC 7208.
+func WithVoidLookupLimit(n int) Option {
+	return func(c *Checker) {
+		c.voidLimit = n
+	}
+}
+
+// WithReceiver sets the receiving host name expanded by the %{r} macro.
+// Defaults to "unknown".
+func WithReceiver(host string) Option {
+	return func(c *Checker) {
+		c.receiver = host
+	}
+}
+
+// NewChecker creates a Checker that queries resolver, or
+// net.DefaultResolver if resolver is nil.
+func NewChecker(resolver Resolver, opts ...Option) *Checker {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	c := &Checker{
+		resolver:    resolver,
+		lookupLimit: 10,
+		voidLimit:   2,
+		receiver:    "unknown",
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Check checks the MAIL FROM identity sender for a client at ip that
+// introduced itself as helo. If sender is empty (the null reverse-path)
+// the HELO identity is checked instead, as RFC 7208 section 2.4 requires.
+func (c *Checker) Check(ctx context.Context, ip net.IP, helo, sender string) Outcome {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	local, domain := "", sender
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		local, domain = sender[:i], sender[i+1:]
+	}
+	if local == "" {
+		local = "postmaster"
+	}
+	return c.CheckHost(ctx, ip, domain, local+"@"+domain, helo)
+}
+
+// CheckHost is the check_host() function of RFC 7208 section 4: it checks
+// whether ip may send mail for domain, with sender and helo available to
+// macros.
+func (c *Checker) CheckHost(ctx context.Context, ip net.IP, domain, sender, helo string) Outcome {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !validDomain(domain) {
+		return Outcome{Result: None, Domain: domain}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	e := &eval{checker: c, ip: ip, sender: sender, helo: helo}
+	return e.checkHost(ctx, domain)
+}
+
+// validDomain reports whether domain is a fully qualified name that can
+// be checked (RFC 7208 section 4.3).
+func validDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// eval is the state of one check, shared by included and redirected
+// records.
+type eval struct {
+	checker *Checker
+	ip      net.IP
+	sender  string
+	helo    string
+
+	lookups int
+	voids   int
+}
+
+// checkHost evaluates the record of domain.
+func (e *eval) checkHost(ctx context.Context, domain string) Outcome {
+	txt, err := e.record(ctx, domain)
+	if err != nil {
+		return failure(domain, err)
+	}
+	if txt == "" {
+		return Outcome{Result: None, Domain: domain}
+	}
+	rec, err := parseRecord(txt)
+	if err != nil {
+		return failure(domain, err)
+	}
+
+	for _, d := range rec.directives {
+		matched, err := e.match(ctx, d, domain)
+		if err != nil {
+			return failure(domain, err)
+		}
+		if !matched {
+			continue
+		}
+		out := Outcome{Result: d.result(), Domain: domain, Mechanism: d.text}
+		if out.Result == Fail && rec.exp != "" {
+			out.Explanation = e.explain(ctx, rec.exp, domain)
+		}
+		return out
+	}
+
+	if rec.redirect == "" {
+		return Outcome{Result: Neutral, Domain: domain}
+	}
+	if err := e.count(); err != nil {
+		return failure(domain, err)
+	}
+	target, err := e.expandDomain(ctx, rec.redirect, domain)
+	if err != nil {
+		return failure(domain, err)
+	}
+	out := e.checkHost(ctx, target)
+	if out.Result == None {
+		return failure(domain, fmt.Errorf("spf: redirect=%s has no SPF record", target))
+	}
+	return out
+}
+
+// failure returns the error result for err.
+func failure(domain string, err error) Outcome {
+	if errors.Is(err, ErrDNS) {
+		return Outcome{Result: TempError, Domain: domain, Err: err}
+	}
+	return Outcome{Result: PermError, Domain: domain, Err: err}
+}
+
+// record returns the SPF record of domain, or "" if it has none.
+func (e *eval) record(ctx context.Context, domain string) (string, error) {
+	txts, err := e.checker.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("%w: TXT %s: %v", ErrDNS, domain, err)
+	}
+	var records []string
+	for _, t := range txts {
+		if len(t) >= 6 && strings.EqualFold(t[:6], "v=spf1") && (len(t) == 6 || t[6] == ' ') {
+			records = append(records, t)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	default:
+		return "", fmt.Errorf("%w for %s", ErrMultipleRecords, domain)
+	}
+}
+
+// count charges a term that queries DNS against the lookup limit.
+func (e *eval) count() error {
+	e.lookups++
+	if e.lookups > e.checker.lookupLimit {
+		return ErrLookupLimit
+	}
+	return nil
+}
+
+// void charges a lookup that returned no records against the void limit.
+func (e *eval) void() error {
+	e.voids++
+	if e.voids > e.checker.voidLimit {
+		return ErrVoidLimit
+	}
+	return nil
+}
+
+// isNotFound reports whether err means the name has no records.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookupIP returns the addresses of host in the client's address family.
+// A name with no such addresses returns no error.
+func (e *eval) lookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	ips, err := e.checker.resolver.LookupIP(ctx, network, host)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %s %s: %v", ErrDNS, network, host, err)
+	}
+	return ips, nil
+}
+
+// network returns the client's address family for LookupIP.
+func (e *eval) network() string {
+	if e.ip.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// match reports whether directive d matches the client.
+func (e *eval) match(ctx context.Context, d directive, domain string) (bool, error) {
+	switch d.mechanism {
+	case "all":
+		return true, nil
+
+	case "ip4", "ip6":
+		return e.inNetwork(d.ip, d.prefix(e.ip)), nil
+
+	case "include":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+		target, err := e.expandDomain(ctx, d.domain, domain)
+		if err != nil {
+			return false, err
+		}
+		out := e.checkHost(ctx, target)
+		switch out.Result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case None:
+			return false, fmt.Errorf("spf: include:%s has no SPF record", target)
+		default:
+			return false, out.Err
+		}
+
+	case "a":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+		target, err := e.target(ctx, d, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIP(ctx, e.network(), target)
+		if err != nil {
+			return false, err
+		}
+		if len(ips) == 0 {
+			return false, e.void()
+		}
+		return e.anyInNetwork(ips, d), nil
+
+	case "mx":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+		target, err := e.target(ctx, d, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := e.checker.resolver.LookupMX(ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, fmt.Errorf("%w: MX %s: %v", ErrDNS, target, err)
+		}
+		if len(mxs) == 0 {
+			return false, e.void()
+		}
+		if len(mxs) > 10 {
+			return false, fmt.Errorf("%w: %s has more than 10 MX records", ErrLookupLimit, target)
+		}
+		for _, mx := range mxs {
+			host := strings.TrimSuffix(mx.Host, ".")
+			if host == "" {
+				// Null MX (RFC 7505).
+				continue
+			}
+			ips, err := e.lookupIP(ctx, e.network(), host)
+			if err != nil {
+				return false, err
+			}
+			if e.anyInNetwork(ips, d) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+		target, err := e.target(ctx, d, domain)
+		if err != nil {
+			return false, err
+		}
+		for _, name := range e.validatedNames(ctx) {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "exists":
+		if err := e.count(); err != nil {
+			return false, err
+		}
+		target, err := e.expandDomain(ctx, d.domain, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIP(ctx, "ip4", target)
+		if err != nil {
+			return false, err
+		}
+		if len(ips) == 0 {
+			return false, e.void()
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: unknown mechanism %q", ErrSyntax, d.mechanism)
+}
+
+// target returns the domain a, mx and ptr mechanisms look up: their
+// domain-spec, or the current domain.
+func (e *eval) target(ctx context.Context, d directive, domain string) (string, error) {
+	if d.domain == "" {
+		return domain, nil
+	}
+	return e.expandDomain(ctx, d.domain, domain)
+}
+
+// validatedNames returns the client's reverse names that resolve back to
+// the client's address, looking at no more than 10 names (RFC 7208
+// section 5.5). Lookup errors leave names unvalidated.
+func (e *eval) validatedNames(ctx context.Context) []string {
+	names, err := e.checker.resolver.LookupAddr(ctx, e.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	var valid []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		ips, err := e.lookupIP(ctx, e.network(), name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(e.ip) {
+				valid = append(valid, name)
+				break
+			}
+		}
+	}
+	return valid
+}
+
+// anyInNetwork reports whether the client is in the network of any of
+// ips with d's prefix length.
+func (e *eval) anyInNetwork(ips []net.IP, d directive) bool {
+	for _, ip := range ips {
+		if e.inNetwork(ip, d.prefix(e.ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// inNetwork reports whether the client is in the network of ip with the
+// given prefix length. Addresses of different families never match.
+func (e *eval) inNetwork(ip net.IP, prefix int) bool {
+	if (ip.To4() != nil) != (e.ip.To4() != nil) {
+		return false
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return ip.Mask(mask).Equal(e.ip.Mask(mask))
+}
+
+// explain returns the explanation published at the exp modifier's
+// domain, or "" if there is none or it cannot be used (RFC 7208 section
+// 6.2). The lookup does not count against the limits.
+func (e *eval) explain(ctx context.Context, spec, domain string) string {
+	target, err := e.expandDomain(ctx, spec, domain)
+	if err != nil {
+		return ""
+	}
+	txts, err := e.checker.resolver.LookupTXT(ctx, target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	text, err := e.expand(ctx, txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	for _, r := range text {
+		if r < 0x20 || r > 0x7e {
+			return ""
+		}
+	}
+	return text
+}
@@ -0,0 +1,295 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/harness"
+	"github.com/iceisfun/icesmtp/internal/dnstest"
+)
+
+// zone is based on the examples of RFC 7208 appendix A.
+func zone() *dnstest.Resolver {
+	return &dnstest.Resolver{
+		TXT: map[string][]string{
+			"example.com":          {"v=spf1 +mx a:colo.example.com/28 -all", "google-site-verification=x"},
+			"mx-only.example.com":  {"v=spf1 mx -all"},
+			"ptr.example.com":      {"v=spf1 ptr -all"},
+			"include.example.com":  {"v=spf1 include:example.com ~all"},
+			"redirect.example.com": {"v=spf1 redirect=example.com"},
+			"exists.example.com":   {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"ip.example.com":       {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 ?all"},
+			"exp.example.com":      {"v=spf1 -all exp=explain._spf.%{d}"},
+			"explain._spf.exp.example.com": {
+				"%{i} is not one of %{d}'s designated mail servers.",
+			},
+			"neutral.example.com":   {"v=spf1 ip4:198.51.100.1"},
+			"multiple.example.com":  {"v=spf1 -all", "v=spf1 +all"},
+			"syntax.example.com":    {"v=spf1 ip4:192.0.2.300 -all"},
+			"unknown.example.com":   {"v=spf1 foo:bar -all"},
+			"modifier.example.com":  {"v=spf1 moo.cow-far_out=man:dog/cat ip4:192.0.2.1 -all"},
+			"loop.example.com":      {"v=spf1 include:loop.example.com -all"},
+			"void.example.com":      {"v=spf1 a:n1.example.com a:n2.example.com a:n3.example.com -all"},
+			"temp.example.com":      {"v=spf1 a:broken.example.com -all"},
+			"noinclude.example.com": {"v=spf1 include:nothing.example.com -all"},
+			"badredir.example.com":  {"v=spf1 redirect=nothing.example.com"},
+		},
+		IP: map[string][]string{
+			"example.com":                           {"192.0.2.10", "192.0.2.11"},
+			"amy.example.com":                       {"192.0.2.65"},
+			"bob.example.com":                       {"192.0.2.66"},
+			"mail-a.example.com":                    {"192.0.2.129"},
+			"mail-b.example.com":                    {"192.0.2.130", "2001:db8::cb01"},
+			"colo.example.com":                      {"192.0.2.200"},
+			"mail.ptr.example.com":                  {"192.0.2.140"},
+			"3.2.0.192.bob._spf.exists.example.com": {"127.0.0.2"},
+		},
+		MX: map[string][]string{
+			"example.com":         {"mail-a.example.com", "mail-b.example.com"},
+			"mx-only.example.com": {"mail-a.example.com"},
+		},
+		PTR: map[string][]string{
+			"192.0.2.140": {"mail.ptr.example.com."},
+			"192.0.2.141": {"spoofed.ptr.example.com."},
+		},
+		Errors: map[string]error{
+			"broken.example.com": dnstest.Temporary("broken.example.com"),
+		},
+	}
+}
+
+func check(t *testing.T, r Resolver, ip, sender string, opts ...Option) Outcome {
+	t.Helper()
+	return NewChecker(r, opts...).Check(context.Background(), net.ParseIP(ip), "client.example.net", sender)
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		ip, sender string
+		want       Result
+		mechanism  string
+	}{
+		{"192.0.2.129", "user@example.com", Pass, "+mx"},
+		{"2001:db8::cb01", "user@example.com", Pass, "+mx"},
+		{"192.0.2.206", "user@example.com", Pass, "a:colo.example.com/28"},
+		{"192.0.2.10", "user@example.com", Fail, "-all"},
+		{"192.0.2.129", "user@mx-only.example.com", Pass, "mx"},
+		{"192.0.2.140", "user@ptr.example.com", Pass, "ptr"},
+		{"192.0.2.141", "user@ptr.example.com", Fail, "-all"},
+		{"192.0.2.130", "user@include.example.com", Pass, "include:example.com"},
+		{"198.51.100.7", "user@include.example.com", SoftFail, "~all"},
+		{"192.0.2.129", "user@redirect.example.com", Pass, "+mx"},
+		{"192.0.2.3", "bob@exists.example.com", Pass, "exists:%{ir}.%{l1r+-}._spf.%{d}"},
+		{"192.0.2.3", "amy@exists.example.com", Fail, "-all"},
+		{"192.0.2.77", "user@ip.example.com", Pass, "ip4:192.0.2.0/24"},
+		{"2001:db8:1::1", "user@ip.example.com", Pass, "ip6:2001:db8::/32"},
+		{"::ffff:192.0.2.77", "user@ip.example.com", Pass, "ip4:192.0.2.0/24"},
+		{"203.0.113.1", "user@ip.example.com", Neutral, "?all"},
+		{"203.0.113.1", "user@neutral.example.com", Neutral, ""},
+		{"192.0.2.1", "user@modifier.example.com", Pass, "ip4:192.0.2.1"},
+		{"192.0.2.1", "user@nospf.example.com", None, ""},
+		{"192.0.2.1", "user@localhost", None, ""},
+		{"192.0.2.1", "user@multiple.example.com", PermError, ""},
+		{"192.0.2.1", "user@syntax.example.com", PermError, ""},
+		{"192.0.2.1", "user@unknown.example.com", PermError, ""},
+		{"192.0.2.1", "user@loop.example.com", PermError, ""},
+		{"192.0.2.1", "user@void.example.com", PermError, ""},
+		{"192.0.2.1", "user@temp.example.com", TempError, ""},
+		{"192.0.2.1", "user@noinclude.example.com", PermError, ""},
+		{"192.0.2.1", "user@badredir.example.com", PermError, ""},
+	}
+	for _, tt := range tests {
+		out := check(t, zone(), tt.ip, tt.sender)
+		if out.Result != tt.want || out.Mechanism != tt.mechanism {
+			t.Errorf("Check(%s, %s) = %s %q (%v), want %s %q",
+				tt.ip, tt.sender, out.Result, out.Mechanism, out.Err, tt.want, tt.mechanism)
+		}
+	}
+}
+
+func TestCheck_Limits(t *testing.T) {
+	out := check(t, zone(), "192.0.2.1", "user@loop.example.com")
+	if !errors.Is(out.Err, ErrLookupLimit) {
+		t.Errorf("loop error = %v", out.Err)
+	}
+	out = check(t, zone(), "192.0.2.1", "user@void.example.com")
+	if !errors.Is(out.Err, ErrVoidLimit) {
+		t.Errorf("void error = %v", out.Err)
+	}
+	out = check(t, zone(), "192.0.2.1", "user@void.example.com", WithVoidLookupLimit(3))
+	if out.Result != Fail {
+		t.Errorf("raised void limit = %s (%v)", out.Result, out.Err)
+	}
+
+	r := zone()
+	r.TXT["chain.example.com"] = []string{"v=spf1 include:example.com include:example.com include:example.com -all"}
+	out = check(t, r, "192.0.2.1", "user@chain.example.com", WithLookupLimit(4))
+	if !errors.Is(out.Err, ErrLookupLimit) {
+		t.Errorf("chain error = %v", out.Err)
+	}
+	if out := check(t, r, "192.0.2.1", "user@chain.example.com"); out.Result != Fail {
+		t.Errorf("chain within limit = %s (%v)", out.Result, out.Err)
+	}
+}
+
+func TestCheck_NullSender(t *testing.T) {
+	r := zone()
+	r.TXT["client.example.net"] = []string{"v=spf1 ip4:192.0.2.5 -all"}
+	out := check(t, r, "192.0.2.5", "")
+	if out.Result != Pass || out.Domain != "client.example.net" {
+		t.Errorf("HELO check = %+v", out)
+	}
+}
+
+func TestCheck_Explanation(t *testing.T) {
+	out := check(t, zone(), "192.0.2.3", "user@exp.example.com")
+	if out.Result != Fail || out.Explanation != "192.0.2.3 is not one of exp.example.com's designated mail servers." {
+		t.Errorf("outcome = %+v", out)
+	}
+}
+
+func TestMacroExpansion(t *testing.T) {
+	// Examples from RFC 7208 section 7.4.
+	c := NewChecker(zone(), WithReceiver("mx.example.org"))
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+	e := &eval{checker: c, ip: net.ParseIP("192.0.2.3").To4(), sender: "strong-bad@email.example.com", helo: "mx.example.net"}
+	e6 := &eval{checker: c, ip: net.ParseIP("2001:db8::cb01"), sender: e.sender}
+	ctx := context.Background()
+
+	tests := []struct {
+		e    *eval
+		in   string
+		want string
+	}{
+		{e, "%{s}", "strong-bad@email.example.com"},
+		{e, "%{o}", "email.example.com"},
+		{e, "%{d}", "email.example.com"},
+		{e, "%{d4}", "email.example.com"},
+		{e, "%{d3}", "email.example.com"},
+		{e, "%{d2}", "example.com"},
+		{e, "%{d1}", "com"},
+		{e, "%{dr}", "com.example.email"},
+		{e, "%{d2r}", "example.email"},
+		{e, "%{l}", "strong-bad"},
+		{e, "%{l-}", "strong.bad"},
+		{e, "%{lr}", "strong-bad"},
+		{e, "%{lr-}", "bad.strong"},
+		{e, "%{l1r-}", "strong"},
+		{e, "%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{e, "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{e, "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{e, "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{e, "%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{e6, "%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+		{e, "%{h} %% %_ %-", "mx.example.net %   %20"},
+		{e, "%{S}", "strong-bad%40email.example.com"},
+	}
+	for _, tt := range tests {
+		got, err := tt.e.expand(ctx, tt.in, "email.example.com", false)
+		if err != nil || got != tt.want {
+			t.Errorf("expand(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	got, err := e.expand(ctx, "%{c} %{r} %{t}", "email.example.com", true)
+	if err != nil || got != "192.0.2.3 mx.example.org 1700000000" {
+		t.Errorf("explanation macros = %q, %v", got, err)
+	}
+
+	for _, bad := range []string{"%{c}", "%{x}", "%{d0}", "%{d", "%z", "trailing%"} {
+		if _, err := e.expand(ctx, bad, "email.example.com", false); !errors.Is(err, ErrSyntax) {
+			t.Errorf("expand(%q) error = %v", bad, err)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	valid := []string{
+		"v=spf1",
+		"v=spf1 a mx ptr all",
+		"v=spf1 a/24 mx//64 a:example.com/24//64 -all",
+		"v=spf1 ip4:192.0.2.1 ip4:192.0.2.0/0 ip6:::1 ip6:2001:db8::/128",
+		"v=spf1 include:_spf.%{d} exists:%{i}.bl.%{d} redirect=%{d2}",
+		"V=SPF1 A:EXAMPLE.COM -ALL",
+	}
+	for _, txt := range valid {
+		if _, err := parseRecord(txt); err != nil {
+			t.Errorf("parseRecord(%q): %v", txt, err)
+		}
+	}
+
+	invalid := []string{
+		"v=spf1 ip4:2001:db8::1",
+		"v=spf1 ip6:192.0.2.1",
+		"v=spf1 ip4:192.0.2.1/33",
+		"v=spf1 a/024",
+		"v=spf1 include",
+		"v=spf1 all:example.com",
+		"v=spf1 redirect=a.example redirect=b.example",
+		"v=spf1 exists:%{q}.example.com",
+		"v=spf1 mx:",
+	}
+	for _, txt := range invalid {
+		if _, err := parseRecord(txt); !errors.Is(err, ErrSyntax) {
+			t.Errorf("parseRecord(%q) error = %v", txt, err)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	r := zone()
+	ctx := context.Background()
+
+	h := harness.NewHarness(harness.WithClientIP("203.0.113.1"), harness.WithServerHostname("mx.example.com"))
+	h.Config.SenderPolicy = NewPolicy(NewChecker(r), WithRejectFail(), WithDeferTempError())
+	h.Config.ContentFilter = icesmtp.AuthResultsFilter{}
+	h.Mailbox.AddDomain("example.org")
+	h.Mailbox.SetCatchAll(true)
+	h.Start(ctx)
+	defer h.Close()
+
+	expect := func(code icesmtp.ReplyCode) string {
+		t.Helper()
+		lines, err := h.Expect(code)
+		if err != nil {
+			t.Fatalf("expected %d: %v (%v)", code, err, lines)
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	expect(220)
+	h.Send("EHLO client.example.net")
+	expect(250)
+
+	h.Send("MAIL FROM:<user@exp.example.com>")
+	if resp := expect(550); !strings.Contains(resp, "5.7.23") || !strings.Contains(resp, "designated mail servers") {
+		t.Errorf("fail response = %q", resp)
+	}
+	h.Send("MAIL FROM:<user@temp.example.com>")
+	if resp := expect(451); !strings.Contains(resp, "4.7.24") {
+		t.Errorf("temperror response = %q", resp)
+	}
+
+	h.Send("MAIL FROM:<user@ip.example.com>")
+	expect(250)
+	h.Send("RCPT TO:<postmaster@example.org>")
+	expect(250)
+	h.Send("DATA")
+	expect(354)
+	h.SendData("Subject: test\r\n\r\nHello.\r\n")
+	expect(250)
+
+	msgs := h.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("stored %d messages", len(msgs))
+	}
+	want := "Authentication-Results: mx.example.com;\r\n\tspf=neutral smtp.mailfrom=user@ip.example.com\r\n"
+	if !strings.HasPrefix(string(msgs[0].Data), want) {
+		t.Errorf("message = %q, want prefix %q", msgs[0].Data, want)
+	}
+}
@@ -0,0 +1,269 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// RecipientState is the current state of one recipient of an entry.
+type RecipientState struct {
+	// Recipient is the envelope recipient.
+	Recipient icesmtp.MailPath
+
+	// Status is the latest recorded status.
+	Status DeliveryStatus
+
+	// Reason is the reason recorded with the latest deferral or failure.
+	Reason string
+
+	// Attempts counts the recorded deferrals and failures.
+	Attempts int
+
+	// UpdatedAt is when the latest update was recorded.
+	UpdatedAt time.Time
+}
+
+// Entry is a committed spool entry.
+type Entry struct {
+	// Meta is the envelope metadata.
+	Meta Meta
+
+	// States holds the per-recipient state, in Meta.Recipients order.
+	States []RecipientState
+
+	path       string
+	dataOffset int64
+	dataSize   int64
+	dataSum    uint32
+
+	// validSize is the length of the file up to the last intact record.
+	validSize int64
+	// torn is true if a partial record follows validSize.
+	torn bool
+}
+
+// ID returns the spool ID of the entry.
+func (e *Entry) ID() icesmtp.StorageMessageID {
+	return e.Meta.SpoolID
+}
+
+// DataSize returns the size of the message data in bytes.
+func (e *Entry) DataSize() icesmtp.ByteCount {
+	return e.dataSize
+}
+
+// Unfinished reports whether any recipient still needs processing.
+func (e *Entry) Unfinished() bool {
+	for _, st := range e.States {
+		if !st.Status.Final() {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending returns the indexes of recipients that still need processing.
+func (e *Entry) Pending() []int {
+	var idx []int
+	for i, st := range e.States {
+		if !st.Status.Final() {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// OpenData opens the message data for reading. The checksum of the data
+// is verified when the reader reaches EOF; a mismatch is reported as
+// ErrCorrupt from Read.
+func (e *Entry) OpenData() (io.ReadCloser, error) {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+	return &dataReader{
+		r:    io.NewSectionReader(f, e.dataOffset, e.dataSize),
+		f:    f,
+		hash: crc32.NewIEEE(),
+		sum:  e.dataSum,
+	}, nil
+}
+
+// Envelope loads the message data and returns the entry as an Envelope.
+func (e *Entry) Envelope() (icesmtp.Envelope, error) {
+	rc, err := e.OpenData()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{meta: e.Meta, data: data}, nil
+}
+
+// dataReader reads entry data and verifies its checksum at EOF.
+type dataReader struct {
+	r    io.Reader
+	f    *os.File
+	hash hash.Hash32
+	sum  uint32
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && d.hash.Sum32() != d.sum {
+		return n, ErrCorrupt
+	}
+	return n, err
+}
+
+func (d *dataReader) Close() error {
+	return d.f.Close()
+}
+
+// readEntry parses the entry file at path.
+// A truncated trailing state record is tolerated and reported via torn.
+func readEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, head); err != nil || string(head) != string(magic) {
+		return nil, ErrBadMagic
+	}
+	offset := int64(len(magic))
+
+	// Metadata record.
+	h, err := readRecordHeader(br)
+	if err != nil || h.typ != recordMeta {
+		return nil, ErrCorrupt
+	}
+	payload, err := readPayload(br, h, info.Size()-offset-recordHeaderSize)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	offset += recordHeaderSize + h.length + 1
+
+	e := &Entry{path: path}
+	if err := json.Unmarshal(payload, &e.Meta); err != nil {
+		return nil, ErrCorrupt
+	}
+
+	// Data record; the payload is skipped and verified lazily.
+	h, err = readRecordHeader(br)
+	if err != nil || h.typ != recordData {
+		return nil, ErrCorrupt
+	}
+	e.dataOffset = offset + recordHeaderSize
+	if h.length >= info.Size()-e.dataOffset {
+		return nil, ErrCorrupt
+	}
+	e.dataSize = h.length
+	e.dataSum = h.sum
+	offset = e.dataOffset + h.length + 1
+
+	e.States = make([]RecipientState, len(e.Meta.Recipients))
+	for i, rcpt := range e.Meta.Recipients {
+		e.States[i] = RecipientState{Recipient: rcpt, Status: StatusPending}
+	}
+
+	// State records.
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	br.Reset(f)
+	for {
+		h, err := readRecordHeader(br)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			e.torn = true
+			break
+		}
+		if err != nil || h.typ != recordState {
+			return nil, ErrCorrupt
+		}
+		payload, err := readPayload(br, h, info.Size()-offset-recordHeaderSize)
+		if err == io.ErrUnexpectedEOF {
+			e.torn = true
+			break
+		}
+		if err != nil {
+			return nil, ErrCorrupt
+		}
+
+		var u StateUpdate
+		if err := json.Unmarshal(payload, &u); err != nil {
+			return nil, ErrCorrupt
+		}
+		e.apply(u)
+		offset += recordHeaderSize + h.length + 1
+	}
+	e.validSize = offset
+
+	return e, nil
+}
+
+// apply applies a state update to the entry.
+func (e *Entry) apply(u StateUpdate) {
+	if u.Recipient < 0 || u.Recipient >= len(e.States) {
+		return
+	}
+	st := &e.States[u.Recipient]
+	st.Status = u.Status
+	st.Reason = u.Reason
+	st.UpdatedAt = u.At
+	if u.Status == StatusDeferred || u.Status == StatusFailed {
+		st.Attempts++
+	}
+}
+
+// envelope is an icesmtp.Envelope backed by a spool entry.
+type envelope struct {
+	meta Meta
+	data []byte
+
+	headersOnce sync.Once
+	headers     *icesmtp.MessageHeaders
+}
+
+func (e *envelope) ID() icesmtp.EnvelopeID     { return e.meta.EnvelopeID }
+func (e *envelope) MailFrom() icesmtp.MailPath { return e.meta.MailFrom }
+func (e *envelope) Recipients() []icesmtp.MailPath {
+	return append([]icesmtp.MailPath(nil), e.meta.Recipients...)
+}
+func (e *envelope) RecipientCount() icesmtp.RecipientCount { return len(e.meta.Recipients) }
+func (e *envelope) ESMTPParams() icesmtp.ESMTPParams       { return e.meta.ESMTPParams }
+func (e *envelope) DeclaredSize() icesmtp.MessageSize      { return 0 }
+func (e *envelope) ReceivedAt() time.Time                  { return e.meta.ReceivedAt }
+func (e *envelope) Data() icesmtp.MessageData              { return e.data }
+func (e *envelope) DataSize() icesmtp.MessageSize          { return icesmtp.MessageSize(len(e.data)) }
+func (e *envelope) IsFinalized() bool                      { return true }
+func (e *envelope) Metadata() icesmtp.EnvelopeMetadata     { return e.meta.Metadata }
+func (e *envelope) Headers() *icesmtp.MessageHeaders {
+	e.headersOnce.Do(func() { e.headers = icesmtp.ParseHeaders(e.data, 0) })
+	return e.headers
+}
@@ -0,0 +1,188 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+// FormatVersion is the version of the on-disk entry format written by
+// this package. Readers reject entries with a different magic line.
+const FormatVersion = 1
+
+// magic is the first line of every spool entry.
+var magic = []byte("ICESPOOL/1\n")
+
+// Record types.
+const (
+	recordMeta  byte = 'M'
+	recordData  byte = 'D'
+	recordState byte = 'S'
+)
+
+// recordHeaderSize is the size of a fixed-width record header:
+// <type> SP <20-digit length> SP <8-hex-digit CRC-32> LF.
+const recordHeaderSize = 1 + 1 + 20 + 1 + 8 + 1
+
+// Format errors.
+var (
+	// ErrBadMagic indicates a file that is not a spool entry of this version.
+	ErrBadMagic = errors.New("spool: bad magic or unsupported version")
+
+	// ErrCorrupt indicates a record whose header or checksum is invalid.
+	ErrCorrupt = errors.New("spool: corrupt record")
+)
+
+// Meta is the envelope metadata stored in the first record of an entry.
+type Meta struct {
+	// Version is the format version that wrote the entry.
+	Version int `json:"version"`
+
+	// SpoolID is the stable identifier of the entry. It is returned to
+	// the engine as StorageReceipt.MessageID.
+	SpoolID icesmtp.StorageMessageID `json:"spool_id"`
+
+	// EnvelopeID is the original envelope identifier.
+	EnvelopeID icesmtp.EnvelopeID `json:"envelope_id"`
+
+	// MailFrom is the envelope sender.
+	MailFrom icesmtp.MailPath `json:"mail_from"`
+
+	// Recipients are the envelope recipients, indexed by StateUpdate.Recipient.
+	Recipients []icesmtp.MailPath `json:"recipients"`
+
+	// ESMTPParams are the parameters from the MAIL command.
+	ESMTPParams icesmtp.ESMTPParams `json:"esmtp_params,omitempty"`
+
+	// Metadata is the session metadata of the envelope.
+	Metadata icesmtp.EnvelopeMetadata `json:"metadata"`
+
+	// ReceivedAt is when the transaction started.
+	ReceivedAt time.Time `json:"received_at"`
+
+	// SpooledAt is when the entry was committed.
+	SpooledAt time.Time `json:"spooled_at"`
+}
+
+// DeliveryStatus is the processing state of one recipient.
+type DeliveryStatus string
+
+const (
+	// StatusPending means the recipient has not been processed yet.
+	StatusPending DeliveryStatus = "pending"
+
+	// StatusDeferred means processing failed temporarily and should be retried.
+	StatusDeferred DeliveryStatus = "deferred"
+
+	// StatusDelivered means the recipient was processed successfully.
+	StatusDelivered DeliveryStatus = "delivered"
+
+	// StatusFailed means processing failed permanently.
+	StatusFailed DeliveryStatus = "failed"
+)
+
+// Final reports whether no further processing is needed for the status.
+func (s DeliveryStatus) Final() bool {
+	return s == StatusDelivered || s == StatusFailed
+}
+
+// StateUpdate is a per-recipient state change appended to an entry.
+type StateUpdate struct {
+	// Recipient is the index into Meta.Recipients.
+	Recipient int `json:"rcpt"`
+
+	// Status is the new status.
+	Status DeliveryStatus `json:"status"`
+
+	// Reason describes a deferral or failure.
+	Reason string `json:"reason,omitempty"`
+
+	// At is when the update was recorded.
+	At time.Time `json:"at"`
+}
+
+// writeRecordHeader writes a fixed-width record header.
+func writeRecordHeader(w io.Writer, typ byte, length int64, sum uint32) error {
+	_, err := fmt.Fprintf(w, "%c %020d %08x\n", typ, length, sum)
+	return err
+}
+
+// writeRecord writes a complete record.
+func writeRecord(w io.Writer, typ byte, payload []byte) error {
+	if err := writeRecordHeader(w, typ, int64(len(payload)), crc32.ChecksumIEEE(payload)); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{'\n'})
+	return err
+}
+
+// encodeJSONRecord writes v as a JSON record.
+func encodeJSONRecord(w io.Writer, typ byte, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeRecord(w, typ, payload)
+}
+
+// recordHeader is a parsed record header.
+type recordHeader struct {
+	typ    byte
+	length int64
+	sum    uint32
+}
+
+// readRecordHeader reads and validates a record header.
+// It returns io.EOF at a clean end of file and io.ErrUnexpectedEOF for a
+// header truncated by a crash.
+func readRecordHeader(r *bufio.Reader) (recordHeader, error) {
+	var buf [recordHeaderSize]byte
+	n, err := io.ReadFull(r, buf[:])
+	if err == io.EOF && n == 0 {
+		return recordHeader{}, io.EOF
+	}
+	if err != nil {
+		return recordHeader{}, io.ErrUnexpectedEOF
+	}
+
+	if buf[1] != ' ' || buf[22] != ' ' || buf[31] != '\n' {
+		return recordHeader{}, ErrCorrupt
+	}
+	length, err := strconv.ParseInt(string(buf[2:22]), 10, 64)
+	if err != nil || length < 0 {
+		return recordHeader{}, ErrCorrupt
+	}
+	sum, err := strconv.ParseUint(string(buf[23:31]), 16, 32)
+	if err != nil {
+		return recordHeader{}, ErrCorrupt
+	}
+
+	return recordHeader{typ: buf[0], length: length, sum: uint32(sum)}, nil
+}
+
+// readPayload reads a record payload and its trailing LF and verifies it.
+// remaining is the number of bytes left in the file after the header; a
+// record that does not fit is reported as truncated without reading it.
+func readPayload(r *bufio.Reader, h recordHeader, remaining int64) ([]byte, error) {
+	if h.length >= remaining {
+		return nil, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, h.length+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if payload[h.length] != '\n' || crc32.ChecksumIEEE(payload[:h.length]) != h.sum {
+		return nil, ErrCorrupt
+	}
+	return payload[:h.length], nil
+}
@@ -0,0 +1,140 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Consumer processes spool entries that still have unfinished recipients.
+// Implementations record progress with Spool.Update (or the Mark helpers)
+// and call Spool.Remove once an entry is finished.
+type Consumer interface {
+	// Consume processes one entry.
+	Consume(ctx context.Context, entry *Entry) error
+}
+
+// ConsumerFunc adapts a function to the Consumer interface.
+type ConsumerFunc func(ctx context.Context, entry *Entry) error
+
+// Consume calls f.
+func (f ConsumerFunc) Consume(ctx context.Context, entry *Entry) error {
+	return f(ctx, entry)
+}
+
+// RecoveryReport summarizes a Recover run.
+type RecoveryReport struct {
+	// Emitted is the number of unfinished entries passed to the consumer.
+	Emitted int
+
+	// Finished is the number of entries found with no pending recipients.
+	Finished int
+
+	// Repaired is the number of entries whose torn trailing record was cut off.
+	Repaired int
+
+	// Discarded is the number of uncommitted files removed from tmp/.
+	// These were never acknowledged to the client.
+	Discarded int
+
+	// Corrupt lists the spool IDs moved to corrupt/.
+	Corrupt []string
+}
+
+// Recover scans the spool after a restart. Uncommitted writes are
+// discarded, torn state records are truncated, unreadable entries are
+// moved to corrupt/, and every entry with unfinished recipients is passed
+// to the consumer in spool ID (arrival) order.
+//
+// Recover must run before new sessions use the spool. Errors returned by
+// the consumer do not stop the scan; they are joined into the result.
+func (s *Spool) Recover(ctx context.Context, consumer Consumer) (RecoveryReport, error) {
+	var report RecoveryReport
+
+	tmpEntries, err := os.ReadDir(filepath.Join(s.dir, tmpDir))
+	if err != nil {
+		return report, err
+	}
+	for _, e := range tmpEntries {
+		if err := os.Remove(filepath.Join(s.dir, tmpDir, e.Name())); err == nil {
+			report.Discarded++
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, queueDir))
+	if err != nil {
+		return report, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && validID(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, id := range names {
+		if err := ctx.Err(); err != nil {
+			return report, errors.Join(append(errs, err)...)
+		}
+
+		entry, err := readEntry(s.entryPath(id))
+		if errors.Is(err, ErrBadMagic) || errors.Is(err, ErrCorrupt) {
+			if err := os.Rename(s.entryPath(id), filepath.Join(s.dir, corruptDir, id)); err != nil {
+				errs = append(errs, err)
+			}
+			report.Corrupt = append(report.Corrupt, id)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if entry.torn {
+			if err := os.Truncate(entry.path, entry.validSize); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			entry.torn = false
+			report.Repaired++
+		}
+
+		if !entry.Unfinished() {
+			report.Finished++
+			continue
+		}
+
+		report.Emitted++
+		if err := consumer.Consume(ctx, entry); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+		}
+	}
+
+	if len(report.Corrupt) > 0 || report.Repaired > 0 {
+		syncDir(filepath.Join(s.dir, queueDir))
+	}
+
+	return report, errors.Join(errs...)
+}
+
+// IDs returns the spool IDs of all committed entries in arrival order.
+func (s *Spool) IDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, queueDir))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
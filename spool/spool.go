@@ -0,0 +1,323 @@
+// Package spool implements a durable on-disk message spool with crash
+// recovery.
+//
+// A Spool is a Storage whose Store methods return only after the message
+// is durable: the entry is written to tmp/, fsynced, renamed into queue/
+// and the queue directory is fsynced. The engine therefore replies 250
+// only for messages that survive a crash. The StorageReceipt.MessageID is
+// the spool ID, an icesmtp.SortableIDGenerator identifier that is also the
+// entry's file name.
+//
+// # Entry format
+//
+// Each entry is a single file beginning with the magic line "ICESPOOL/1\n"
+// followed by records. Every record has a fixed-width header
+//
+//	<type> SP <20-digit decimal length> SP <8-digit hex CRC-32> LF
+//
+// then the payload and a terminating LF. Records appear in this order:
+//
+//	M  envelope metadata (JSON, see Meta)
+//	D  message data, exactly as received
+//	S  per-recipient state update (JSON, see StateUpdate), zero or more
+//
+// State records are appended and fsynced as recipients are processed; a
+// trailing record torn by a crash is discarded by Recover.
+package spool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// Spool subdirectories.
+const (
+	tmpDir     = "tmp"
+	queueDir   = "queue"
+	corruptDir = "corrupt"
+)
+
+// ErrNotFound indicates a spool ID with no committed entry.
+var ErrNotFound = errors.New("spool: entry not found")
+
+// Spool is a durable message spool. It implements icesmtp.Storage.
+type Spool struct {
+	dir      string
+	fileMode os.FileMode
+	ids      *icesmtp.SortableIDGenerator
+
+	mu      sync.Mutex
+	metrics icesmtp.StorageMetrics
+}
+
+// Option configures a Spool.
+type Option func(*Spool)
+
+// WithFileMode sets the permissions for entry files. Defaults to 0600.
+func WithFileMode(mode os.FileMode) Option {
+	return func(s *Spool) {
+		s.fileMode = mode
+	}
+}
+
+// Open opens or creates a spool rooted at dir.
+// Call Recover once at startup before accepting new sessions.
+func Open(dir string, opts ...Option) (*Spool, error) {
+	s := &Spool{
+		dir:      dir,
+		fileMode: 0600,
+		ids:      icesmtp.NewSortableIDGenerator(0),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	for _, sub := range []string{tmpDir, queueDir, corruptDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Store durably spools the envelope.
+func (s *Spool) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	return s.store(ctx, envelope, icesmtp.StorageOpStore, bytes.NewReader(envelope.Data()))
+}
+
+// StoreStream durably spools the envelope with streamed data.
+func (s *Spool) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	return s.store(ctx, envelope, icesmtp.StorageOpStoreStream, data)
+}
+
+func (s *Spool) store(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, data io.Reader) (icesmtp.StorageReceipt, error) {
+	start := time.Now()
+
+	if err := ctx.Err(); err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "store cancelled")
+	}
+
+	id := s.ids.NewID()
+	meta := Meta{
+		Version:     FormatVersion,
+		SpoolID:     id,
+		EnvelopeID:  envelope.ID(),
+		MailFrom:    envelope.MailFrom(),
+		Recipients:  envelope.Recipients(),
+		ESMTPParams: envelope.ESMTPParams(),
+		Metadata:    envelope.Metadata(),
+		ReceivedAt:  envelope.ReceivedAt(),
+		SpooledAt:   time.Now().UTC(),
+	}
+
+	tmpPath := filepath.Join(s.dir, tmpDir, id)
+	size, err := s.writeEntry(tmpPath, meta, data)
+	if err != nil {
+		os.Remove(tmpPath)
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "failed to write spool entry")
+	}
+
+	if err := os.Rename(tmpPath, s.entryPath(id)); err != nil {
+		os.Remove(tmpPath)
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "failed to commit spool entry")
+	}
+	if err := syncDir(filepath.Join(s.dir, queueDir)); err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, false, "failed to sync spool directory")
+	}
+
+	s.mu.Lock()
+	s.metrics.MessagesStored++
+	s.metrics.BytesStored += uint64(size)
+	s.metrics.StoreLatencyNs = int64(time.Since(start))
+	s.mu.Unlock()
+
+	return icesmtp.StorageReceipt{
+		MessageID:    id,
+		EnvelopeID:   envelope.ID(),
+		StoredAt:     meta.SpooledAt.Unix(),
+		BytesWritten: size,
+	}, nil
+}
+
+// writeEntry writes a complete, fsynced entry to path and returns the
+// number of data bytes written.
+func (s *Spool) writeEntry(path string, meta Meta, data io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, s.fileMode)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(magic); err != nil {
+		return 0, err
+	}
+	if err := encodeJSONRecord(f, recordMeta, meta); err != nil {
+		return 0, err
+	}
+
+	// Reserve the data header; length and checksum are filled in after
+	// the data has been streamed.
+	headerAt, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeRecordHeader(f, recordData, 0, 0); err != nil {
+		return 0, err
+	}
+
+	sum := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(f, sum), data)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write([]byte{'\n'}); err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Seek(headerAt, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := writeRecordHeader(f, recordData, size, sum.Sum32()); err != nil {
+		return 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return size, f.Close()
+}
+
+// Get loads a committed entry by spool ID.
+func (s *Spool) Get(id icesmtp.StorageMessageID) (*Entry, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	e, err := readEntry(s.entryPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return e, err
+}
+
+// Update durably appends per-recipient state updates to an entry.
+// Updates with a zero At are stamped with the current time.
+func (s *Spool) Update(id icesmtp.StorageMessageID, updates ...StateUpdate) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.entryPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	for _, u := range updates {
+		if u.At.IsZero() {
+			u.At = time.Now().UTC()
+		}
+		if err := encodeJSONRecord(&buf, recordState, u); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// MarkDelivered records that a recipient was processed successfully.
+func (s *Spool) MarkDelivered(id icesmtp.StorageMessageID, recipient int) error {
+	return s.Update(id, StateUpdate{Recipient: recipient, Status: StatusDelivered})
+}
+
+// MarkDeferred records a temporary failure for a recipient.
+func (s *Spool) MarkDeferred(id icesmtp.StorageMessageID, recipient int, reason string) error {
+	return s.Update(id, StateUpdate{Recipient: recipient, Status: StatusDeferred, Reason: reason})
+}
+
+// MarkFailed records a permanent failure for a recipient.
+func (s *Spool) MarkFailed(id icesmtp.StorageMessageID, recipient int, reason string) error {
+	return s.Update(id, StateUpdate{Recipient: recipient, Status: StatusFailed, Reason: reason})
+}
+
+// Remove deletes an entry, typically once it is no longer Unfinished.
+func (s *Spool) Remove(id icesmtp.StorageMessageID) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	if err := os.Remove(s.entryPath(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return syncDir(filepath.Join(s.dir, queueDir))
+}
+
+// entryPath returns the committed path of an entry.
+func (s *Spool) entryPath(id icesmtp.StorageMessageID) string {
+	return filepath.Join(s.dir, queueDir, id)
+}
+
+// Metrics returns storage metrics.
+func (s *Spool) Metrics() icesmtp.StorageMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// Healthy checks that the spool directories are writable.
+func (s *Spool) Healthy(ctx context.Context) error {
+	f, err := os.CreateTemp(filepath.Join(s.dir, tmpDir), ".health-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// validID reports whether id is safe to use as a file name.
+func validID(id icesmtp.StorageMessageID) bool {
+	return id != "" && !strings.HasPrefix(id, ".") && !strings.ContainsAny(id, "/\\\x00")
+}
+
+// syncDir fsyncs a directory so that entries created in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Ensure Spool implements the interfaces.
+var (
+	_ icesmtp.Storage            = (*Spool)(nil)
+	_ icesmtp.StorageWithMetrics = (*Spool)(nil)
+	_ icesmtp.StorageWithHealth  = (*Spool)(nil)
+)
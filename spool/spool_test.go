@@ -0,0 +1,204 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+func buildEnvelope(t *testing.T, data string, rcpts ...string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{SessionID: "sess"})
+	b.SetMailFrom(icesmtp.MailPath{Address: "sender@example.org"}, icesmtp.ESMTPParams{"SIZE": "42"})
+	for _, r := range rcpts {
+		b.AddRecipient(icesmtp.MailPath{Address: r})
+	}
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("finalize: %v", err)
+	}
+	return env
+}
+
+func TestSpool_StoreAndGet(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := buildEnvelope(t, "Subject: spool\r\n\r\nbody\r\n", "a@example.com", "b@example.com")
+	receipt, err := s.StoreStream(context.Background(), env, strings.NewReader(string(env.Data())))
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	entry, err := s.Get(receipt.MessageID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if entry.ID() != receipt.MessageID || entry.Meta.EnvelopeID != env.ID() {
+		t.Errorf("unexpected ids: %+v", entry.Meta)
+	}
+	if entry.Meta.ESMTPParams["SIZE"] != "42" || entry.Meta.Metadata.SessionID != "sess" {
+		t.Errorf("metadata not preserved: %+v", entry.Meta)
+	}
+
+	spooled, err := entry.Envelope()
+	if err != nil {
+		t.Fatalf("envelope: %v", err)
+	}
+	if string(spooled.Data()) != string(env.Data()) || spooled.RecipientCount() != 2 {
+		t.Errorf("spooled envelope mismatch: %q", spooled.Data())
+	}
+
+	if err := s.MarkDelivered(receipt.MessageID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkDeferred(receipt.MessageID, 1, "greylisted"); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, _ = s.Get(receipt.MessageID)
+	if entry.States[0].Status != StatusDelivered || entry.States[1].Status != StatusDeferred {
+		t.Errorf("unexpected states: %+v", entry.States)
+	}
+	if !entry.Unfinished() || len(entry.Pending()) != 1 || entry.States[1].Attempts != 1 {
+		t.Errorf("unexpected pending state: %+v", entry.States)
+	}
+}
+
+func TestSpool_Recover(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	pending, _ := s.Store(ctx, buildEnvelope(t, "one\r\n", "a@example.com"))
+	done, _ := s.Store(ctx, buildEnvelope(t, "two\r\n", "a@example.com"))
+	torn, _ := s.Store(ctx, buildEnvelope(t, "three\r\n", "a@example.com"))
+	corrupt, _ := s.Store(ctx, buildEnvelope(t, "four\r\n", "a@example.com"))
+
+	s.MarkDelivered(done.MessageID, 0)
+
+	// A crash while appending a state record leaves a partial record.
+	f, _ := os.OpenFile(filepath.Join(dir, queueDir, torn.MessageID), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("S 0000000000000")
+	f.Close()
+
+	// A crash while writing a new entry leaves a file in tmp/.
+	os.WriteFile(filepath.Join(dir, tmpDir, "partial"), []byte("ICESPOOL/1\n"), 0600)
+
+	os.WriteFile(filepath.Join(dir, queueDir, corrupt.MessageID), []byte("garbage"), 0600)
+
+	// Reopen as a restarted process would.
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var emitted []string
+	report, err := s.Recover(ctx, ConsumerFunc(func(ctx context.Context, e *Entry) error {
+		emitted = append(emitted, e.ID())
+		rc, err := e.OpenData()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		return err
+	}))
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+
+	if len(emitted) != 2 || emitted[0] != pending.MessageID || emitted[1] != torn.MessageID {
+		t.Errorf("emitted %v, want [%s %s]", emitted, pending.MessageID, torn.MessageID)
+	}
+	if report.Finished != 1 || report.Repaired != 1 || report.Discarded != 1 ||
+		len(report.Corrupt) != 1 || report.Corrupt[0] != corrupt.MessageID {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	// The repaired entry accepts further updates.
+	if err := s.MarkDelivered(torn.MessageID, 0); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := s.Get(torn.MessageID)
+	if err != nil || entry.Unfinished() {
+		t.Errorf("repaired entry: %+v, %v", entry, err)
+	}
+
+	if _, err := s.Get(corrupt.MessageID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("corrupt entry still in queue: %v", err)
+	}
+}
+
+func TestSpool_DataChecksum(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir)
+	receipt, err := s.Store(context.Background(), buildEnvelope(t, "checksummed data\r\n", "a@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, queueDir, receipt.MessageID)
+	b, _ := os.ReadFile(path)
+	i := strings.Index(string(b), "checksummed")
+	b[i] = 'C'
+	os.WriteFile(path, b, 0600)
+
+	entry, err := s.Get(receipt.MessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := entry.Envelope(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestSpool_RecoverOversizedLength(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Record lengths far beyond the end of the file must not be
+	// allocated. In the metadata record they mark the entry corrupt; in
+	// a trailing state record they look like a torn write.
+	for id, header := range map[string]string{
+		"huge":  "M 09223372036854775807 00000000\n",
+		"large": "M 00000000001000000000 00000000\n",
+	} {
+		os.WriteFile(filepath.Join(dir, queueDir, id), []byte("ICESPOOL/1\n"+header+"{}\n"), 0600)
+	}
+	torn, _ := s.Store(ctx, buildEnvelope(t, "one\r\n", "a@example.com"))
+	f, _ := os.OpenFile(filepath.Join(dir, queueDir, torn.MessageID), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("S 09223372036854775807 00000000\n{}\n")
+	f.Close()
+
+	report, err := s.Recover(ctx, ConsumerFunc(func(ctx context.Context, e *Entry) error { return nil }))
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if len(report.Corrupt) != 2 || report.Repaired != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	for _, id := range []string{"huge", "large"} {
+		if _, err := os.Stat(filepath.Join(dir, corruptDir, id)); err != nil {
+			t.Errorf("%s not moved to corrupt/: %v", id, err)
+		}
+	}
+}
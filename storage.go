@@ -3,6 +3,7 @@ package icesmtp
 import (
 	"context"
 	"io"
+	"strings"
 )
 
 // Storage defines the interface for durable message storage.
@@ -63,8 +64,10 @@ type StorageError struct {
 	// Cause is the underlying error.
 	Cause error
 
-	// Retryable indicates whether the operation may succeed if retried.
-	Retryable bool
+	// Permanent indicates the operation will not succeed if retried. The
+	// engine replies 554 to permanent errors and 451 otherwise, so the
+	// zero value is a temporary failure.
+	Permanent bool
 
 	// Message is a human-readable error message.
 	Message string
@@ -94,18 +97,40 @@ func (e *StorageError) Unwrap() error {
 
 // StorageHook provides optional callbacks for storage events.
 // Implementations may use these for logging, metrics, or side effects.
+// Hooks are configured with SessionConfig.StorageHooks and run in order.
 type StorageHook interface {
 	// BeforeStore is called before storing an envelope.
-	// Returning an error aborts the store operation.
+	// Returning an error aborts the store operation. A *StorageVetoError
+	// selects the SMTP response; other errors reply 451.
 	BeforeStore(ctx context.Context, envelope Envelope) error
 
 	// AfterStore is called after successfully storing an envelope.
 	AfterStore(ctx context.Context, envelope Envelope, receipt StorageReceipt)
 
-	// OnStoreError is called when a store operation fails.
-	OnStoreError(ctx context.Context, envelope Envelope, err error)
+	// OnStoreError is called when a store operation fails. Errors that
+	// are not already a *StorageError are wrapped as retryable.
+	OnStoreError(ctx context.Context, envelope Envelope, err *StorageError)
 }
 
+// StorageVetoError is returned by StorageHook.BeforeStore to reject a
+// message with a specific SMTP response.
+type StorageVetoError struct {
+	// Response is sent to the client instead of the acceptance reply.
+	Response Response
+}
+
+func (e *StorageVetoError) Error() string {
+	return "store vetoed: " + strings.TrimSpace(e.Response.String())
+}
+
+// NullStorageHook is a StorageHook that does nothing.
+// Embed it to implement only some of the callbacks.
+type NullStorageHook struct{}
+
+func (NullStorageHook) BeforeStore(_ context.Context, _ Envelope) error             { return nil }
+func (NullStorageHook) AfterStore(_ context.Context, _ Envelope, _ StorageReceipt)  {}
+func (NullStorageHook) OnStoreError(_ context.Context, _ Envelope, _ *StorageError) {}
+
 // StorageMetrics provides storage statistics.
 type StorageMetrics struct {
 	// MessagesStored is the total number of messages stored.
@@ -0,0 +1,359 @@
+// Package webhook provides a Storage implementation that POSTs each
+// accepted message to an HTTP endpoint.
+//
+// Requests are encoded either as multipart/form-data (a JSON "envelope"
+// part and a raw message/rfc822 "message" part) or as a single JSON
+// document with the message base64-encoded. Requests can be signed with
+// HMAC-SHA256 and are retried with exponential backoff. HTTP failures are
+// mapped onto StorageError.Permanent so that the engine replies 451 for
+// temporary and 554 for permanent rejections.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+	"github.com/iceisfun/icesmtp/internal/storeutil"
+)
+
+// Encoding selects the request body format.
+type Encoding int
+
+const (
+	// EncodingMultipart sends multipart/form-data with "envelope" and
+	// "message" parts.
+	EncodingMultipart Encoding = iota
+
+	// EncodingJSON sends a single JSON Payload with Data base64-encoded.
+	EncodingJSON
+)
+
+// Request headers set on every POST.
+const (
+	// HeaderEnvelopeID carries the envelope ID; receivers may use it to
+	// deduplicate retried deliveries.
+	HeaderEnvelopeID = "X-Icesmtp-Envelope-Id"
+
+	// HeaderTimestamp carries the Unix time used in the signature.
+	HeaderTimestamp = "X-Icesmtp-Timestamp"
+
+	// HeaderSignature carries "sha256=" followed by the hex HMAC of
+	// "<timestamp>.<body>".
+	HeaderSignature = "X-Icesmtp-Signature"
+)
+
+// ErrBadSignature is returned by Verify for an invalid signature.
+var ErrBadSignature = errors.New("webhook: invalid signature")
+
+// Payload is the JSON description of a message sent to the endpoint.
+type Payload struct {
+	EnvelopeID  icesmtp.EnvelopeID       `json:"envelope_id"`
+	MailFrom    icesmtp.MailPath         `json:"mail_from"`
+	Recipients  []icesmtp.MailPath       `json:"recipients"`
+	ESMTPParams icesmtp.ESMTPParams      `json:"esmtp_params,omitempty"`
+	Metadata    icesmtp.EnvelopeMetadata `json:"metadata"`
+	ReceivedAt  time.Time                `json:"received_at"`
+	Size        icesmtp.ByteCount        `json:"size"`
+
+	// Data is the raw message. It is only set with EncodingJSON, where
+	// encoding/json represents it as base64.
+	Data []byte `json:"data,omitempty"`
+}
+
+// HTTPError is the cause of a StorageError for a non-2xx response.
+type HTTPError struct {
+	// StatusCode is the HTTP status code of the last attempt.
+	StatusCode int
+
+	// Body is the start of the response body.
+	Body string
+}
+
+func (e *HTTPError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("webhook returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("webhook returned HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// Storage posts envelopes to a URL.
+type Storage struct {
+	url         string
+	encoding    Encoding
+	secret      []byte
+	client      *http.Client
+	header      http.Header
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	mu      sync.Mutex
+	metrics icesmtp.StorageMetrics
+}
+
+// Option configures a Storage.
+type Option func(*Storage)
+
+// WithEncoding sets the request body format. Defaults to EncodingMultipart.
+func WithEncoding(enc Encoding) Option {
+	return func(s *Storage) {
+		s.encoding = enc
+	}
+}
+
+// WithSecret enables HMAC-SHA256 request signing with the given key.
+func WithSecret(secret []byte) Option {
+	return func(s *Storage) {
+		s.secret = secret
+	}
+}
+
+// WithClient sets the HTTP client. Defaults to a client with a 30 second
+// timeout.
+func WithClient(client *http.Client) Option {
+	return func(s *Storage) {
+		s.client = client
+	}
+}
+
+// WithHeader adds a header to every request, e.g. for authorization.
+func WithHeader(key, value string) Option {
+	return func(s *Storage) {
+		s.header.Add(key, value)
+	}
+}
+
+// WithRetry sets the maximum number of attempts and the backoff bounds.
+// The delay starts at initial and doubles up to max. Defaults are 3
+// attempts, 500ms and 5s.
+func WithRetry(maxAttempts int, initial, max time.Duration) Option {
+	return func(s *Storage) {
+		s.maxAttempts = maxAttempts
+		s.backoff = initial
+		s.maxBackoff = max
+	}
+}
+
+// New creates a webhook storage that posts to url.
+func New(url string, opts ...Option) *Storage {
+	s := &Storage{
+		url:         url,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		header:      make(http.Header),
+		maxAttempts: 3,
+		backoff:     500 * time.Millisecond,
+		maxBackoff:  5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.maxAttempts < 1 {
+		s.maxAttempts = 1
+	}
+	return s
+}
+
+// Store posts the envelope.
+func (s *Storage) Store(ctx context.Context, envelope icesmtp.Envelope) (icesmtp.StorageReceipt, error) {
+	return s.store(ctx, envelope, icesmtp.StorageOpStore, envelope.Data())
+}
+
+// StoreStream reads the data and posts the envelope.
+func (s *Storage) StoreStream(ctx context.Context, envelope icesmtp.Envelope, data io.Reader) (icesmtp.StorageReceipt, error) {
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, icesmtp.StorageOpStoreStream, err, false, "failed to read message data")
+	}
+	return s.store(ctx, envelope, icesmtp.StorageOpStoreStream, buf)
+}
+
+func (s *Storage) store(ctx context.Context, envelope icesmtp.Envelope, op icesmtp.StorageOperation, data []byte) (icesmtp.StorageReceipt, error) {
+	start := time.Now()
+
+	body, contentType, err := s.encode(envelope, data)
+	if err != nil {
+		return storeutil.Fail(&s.mu, &s.metrics, envelope, op, err, true, "failed to encode webhook request")
+	}
+
+	delay := s.backoff
+	var lastErr error
+	retryable := true
+	for attempt := 1; attempt <= s.maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return storeutil.Fail(&s.mu, &s.metrics, envelope, op, errors.Join(lastErr, ctx.Err()), false, "webhook delivery cancelled")
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, s.maxBackoff)
+		}
+
+		var id string
+		id, retryable, lastErr = s.post(ctx, envelope.ID(), body, contentType)
+		if lastErr == nil {
+			if id == "" {
+				id = envelope.ID()
+			}
+
+			s.mu.Lock()
+			s.metrics.MessagesStored++
+			s.metrics.BytesStored += uint64(len(data))
+			s.metrics.StoreLatencyNs = int64(time.Since(start))
+			s.mu.Unlock()
+
+			return icesmtp.StorageReceipt{
+				MessageID:    id,
+				EnvelopeID:   envelope.ID(),
+				StoredAt:     time.Now().Unix(),
+				BytesWritten: int64(len(data)),
+			}, nil
+		}
+		if !retryable {
+			break
+		}
+	}
+
+	return storeutil.Fail(&s.mu, &s.metrics, envelope, op, lastErr, !retryable, "webhook delivery failed")
+}
+
+// post performs one request. It returns the message ID from the response,
+// if any, and whether a failure may succeed on retry.
+func (s *Storage) post(ctx context.Context, envelopeID string, body []byte, contentType string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return "", false, err
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HeaderEnvelopeID, envelopeID)
+	if len(s.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, ts)
+		req.Header.Set(HeaderSignature, Sign(s.secret, ts, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		var ack struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(respBody, &ack)
+		return ack.ID, false, nil
+	}
+
+	return "", retryableStatus(resp.StatusCode), &HTTPError{
+		StatusCode: resp.StatusCode,
+		Body:       string(bytes.TrimSpace(respBody)),
+	}
+}
+
+// retryableStatus reports whether an HTTP status indicates a temporary
+// failure: any 5xx, 408 Request Timeout and 429 Too Many Requests.
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// encode builds the request body for the configured encoding.
+func (s *Storage) encode(envelope icesmtp.Envelope, data []byte) ([]byte, string, error) {
+	payload := Payload{
+		EnvelopeID:  envelope.ID(),
+		MailFrom:    envelope.MailFrom(),
+		Recipients:  envelope.Recipients(),
+		ESMTPParams: envelope.ESMTPParams(),
+		Metadata:    envelope.Metadata(),
+		ReceivedAt:  envelope.ReceivedAt(),
+		Size:        int64(len(data)),
+	}
+
+	if s.encoding == EncodingJSON {
+		payload.Data = data
+		body, err := json.Marshal(payload)
+		return body, "application/json", err
+	}
+
+	meta, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="envelope"`)
+	h.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(meta)
+
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="message"; filename="`+envelope.ID()+`.eml"`)
+	h.Set("Content-Type", "message/rfc822")
+	part, err = mw.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(data)
+
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
+// Sign returns the HeaderSignature value for a timestamp and body.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of a received webhook request
+// against its body. Receivers should also reject stale timestamps.
+func Verify(secret []byte, header http.Header, body []byte) error {
+	want := Sign(secret, header.Get(HeaderTimestamp), body)
+	if !hmac.Equal([]byte(want), []byte(header.Get(HeaderSignature))) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Metrics returns storage metrics.
+func (s *Storage) Metrics() icesmtp.StorageMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metrics
+}
+
+// Ensure Storage implements the interfaces.
+var (
+	_ icesmtp.Storage            = (*Storage)(nil)
+	_ icesmtp.StorageWithMetrics = (*Storage)(nil)
+)
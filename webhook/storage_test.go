@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/iceisfun/icesmtp"
+)
+
+func buildEnvelope(t *testing.T, data string) icesmtp.Envelope {
+	t.Helper()
+	b := icesmtp.NewStandardEnvelopeBuilder(icesmtp.EnvelopeMetadata{ClientIP: "192.0.2.1"})
+	b.SetMailFrom(icesmtp.MailPath{Address: "a@example.org"}, nil)
+	b.AddRecipient(icesmtp.MailPath{Address: "b@example.com"})
+	w, _ := b.DataWriter()
+	w.Write([]byte(data))
+	w.Close()
+	env, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestStorage_Multipart(t *testing.T) {
+	secret := []byte("s3cret")
+	var gotPayload Payload
+	var gotMessage string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify(secret, r.Header, body); err != nil {
+			t.Errorf("verify: %v", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatalf("parse multipart: %v", err)
+		}
+		json.Unmarshal([]byte(r.FormValue("envelope")), &gotPayload)
+		f, _, err := r.FormFile("message")
+		if err != nil {
+			t.Fatalf("message part: %v", err)
+		}
+		raw, _ := io.ReadAll(f)
+		gotMessage = string(raw)
+		w.Write([]byte(`{"id":"remote-42"}`))
+	}))
+	defer srv.Close()
+
+	s := New(srv.URL, WithSecret(secret))
+	env := buildEnvelope(t, "Subject: hi\r\n\r\nbody\r\n")
+	receipt, err := s.Store(context.Background(), env)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if receipt.MessageID != "remote-42" {
+		t.Errorf("MessageID = %q", receipt.MessageID)
+	}
+	if gotPayload.EnvelopeID != env.ID() || gotPayload.MailFrom.Address != "a@example.org" ||
+		gotPayload.Metadata.ClientIP != "192.0.2.1" {
+		t.Errorf("unexpected payload: %+v", gotPayload)
+	}
+	if gotMessage != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Errorf("message part = %q", gotMessage)
+	}
+}
+
+func TestStorage_JSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if string(p.Data) != "Subject: hi\r\n\r\nbody\r\n" || p.Size != int64(len(p.Data)) {
+			t.Errorf("data = %q, size %d", p.Data, p.Size)
+		}
+		if r.Header.Get(HeaderSignature) != "" {
+			t.Error("unexpected signature without secret")
+		}
+	}))
+	defer srv.Close()
+
+	s := New(srv.URL, WithEncoding(EncodingJSON))
+	env := buildEnvelope(t, "Subject: hi\r\n\r\nbody\r\n")
+	receipt, err := s.Store(context.Background(), env)
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if receipt.MessageID != env.ID() {
+		t.Errorf("MessageID = %q, want envelope ID", receipt.MessageID)
+	}
+}
+
+func TestStorage_RetryAndErrorMapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantErr   bool
+		retryable bool
+		attempts  int32
+	}{
+		{"recovers after 503", []int{503, 200}, false, false, 2},
+		{"5xx exhausts retries", []int{500, 502, 503}, true, true, 3},
+		{"4xx is permanent", []int{422}, true, false, 1},
+		{"429 is retried", []int{429, 429, 429}, true, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(n.Add(1)) - 1
+				w.WriteHeader(tt.statuses[min(i, len(tt.statuses)-1)])
+			}))
+			defer srv.Close()
+
+			s := New(srv.URL, WithRetry(3, time.Millisecond, 2*time.Millisecond))
+			_, err := s.Store(context.Background(), buildEnvelope(t, "x\r\n"))
+
+			if got := n.Load(); got != tt.attempts {
+				t.Errorf("attempts = %d, want %d", got, tt.attempts)
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var se *icesmtp.StorageError
+			if !errors.As(err, &se) {
+				t.Fatalf("expected *StorageError, got %v", err)
+			}
+			if se.Permanent == tt.retryable {
+				t.Errorf("Permanent = %v, want %v", se.Permanent, !tt.retryable)
+			}
+			var he *HTTPError
+			if !errors.As(err, &he) {
+				t.Errorf("expected *HTTPError cause, got %v", se.Cause)
+			}
+		})
+	}
+}